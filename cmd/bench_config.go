@@ -0,0 +1,172 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// benchConfig describes the matrix of a benchmark. Fields that are not set
+// in the config file keep the defaults of defaultBenchConfig.
+//
+// Example:
+//
+//	{
+//	  "files": [
+//	    {"size": 1024, "count": 10, "timeout": "10s"},
+//	    {"size": 10485760, "timeout": "1m"}
+//	  ],
+//	  "loss": {"p": [0, 0.01, 0.05], "q": [0.5, 0.9]},
+//	  "port": 9000,
+//	  "proxy_port": 9001,
+//	  "clients": 4
+//	}
+type benchConfig struct {
+	Files []benchFile `json:"files"`
+	// Loss is swept over all combinations of p and q. A missing dimension
+	// takes the value of the -p or -q flag.
+	Loss      lossGrid `json:"loss"`
+	Port      int      `json:"port"`
+	ProxyPort int      `json:"proxy_port"`
+	// Clients is the number of clients that download each file concurrently.
+	Clients int `json:"clients"`
+}
+
+// benchFile describes Count files of the same size that are requested
+// together.
+type benchFile struct {
+	Size    int64    `json:"size"`
+	Count   int      `json:"count"`
+	Timeout duration `json:"timeout"`
+}
+
+type lossGrid struct {
+	P []float32 `json:"p"`
+	Q []float32 `json:"q"`
+}
+
+type lossPoint struct {
+	p, q float32
+}
+
+// duration is a time.Duration that is written as a string like "1m30s" in
+// JSON.
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"20s\": %v", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+func defaultBenchConfig() benchConfig {
+	files := make([]benchFile, len(testfiles))
+	for i, tf := range testfiles {
+		files[i] = benchFile{Size: tf.size, Count: 1, Timeout: duration(tf.timeout)}
+	}
+	return benchConfig{
+		Files:     files,
+		Port:      8080,
+		ProxyPort: 8081,
+		Clients:   1,
+	}
+}
+
+// loadBenchConfig reads the config file at path. An empty path returns the
+// default config.
+func loadBenchConfig(path string) (benchConfig, error) {
+	cfg := defaultBenchConfig()
+	if path == "" {
+		return cfg, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return cfg, err
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		return cfg, fmt.Errorf("invalid bench config %v: %v", path, err)
+	}
+	return cfg, cfg.validate()
+}
+
+func (c *benchConfig) validate() error {
+	if len(c.Files) == 0 {
+		return errors.New("bench config without files")
+	}
+	for i := range c.Files {
+		f := &c.Files[i]
+		if f.Size < 0 {
+			return fmt.Errorf("file %v: negative size", i+1)
+		}
+		if f.Count == 0 {
+			f.Count = 1
+		}
+		if f.Count < 0 {
+			return fmt.Errorf("file %v: negative count", i+1)
+		}
+		if f.Timeout <= 0 {
+			return fmt.Errorf("file %v: timeout must be positive", i+1)
+		}
+	}
+	for _, x := range append(append([]float32{}, c.Loss.P...), c.Loss.Q...) {
+		if x < 0 || x > 1 {
+			return errors.New("loss parameters must be between 0 and 1")
+		}
+	}
+	if c.Port <= 0 || c.ProxyPort <= 0 || c.Port == c.ProxyPort {
+		return errors.New("port and proxy_port must be positive and differ")
+	}
+	if c.Clients < 1 {
+		return errors.New("clients must be at least 1")
+	}
+	return nil
+}
+
+// lossPoints returns the grid of loss parameters to sweep over. p and q are
+// used for missing dimensions.
+func (c benchConfig) lossPoints(p, q float32) []lossPoint {
+	ps, qs := c.Loss.P, c.Loss.Q
+	if len(ps) == 0 {
+		ps = []float32{p}
+	}
+	if len(qs) == 0 {
+		qs = []float32{q}
+	}
+	points := []lossPoint{}
+	for _, p := range ps {
+		for _, q := range qs {
+			points = append(points, lossPoint{p, q})
+		}
+	}
+	return points
+}
+
+func (f benchFile) String() string {
+	s := fmt.Sprintf("size: %v, timeout: %v", f.Size, time.Duration(f.Timeout))
+	if f.Count > 1 {
+		s += fmt.Sprintf(", count: %v", f.Count)
+	}
+	return s
+}
+
+func (c benchConfig) String() string {
+	files := make([]string, len(c.Files))
+	for i, f := range c.Files {
+		files[i] = fmt.Sprintf("%v: %v", i+1, f)
+	}
+	return fmt.Sprintf("files: [%v], port: %v, clients: %v", strings.Join(files, "; "), c.Port, c.Clients)
+}
@@ -0,0 +1,129 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLoadBenchConfig(t *testing.T) {
+	tests := map[string]struct {
+		json string
+		want benchConfig
+		err  bool
+	}{
+		"count defaults to 1": {
+			json: `{"files": [{"size": 1024, "timeout": "10s"}, {"size": 0, "count": 3, "timeout": "1m"}]}`,
+			want: benchConfig{
+				Files: []benchFile{
+					{Size: 1024, Count: 1, Timeout: duration(10 * time.Second)},
+					{Size: 0, Count: 3, Timeout: duration(time.Minute)},
+				},
+				Port:      8080,
+				ProxyPort: 8081,
+				Clients:   1,
+			},
+		},
+		"all fields": {
+			json: `{"files": [{"size": 1, "count": 2, "timeout": "1s"}], "loss": {"p": [0, 0.1], "q": [0.5]}, "port": 9000, "proxy_port": 9001, "clients": 4}`,
+			want: benchConfig{
+				Files:     []benchFile{{Size: 1, Count: 2, Timeout: duration(time.Second)}},
+				Loss:      lossGrid{P: []float32{0, 0.1}, Q: []float32{0.5}},
+				Port:      9000,
+				ProxyPort: 9001,
+				Clients:   4,
+			},
+		},
+		"unknown field":      {json: `{"files": [{"size": 1, "timeout": "1s"}], "ports": 9000}`, err: true},
+		"unknown file field": {json: `{"files": [{"size": 1, "timeout": "1s", "name": "a"}]}`, err: true},
+		"no files":           {json: `{"files": []}`, err: true},
+		"negative size":      {json: `{"files": [{"size": -1, "timeout": "1s"}]}`, err: true},
+		"negative count":     {json: `{"files": [{"size": 1, "count": -1, "timeout": "1s"}]}`, err: true},
+		"zero timeout":       {json: `{"files": [{"size": 1, "timeout": "0s"}]}`, err: true},
+		"numeric timeout":    {json: `{"files": [{"size": 1, "timeout": 10}]}`, err: true},
+		"loss above 1":       {json: `{"files": [{"size": 1, "timeout": "1s"}], "loss": {"q": [1.5]}}`, err: true},
+		"negative loss":      {json: `{"files": [{"size": 1, "timeout": "1s"}], "loss": {"p": [-0.1]}}`, err: true},
+		"zero port":          {json: `{"files": [{"size": 1, "timeout": "1s"}], "port": 0}`, err: true},
+		"negative proxy port": {
+			json: `{"files": [{"size": 1, "timeout": "1s"}], "proxy_port": -1}`,
+			err:  true,
+		},
+		"same ports": {json: `{"files": [{"size": 1, "timeout": "1s"}], "port": 9000, "proxy_port": 9000}`, err: true},
+		"no clients": {json: `{"files": [{"size": 1, "timeout": "1s"}], "clients": 0}`, err: true},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "bench.json")
+			if err := os.WriteFile(path, []byte(tc.json), 0644); err != nil {
+				t.Fatal(err)
+			}
+			got, err := loadBenchConfig(path)
+			if tc.err {
+				if err == nil {
+					t.Errorf("loadBenchConfig(%v) = %v, want an error", tc.json, got)
+				}
+				return
+			}
+			if err != nil || !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("loadBenchConfig(%v) = %+v, %v, want %+v", tc.json, got, err, tc.want)
+			}
+		})
+	}
+}
+
+func TestLoadBenchConfigDefault(t *testing.T) {
+	got, err := loadBenchConfig("")
+	if err != nil {
+		t.Fatalf("loadBenchConfig(\"\") error = %v", err)
+	}
+	if want := defaultBenchConfig(); !reflect.DeepEqual(got, want) {
+		t.Errorf("loadBenchConfig(\"\") = %+v, want %+v", got, want)
+	}
+	if err := got.validate(); err != nil {
+		t.Errorf("default config is invalid: %v", err)
+	}
+}
+
+func TestBenchConfigValidateCount(t *testing.T) {
+	cfg := defaultBenchConfig()
+	cfg.Files = []benchFile{{Size: 1, Timeout: duration(time.Second)}}
+	if err := cfg.validate(); err != nil {
+		t.Fatalf("validate() error = %v", err)
+	}
+	if cfg.Files[0].Count != 1 {
+		t.Errorf("Count = %v after validate, want 1", cfg.Files[0].Count)
+	}
+}
+
+func TestLossPoints(t *testing.T) {
+	tests := map[string]struct {
+		loss lossGrid
+		want []lossPoint
+	}{
+		"flags only": {
+			want: []lossPoint{{0.1, 0.9}},
+		},
+		"missing q": {
+			loss: lossGrid{P: []float32{0, 0.5}},
+			want: []lossPoint{{0, 0.9}, {0.5, 0.9}},
+		},
+		"missing p": {
+			loss: lossGrid{Q: []float32{0.2, 0.3}},
+			want: []lossPoint{{0.1, 0.2}, {0.1, 0.3}},
+		},
+		"grid": {
+			loss: lossGrid{P: []float32{0, 0.5}, Q: []float32{0.2, 0.3}},
+			want: []lossPoint{{0, 0.2}, {0, 0.3}, {0.5, 0.2}, {0.5, 0.3}},
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			cfg := benchConfig{Loss: tc.loss}
+			if got := cfg.lossPoints(0.1, 0.9); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("lossPoints(0.1, 0.9) with %+v = %v, want %v", tc.loss, got, tc.want)
+			}
+		})
+	}
+}
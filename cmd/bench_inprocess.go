@@ -0,0 +1,206 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"time"
+
+	"github.com/hendrikcech/rft/rftp"
+)
+
+// runInProcess runs the benchmark with the server and the clients of this
+// build in the bench process. Each point of the loss grid is a run.
+func runInProcess(cfg benchConfig) (benchReport, error) {
+	if benchNetwork != "udp" && benchNetwork != "mem" {
+		return benchReport{}, fmt.Errorf("unknown network %q", benchNetwork)
+	}
+	if profileDir != "" {
+		if err := os.MkdirAll(profileDir, 0755); err != nil {
+			return benchReport{}, fmt.Errorf("can't create profile directory: %v", err)
+		}
+	}
+
+	report := benchReport{}
+	for i, loss := range cfg.lossPoints(p, q) {
+		run := i + 1
+		if benchRun != 0 && benchRun != run {
+			continue
+		}
+		rs, err := runInProcessLoss(cfg, run, loss)
+		if err != nil {
+			return benchReport{}, err
+		}
+		report.add(rs)
+	}
+	return report, nil
+}
+
+func runInProcessLoss(cfg benchConfig, run int, loss lossPoint) (benchReport, error) {
+	r := runner{sample: inProcessSample}
+	if err := r.setup(cfg.Files, cfg.Clients); err != nil {
+		return benchReport{}, err
+	}
+	defer func() {
+		if err := r.cleanup(); err != nil {
+			log.Println(err)
+		}
+	}()
+	log.Printf("setup directories: src: %v, dest: %v\n", r.src, r.dest)
+
+	var network *rftp.MemNetwork
+	server := rftp.NewServer()
+	if benchNetwork == "mem" {
+		network = rftp.NewMemNetwork()
+		server.Conn = network.NewConnection()
+	}
+	server.SetLogger(newLogger())
+	if lossSim := loss.simulator(serverRole, seed); lossSim != nil {
+		server.Conn.LossSim(lossSim)
+	}
+	// The impairments apply once to each direction, like the proxy does.
+	server.Conn.Impair(newImpairments(serverRole))
+	dh, err := directoryHandler(r.src)
+	if err != nil {
+		return benchReport{}, err
+	}
+	server.SetFileHandler(dh)
+
+	host := fmt.Sprintf("localhost:%v", cfg.Port)
+	done := make(chan error, 1)
+	// The label tells the goroutines of the server apart from the ones of the
+	// clients when they are counted.
+	go pprof.Do(context.Background(), serverLabel, func(context.Context) {
+		done <- server.Listen(host)
+	})
+	select {
+	case <-server.Ready():
+	case err := <-done:
+		return benchReport{}, fmt.Errorf("failed to start server: %v", err)
+	}
+	log.Printf("run in-process server on %v network: %v\n", benchNetwork, host)
+
+	stopProfile, err := startProfile(run)
+	if err != nil {
+		return benchReport{}, err
+	}
+	name := "in-process-" + benchNetwork
+	report := r.transferAll(run, name, name, loss, seed,
+		func(tf testfile, dir string, clientSeed int64, _ bool) (time.Duration, bool) {
+			return downloadInProcess(network, host, loss, clientSeed, tf, dir)
+		})
+	if err := stopProfile(); err != nil {
+		return benchReport{}, fmt.Errorf("failed to write profile: %v", err)
+	}
+
+	if err := server.Close(); err != nil {
+		log.Printf("failed to close server: %v\n", err)
+	}
+	if err := <-done; err != nil {
+		log.Printf("server crashed: %v\n", err)
+	}
+	return report, nil
+}
+
+// downloadInProcess requests tf with a new client. After a timeout the
+// client is closed before the files are, so it doesn't write to them
+// anymore.
+func downloadInProcess(network *rftp.MemNetwork, host string, loss lossPoint, clientSeed int64, tf testfile, dir string) (time.Duration, bool) {
+	frs := make([]rftp.FileRequest, len(tf.names))
+	for i, name := range tf.names {
+		f, err := os.Create(filepath.Join(dir, name))
+		if err != nil {
+			log.Printf("failed to download file: %v\n", err)
+			return 0, false
+		}
+		defer f.Close()
+		frs[i] = rftp.FileRequest{Name: name, Dest: f}
+	}
+
+	conn := rftp.NewUDPConnection()
+	if network != nil {
+		conn = network.NewConnection()
+	}
+	if lossSim := loss.simulator(clientRole, clientSeed); lossSim != nil {
+		conn.LossSim(lossSim)
+	}
+	client := &rftp.Client{Conn: conn, Logger: newLogger()}
+
+	start := time.Now()
+	reqs, err := client.RequestFiles(host, frs)
+	if err != nil {
+		log.Printf("failed to download file: %v\n", err)
+		return time.Since(start), false
+	}
+	done := make(chan struct{})
+	go func() {
+		for _, req := range reqs {
+			req.Wait()
+		}
+		close(done)
+	}()
+
+	select {
+	case <-time.After(tf.timeout):
+		log.Printf("abandoned client after timeout: %v", tf.timeout)
+		client.Close()
+		return time.Since(start), true
+	case <-done:
+	}
+	return time.Since(start), false
+}
+
+// simulator returns the loss simulator of the point that draws from seed. If
+// the point has no loss parameters, the loss model of the flags is used.
+func (l lossPoint) simulator(role simRole, seed int64) rftp.LossSimulator {
+	p, q := l.p, l.q
+	if p == -1 && q == -1 {
+		return newSeededLossSimulator(role, seed)
+	}
+	if p == -1 {
+		p = q
+	} else if q == -1 {
+		q = p
+	}
+	return rftp.NewMarkovLossSimulator(p, q, role.seededRand(seed, lossStream))
+}
+
+// startProfile starts the CPU profile of a run if --profile-dir is set. The
+// returned function stops it and writes the memory profile. The memory
+// profile counts the allocations since the start of the process, compare it
+// with the profile of the previous run with go tool pprof -base to see the
+// allocations of a single run.
+func startProfile(run int) (func() error, error) {
+	if profileDir == "" {
+		return func() error { return nil }, nil
+	}
+	cpu, err := os.Create(filepath.Join(profileDir, fmt.Sprintf("run%d.cpu.pprof", run)))
+	if err != nil {
+		return nil, err
+	}
+	if err := pprof.StartCPUProfile(cpu); err != nil {
+		cpu.Close()
+		return nil, err
+	}
+
+	return func() error {
+		pprof.StopCPUProfile()
+		if err := cpu.Close(); err != nil {
+			return err
+		}
+		mem, err := os.Create(filepath.Join(profileDir, fmt.Sprintf("run%d.mem.pprof", run)))
+		if err != nil {
+			return err
+		}
+		runtime.GC() // up-to-date statistics
+		if err := pprof.Lookup("allocs").WriteTo(mem, 0); err != nil {
+			mem.Close()
+			return err
+		}
+		return mem.Close()
+	}, nil
+}
@@ -0,0 +1,202 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// serverSample is a measurement of the resources the server uses.
+type serverSample struct {
+	memory     uint64 // resident bytes of the server process
+	heap       uint64 // bytes of the heap of the bench process
+	goroutines int
+}
+
+// sampleInterval is how often the server is measured during a round of
+// transfers.
+const sampleInterval = 100 * time.Millisecond
+
+// sampleServer measures the server with sample until stop is closed. The
+// returned channel receives the peak values.
+func sampleServer(sample func() serverSample, stop <-chan struct{}) <-chan serverSample {
+	peak := make(chan serverSample, 1)
+	go func() {
+		p := serverSample{}
+		ticker := time.NewTicker(sampleInterval)
+		defer ticker.Stop()
+		for {
+			s := sample()
+			if s.memory > p.memory {
+				p.memory = s.memory
+			}
+			if s.heap > p.heap {
+				p.heap = s.heap
+			}
+			if s.goroutines > p.goroutines {
+				p.goroutines = s.goroutines
+			}
+			select {
+			case <-ticker.C:
+			case <-stop:
+				peak <- p
+				return
+			}
+		}
+	}()
+	return peak
+}
+
+// processMemory returns the resident memory of the process with the given
+// pid. It only works on Linux.
+func processMemory(pid int) (uint64, error) {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 3 && fields[0] == "VmRSS:" && fields[2] == "kB" {
+			kb, err := strconv.ParseUint(fields[1], 10, 64)
+			return kb * 1024, err
+		}
+	}
+	if err := s.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("no VmRSS in status of process %d", pid)
+}
+
+// serverLabel is the pprof label of the goroutines of an in-process server.
+// Goroutines inherit the labels of the goroutine that starts them.
+var serverLabel = pprof.Labels("rft", "server")
+
+// inProcessSample measures the heap of the bench process, which includes the
+// clients, and the goroutines of the server. The memory of the server alone
+// is not known.
+func inProcessSample() serverSample {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return serverSample{heap: m.HeapInuse, goroutines: labeledGoroutines(`"rft":"server"`)}
+}
+
+// labeledGoroutines counts the goroutines whose labels contain label. It
+// parses the text format of the goroutine profile, in which each group of
+// goroutines starts with "<count> @ <pcs>" and is followed by a
+// "# labels: {...}" line if the goroutines are labeled.
+func labeledGoroutines(label string) int {
+	var buf bytes.Buffer
+	if err := pprof.Lookup("goroutine").WriteTo(&buf, 1); err != nil {
+		return 0
+	}
+	n, count := 0, 0
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if i := strings.Index(line, " @ "); i > 0 {
+			count, _ = strconv.Atoi(line[:i])
+			continue
+		}
+		if strings.HasPrefix(line, "# labels: ") && strings.Contains(line, label) {
+			n += count
+		}
+	}
+	return n
+}
+
+// benchLoad describes a round of concurrent transfers of one file group.
+type benchLoad struct {
+	Run        int     `json:"run"`
+	Server     string  `json:"server"`
+	Client     string  `json:"client"`
+	Size       int64   `json:"size"`
+	Files      int     `json:"files"`
+	P          float32 `json:"p"`
+	Q          float32 `json:"q"`
+	Repetition int     `json:"repetition"`
+	Clients    int     `json:"clients"`
+	Completed  int     `json:"completed"`
+	// Seconds is the time until the last client finished.
+	Seconds float64 `json:"duration_s"`
+	// AggregateThroughput is the bytes per second of all successful clients.
+	AggregateThroughput float64 `json:"aggregate_throughput_bps"`
+	// Fairness is Jain's fairness index of the throughputs of the clients, in
+	// which failed clients count with 0. It is 1 if all clients got the same
+	// throughput and 1/Clients if one client got everything.
+	Fairness float64 `json:"fairness"`
+	// Completion times of the successful clients.
+	MinCompletion    float64 `json:"min_completion_s"`
+	MedianCompletion float64 `json:"median_completion_s"`
+	MaxCompletion    float64 `json:"max_completion_s"`
+	// ServerMemory is the peak resident memory of the server process. It is
+	// not measured in process.
+	ServerMemory uint64 `json:"server_memory_bytes,omitempty"`
+	// ProcessHeap is the peak heap of the bench process, with the server and
+	// all clients. It is only measured in process.
+	ProcessHeap uint64 `json:"process_heap_bytes,omitempty"`
+	// ServerGoroutines is the peak number of goroutines of the server. It is
+	// only measured in process.
+	ServerGoroutines int `json:"server_goroutines,omitempty"`
+}
+
+func newBenchLoad(results []benchResult, wall time.Duration, peak serverSample) benchLoad {
+	r := results[0]
+	l := benchLoad{
+		Run:              r.Run,
+		Server:           r.Server,
+		Client:           r.Client,
+		Size:             r.Size,
+		Files:            r.Files,
+		P:                r.P,
+		Q:                r.Q,
+		Repetition:       r.Repetition,
+		Clients:          len(results),
+		Seconds:          wall.Seconds(),
+		ServerMemory:     peak.memory,
+		ProcessHeap:      peak.heap,
+		ServerGoroutines: peak.goroutines,
+	}
+	throughputs := make([]float64, len(results))
+	completions := []float64{}
+	bytes := 0.0
+	for i, r := range results {
+		if !r.Success {
+			continue
+		}
+		l.Completed++
+		throughputs[i] = r.Throughput
+		completions = append(completions, r.Seconds)
+		bytes += float64(r.Size * int64(r.Files))
+	}
+	if wall > 0 {
+		l.AggregateThroughput = bytes / wall.Seconds()
+	}
+	l.Fairness = jainIndex(throughputs)
+	if len(completions) > 0 {
+		sort.Float64s(completions)
+		l.MinCompletion = completions[0]
+		l.MedianCompletion = percentile(completions, 50)
+		l.MaxCompletion = completions[len(completions)-1]
+	}
+	return l
+}
+
+// jainIndex returns (sum x)^2 / (n * sum x^2), or 0 if all values are 0.
+func jainIndex(xs []float64) float64 {
+	sum, squares := 0.0, 0.0
+	for _, x := range xs {
+		sum += x
+		squares += x * x
+	}
+	if squares == 0 {
+		return 0
+	}
+	return sum * sum / (float64(len(xs)) * squares)
+}
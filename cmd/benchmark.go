@@ -10,15 +10,20 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
+	"sync"
 	"syscall"
 	"time"
 
+	"github.com/hendrikcech/rft/rftp"
 	"github.com/spf13/cobra"
 )
 
+// testfile is a group of files of the same size that are requested
+// together.
 type testfile struct {
-	size int64
-	name string
+	size  int64
+	names []string
 
 	timeout time.Duration
 }
@@ -50,10 +55,13 @@ type runner struct {
 	src  string
 	dest string
 
-	tf []testfile
+	tf      []testfile
+	clients int
+	// sample measures the server during the transfers, if set.
+	sample func() serverSample
 }
 
-func (r *runner) setup() error {
+func (r *runner) setup(files []benchFile, clients int) error {
 	src, err := ioutil.TempDir("", "rftpSrc")
 	if err != nil {
 		return err
@@ -67,32 +75,48 @@ func (r *runner) setup() error {
 	}
 
 	r.dest = dest
-
-	for _, tf := range testfiles {
-		file, err := ioutil.TempFile(r.src, fmt.Sprintf("%v-", tf.size))
-		if err != nil {
-			return err
-		}
-		// write random content
-		_, err = io.CopyN(file, rand.Reader, tf.size)
-		if err != nil {
+	r.clients = clients
+	// each concurrent client downloads to its own directory
+	for i := 0; i < clients; i++ {
+		if err := os.Mkdir(r.clientDir(i), 0755); err != nil {
 			return err
 		}
+	}
 
-		fi, err := file.Stat()
-		if err != nil {
-			return err
-		}
-		r.tf = append(r.tf, testfile{size: fi.Size(), name: fi.Name(), timeout: tf.timeout})
-
-		if err := file.Close(); err != nil {
-			return err
+	for _, f := range files {
+		tf := testfile{size: f.Size, timeout: time.Duration(f.Timeout)}
+		for i := 0; i < f.Count; i++ {
+			name, err := createRandomFile(r.src, f.Size)
+			if err != nil {
+				return err
+			}
+			tf.names = append(tf.names, name)
 		}
+		r.tf = append(r.tf, tf)
 	}
 
 	return nil
 }
 
+func (r *runner) clientDir(i int) string {
+	return filepath.Join(r.dest, strconv.Itoa(i))
+}
+
+// createRandomFile creates a file of the given size with random content in
+// dir and returns its name.
+func createRandomFile(dir string, size int64) (string, error) {
+	file, err := ioutil.TempFile(dir, fmt.Sprintf("%v-", size))
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	// write random content
+	if _, err := io.CopyN(file, rand.Reader, size); err != nil {
+		return "", err
+	}
+	return filepath.Base(file.Name()), file.Close()
+}
+
 func (r *runner) cleanup() (err error) {
 	srcErr := os.RemoveAll(r.src)
 	if srcErr != nil {
@@ -110,14 +134,14 @@ type combination struct {
 	server, client []string
 }
 
-func getServerClientCombinations(binaries []string, p, q float32) []combination {
+func getServerClientCombinations(binaries []string, p, q float32, serverPort, clientPort string) []combination {
 	cc := []combination{}
 
 	for _, bs := range binaries {
 		for _, bc := range binaries {
 			c := combination{
-				server: []string{bs, "-s", "-v", "-q", fmt.Sprintf("%f", q), "-p", fmt.Sprintf("%f", p), "-t", "8080", "0.0.0.0"},
-				client: []string{bc, "localhost", "-v", "-q", fmt.Sprintf("%f", q), "-p", fmt.Sprintf("%f", p), "-t", "8080"},
+				server: []string{bs, "-s", "-v", "-q", fmt.Sprintf("%f", q), "-p", fmt.Sprintf("%f", p), "-t", serverPort, "0.0.0.0"},
+				client: []string{bc, "localhost", "-v", "-q", fmt.Sprintf("%f", q), "-p", fmt.Sprintf("%f", p), "-t", clientPort},
 			}
 
 			cc = append(cc, c)
@@ -128,7 +152,7 @@ func getServerClientCombinations(binaries []string, p, q float32) []combination
 }
 
 var benchCmd = &cobra.Command{
-	Use:   "bench <rft1> <rft2>",
+	Use:   "bench [<rft1> <rft2>]",
 	Short: "An automatic benchmark of rft implementations",
 	Long: fmt.Sprintf(`bench runs all combinations in which <rft1> and <rft2> can be used to
 download files from each other. Use the -r flag, to only run a
@@ -142,132 +166,371 @@ specific combination. The order is deterministic:
 Use the -s flag to only run tests of a certain file, currently configured are:
 
 %v
+A JSON config file given with --config replaces these files and can set the
+number of files per request, the ports, the number of concurrent clients and a
+grid of loss parameters to sweep over:
+
+	{
+	  "files": [{"size": 1024, "count": 10, "timeout": "10s"}],
+	  "loss": {"p": [0, 0.01, 0.05], "q": [0.5, 0.9]},
+	  "port": 9000,
+	  "proxy_port": 9001,
+	  "clients": 4
+	}
+
+With --in-process, no binaries are needed. The server and the clients of this
+build run inside the bench process and exchange packets over UDP on localhost
+or, with --network mem, over an in-memory network. Each point of the loss grid
+is a run. --profile-dir writes a CPU and a memory profile of each run.
+
+With more than one client (-c or "clients" in the config), each file group is
+downloaded by all clients at once and the report adds a table with the
+completion times of the clients, their aggregate throughput, the fairness
+between them (Jain's index, 1 means equal throughputs) and the peak memory of
+the server. In process, the server memory can't be told apart from the one of
+the clients, so the heap of the whole bench process is reported instead,
+together with the number of server goroutines.
+
+The server and each client draw their losses from their own seed, which is
+derived from --seed. The seeds are part of the JSON and CSV reports, and a
+bench with the same --seed runs with the same seeds again.
 `, testfiles),
-	Args: cobra.MinimumNArgs(2),
+	Args: func(cmd *cobra.Command, args []string) error {
+		if inProcess {
+			return cobra.NoArgs(cmd, args)
+		}
+		return cobra.MinimumNArgs(2)(cmd, args)
+	},
 	Run: func(cmd *cobra.Command, args []string) {
 		log.Println(args)
 
-		binary1Path, err := filepath.Abs(args[0])
-		if err != nil {
-			log.Fatalf("failed to set rft path: %v\n", err)
+		if err := checkLossParams(); err != nil {
+			log.Fatal(err)
 		}
-		binary2Path, err := filepath.Abs(args[1])
-		if err != nil {
-			log.Fatalf("failed to set rft path: %v\n", err)
+		log.Printf("bench seed: %v\n", seed)
+		if reportFormat != "text" && reportFormat != "json" && reportFormat != "csv" {
+			log.Fatalf("unknown report format %q\n", reportFormat)
+		}
+		if repeat < 1 {
+			log.Fatal("repeat must be at least 1")
 		}
-		cc := getServerClientCombinations([]string{binary1Path, binary2Path}, p, q)
 
-		for r, c := range cc {
-			if run != 0 && run != r+1 {
-				continue
-			}
+		cfg, err := loadBenchConfig(benchConfigFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if benchClients < 0 {
+			log.Fatal("clients must not be negative")
+		}
+		if benchClients > 0 {
+			cfg.Clients = benchClients
+		}
+		log.Printf("bench config: %v\n", cfg)
 
-			r := runner{}
-			err = r.setup()
+		if inProcess {
+			report, err := runInProcess(cfg)
 			if err != nil {
 				log.Fatal(err)
 			}
-			log.Printf("setup directories: src: %v, dest: %v\n", r.src, r.dest)
-
-			serverCMD := exec.Command(c.server[0], append(c.server[1:], r.src)...)
-			serverCMD.Dir = r.src
-			log.Printf("run server: %v\n", serverCMD.Args)
-
-			if stdout {
-				serverCMD.Stdout = os.Stdout
-				serverCMD.Stderr = os.Stderr
+			if err := writeBenchReport(report); err != nil {
+				log.Fatal(err)
 			}
+			return
+		}
 
-			err = serverCMD.Start()
+		binary1Path, err := filepath.Abs(args[0])
+		if err != nil {
+			log.Fatalf("failed to set rft path: %v\n", err)
+		}
+		binary2Path, err := filepath.Abs(args[1])
+		if err != nil {
+			log.Fatalf("failed to set rft path: %v\n", err)
+		}
+		// Network conditions are emulated by a proxy between client and server,
+		// so that they also apply to implementations that don't support them.
+		serverPort := strconv.Itoa(cfg.Port)
+		clientPort := serverPort
+		if impairment != (rftp.Impairment{}) {
+			send, receive := newImpairments(proxyRole)
+			proxy, err := startImpairedProxy(fmt.Sprintf("0.0.0.0:%v", cfg.ProxyPort), "localhost:"+serverPort, send, receive)
 			if err != nil {
-				log.Fatalf("failed to create run test server: %v\n", err)
+				log.Fatalf("failed to start proxy: %v\n", err)
 			}
+			defer proxy.close()
+			clientPort = strconv.Itoa(cfg.ProxyPort)
+			log.Printf("emulating network conditions: %+v\n", impairment)
+		}
 
-			for i, tf := range r.tf {
-				if size != 0 && size != i+1 {
+		report := benchReport{}
+		for i, loss := range cfg.lossPoints(p, q) {
+			cc := getServerClientCombinations([]string{binary1Path, binary2Path}, loss.p, loss.q, serverPort, clientPort)
+			for run, c := range cc {
+				if benchRun != 0 && benchRun != run+1 {
 					continue
 				}
-				clientCMD := exec.Command(c.client[0], append(c.client[1:], tf.name)...)
-				clientCMD.Dir = r.dest
-				if i == 0 {
-					log.Printf("run client: %v\n", clientCMD.Args)
-				}
-				if stdout {
-					clientCMD.Stdout = os.Stdout
-					clientCMD.Stderr = os.Stderr
-				}
-
-				start := time.Now()
-				err = clientCMD.Start()
+				rs, err := runCombination(cfg, run+1, c, loss, deriveSeed(seed, i, run+1))
 				if err != nil {
-					log.Printf("failed to download file: %v\n", err)
+					log.Fatal(err)
 				}
+				report.add(rs)
+				time.Sleep(1 * time.Second)
+			}
+		}
 
-				done := make(chan error, 1)
-				go func() {
-					done <- clientCMD.Wait()
-				}()
-
-				select {
-				case <-time.After(tf.timeout):
-					if err := clientCMD.Process.Kill(); err != nil {
-						log.Printf("failed to kill client process: %v", err)
-					} else {
-						log.Printf("killed client process after timeout: %v", tf.timeout)
-					}
-				case err := <-done:
-					if err != nil {
-						log.Printf("client crashed: %v", err)
-					}
-				}
+		if err := writeBenchReport(report); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
 
-				duration := time.Since(start)
+// deriveSeed derives the seed of a server or a client of the bench from
+// base, so that every process draws its own drop pattern and --seed of the
+// bench reproduces all of them.
+func deriveSeed(base int64, ids ...int) int64 {
+	stream := uint64(0)
+	for _, id := range ids {
+		stream = stream*1000003 + uint64(id)
+	}
+	if s := rftp.NewRand(base, stream).Int63(); s != 0 {
+		return s
+	}
+	return 1 // 0 would pick a random seed
+}
 
-				if compareFiles(filepath.Join(r.src, tf.name), filepath.Join(r.dest, tf.name)) {
-					log.Printf("succesfully transferred file of size %v bytes in %v\n", byteCountIEC(tf.size), duration)
-				} else {
-					log.Printf("incorrectly transferred file of size %v bytes in %v\n", byteCountIEC(tf.size), duration)
-				}
-			}
+// runCombination starts the server of c with serverSeed and downloads all
+// configured files with the client of c.
+func runCombination(cfg benchConfig, run int, c combination, loss lossPoint, serverSeed int64) (benchReport, error) {
+	r := runner{}
+	if err := r.setup(cfg.Files, cfg.Clients); err != nil {
+		return benchReport{}, err
+	}
+	defer func() {
+		if err := r.cleanup(); err != nil {
+			log.Println(err)
+		}
+	}()
+	log.Printf("setup directories: src: %v, dest: %v\n", r.src, r.dest)
 
-			serverCMD.Process.Signal(syscall.SIGTERM)
-
-			done := make(chan error, 1)
-			go func() {
-				done <- serverCMD.Wait()
-			}()
-			select {
-			case <-time.After(1 * time.Second):
-				if err := serverCMD.Process.Kill(); err != nil {
-					log.Printf("failed to server kill process: %v", err)
-				} else {
-					log.Printf("killed server process after timeout")
-				}
-			case err := <-done:
-				if err != nil {
-					log.Printf("server crashed: %v\n", err)
+	serverArgs := append(c.server[1:len(c.server):len(c.server)], "--seed", strconv.FormatInt(serverSeed, 10), r.src)
+	serverCMD := exec.Command(c.server[0], serverArgs...)
+	serverCMD.Dir = r.src
+	log.Printf("run server: %v\n", serverCMD.Args)
+
+	if stdout {
+		serverCMD.Stdout = os.Stdout
+		serverCMD.Stderr = os.Stderr
+	}
+
+	if err := serverCMD.Start(); err != nil {
+		return benchReport{}, fmt.Errorf("failed to create run test server: %v", err)
+	}
+	r.sample = func() serverSample {
+		memory, _ := processMemory(serverCMD.Process.Pid)
+		return serverSample{memory: memory}
+	}
+
+	report := r.transferAll(run, c.server[0], c.client[0], loss, serverSeed,
+		func(tf testfile, dir string, clientSeed int64, logCmd bool) (time.Duration, bool) {
+			return r.download(c, tf, dir, clientSeed, logCmd)
+		})
+
+	serverCMD.Process.Signal(syscall.SIGTERM)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- serverCMD.Wait()
+	}()
+	select {
+	case <-time.After(1 * time.Second):
+		if err := serverCMD.Process.Kill(); err != nil {
+			log.Printf("failed to server kill process: %v", err)
+		} else {
+			log.Printf("killed server process after timeout")
+		}
+	case err := <-done:
+		if err != nil {
+			log.Printf("server crashed: %v\n", err)
+		}
+	}
+	return report, nil
+}
+
+// downloadFunc downloads tf to dir with a client that simulates loss with
+// clientSeed and returns how long it took and whether the transfer was
+// aborted after the timeout of the file.
+type downloadFunc func(tf testfile, dir string, clientSeed int64, logCmd bool) (time.Duration, bool)
+
+// transferAll downloads each selected file group repeat times. The seeds of
+// the clients are derived from the seed of the server.
+func (r *runner) transferAll(run int, server, client string, loss lossPoint, serverSeed int64, download downloadFunc) benchReport {
+	report := benchReport{}
+	for i, tf := range r.tf {
+		if size != 0 && size != i+1 {
+			continue
+		}
+		for rep := 1; rep <= repeat; rep++ {
+			res := newBenchResult(run, server, client, tf, loss, rep)
+			res.ServerSeed = serverSeed
+			results, load := r.downloadAll(res, tf, download, i == 0 && rep == 1)
+			report.Results = append(report.Results, results...)
+			report.Load = append(report.Load, load)
+		}
+	}
+	return report
+}
+
+// downloadAll lets each concurrent client download tf, retrying failed
+// transfers, and returns the result of each client and of the whole round.
+func (r *runner) downloadAll(base benchResult, tf testfile, download downloadFunc, logCmd bool) ([]benchResult, benchLoad) {
+	stop := make(chan struct{})
+	var peak <-chan serverSample
+	if r.sample != nil {
+		peak = sampleServer(r.sample, stop)
+	}
+	start := time.Now()
+
+	results := make([]benchResult, r.clients)
+	var wg sync.WaitGroup
+	for k := 0; k < r.clients; k++ {
+		wg.Add(1)
+		go func(k int, dir string) {
+			defer wg.Done()
+			res := base
+			res.ClientID = k
+			for attempt := 0; attempt <= retries; attempt++ {
+				res.Retries = attempt
+				res.ClientSeed = deriveSeed(base.ServerSeed, int(base.Size), base.Files, base.Repetition, k, attempt)
+				d, timedOut := download(tf, dir, res.ClientSeed, logCmd && k == 0 && attempt == 0)
+				res.setDuration(d)
+				res.TimedOut = timedOut
+				res.Success = r.compare(tf, dir)
+				if res.Success {
+					break
 				}
 			}
-
-			err := r.cleanup()
-			if err != nil {
-				log.Fatal(err)
+			if res.Success {
+				log.Printf("succesfully transferred %v file(s) of size %v bytes in %v\n", len(tf.names), byteCountIEC(tf.size), res.Duration)
+			} else {
+				log.Printf("incorrectly transferred %v file(s) of size %v bytes in %v\n", len(tf.names), byteCountIEC(tf.size), res.Duration)
 			}
+			results[k] = res
+		}(k, r.clientDir(k))
+	}
+	wg.Wait()
+
+	wall := time.Since(start)
+	close(stop)
+	sample := serverSample{}
+	if r.sample != nil {
+		sample = <-peak
+	}
+	load := newBenchLoad(results, wall, sample)
+	if r.clients > 1 {
+		log.Printf("%v of %v clients completed in %v, fairness %.2f\n", load.Completed, load.Clients, wall, load.Fairness)
+	}
+	return results, load
+}
 
-			time.Sleep(1 * time.Second)
-			fmt.Println()
+// compare reports whether all files of tf were transferred correctly to dir.
+func (r *runner) compare(tf testfile, dir string) bool {
+	for _, name := range tf.names {
+		if !compareFiles(filepath.Join(r.src, name), filepath.Join(dir, name)) {
+			return false
 		}
-	},
+	}
+	return true
+}
+
+// download runs the client to fetch tf to dir and returns how long it took
+// and whether the client was killed after the timeout of the file.
+func (r *runner) download(c combination, tf testfile, dir string, clientSeed int64, logCmd bool) (time.Duration, bool) {
+	// partial files of a previous attempt must not be mistaken for the result
+	for _, name := range tf.names {
+		os.Remove(filepath.Join(dir, name))
+	}
+
+	clientArgs := append(c.client[1:len(c.client):len(c.client)], "--seed", strconv.FormatInt(clientSeed, 10))
+	clientCMD := exec.Command(c.client[0], append(clientArgs, tf.names...)...)
+	clientCMD.Dir = dir
+	if logCmd {
+		log.Printf("run client: %v\n", clientCMD.Args)
+	}
+	if stdout {
+		clientCMD.Stdout = os.Stdout
+		clientCMD.Stderr = os.Stderr
+	}
+
+	start := time.Now()
+	if err := clientCMD.Start(); err != nil {
+		log.Printf("failed to download file: %v\n", err)
+		return 0, false
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- clientCMD.Wait()
+	}()
+
+	timedOut := false
+	select {
+	case <-time.After(tf.timeout):
+		timedOut = true
+		if err := clientCMD.Process.Kill(); err != nil {
+			log.Printf("failed to kill client process: %v", err)
+		} else {
+			log.Printf("killed client process after timeout: %v", tf.timeout)
+		}
+	case err := <-done:
+		if err != nil {
+			log.Printf("client crashed: %v", err)
+		}
+	}
+	return time.Since(start), timedOut
+}
+
+// writeBenchReport writes the results to the report file or to stdout.
+func writeBenchReport(report benchReport) error {
+	w := os.Stdout
+	if reportFile != "" {
+		f, err := os.Create(reportFile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	return writeReport(w, reportFormat, report)
 }
 
-var run int
+var benchRun int
 var size int
 var stdout bool
+var repeat int
+var retries int
+var reportFormat string
+var reportFile string
+var benchConfigFile string
+var inProcess bool
+var benchNetwork string
+var profileDir string
+var benchClients int
 
 func init() {
-	benchCmd.Flags().IntVarP(&run, "run", "r", 0, "Specify which run should be executed, 0 runs all combinations")
+	benchCmd.Flags().IntVarP(&benchRun, "run", "r", 0, "Specify which run should be executed, 0 runs all combinations")
 	benchCmd.Flags().IntVarP(&size, "size", "s", 0, "Specify which file size should be tested, 0 runs all configured sizes")
 	benchCmd.Flags().BoolVarP(&stdout, "out", "o", false, "Print command output to stdout and stderr")
+	benchCmd.Flags().IntVarP(&repeat, "repeat", "n", 1, "Repeat the transfer of each file this many times")
+	benchCmd.Flags().IntVar(&retries, "retries", 0, "Retry a failed transfer up to this many times")
+	benchCmd.Flags().StringVar(&reportFormat, "format", "text",
+		`Format of the report, one of "text" (summary and load table), "json"
+(results, summary and load) or "csv" (results)`)
+	benchCmd.Flags().StringVar(&reportFile, "report", "", "Write the report to this file instead of stdout")
+	benchCmd.Flags().StringVar(&benchConfigFile, "config", "", "Read the files, ports, clients and loss grid from this JSON file")
+	benchCmd.Flags().BoolVar(&inProcess, "in-process", false, "Run the server and the clients of this build in the bench process")
+	benchCmd.Flags().StringVar(&benchNetwork, "network", "udp",
+		`Network of the in-process benchmark, "udp" (localhost) or "mem" (in-memory)`)
+	benchCmd.Flags().StringVar(&profileDir, "profile-dir", "", "Write CPU and memory profiles of each in-process run to this directory")
+	benchCmd.Flags().IntVarP(&benchClients, "clients", "c", 0, "Number of concurrent clients, 0 uses the config")
 	rootCmd.AddCommand(benchCmd)
 }
 
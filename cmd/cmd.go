@@ -2,17 +2,21 @@
 package cmd
 
 import (
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
+	"log/slog"
+	"net/http"
 	"os"
 
 	"math/rand"
 	"time"
 
 	"path/filepath"
+	"strconv"
+	"strings"
 
 	"github.com/hendrikcech/rft/rftp"
 	"github.com/spf13/cobra"
@@ -24,6 +28,31 @@ var (
 	p, q  float32
 	out   string
 	debug bool
+	rnge  string
+
+	schedule      string
+	priorities    []int
+	metricsAddr   string
+	multicast     string
+	multicastWait time.Duration
+	fec           uint8
+	compress      []string
+	compressions  []rftp.Compression
+	delta         bool
+	byChecksum    bool
+
+	gilbertElliott string
+	lossTraceFile  string
+	geParams       []float32
+	lossTrace      []bool
+
+	impairment rftp.Impairment
+	seed       int64
+
+	recordFile string
+	recorder   *rftp.PcapWriter
+	traceDir   string
+	tracer     rftp.Tracer
 )
 
 var rootCmd = &cobra.Command{
@@ -34,33 +63,50 @@ var rootCmd = &cobra.Command{
 		host := args[0]
 		files := args[1:]
 
-		if (p != -1 && (p < 0 || p > 1)) || (q != -1 && (q < 0 || p > 1)) {
-			log.Print("p and q must be value between 0 and 1")
+		if err := checkLossParams(); err != nil {
+			log.Print(err)
 			os.Exit(1)
-		} else if p == -1 && q != -1 {
-			p = q
-		} else if p != -1 && q == -1 {
-			q = p
 		}
-
-		if !debug {
-			log.SetOutput(ioutil.Discard)
+		if err := startRecording(); err != nil {
+			log.Print(err)
+			os.Exit(1)
 		}
 
 		if s {
-			log.Printf("start file server for dir %v\n", files[0])
 			server := rftp.NewServer()
-			if p != -1 || q != -1 {
-				lossSim := rftp.NewMarkovLossSimulator(p, q)
+			server.SetLogger(newLogger())
+			if lossSim := newLossSimulator(serverRole); lossSim != nil {
 				server.Conn.LossSim(lossSim)
-				rand.Seed(time.Now().UTC().UnixNano())
 			}
-			dh, err := directoryHandler(files[0])
+			server.Conn.Impair(newImpairments(serverRole))
+			if recorder != nil {
+				server.Conn.Record(recorder)
+			}
+			server.SetTracer(tracer)
+			dir, err := newDirectory(files[0])
 			if err != nil {
 				log.Printf("Can not serve directory %s: %s", files[0], err)
 				return
 			}
-			server.SetFileHandler(dh)
+			server.SetFileHandler(dir.handle)
+			server.SetContentHandler(dir.content)
+			server.SetListingHandler(dir.handleListing)
+			policy, err := rftp.ParseSchedulingPolicy(schedule)
+			if err != nil {
+				log.Println(err)
+				return
+			}
+			server.SetSchedulingPolicy(policy)
+			if multicast != "" {
+				server.SetMulticast(multicast, multicastWait)
+			}
+			if metricsAddr != "" {
+				mux := http.NewServeMux()
+				mux.Handle("/metrics", server.MetricsHandler())
+				go func() {
+					log.Printf("metrics server failed: %v\n", http.ListenAndServe(metricsAddr, mux))
+				}()
+			}
 			err = server.Listen(fmt.Sprintf(":%v", t))
 			if err != nil {
 				log.Println(err)
@@ -74,57 +120,131 @@ var rootCmd = &cobra.Command{
 		}
 
 		hs := fmt.Sprintf("%v:%v", host, t)
-		log.Printf("running client request to host '%v' for files %v\n", hs, files)
-
-		var client rftp.Client
-		if p != -1 || q != -1 {
-			lossSim := rftp.NewMarkovLossSimulator(p, q)
-			conn := rftp.NewUDPConnection()
-			conn.LossSim(lossSim)
-			client = rftp.Client{Conn: conn}
-			rand.Seed(time.Now().UTC().UnixNano())
-		} else {
-			client = rftp.Client{Conn: rftp.NewUDPConnection()}
-		}
 
-		reqs, err := client.Request(hs, files)
+		start, length, err := parseRange(rnge)
 		if err != nil {
-			log.Printf("error on request: %v\n", err)
+			log.Printf("Invalid range: %v", err)
+			return
 		}
-
-		for i, req := range reqs {
-			var w io.Writer
-			path := filepath.Join(out, files[i])
+		for _, name := range compress {
+			c, err := rftp.ParseCompression(name)
+			if err != nil {
+				log.Println(err)
+				return
+			}
+			compressions = append(compressions, c)
+		}
+		if len(priorities) > len(files) {
+			log.Printf("Got more priorities than files")
+			return
+		}
+		if delta && (out == "-" || start > 0 || length > 0) {
+			log.Printf("--delta requires an out directory and no range")
+			return
+		}
+		frs := make([]rftp.FileRequest, len(files))
+		// temps are the files deltas are rebuilt into, they replace the local
+		// copies once they are complete.
+		temps := make([]string, len(files))
+		for i, f := range files {
+			frs[i] = rftp.FileRequest{Name: f, Start: start, Length: length}
+			if byChecksum {
+				sum, err := hex.DecodeString(f)
+				if err != nil || len(sum) != len(frs[i].Checksum) {
+					log.Printf("Invalid MD5 checksum %q", f)
+					return
+				}
+				copy(frs[i].Checksum[:], sum)
+			}
+			if i < len(priorities) {
+				if priorities[i] < 0 || priorities[i] > 255 {
+					log.Printf("Priorities must be between 0 and 255")
+					return
+				}
+				frs[i].Priority = uint8(priorities[i])
+			}
 			if out == "-" {
-				w = os.Stdout
-			} else {
-				w, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0644)
+				continue
+			}
+			path := filepath.Join(out, f)
+			if info, err := os.Stat(path); delta && err == nil && info.Mode().IsRegular() && info.Size() > 0 {
+				basis, err := os.Open(path)
+				if err != nil {
+					log.Printf("Can't read local copy %s: %s", path, err)
+					return
+				}
+				defer basis.Close()
+				temp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".rft-*")
 				if err != nil {
-					log.Printf("Can't write file to %s: %s", path, err)
+					log.Printf("Can't write file to %s: %s", filepath.Dir(path), err)
 					return
 				}
+				defer temp.Close()
+				defer os.Remove(temp.Name())
+				temp.Chmod(info.Mode().Perm())
+				frs[i].Basis = io.NewSectionReader(basis, 0, info.Size())
+				frs[i].Dest = temp
+				temps[i] = temp.Name()
+				continue
 			}
+			file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+			if err != nil {
+				log.Printf("Can't write file to %s: %s", path, err)
+				return
+			}
+			defer file.Close()
+			frs[i].Dest = file
+		}
+
+		client := newClient()
+		reqs, err := client.RequestFiles(hs, frs)
+		if err != nil {
+			log.Printf("error on request: %v\n", err)
+		}
 
+		if out != "-" {
+			// All files are written to their destination concurrently.
 			if !debug {
-				fi, err := os.Stat(path)
-				r := &progressReader{req, 0, fi.Name()}
-				io.Copy(w, r)
+				names := make([]string, len(files))
+				for i, f := range files {
+					names[i] = filepath.Base(f)
+				}
+				newProgressDisplay(os.Stdout, names, reqs).waitAll()
+			}
+			for i, req := range reqs {
+				err := req.Wait()
+				if err == nil && temps[i] != "" {
+					err = os.Rename(temps[i], filepath.Join(out, files[i]))
+				}
 				if err != nil {
-					log.Panic(err)
+					log.Printf("File %s error: %s", files[i], err)
+				} else if debug {
+					log.Printf("File %s received (checksum is valid)\n", files[i])
 				}
-				printProgress(fi.Name(), fi.Size(), int64(req.Size()))
+			}
+		}
+
+		for i, req := range reqs {
+			if out != "-" {
+				break
+			}
+			name := filepath.Base(files[i])
+			if !debug {
+				r := &progressReader{req, 0, name}
+				io.Copy(os.Stdout, r)
+				printProgress(name, int64(req.Received()), int64(req.Size()))
 				if req.Err != nil {
 					fmt.Printf("err: %v\n", req.Err)
 				} else {
 					fmt.Println("success")
 				}
 			} else {
-				io.Copy(w, req)
+				io.Copy(os.Stdout, req)
 			}
 
 			if req.Err != nil {
 				log.Printf("File %s error: %s", files[i], req.Err)
-			} else {
+			} else if debug {
 				log.Printf("File %s received (checksum is valid)\n", files[i])
 			}
 		}
@@ -136,6 +256,193 @@ var rootCmd = &cobra.Command{
 	},
 }
 
+// checkLossParams validates the parameters of the loss simulation. If only one
+// of p and q is set, the other one is set to the same value.
+func checkLossParams() error {
+	models := 0
+	if p != -1 || q != -1 {
+		models++
+	}
+	if gilbertElliott != "" {
+		models++
+	}
+	if lossTraceFile != "" {
+		models++
+	}
+	if models > 1 {
+		return errors.New("only one of p/q, --gilbert-elliott and --loss-trace can be used")
+	}
+
+	for _, x := range []float64{impairment.Reorder, impairment.Duplicate, impairment.Corrupt} {
+		if x < 0 || x > 1 {
+			return errors.New("reorder, duplicate and corrupt must be values between 0 and 1")
+		}
+	}
+	if impairment.Delay < 0 || impairment.Jitter < 0 || impairment.Bandwidth < 0 || impairment.QueueSize < 0 {
+		return errors.New("delay, jitter, bandwidth and queue must not be negative")
+	}
+
+	if (p != -1 && (p < 0 || p > 1)) || (q != -1 && (q < 0 || q > 1)) {
+		return errors.New("p and q must be value between 0 and 1")
+	} else if p == -1 && q != -1 {
+		p = q
+	} else if p != -1 && q == -1 {
+		q = p
+	}
+
+	if gilbertElliott != "" {
+		params, err := parseGilbertElliott(gilbertElliott)
+		if err != nil {
+			return err
+		}
+		geParams = params
+	}
+
+	if lossTraceFile != "" {
+		f, err := os.Open(lossTraceFile)
+		if err != nil {
+			return fmt.Errorf("can't open loss trace: %v", err)
+		}
+		defer f.Close()
+		trace, err := rftp.ParseLossTrace(f)
+		if err != nil {
+			return fmt.Errorf("invalid loss trace %v: %v", lossTraceFile, err)
+		}
+		lossTrace = trace
+	}
+
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	if models > 0 || impairment != (rftp.Impairment{}) {
+		fmt.Fprintf(os.Stderr, "simulation seed: %v\n", seed)
+	}
+	return nil
+}
+
+// parseGilbertElliott parses the parameters "p,r,k,h" of the Gilbert-Elliott
+// model.
+func parseGilbertElliott(s string) ([]float32, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return nil, fmt.Errorf("gilbert-elliott parameters must be of the form p,r,k,h")
+	}
+	params := make([]float32, len(parts))
+	for i, part := range parts {
+		x, err := strconv.ParseFloat(strings.TrimSpace(part), 32)
+		if err != nil || x < 0 || x > 1 {
+			return nil, fmt.Errorf("gilbert-elliott parameter %q must be a value between 0 and 1", part)
+		}
+		params[i] = float32(x)
+	}
+	return params, nil
+}
+
+// simRole selects the random streams of the simulation. Every role and
+// direction draws from its own stream, so that a seed reproduces the same
+// drop pattern even if the traffic in the other direction differs.
+type simRole uint64
+
+const (
+	clientRole simRole = iota
+	serverRole
+	proxyRole
+)
+
+const (
+	lossStream = iota
+	sendStream
+	receiveStream
+	streamsPerRole
+)
+
+func (r simRole) rand(stream uint64) *rand.Rand {
+	return r.seededRand(seed, stream)
+}
+
+func (r simRole) seededRand(s int64, stream uint64) *rand.Rand {
+	return rftp.NewRand(s, uint64(r)*streamsPerRole+stream)
+}
+
+// newImpairments returns the configured impairments of the sent and the
+// received packets.
+func newImpairments(role simRole) (send, receive rftp.Impairment) {
+	send, receive = impairment, impairment
+	send.Rand = role.rand(sendStream)
+	receive.Rand = role.rand(receiveStream)
+	return send, receive
+}
+
+// newLossSimulator returns the configured loss simulator or nil if no loss
+// should be simulated. checkLossParams must be called before.
+func newLossSimulator(role simRole) rftp.LossSimulator {
+	return newSeededLossSimulator(role, seed)
+}
+
+// newSeededLossSimulator is like newLossSimulator, but draws from the given
+// seed instead of --seed.
+func newSeededLossSimulator(role simRole, s int64) rftp.LossSimulator {
+	switch {
+	case p != -1 || q != -1:
+		return rftp.NewMarkovLossSimulator(p, q, role.seededRand(s, lossStream))
+	case geParams != nil:
+		return rftp.NewGilbertElliottLossSimulator(geParams[0], geParams[1], geParams[2], geParams[3],
+			role.seededRand(s, lossStream))
+	case lossTrace != nil:
+		return rftp.NewTraceLossSimulator(lossTrace)
+	}
+	return nil
+}
+
+// startRecording creates the capture file and the trace directory if packets
+// or events should be recorded.
+func startRecording() error {
+	if traceDir != "" {
+		if err := os.MkdirAll(traceDir, 0755); err != nil {
+			return fmt.Errorf("can't create trace directory: %v", err)
+		}
+		tracer = rftp.NewDirTracer(traceDir)
+	}
+	if recordFile == "" {
+		return nil
+	}
+	f, err := os.Create(recordFile)
+	if err != nil {
+		return fmt.Errorf("can't create capture file: %v", err)
+	}
+	recorder, err = rftp.NewPcapWriter(f)
+	return err
+}
+
+// newLogger returns the logger of the rft library. It logs everything to
+// stderr in debug mode and is silent otherwise.
+func newLogger() *slog.Logger {
+	if !debug {
+		return nil
+	}
+	return slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug}))
+}
+
+// newClient returns a client that simulates loss if configured.
+func newClient() *rftp.Client {
+	conn := rftp.NewUDPConnection()
+	if lossSim := newLossSimulator(clientRole); lossSim != nil {
+		conn.LossSim(lossSim)
+	}
+	conn.Impair(newImpairments(clientRole))
+	if recorder != nil {
+		conn.Record(recorder)
+	}
+	return &rftp.Client{
+		Conn:        conn,
+		Tracer:      tracer,
+		Logger:      newLogger(),
+		Multicast:   multicast,
+		FEC:         fec,
+		Compression: compressions,
+	}
+}
+
 type progressReader struct {
 	req  *rftp.FileResponse
 	done int64
@@ -159,54 +466,27 @@ func printProgress(filename string, done, total int64) {
 	}
 }
 
-func directoryHandler(dirname string) (rftp.FileHandler, error) {
-	info, err := os.Stat(dirname)
-	if err != nil {
-		return nil, err
+// parseRange parses a range of the form "start[:length]". An empty range
+// selects the whole file.
+func parseRange(r string) (start, length uint64, err error) {
+	if r == "" {
+		return 0, 0, nil
 	}
-	if !info.IsDir() {
-		return nil, fmt.Errorf("is file, not directory")
-	}
-
-	type file struct {
-		path string
-		info os.FileInfo
+	parts := strings.SplitN(r, ":", 2)
+	start, err = strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid start %q", parts[0])
 	}
-
-	var files []file
-	walkFn := func(path string, info os.FileInfo, err error) error {
+	if len(parts) == 2 && parts[1] != "" {
+		length, err = strconv.ParseUint(parts[1], 10, 64)
 		if err != nil {
-			return nil
+			return 0, 0, fmt.Errorf("invalid length %q", parts[1])
 		}
-
-		if !info.IsDir() {
-			p, err := filepath.Rel(dirname, path)
-			if err != nil {
-				return err
-			}
-			files = append(files, file{p, info})
+		if length == 0 {
+			return 0, 0, errors.New("length must be greater than 0")
 		}
-		return nil
 	}
-	if err := filepath.Walk(dirname, walkFn); err != nil {
-		return nil, err
-	}
-
-	return func(name string) (*io.SectionReader, error) {
-		for _, f := range files {
-			if f.path == name {
-				file, err := os.Open(filepath.Join(dirname, f.path))
-				if err != nil {
-					return nil, err
-				}
-				if !debug {
-					fmt.Printf("handling file: %v, size: %v\n", file.Name(), byteCountIEC(f.info.Size()))
-				}
-				return io.NewSectionReader(file, 0, f.info.Size()), nil
-			}
-		}
-		return nil, errors.New("file not found")
-	}, nil
+	return start, length, nil
 }
 
 // byteCountIEC prints bytes in human readable format, taken from here:
@@ -240,9 +520,75 @@ only one is specified, assume p=q; if neither is specified assume no loss`)
 		`specify the loss probabilities for the Markov chain model (0 <= p <= 1). If
 only one is specified, assume p=q; if neither is specified assume no loss`)
 
+	rootCmd.PersistentFlags().StringVar(&gilbertElliott, "gilbert-elliott", "",
+		`simulate loss with the Gilbert-Elliott model "p,r,k,h": p and r are the
+probabilities to change from the good to the bad state and back, 1-k and 1-h
+are the loss probabilities in the good and the bad state`)
+
+	rootCmd.PersistentFlags().StringVar(&lossTraceFile, "loss-trace", "",
+		`simulate loss by replaying a trace file of '0' (received) and '1' (lost)
+characters, one per packet; the trace is repeated when it ends`)
+
+	rootCmd.PersistentFlags().DurationVar(&impairment.Delay, "delay", 0,
+		`emulate network conditions: delay every sent and received packet; the delay
+is one-way, so the round trip time grows by twice the delay`)
+	rootCmd.PersistentFlags().DurationVar(&impairment.Jitter, "jitter", 0,
+		"emulate network conditions: maximum random deviation from the delay")
+	rootCmd.PersistentFlags().Float64Var(&impairment.Reorder, "reorder", 0,
+		"emulate network conditions: probability that a packet skips the delay (0 <= reorder <= 1)")
+	rootCmd.PersistentFlags().Float64Var(&impairment.Duplicate, "duplicate", 0,
+		"emulate network conditions: probability that a packet is duplicated (0 <= duplicate <= 1)")
+	rootCmd.PersistentFlags().Float64Var(&impairment.Corrupt, "corrupt", 0,
+		"emulate network conditions: probability that a bit of a packet is flipped (0 <= corrupt <= 1)")
+	rootCmd.PersistentFlags().IntVar(&impairment.Bandwidth, "bandwidth", 0,
+		"emulate network conditions: limit the bandwidth to bytes per second, 0 is unlimited")
+	rootCmd.PersistentFlags().IntVar(&impairment.QueueSize, "queue", 0,
+		`emulate network conditions: bytes that can be queued in front of the bandwidth
+limit before packets are dropped, 0 is unlimited`)
+	rootCmd.PersistentFlags().StringVar(&recordFile, "record", "",
+		`record all sent and received packets to a pcapng file, which can be opened
+with Wireshark or decoded with "rft replay"`)
+	rootCmd.PersistentFlags().StringVar(&traceDir, "trace-dir", "",
+		"write a JSON lines event trace of each connection to this directory")
+	rootCmd.PersistentFlags().Int64Var(&seed, "seed", 0,
+		`seed of the loss and network simulation; runs with the same seed drop the
+same packets, 0 picks a random seed`)
+
 	rootCmd.Flags().StringVarP(&out, "out", "o", ".",
 		`specify the directory in which the requested files are going to be stored;
 set to '-' to redirect file content to stdout`)
+	rootCmd.Flags().StringVar(&rnge, "range", "",
+		`request only the byte range "start[:length]" of each file; if length is
+omitted, the range extends to the end of the file`)
+	rootCmd.Flags().StringVar(&schedule, "schedule", rftp.Sequential.String(),
+		`server mode: order in which the files of a request are streamed, one of
+"sequential", "round-robin", "smallest-first" or "priority"`)
+	rootCmd.Flags().StringVar(&metricsAddr, "metrics-addr", "",
+		`server mode: serve Prometheus metrics at http://<addr>/metrics, e.g.,
+":9100"`)
+	rootCmd.Flags().StringVar(&multicast, "multicast", "",
+		`multicast group, e.g., "239.0.0.1:9001"; the server streams files that
+several clients request to the group once, the client receives them there`)
+	rootCmd.Flags().DurationVar(&multicastWait, "multicast-wait", 500*time.Millisecond,
+		`server mode: time a multicast session waits for further clients before
+it streams`)
+	rootCmd.Flags().Uint8Var(&fec, "fec", 0,
+		`ask the server for a repair packet per this many chunks, from which one
+lost chunk of each group is reconstructed without re-requesting it; 0 disables
+repair packets`)
+	rootCmd.Flags().StringSliceVar(&compress, "compress", nil,
+		`comma separated compressions ("deflate", "gzip") the server may compress the
+files with, in the order of preference`)
+	rootCmd.Flags().BoolVar(&delta, "delta", false,
+		`use the files that already exist in the out directory as local copies;
+the server only sends the changed parts, and the files are replaced once they
+are complete`)
+	rootCmd.Flags().BoolVar(&byChecksum, "by-checksum", false,
+		`the files are the hex MD5 checksums of the requested files; the server
+looks them up by their content, and they are stored under their checksum`)
+	rootCmd.Flags().IntSliceVar(&priorities, "priority", nil,
+		`comma separated priorities (0-255) of the requested files in the order of
+the files; used by servers that stream files by priority`)
 	rootCmd.Flags().BoolVarP(&debug, "v", "v", false, "print debug output")
 
 	rootCmd.Flags().SortFlags = false
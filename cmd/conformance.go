@@ -0,0 +1,182 @@
+package cmd
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/hendrikcech/rft/rftp"
+	"github.com/spf13/cobra"
+)
+
+var conformanceRole string
+var conformancePort int
+var conformanceSize int64
+
+const conformanceFile = "conformance.bin"
+
+var conformanceCmd = &cobra.Command{
+	Use:   "conformance <rft>",
+	Short: "Check which parts of the protocol an rft implementation violates",
+	Long: `conformance runs the server or the client of <rft> against a scripted peer,
+which sends crafted message sequences, e.g., lost metadata, resend entries with
+length 0, duplicate requests, out-of-order acks, close messages and unknown
+versions. It prints whether each behavior passed and exits with status 1 if
+any behavior failed.
+
+The server under test is started with "-s -t <port> 0.0.0.0 <dir>", the client
+under test with "-t <port> localhost <file>" in an empty directory.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		binary, err := filepath.Abs(args[0])
+		if err != nil {
+			log.Fatal(err)
+		}
+		if conformanceRole != "server" && conformanceRole != "client" && conformanceRole != "both" {
+			log.Fatalf("unknown role %q\n", conformanceRole)
+		}
+
+		content := make([]byte, conformanceSize)
+		if _, err := io.ReadFull(rand.Reader, content); err != nil {
+			log.Fatal(err)
+		}
+
+		results := []rftp.ConformanceResult{}
+		if conformanceRole != "client" {
+			rs, err := checkServer(binary, content)
+			if err != nil {
+				log.Fatal(err)
+			}
+			results = append(results, rs...)
+		}
+		if conformanceRole != "server" {
+			host := net.JoinHostPort("localhost", strconv.Itoa(conformancePort))
+			results = append(results, rftp.CheckClient(host, conformanceFile, content, clientUnderTest(binary))...)
+		}
+
+		if err := writeConformanceResults(os.Stdout, results); err != nil {
+			log.Fatal(err)
+		}
+		for _, r := range results {
+			if !r.Passed {
+				os.Exit(1)
+			}
+		}
+	},
+}
+
+// checkServer serves content with the server of binary and runs the checks
+// against it.
+func checkServer(binary string, content []byte) ([]rftp.ConformanceResult, error) {
+	dir, err := ioutil.TempDir("", "rftpConformance")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, conformanceFile), content, 0644); err != nil {
+		return nil, err
+	}
+
+	server := exec.Command(binary, "-s", "-t", strconv.Itoa(conformancePort), "0.0.0.0", dir)
+	if stdout {
+		server.Stdout = os.Stdout
+		server.Stderr = os.Stderr
+	}
+	if err := server.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start server: %v", err)
+	}
+	defer func() {
+		server.Process.Signal(syscall.SIGTERM)
+		done := make(chan error, 1)
+		go func() {
+			done <- server.Wait()
+		}()
+		select {
+		case <-time.After(1 * time.Second):
+			server.Process.Kill()
+		case <-done:
+		}
+	}()
+	// give the server time to open its socket, a lost request would fail the
+	// first check
+	time.Sleep(500 * time.Millisecond)
+
+	host := net.JoinHostPort("localhost", strconv.Itoa(conformancePort))
+	return rftp.CheckServer(host, conformanceFile, content), nil
+}
+
+// clientUnderTest starts the client of binary in a new directory for each
+// check.
+func clientUnderTest(binary string) rftp.ConformanceClient {
+	return func(host, name string) (<-chan rftp.ClientExit, func(), error) {
+		h, port, err := net.SplitHostPort(host)
+		if err != nil {
+			return nil, nil, err
+		}
+		dir, err := ioutil.TempDir("", "rftpConformance")
+		if err != nil {
+			return nil, nil, err
+		}
+		client := exec.Command(binary, "-t", port, h, name)
+		client.Dir = dir
+		if stdout {
+			client.Stdout = os.Stdout
+			client.Stderr = os.Stderr
+		}
+		if err := client.Start(); err != nil {
+			os.RemoveAll(dir)
+			return nil, nil, err
+		}
+
+		exit := make(chan rftp.ClientExit, 1)
+		go func() {
+			defer os.RemoveAll(dir)
+			err := client.Wait()
+			data, readErr := ioutil.ReadFile(filepath.Join(dir, name))
+			if readErr != nil && !errors.Is(readErr, os.ErrNotExist) && err == nil {
+				err = readErr
+			}
+			exit <- rftp.ClientExit{Data: data, Err: err}
+		}()
+		return exit, func() { client.Process.Kill() }, nil
+	}
+}
+
+func writeConformanceResults(w io.Writer, results []rftp.ConformanceResult) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "role\tbehavior\tresult\tdetail")
+	passed := 0
+	for _, r := range results {
+		result := "FAIL"
+		if r.Passed {
+			result = "pass"
+			passed++
+		}
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\n", r.Role, r.Name, result, r.Detail)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, "%v of %v behaviors passed\n", passed, len(results))
+	return err
+}
+
+func init() {
+	conformanceCmd.Flags().StringVar(&conformanceRole, "role", "both",
+		`Role of <rft> to check, "server", "client" or "both"`)
+	conformanceCmd.Flags().IntVarP(&conformancePort, "port", "t", 9500, "Port of the server, either the one under test or the scripted one")
+	conformanceCmd.Flags().Int64Var(&conformanceSize, "size", 50*1024, "Size of the transferred file in bytes")
+	conformanceCmd.Flags().BoolVarP(&stdout, "out", "o", false, "Print the output of <rft> to stdout and stderr")
+	rootCmd.AddCommand(conformanceCmd)
+}
@@ -0,0 +1,343 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hendrikcech/rft/rftp"
+)
+
+type servedFile struct {
+	path string
+	info os.FileInfo
+}
+
+// directory serves the files below root, by name and by checksum. The file
+// list is refreshed on every listing request and whenever a checksum is not
+// indexed.
+type directory struct {
+	root string
+	sums *checksumCache
+
+	lock  sync.Mutex
+	files []servedFile
+	// index maps checksums to the paths of the files, it is built on the
+	// first request by checksum and updated on misses, at most once per
+	// reindexInterval.
+	index   map[[16]byte]string
+	indexed time.Time
+}
+
+// reindexInterval limits how often requests for unknown checksums scan the
+// directory.
+const reindexInterval = 5 * time.Second
+
+func directoryHandler(dirname string) (rftp.FileHandler, error) {
+	d, err := newDirectory(dirname)
+	if err != nil {
+		return nil, err
+	}
+	return d.handle, nil
+}
+
+func newDirectory(dirname string) (*directory, error) {
+	info, err := os.Stat(dirname)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("is file, not directory")
+	}
+
+	d := &directory{
+		root: dirname,
+		sums: newChecksumCache(),
+	}
+	if err := d.scan(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *directory) scan() error {
+	var files []servedFile
+	walkFn := func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+
+		if !info.IsDir() {
+			p, err := filepath.Rel(d.root, path)
+			if err != nil {
+				return err
+			}
+			files = append(files, servedFile{filepath.ToSlash(p), info})
+		}
+		return nil
+	}
+	if err := filepath.Walk(d.root, walkFn); err != nil {
+		return err
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.files = files
+	return nil
+}
+
+func (d *directory) lookup(name string) (servedFile, bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	for _, f := range d.files {
+		if f.path == name {
+			return f, true
+		}
+	}
+	return servedFile{}, false
+}
+
+// handleListing serves the listing of a directory.
+func (d *directory) handleListing(dir string) (*io.SectionReader, error) {
+	l, err := d.listing(dir)
+	if err != nil {
+		return nil, err
+	}
+	return io.NewSectionReader(bytes.NewReader(l), 0, int64(len(l))), nil
+}
+
+func (d *directory) handle(name string) (*io.SectionReader, error) {
+	f, ok := d.lookup(name)
+	if !ok {
+		return nil, errors.New("file not found")
+	}
+	file, err := os.Open(filepath.Join(d.root, filepath.FromSlash(f.path)))
+	if err != nil {
+		return nil, err
+	}
+	if !debug {
+		fmt.Printf("handling file: %v, size: %v\n", file.Name(), byteCountIEC(f.info.Size()))
+	}
+	return io.NewSectionReader(file, 0, f.info.Size()), nil
+}
+
+// content serves the file with the given checksum.
+func (d *directory) content(sum [16]byte) (*io.SectionReader, error) {
+	if r, err := d.openIndexed(sum); err == nil {
+		return r, nil
+	}
+	// The file is new, renamed or changed since the index was built, or it
+	// doesn't exist at all. Unknown checksums must not make the server scan
+	// the directory on every request.
+	d.lock.Lock()
+	stale := time.Since(d.indexed) >= reindexInterval
+	if stale {
+		d.indexed = time.Now()
+	}
+	d.lock.Unlock()
+	if !stale {
+		return nil, errors.New("file not found")
+	}
+	if err := d.scan(); err != nil {
+		return nil, err
+	}
+	d.buildIndex()
+	return d.openIndexed(sum)
+}
+
+// buildIndex indexes the checksums of all files, only new and changed files
+// are read.
+func (d *directory) buildIndex() {
+	d.lock.Lock()
+	files := d.files
+	d.lock.Unlock()
+
+	index := make(map[[16]byte]string, len(files))
+	for _, f := range files {
+		sum, err := d.sums.sum(filepath.Join(d.root, filepath.FromSlash(f.path)), f.info)
+		if err != nil {
+			continue
+		}
+		index[sum] = f.path
+	}
+	d.lock.Lock()
+	d.index = index
+	d.lock.Unlock()
+}
+
+// openIndexed opens the indexed file with the given checksum, if it didn't
+// change since it was indexed.
+func (d *directory) openIndexed(sum [16]byte) (*io.SectionReader, error) {
+	d.lock.Lock()
+	p, ok := d.index[sum]
+	d.lock.Unlock()
+	if !ok {
+		return nil, errors.New("file not found")
+	}
+	path := filepath.Join(d.root, filepath.FromSlash(p))
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if s, err := d.sums.sum(path, info); err != nil || s != sum {
+		file.Close()
+		return nil, errors.New("file changed")
+	}
+	if !debug {
+		fmt.Printf("handling file: %v (%x), size: %v\n", file.Name(), sum, byteCountIEC(info.Size()))
+	}
+	return io.NewSectionReader(file, 0, info.Size()), nil
+}
+
+// listing returns the listing of all files below dir. The paths in the
+// listing are relative to dir.
+func (d *directory) listing(dir string) ([]byte, error) {
+	if err := d.scan(); err != nil {
+		return nil, err
+	}
+	dir = path.Clean("/" + dir)[1:]
+
+	d.lock.Lock()
+	files := d.files
+	d.lock.Unlock()
+
+	entries := []listingEntry{}
+	for _, f := range files {
+		rel := f.path
+		if dir != "" {
+			if !strings.HasPrefix(f.path, dir+"/") {
+				continue
+			}
+			rel = strings.TrimPrefix(f.path, dir+"/")
+		}
+		sum, err := d.sums.sum(filepath.Join(d.root, filepath.FromSlash(f.path)), f.info)
+		if err != nil {
+			continue
+		}
+		entries = append(entries, listingEntry{path: rel, size: f.info.Size(), sum: sum})
+	}
+	if len(entries) == 0 && dir != "" {
+		return nil, fmt.Errorf("directory %v not found", dir)
+	}
+	if !debug {
+		fmt.Printf("handling listing: %v, files: %v\n", dir, len(entries))
+	}
+	return formatListing(entries), nil
+}
+
+type listingEntry struct {
+	path string
+	size int64
+	sum  [16]byte
+}
+
+// listingHeader starts each listing, so that listings are never empty.
+const listingHeader = "# rft listing v1"
+
+// formatListing encodes one entry per line as "<md5> <size> <quoted path>".
+func formatListing(entries []listingEntry) []byte {
+	buf := new(bytes.Buffer)
+	fmt.Fprintln(buf, listingHeader)
+	for _, e := range entries {
+		fmt.Fprintf(buf, "%x %d %s\n", e.sum, e.size, strconv.Quote(e.path))
+	}
+	return buf.Bytes()
+}
+
+func parseListing(r io.Reader) ([]listingEntry, error) {
+	entries := []listingEntry{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "#") {
+			continue
+		}
+		fields := strings.SplitN(scanner.Text(), " ", 3)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("invalid listing line: %q", scanner.Text())
+		}
+		e := listingEntry{}
+		sum, err := hex.DecodeString(fields[0])
+		if err != nil || len(sum) != len(e.sum) {
+			return nil, fmt.Errorf("invalid checksum %q", fields[0])
+		}
+		copy(e.sum[:], sum)
+		size, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid size %q: %v", fields[1], err)
+		}
+		e.size = size
+		if e.path, err = strconv.Unquote(fields[2]); err != nil {
+			return nil, fmt.Errorf("invalid path %v: %v", fields[2], err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, scanner.Err()
+}
+
+type checksumEntry struct {
+	size    int64
+	modTime time.Time
+	sum     [16]byte
+}
+
+// checksumCache remembers the MD5 checksums of files. A checksum is computed
+// again if the size or the modification time of the file changed.
+type checksumCache struct {
+	lock    sync.Mutex
+	entries map[string]checksumEntry
+}
+
+func newChecksumCache() *checksumCache {
+	return &checksumCache{
+		entries: make(map[string]checksumEntry),
+	}
+}
+
+func (c *checksumCache) sum(path string, info os.FileInfo) ([16]byte, error) {
+	c.lock.Lock()
+	e, ok := c.entries[path]
+	c.lock.Unlock()
+	if ok && e.size == info.Size() && e.modTime.Equal(info.ModTime()) {
+		return e.sum, nil
+	}
+
+	sum, err := fileChecksum(path)
+	if err != nil {
+		return sum, err
+	}
+	c.lock.Lock()
+	c.entries[path] = checksumEntry{size: info.Size(), modTime: info.ModTime(), sum: sum}
+	c.lock.Unlock()
+	return sum, nil
+}
+
+func fileChecksum(path string) ([16]byte, error) {
+	var sum [16]byte
+	f, err := os.Open(path)
+	if err != nil {
+		return sum, err
+	}
+	defer f.Close()
+	h := md5.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return sum, err
+	}
+	copy(sum[:], h.Sum(nil))
+	return sum, nil
+}
@@ -0,0 +1,34 @@
+package cmd
+
+import (
+	"crypto/md5"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDirectoryContent(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "a"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	d, err := newDirectory(root)
+	if err != nil {
+		t.Fatalf("newDirectory() error = %v", err)
+	}
+	if r, err := d.content(md5.Sum([]byte("a"))); err != nil || r.Size() != 1 {
+		t.Fatalf("content() of a = %v, %v", r, err)
+	}
+
+	// Unknown checksums are answered from the index until it is stale.
+	if err := os.WriteFile(filepath.Join(root, "b"), []byte("b"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.content(md5.Sum([]byte("b"))); err == nil {
+		t.Errorf("content() of b scanned the directory again right away")
+	}
+	d.indexed = d.indexed.Add(-reindexInterval)
+	if r, err := d.content(md5.Sum([]byte("b"))); err != nil || r.Size() != 1 {
+		t.Errorf("content() of b = %v, %v after the index is stale", r, err)
+	}
+}
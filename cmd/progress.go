@@ -0,0 +1,137 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hendrikcech/rft/rftp"
+)
+
+// progressDisplay renders one progress line per file and a summary line. The
+// lines are redrawn in place on every update.
+type progressDisplay struct {
+	w     io.Writer
+	names []string
+	reqs  []*rftp.FileResponse
+	start time.Time
+
+	lock     sync.Mutex
+	finished []bool
+	lines    int
+}
+
+func newProgressDisplay(w io.Writer, names []string, reqs []*rftp.FileResponse) *progressDisplay {
+	return &progressDisplay{
+		w:     w,
+		names: names,
+		reqs:  reqs,
+		start: time.Now(),
+
+		finished: make([]bool, len(reqs)),
+	}
+}
+
+// waitAll waits concurrently for all responses to finish and redraws the
+// display until then.
+func (d *progressDisplay) waitAll() {
+	var wg sync.WaitGroup
+	for i, req := range d.reqs {
+		wg.Add(1)
+		go func(i int, req *rftp.FileResponse) {
+			defer wg.Done()
+			req.Wait()
+			d.lock.Lock()
+			d.finished[i] = true
+			d.lock.Unlock()
+		}(i, req)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	ticker := time.NewTicker(200 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		d.render()
+		select {
+		case <-done:
+			d.render()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (d *progressDisplay) render() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	elapsed := time.Since(d.start)
+	width := len("total")
+	for _, n := range d.names {
+		if len(n) > width {
+			width = len(n)
+		}
+	}
+
+	b := &strings.Builder{}
+	if d.lines > 0 {
+		// move the cursor back to the first line of the display
+		fmt.Fprintf(b, "\033[%dA", d.lines)
+	}
+
+	var done, total, retrans uint64
+	finished := true
+	for i, req := range d.reqs {
+		received, size := req.Received(), req.Size()
+		done += received
+		total += size
+		retrans += req.Retransmissions()
+
+		status := ""
+		if !d.finished[i] {
+			finished = false
+		} else if err := req.Wait(); err != nil {
+			status = fmt.Sprintf("err: %v", err)
+		} else {
+			status = "success"
+		}
+		fmt.Fprintf(b, "\r\033[K%-*s %v  %v\n", width, d.names[i],
+			progressLine(received, size, elapsed, req.Retransmissions()), status)
+	}
+	status := ""
+	if finished {
+		status = fmt.Sprintf("in %v", elapsed.Round(time.Millisecond))
+	}
+	fmt.Fprintf(b, "\r\033[K%-*s %v  %v\n", width, "total",
+		progressLine(done, total, elapsed, retrans), status)
+
+	d.lines = len(d.reqs) + 1
+	fmt.Fprint(d.w, b.String())
+}
+
+func progressLine(done, total uint64, elapsed time.Duration, retrans uint64) string {
+	rate := float64(0)
+	if elapsed > 0 {
+		rate = float64(done) / elapsed.Seconds()
+	}
+	eta := "-"
+	if rate > 0 && total > done {
+		secs := float64(total-done) / rate
+		eta = time.Duration(secs * float64(time.Second)).Round(time.Second).String()
+	} else if total > 0 && total <= done {
+		eta = "0s"
+	}
+	percent := float64(0)
+	if total > 0 {
+		percent = float64(done) / float64(total) * 100
+	}
+	return fmt.Sprintf("%10v / %-10v %6.2f%%  %10v/s  ETA %-6v  retrans %v",
+		byteCountIEC(int64(done)), byteCountIEC(int64(total)), percent,
+		byteCountIEC(int64(rate)), eta, retrans)
+}
@@ -0,0 +1,98 @@
+package cmd
+
+import (
+	"log"
+	"net"
+	"sync"
+
+	"github.com/hendrikcech/rft/rftp"
+)
+
+// impairedProxy forwards UDP packets between clients and a server and impairs
+// them in both directions. It is used by the benchmark to emulate network
+// conditions for implementations that do not support them.
+type impairedProxy struct {
+	conn   net.PacketConn
+	server *net.UDPAddr
+
+	lock      sync.Mutex
+	upstreams map[string]net.PacketConn
+}
+
+// startImpairedProxy impairs the packets to the clients according to send and
+// the packets from the clients according to receive.
+func startImpairedProxy(listen, server string, send, receive rftp.Impairment) (*impairedProxy, error) {
+	serverAddr, err := net.ResolveUDPAddr("udp4", server)
+	if err != nil {
+		return nil, err
+	}
+	listenAddr, err := net.ResolveUDPAddr("udp4", listen)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp4", listenAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &impairedProxy{
+		conn:      rftp.NewImpairedPacketConn(conn, send, receive),
+		server:    serverAddr,
+		upstreams: make(map[string]net.PacketConn),
+	}
+	go p.serve()
+	return p, nil
+}
+
+// serve forwards the packets of the clients to the server. Every client gets
+// its own upstream socket, so that the server can tell the clients apart.
+func (p *impairedProxy) serve() {
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := p.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		p.lock.Lock()
+		upstream, ok := p.upstreams[addr.String()]
+		if !ok {
+			upstream, err = net.ListenUDP("udp4", nil)
+			if err != nil {
+				p.lock.Unlock()
+				log.Printf("proxy: can't create upstream socket: %v\n", err)
+				continue
+			}
+			p.upstreams[addr.String()] = upstream
+			go p.serveUpstream(upstream, addr)
+		}
+		p.lock.Unlock()
+
+		if _, err := upstream.WriteTo(buf[:n], p.server); err != nil {
+			log.Printf("proxy: can't forward packet to server: %v\n", err)
+		}
+	}
+}
+
+// serveUpstream forwards the packets of the server to the client.
+func (p *impairedProxy) serveUpstream(upstream net.PacketConn, client net.Addr) {
+	buf := make([]byte, 65536)
+	for {
+		n, _, err := upstream.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if _, err := p.conn.WriteTo(buf[:n], client); err != nil {
+			log.Printf("proxy: can't forward packet to client: %v\n", err)
+		}
+	}
+}
+
+func (p *impairedProxy) close() {
+	p.conn.Close()
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for _, upstream := range p.upstreams {
+		upstream.Close()
+	}
+}
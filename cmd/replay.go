@@ -0,0 +1,66 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/hendrikcech/rft/rftp"
+	"github.com/spf13/cobra"
+)
+
+var replayPort int
+
+var replayCmd = &cobra.Command{
+	Use:   "replay <capture>",
+	Short: "Decode the rft packets of a pcap or pcapng capture",
+	Long: `replay prints one line per UDP datagram of a capture, e.g., recorded with
+--record or tcpdump. Each line contains the time since the first datagram, the
+direction as seen by the recording endpoint, the addresses and the decoded
+message.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		f, err := os.Open(args[0])
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		defer f.Close()
+
+		if err := replay(f, os.Stdout); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	},
+}
+
+func replay(r io.Reader, w io.Writer) error {
+	cr, err := rftp.NewCaptureReader(r)
+	if err != nil {
+		return err
+	}
+
+	var start *rftp.CapturedDatagram
+	for {
+		d, err := cr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if replayPort != 0 && d.Src.Port != replayPort && d.Dst.Port != replayPort {
+			continue
+		}
+		if start == nil {
+			start = d
+		}
+		fmt.Fprintf(w, "%10.6f %-3v %v > %v  %v\n", d.Time.Sub(start.Time).Seconds(),
+			d.Direction, d.Src, d.Dst, rftp.DescribeDatagram(d.Data))
+	}
+}
+
+func init() {
+	replayCmd.Flags().IntVarP(&replayPort, "port", "t", 0, "only decode datagrams from or to this port")
+	rootCmd.AddCommand(replayCmd)
+}
@@ -0,0 +1,273 @@
+package cmd
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// benchResult is the outcome of a single transfer of the benchmark.
+type benchResult struct {
+	Run        int     `json:"run"`
+	Server     string  `json:"server"`
+	Client     string  `json:"client"`
+	File       string  `json:"file"`
+	Size       int64   `json:"size"`
+	Files      int     `json:"files"`
+	P          float32 `json:"p"`
+	Q          float32 `json:"q"`
+	Repetition int     `json:"repetition"`
+	ClientID   int     `json:"client_id"`
+	// Duration of the last attempt.
+	Duration   time.Duration `json:"-"`
+	Seconds    float64       `json:"duration_s"`
+	Throughput float64       `json:"throughput_bps"` // bytes per second
+	Success    bool          `json:"success"`
+	TimedOut   bool          `json:"timed_out"`
+	Retries    int           `json:"retries"`
+	// Seeds of the loss simulation, the client seed is the one of the last
+	// attempt.
+	ServerSeed int64 `json:"server_seed"`
+	ClientSeed int64 `json:"client_seed"`
+}
+
+func newBenchResult(run int, server, client string, tf testfile, loss lossPoint, repetition int) benchResult {
+	return benchResult{
+		Run:        run,
+		Server:     server,
+		Client:     client,
+		File:       strings.Join(tf.names, " "),
+		Size:       tf.size,
+		Files:      len(tf.names),
+		P:          loss.p,
+		Q:          loss.q,
+		Repetition: repetition,
+	}
+}
+
+func (r *benchResult) setDuration(d time.Duration) {
+	r.Duration = d
+	r.Seconds = d.Seconds()
+	if d > 0 {
+		r.Throughput = float64(r.Size*int64(r.Files)) / d.Seconds()
+	}
+}
+
+// benchSummary aggregates the repetitions and clients of one file group of
+// one run at one point of the loss grid.
+type benchSummary struct {
+	Run       int     `json:"run"`
+	Server    string  `json:"server"`
+	Client    string  `json:"client"`
+	Size      int64   `json:"size"`
+	Files     int     `json:"files"`
+	P         float32 `json:"p"`
+	Q         float32 `json:"q"`
+	N         int     `json:"n"`
+	Successes int     `json:"successes"`
+	Mean      float64 `json:"mean_s"`
+	Median    float64 `json:"median_s"`
+	P90       float64 `json:"p90_s"`
+	P99       float64 `json:"p99_s"`
+	Min       float64 `json:"min_s"`
+	Max       float64 `json:"max_s"`
+	// MeanThroughput and MedianThroughput are in bytes per second.
+	MeanThroughput   float64 `json:"mean_throughput_bps"`
+	MedianThroughput float64 `json:"median_throughput_bps"`
+}
+
+// summarize groups the results by loss parameters, run and file group.
+// Durations and throughputs are computed over the successful transfers only.
+func summarize(results []benchResult) []benchSummary {
+	type key struct {
+		p, q  float32
+		run   int
+		size  int64
+		files int
+	}
+	groups := map[key][]benchResult{}
+	keys := []key{}
+	for _, r := range results {
+		k := key{r.P, r.Q, r.Run, r.Size, r.Files}
+		if _, ok := groups[k]; !ok {
+			keys = append(keys, k)
+		}
+		groups[k] = append(groups[k], r)
+	}
+
+	summaries := []benchSummary{}
+	for _, k := range keys {
+		rs := groups[k]
+		s := benchSummary{Run: k.run, Server: rs[0].Server, Client: rs[0].Client, Size: k.size,
+			Files: k.files, P: k.p, Q: k.q, N: len(rs)}
+		durations := []float64{}
+		throughputs := []float64{}
+		for _, r := range rs {
+			if !r.Success {
+				continue
+			}
+			s.Successes++
+			durations = append(durations, r.Seconds)
+			throughputs = append(throughputs, r.Throughput)
+		}
+		if len(durations) > 0 {
+			sort.Float64s(durations)
+			sort.Float64s(throughputs)
+			s.Mean = mean(durations)
+			s.Median = percentile(durations, 50)
+			s.P90 = percentile(durations, 90)
+			s.P99 = percentile(durations, 99)
+			s.Min = durations[0]
+			s.Max = durations[len(durations)-1]
+			s.MeanThroughput = mean(throughputs)
+			s.MedianThroughput = percentile(throughputs, 50)
+		}
+		summaries = append(summaries, s)
+	}
+	return summaries
+}
+
+func mean(xs []float64) float64 {
+	sum := 0.0
+	for _, x := range xs {
+		sum += x
+	}
+	return sum / float64(len(xs))
+}
+
+// percentile interpolates linearly between the closest ranks of the sorted
+// values. It is 0 without values.
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	if len(sorted) == 1 {
+		return sorted[0]
+	}
+	rank := p / 100 * float64(len(sorted)-1)
+	lo := int(math.Floor(rank))
+	hi := int(math.Ceil(rank))
+	return sorted[lo] + (rank-float64(lo))*(sorted[hi]-sorted[lo])
+}
+
+// benchReport collects the results of the single transfers and of the rounds
+// of concurrent transfers.
+type benchReport struct {
+	Results []benchResult
+	Load    []benchLoad
+}
+
+func (r *benchReport) add(o benchReport) {
+	r.Results = append(r.Results, o.Results...)
+	r.Load = append(r.Load, o.Load...)
+}
+
+// concurrent returns whether any round had more than one client.
+func (r benchReport) concurrent() bool {
+	for _, l := range r.Load {
+		if l.Clients > 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// writeReport writes the results in the given format, one of "text", "json"
+// or "csv". Only the text and the JSON report contain the summary.
+func writeReport(w io.Writer, format string, report benchReport) error {
+	switch format {
+	case "text":
+		if err := writeSummaryTable(w, summarize(report.Results)); err != nil {
+			return err
+		}
+		if !report.concurrent() {
+			return nil
+		}
+		fmt.Fprintln(w)
+		return writeLoadTable(w, report.Load)
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(struct {
+			Results []benchResult  `json:"results"`
+			Summary []benchSummary `json:"summary"`
+			Load    []benchLoad    `json:"load"`
+		}{report.Results, summarize(report.Results), report.Load})
+	case "csv":
+		return writeCSV(w, report.Results)
+	}
+	return fmt.Errorf("unknown report format %q", format)
+}
+
+func writeCSV(w io.Writer, results []benchResult) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"run", "server", "client", "file", "size", "files", "p", "q", "repetition",
+		"client_id", "duration_s", "throughput_bps", "success", "timed_out", "retries", "server_seed", "client_seed"})
+	for _, r := range results {
+		cw.Write([]string{
+			strconv.Itoa(r.Run),
+			r.Server,
+			r.Client,
+			r.File,
+			strconv.FormatInt(r.Size, 10),
+			strconv.Itoa(r.Files),
+			strconv.FormatFloat(float64(r.P), 'g', -1, 32),
+			strconv.FormatFloat(float64(r.Q), 'g', -1, 32),
+			strconv.Itoa(r.Repetition),
+			strconv.Itoa(r.ClientID),
+			strconv.FormatFloat(r.Seconds, 'f', 6, 64),
+			strconv.FormatFloat(r.Throughput, 'f', 0, 64),
+			strconv.FormatBool(r.Success),
+			strconv.FormatBool(r.TimedOut),
+			strconv.Itoa(r.Retries),
+			strconv.FormatInt(r.ServerSeed, 10),
+			strconv.FormatInt(r.ClientSeed, 10),
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func writeSummaryTable(w io.Writer, summaries []benchSummary) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "p\tq\trun\tsize\tfiles\tok\tmean\tmedian\tp90\tp99\tmin\tmax\tthroughput\t")
+	for _, s := range summaries {
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\t%v/%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v/s\t\n",
+			s.P, s.Q, s.Run, byteCountIEC(s.Size), s.Files, s.Successes, s.N,
+			seconds(s.Mean), seconds(s.Median), seconds(s.P90), seconds(s.P99),
+			seconds(s.Min), seconds(s.Max), byteCountIEC(int64(s.MedianThroughput)))
+	}
+	return tw.Flush()
+}
+
+func writeLoadTable(w io.Writer, loads []benchLoad) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	// In process, only the heap of the whole process is known.
+	memory := "server memory"
+	if len(loads) > 0 && loads[0].ProcessHeap > 0 {
+		memory = "process heap"
+	}
+	fmt.Fprintf(tw, "p\tq\trun\tsize\tfiles\trep\tok\twall\tmin\tmedian\tmax\taggregate\tfairness\t%v\tgoroutines\t\n", memory)
+	for _, l := range loads {
+		mem := l.ServerMemory
+		if l.ProcessHeap > 0 {
+			mem = l.ProcessHeap
+		}
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\t%v\t%v/%v\t%v\t%v\t%v\t%v\t%v/s\t%.2f\t%v\t%v\t\n",
+			l.P, l.Q, l.Run, byteCountIEC(l.Size), l.Files, l.Repetition, l.Completed, l.Clients,
+			seconds(l.Seconds), seconds(l.MinCompletion), seconds(l.MedianCompletion), seconds(l.MaxCompletion),
+			byteCountIEC(int64(l.AggregateThroughput)), l.Fairness, byteCountIEC(int64(mem)), l.ServerGoroutines)
+	}
+	return tw.Flush()
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second)).Round(time.Millisecond)
+}
@@ -0,0 +1,105 @@
+package cmd
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPercentile(t *testing.T) {
+	tests := map[string]struct {
+		sorted []float64
+		p      float64
+		want   float64
+	}{
+		"empty":         {sorted: nil, p: 50, want: 0},
+		"single":        {sorted: []float64{3}, p: 90, want: 3},
+		"median odd":    {sorted: []float64{1, 2, 10}, p: 50, want: 2},
+		"median even":   {sorted: []float64{1, 2, 4, 10}, p: 50, want: 3},
+		"interpolation": {sorted: []float64{0, 10}, p: 90, want: 9},
+		"min":           {sorted: []float64{1, 2, 3}, p: 0, want: 1},
+		"max":           {sorted: []float64{1, 2, 3}, p: 100, want: 3},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := percentile(tc.sorted, tc.p); got != tc.want {
+				t.Errorf("percentile(%v, %v) = %v, want %v", tc.sorted, tc.p, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestJainIndex(t *testing.T) {
+	tests := map[string]struct {
+		xs   []float64
+		want float64
+	}{
+		"empty":      {xs: nil, want: 0},
+		"all zeros":  {xs: []float64{0, 0, 0}, want: 0},
+		"equal":      {xs: []float64{5, 5, 5, 5}, want: 1},
+		"one of two": {xs: []float64{4, 0}, want: 0.5},
+		"one of four": {
+			xs:   []float64{0, 7, 0, 0},
+			want: 0.25,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := jainIndex(tc.xs); got != tc.want {
+				t.Errorf("jainIndex(%v) = %v, want %v", tc.xs, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSummarize(t *testing.T) {
+	result := func(run int, p float32, d time.Duration, success bool) benchResult {
+		r := benchResult{Run: run, Server: "s", Client: "c", Size: 1000, Files: 1, P: p, Q: p, Success: success}
+		r.setDuration(d)
+		return r
+	}
+	tests := map[string]struct {
+		results []benchResult
+		want    []benchSummary
+	}{
+		"empty": {results: nil, want: []benchSummary{}},
+		"failures only count in N": {
+			results: []benchResult{
+				result(1, 0.1, time.Second, true),
+				result(1, 0.1, 5*time.Second, true),
+				result(1, 0.1, time.Minute, false),
+			},
+			want: []benchSummary{{
+				Run: 1, Server: "s", Client: "c", Size: 1000, Files: 1, P: 0.1, Q: 0.1,
+				N: 3, Successes: 2, Mean: 3, Median: 3, P90: 4.6, P99: 4.96, Min: 1, Max: 5,
+				MeanThroughput: 600, MedianThroughput: 600,
+			}},
+		},
+		"grouped by run and loss": {
+			results: []benchResult{
+				result(1, 0.1, time.Second, true),
+				result(2, 0.2, 2*time.Second, true),
+				result(1, 0.1, time.Second, false),
+			},
+			want: []benchSummary{
+				{Run: 1, Server: "s", Client: "c", Size: 1000, Files: 1, P: 0.1, Q: 0.1,
+					N: 2, Successes: 1, Mean: 1, Median: 1, P90: 1, P99: 1, Min: 1, Max: 1,
+					MeanThroughput: 1000, MedianThroughput: 1000},
+				{Run: 2, Server: "s", Client: "c", Size: 1000, Files: 1, P: 0.2, Q: 0.2,
+					N: 1, Successes: 1, Mean: 2, Median: 2, P90: 2, P99: 2, Min: 2, Max: 2,
+					MeanThroughput: 500, MedianThroughput: 500},
+			},
+		},
+		"no successes": {
+			results: []benchResult{result(1, 0, time.Second, false)},
+			want:    []benchSummary{{Run: 1, Server: "s", Client: "c", Size: 1000, Files: 1, N: 1}},
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := summarize(tc.results); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("summarize() = %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
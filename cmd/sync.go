@@ -0,0 +1,283 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/hendrikcech/rft/rftp"
+	"github.com/spf13/cobra"
+)
+
+var syncDelete bool
+
+var syncCmd = &cobra.Command{
+	Use:   "sync <host> <remote-dir> <local-dir>",
+	Short: "Mirror a directory of a rft server to a local directory",
+	Long: `sync fetches a listing of all files below <remote-dir> of the server,
+including their sizes and checksums. Files whose local checksum matches are
+skipped, partially downloaded files are resumed and all other files are
+downloaded. Use "." as <remote-dir> to mirror the whole served directory.`,
+	Args: cobra.ExactArgs(3),
+	Run: func(cmd *cobra.Command, args []string) {
+		host, remote, local := args[0], args[1], args[2]
+
+		if err := checkLossParams(); err != nil {
+			log.Print(err)
+			os.Exit(1)
+		}
+		if err := startRecording(); err != nil {
+			log.Print(err)
+			os.Exit(1)
+		}
+
+		if err := os.MkdirAll(local, 0755); err != nil {
+			fmt.Printf("Can't create local directory: %v\n", err)
+			os.Exit(1)
+		}
+
+		hs := fmt.Sprintf("%v:%v", host, t)
+		sum, err := syncDir(hs, remote, local, newClient)
+		if err != nil {
+			fmt.Printf("sync failed: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println(sum)
+		if sum.failed > 0 {
+			os.Exit(1)
+		}
+	},
+}
+
+type syncSummary struct {
+	upToDate    int
+	downloaded  int
+	resumed     int
+	deleted     int
+	failed      int
+	transferred uint64
+	duration    time.Duration
+}
+
+func (s syncSummary) String() string {
+	return fmt.Sprintf("%v up to date, %v downloaded (%v resumed), %v deleted, %v failed; transferred %v in %v",
+		s.upToDate, s.downloaded, s.resumed, s.deleted, s.failed,
+		byteCountIEC(int64(s.transferred)), s.duration.Round(time.Millisecond))
+}
+
+// syncJob is a file that has to be downloaded.
+type syncJob struct {
+	entry  listingEntry
+	local  string
+	offset uint64
+}
+
+// syncDir mirrors remote to local with the clients that client returns.
+func syncDir(host, remote, local string, client func() *rftp.Client) (syncSummary, error) {
+	start := time.Now()
+	sum := syncSummary{}
+
+	entries, err := fetchListing(client(), host, remote)
+	if err != nil {
+		return sum, err
+	}
+
+	jobs := []syncJob{}
+	wanted := map[string]struct{}{}
+	for _, e := range entries {
+		lp, err := localPath(local, e.path)
+		if err != nil {
+			log.Println(err)
+			sum.failed++
+			continue
+		}
+		wanted[lp] = struct{}{}
+
+		info, err := os.Stat(lp)
+		switch {
+		case err != nil:
+			jobs = append(jobs, syncJob{entry: e, local: lp})
+		case info.Size() == e.size:
+			localSum, err := fileChecksum(lp)
+			if err == nil && localSum == e.sum {
+				sum.upToDate++
+				continue
+			}
+			jobs = append(jobs, syncJob{entry: e, local: lp})
+		case info.Size() < e.size:
+			jobs = append(jobs, syncJob{entry: e, local: lp, offset: uint64(info.Size()) / 1024})
+		default:
+			jobs = append(jobs, syncJob{entry: e, local: lp})
+		}
+	}
+
+	failed, err := download(client(), host, remote, jobs, &sum)
+	if err != nil {
+		return sum, err
+	}
+	// A partial file may not be a prefix of the remote file, download those
+	// files again completely.
+	retry := []syncJob{}
+	for _, j := range failed {
+		if j.offset > 0 {
+			j.offset = 0
+			retry = append(retry, j)
+		} else {
+			sum.failed++
+		}
+	}
+	if len(retry) > 0 {
+		failed, err = download(client(), host, remote, retry, &sum)
+		if err != nil {
+			return sum, err
+		}
+		sum.failed += len(failed)
+	}
+
+	if syncDelete {
+		sum.deleted, err = deleteExtraneous(local, wanted)
+		if err != nil {
+			return sum, err
+		}
+	}
+
+	sum.duration = time.Since(start)
+	return sum, nil
+}
+
+func fetchListing(client *rftp.Client, host, remote string) ([]listingEntry, error) {
+	reqs, err := client.RequestFiles(host, []rftp.FileRequest{{Name: remote, Listing: true}})
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(reqs[0])
+	if err != nil {
+		return nil, err
+	}
+	if reqs[0].Err != nil {
+		return nil, fmt.Errorf("can't get listing of %v: %v", remote, reqs[0].Err)
+	}
+	return parseListing(bytes.NewReader(data))
+}
+
+// localPath returns the local path of a remote file. Absolute paths and paths
+// that would leave the local directory are rejected.
+func localPath(local, remotePath string) (string, error) {
+	if path.IsAbs(remotePath) || filepath.IsAbs(remotePath) {
+		return "", fmt.Errorf("refusing to write absolute path %v", remotePath)
+	}
+	root := filepath.Clean(local)
+	lp := filepath.Join(root, filepath.FromSlash(remotePath))
+	if !strings.HasPrefix(lp, root+string(filepath.Separator)) {
+		return "", fmt.Errorf("refusing to write %v outside of %v", remotePath, local)
+	}
+	return lp, nil
+}
+
+// download requests all jobs at once and returns the jobs that failed.
+func download(client *rftp.Client, host, remote string, jobs []syncJob, sum *syncSummary) ([]syncJob, error) {
+	failed := []syncJob{}
+	frs := []rftp.FileRequest{}
+	requested := []syncJob{}
+	// files are the destinations of the requested jobs, each is closed once
+	// its transfer is done.
+	files := []*os.File{}
+	for _, j := range jobs {
+		if err := os.MkdirAll(filepath.Dir(j.local), 0755); err != nil {
+			log.Println(err)
+			failed = append(failed, j)
+			continue
+		}
+		flags := os.O_RDWR | os.O_CREATE
+		if j.offset == 0 {
+			flags |= os.O_TRUNC
+		}
+		file, err := os.OpenFile(j.local, flags, 0644)
+		if err != nil {
+			log.Println(err)
+			failed = append(failed, j)
+			continue
+		}
+
+		// Empty files can't be requested, the server answers with an error.
+		if j.entry.size == 0 {
+			file.Close()
+			sum.downloaded++
+			continue
+		}
+		frs = append(frs, rftp.FileRequest{
+			Name:   path.Join(remote, j.entry.path),
+			Dest:   file,
+			Offset: j.offset,
+		})
+		requested = append(requested, j)
+		files = append(files, file)
+	}
+	if len(frs) == 0 {
+		return failed, nil
+	}
+
+	reqs, err := client.RequestFiles(host, frs)
+	if err != nil {
+		for _, f := range files {
+			f.Close()
+		}
+		return nil, err
+	}
+	if !debug {
+		names := make([]string, len(requested))
+		for i, j := range requested {
+			names[i] = j.entry.path
+		}
+		newProgressDisplay(os.Stdout, names, reqs).waitAll()
+	}
+	for i, req := range reqs {
+		j := requested[i]
+		err := req.Wait()
+		files[i].Close()
+		if err != nil {
+			log.Printf("File %s error: %s", j.entry.path, err)
+			failed = append(failed, j)
+			continue
+		}
+		sum.downloaded++
+		if j.offset > 0 {
+			sum.resumed++
+		}
+		sum.transferred += req.Received() - j.offset*1024
+	}
+	return failed, nil
+}
+
+// deleteExtraneous removes all files below local that are not wanted.
+func deleteExtraneous(local string, wanted map[string]struct{}) (int, error) {
+	deleted := 0
+	err := filepath.Walk(local, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		if _, ok := wanted[p]; ok {
+			return nil
+		}
+		if err := os.Remove(p); err != nil {
+			return err
+		}
+		log.Printf("deleted %v\n", p)
+		deleted++
+		return nil
+	})
+	return deleted, err
+}
+
+func init() {
+	syncCmd.Flags().IntVarP(&t, "port", "t", 2020, "specify the port number to use")
+	syncCmd.Flags().BoolVar(&syncDelete, "delete", false, "delete local files that do not exist on the server")
+	syncCmd.Flags().BoolVarP(&debug, "v", "v", false, "print debug output")
+	rootCmd.AddCommand(syncCmd)
+}
@@ -0,0 +1,212 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/md5"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/hendrikcech/rft/rftp"
+)
+
+func TestListingRoundTrip(t *testing.T) {
+	entries := []listingEntry{
+		{path: "a", size: 0, sum: md5.Sum(nil)},
+		{path: "dir/with space", size: 1024, sum: md5.Sum([]byte("b"))},
+		{path: "quote\"and\nnewline", size: 1 << 40, sum: md5.Sum([]byte("c"))},
+	}
+	got, err := parseListing(bytes.NewReader(formatListing(entries)))
+	if err != nil {
+		t.Fatalf("parseListing() error = %v", err)
+	}
+	if !reflect.DeepEqual(got, entries) {
+		t.Errorf("parseListing(formatListing(%v)) = %v", entries, got)
+	}
+}
+
+func TestLocalPath(t *testing.T) {
+	root := filepath.Join("tmp", "dest")
+	tests := map[string]struct {
+		remote string
+		want   string
+		err    bool
+	}{
+		"file":          {remote: "a", want: filepath.Join(root, "a")},
+		"subdirectory":  {remote: "dir/b", want: filepath.Join(root, "dir", "b")},
+		"inner dotdot":  {remote: "dir/../b", want: filepath.Join(root, "b")},
+		"parent":        {remote: "../a", err: true},
+		"nested parent": {remote: "dir/../../a", err: true},
+		"root itself":   {remote: ".", err: true},
+		"absolute":      {remote: "/etc/passwd", err: true},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := localPath(root, tc.remote)
+			if tc.err {
+				if err == nil {
+					t.Errorf("localPath(%q, %q) = %v, want an error", root, tc.remote, got)
+				}
+				return
+			}
+			if err != nil || got != tc.want {
+				t.Errorf("localPath(%q, %q) = %v, %v, want %v", root, tc.remote, got, err, tc.want)
+			}
+		})
+	}
+}
+
+// startSyncServer serves the files and listings of the handlers on network at
+// localhost:2020 until the test ends.
+func startSyncServer(t *testing.T, network *rftp.MemNetwork, fh rftp.FileHandler, lh rftp.ListingHandler) {
+	t.Helper()
+	server := rftp.NewServer()
+	server.Conn = network.NewConnection()
+	server.SetFileHandler(fh)
+	server.SetListingHandler(lh)
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Listen("localhost:2020")
+	}()
+	select {
+	case <-server.Ready():
+	case err := <-done:
+		t.Fatalf("server failed to listen: %v", err)
+	}
+	t.Cleanup(func() {
+		server.Close()
+		<-done
+	})
+}
+
+func writeFiles(t *testing.T, root string, files map[string][]byte) {
+	t.Helper()
+	for name, data := range files {
+		p := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSyncDir(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	random := func(n int) []byte {
+		data := make([]byte, n)
+		rng.Read(data)
+		return data
+	}
+	files := map[string][]byte{
+		"same":      random(2000),
+		"dir/short": random(5000),
+		"missing":   random(3000),
+	}
+	src, dst := t.TempDir(), t.TempDir()
+	writeFiles(t, src, files)
+	writeFiles(t, dst, map[string][]byte{
+		"same":      files["same"],
+		"dir/short": files["dir/short"][:2048],
+		"extra":     []byte("not on the server"),
+	})
+
+	d, err := newDirectory(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	network := rftp.NewMemNetwork()
+	startSyncServer(t, network, d.handle, d.handleListing)
+	client := func() *rftp.Client {
+		return &rftp.Client{Conn: network.NewConnection()}
+	}
+
+	defer func(d bool) { syncDelete = d }(syncDelete)
+	tests := []struct {
+		name   string
+		delete bool
+		want   syncSummary
+		extra  bool
+	}{
+		{
+			name: "keep extraneous",
+			want: syncSummary{
+				upToDate:    1,
+				downloaded:  2,
+				resumed:     1,
+				transferred: 5000 - 2048 + 3000,
+			},
+			extra: true,
+		},
+		{
+			name:   "delete extraneous",
+			delete: true,
+			want:   syncSummary{upToDate: 3, deleted: 1},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			syncDelete = tc.delete
+			sum, err := syncDir("localhost:2020", ".", dst, client)
+			if err != nil {
+				t.Fatalf("syncDir() error = %v", err)
+			}
+			sum.duration = 0
+			if sum != tc.want {
+				t.Errorf("syncDir() = %+v, want %+v", sum, tc.want)
+			}
+			for name, data := range files {
+				got, err := os.ReadFile(filepath.Join(dst, filepath.FromSlash(name)))
+				if err != nil || !bytes.Equal(got, data) {
+					t.Errorf("%v differs from the server after sync, err = %v", name, err)
+				}
+			}
+			if _, err := os.Stat(filepath.Join(dst, "extra")); (err == nil) != tc.extra {
+				t.Errorf("extra exists = %v, want %v", err == nil, tc.extra)
+			}
+		})
+	}
+}
+
+func TestSyncDirRejectsTraversal(t *testing.T) {
+	data := []byte("inside")
+	listing := formatListing([]listingEntry{
+		{path: "../outside", size: int64(len(data)), sum: md5.Sum(data)},
+		{path: "/absolute", size: int64(len(data)), sum: md5.Sum(data)},
+		{path: "inside", size: int64(len(data)), sum: md5.Sum(data)},
+	})
+	network := rftp.NewMemNetwork()
+	startSyncServer(t, network,
+		func(name string) (*io.SectionReader, error) {
+			return io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data))), nil
+		},
+		func(string) (*io.SectionReader, error) {
+			return io.NewSectionReader(bytes.NewReader(listing), 0, int64(len(listing))), nil
+		})
+	client := func() *rftp.Client {
+		return &rftp.Client{Conn: network.NewConnection()}
+	}
+
+	parent := t.TempDir()
+	dst := filepath.Join(parent, "dst")
+	if err := os.Mkdir(dst, 0755); err != nil {
+		t.Fatal(err)
+	}
+	sum, err := syncDir("localhost:2020", ".", dst, client)
+	if err != nil {
+		t.Fatalf("syncDir() error = %v", err)
+	}
+	if sum.failed != 2 || sum.downloaded != 1 {
+		t.Errorf("syncDir() = %+v, want 2 failed and 1 downloaded", sum)
+	}
+	if _, err := os.Stat(filepath.Join(parent, "outside")); err == nil {
+		t.Errorf("sync wrote outside of the local directory")
+	}
+	if got, err := os.ReadFile(filepath.Join(dst, "inside")); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("inside = %q, %v, want %q", got, err, data)
+	}
+}
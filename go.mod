@@ -1,5 +1,10 @@
 module github.com/hendrikcech/rft
 
-go 1.14
+go 1.21
 
 require github.com/spf13/cobra v1.0.0
+
+require (
+	github.com/inconshreveable/mousetrap v1.0.0 // indirect
+	github.com/spf13/pflag v1.0.3 // indirect
+)
@@ -0,0 +1,31 @@
+package rftp
+
+// bitmap records which chunks of a file have been received. It grows on
+// demand, because the number of chunks is only known after the metadata
+// arrived.
+type bitmap struct {
+	words []uint64
+	count uint64
+}
+
+func (b *bitmap) set(i uint64) bool {
+	w := i / 64
+	for uint64(len(b.words)) <= w {
+		b.words = append(b.words, 0)
+	}
+	mask := uint64(1) << (i % 64)
+	if b.words[w]&mask != 0 {
+		return false
+	}
+	b.words[w] |= mask
+	b.count++
+	return true
+}
+
+func (b *bitmap) get(i uint64) bool {
+	w := i / 64
+	if w >= uint64(len(b.words)) {
+		return false
+	}
+	return b.words[w]&(uint64(1)<<(i%64)) != 0
+}
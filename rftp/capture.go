@@ -0,0 +1,374 @@
+package rftp
+
+import (
+	"bufio"
+	"encoding"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// Direction of a captured datagram as seen by the recording endpoint.
+type Direction uint8
+
+const (
+	DirectionUnknown Direction = iota
+	Inbound
+	Outbound
+)
+
+func (d Direction) String() string {
+	switch d {
+	case Inbound:
+		return "in"
+	case Outbound:
+		return "out"
+	}
+	return "?"
+}
+
+// CapturedDatagram is a UDP datagram read from a capture file.
+type CapturedDatagram struct {
+	Time      time.Time
+	Direction Direction
+	Src, Dst  *net.UDPAddr
+	Data      []byte
+}
+
+const (
+	pcapMagicMicros = 0xa1b2c3d4
+	pcapMagicNanos  = 0xa1b23c4d
+	linkTypeNull    = 0
+	linkTypeEther   = 1
+	linkTypeLinux   = 113
+)
+
+type captureInterface struct {
+	linkType uint16
+	tsPerSec uint64
+}
+
+// CaptureReader reads the UDP datagrams of a pcap or pcapng file, e.g., one
+// written by a PcapWriter or by tcpdump. Packets that are not IPv4 UDP
+// datagrams are skipped.
+type CaptureReader struct {
+	r     *bufio.Reader
+	order binary.ByteOrder
+	ng    bool
+	ifs   []captureInterface
+}
+
+func NewCaptureReader(r io.Reader) (*CaptureReader, error) {
+	c := &CaptureReader{r: bufio.NewReader(r)}
+	magic, err := c.r.Peek(4)
+	if err != nil {
+		return nil, err
+	}
+
+	if binary.LittleEndian.Uint32(magic) == pcapngSectionHeader {
+		c.ng = true
+		return c, nil
+	}
+
+	hdr := make([]byte, 24)
+	if _, err := io.ReadFull(c.r, hdr); err != nil {
+		return nil, err
+	}
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		switch order.Uint32(hdr) {
+		case pcapMagicMicros:
+			c.order = order
+			c.ifs = []captureInterface{{uint16(order.Uint32(hdr[20:])), 1000000}}
+			return c, nil
+		case pcapMagicNanos:
+			c.order = order
+			c.ifs = []captureInterface{{uint16(order.Uint32(hdr[20:])), 1000000000}}
+			return c, nil
+		}
+	}
+	return nil, errors.New("not a pcap or pcapng file")
+}
+
+// Next returns the next UDP datagram of the capture. It returns io.EOF at the
+// end of the capture.
+func (c *CaptureReader) Next() (*CapturedDatagram, error) {
+	for {
+		var d *CapturedDatagram
+		var err error
+		if c.ng {
+			d, err = c.nextBlock()
+		} else {
+			d, err = c.nextRecord()
+		}
+		if err != nil || d != nil {
+			return d, err
+		}
+	}
+}
+
+func (c *CaptureReader) nextRecord() (*CapturedDatagram, error) {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(c.r, hdr); err != nil {
+		return nil, err
+	}
+	capLen := c.order.Uint32(hdr[8:])
+	data := make([]byte, capLen)
+	if _, err := io.ReadFull(c.r, data); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	sec := uint64(c.order.Uint32(hdr[0:]))
+	frac := uint64(c.order.Uint32(hdr[4:]))
+	ts := sec*c.ifs[0].tsPerSec + frac
+	return decodeDatagram(c.ifs[0], ts, DirectionUnknown, data), nil
+}
+
+func (c *CaptureReader) nextBlock() (*CapturedDatagram, error) {
+	hdr := make([]byte, 8)
+	if _, err := io.ReadFull(c.r, hdr); err != nil {
+		return nil, err
+	}
+
+	blockType := binary.LittleEndian.Uint32(hdr)
+	if blockType == pcapngSectionHeader {
+		// the byte order of the section is given by its magic
+		magic, err := c.r.Peek(4)
+		if err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		if binary.LittleEndian.Uint32(magic) == pcapngByteOrderMagic {
+			c.order = binary.LittleEndian
+		} else {
+			c.order = binary.BigEndian
+		}
+		c.ifs = nil
+	}
+	if c.order == nil {
+		return nil, errors.New("pcapng block before section header")
+	}
+
+	total := c.order.Uint32(hdr[4:])
+	if total < 12 || total%4 != 0 {
+		return nil, fmt.Errorf("invalid pcapng block length %v", total)
+	}
+	body := make([]byte, total-8)
+	if _, err := io.ReadFull(c.r, body); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	body = body[:len(body)-4]
+
+	switch c.order.Uint32(hdr) {
+	case pcapngInterface:
+		if len(body) < 8 {
+			return nil, errors.New("interface block too short")
+		}
+		iface := captureInterface{linkType: c.order.Uint16(body), tsPerSec: 1000000}
+		for code, value := range c.options(body[8:]) {
+			if code == pcapngOptionTsresol && len(value) > 0 {
+				iface.tsPerSec = tsPerSec(value[0])
+			}
+		}
+		c.ifs = append(c.ifs, iface)
+
+	case pcapngEnhancedPacket:
+		if len(body) < 20 {
+			return nil, errors.New("packet block too short")
+		}
+		id := c.order.Uint32(body)
+		if int(id) >= len(c.ifs) {
+			return nil, fmt.Errorf("packet of unknown interface %v", id)
+		}
+		ts := uint64(c.order.Uint32(body[4:]))<<32 | uint64(c.order.Uint32(body[8:]))
+		capLen := int(c.order.Uint32(body[12:]))
+		if 20+capLen > len(body) {
+			return nil, errors.New("packet block too short")
+		}
+		data := body[20 : 20+capLen]
+
+		dir := DirectionUnknown
+		opts := body[20+capLen+pad4(capLen):]
+		if flags, ok := c.options(opts)[pcapngOptionEpbFlags]; ok && len(flags) == 4 {
+			dir = Direction(c.order.Uint32(flags) & 3)
+		}
+		return decodeDatagram(c.ifs[id], ts, dir, data), nil
+	}
+	return nil, nil
+}
+
+func (c *CaptureReader) options(b []byte) map[uint16][]byte {
+	opts := map[uint16][]byte{}
+	for len(b) >= 4 {
+		code := c.order.Uint16(b)
+		length := int(c.order.Uint16(b[2:]))
+		if code == pcapngOptionEnd || 4+length > len(b) {
+			break
+		}
+		opts[code] = b[4 : 4+length]
+		b = b[4+length+pad4(length):]
+	}
+	return opts
+}
+
+func tsPerSec(tsresol uint8) uint64 {
+	base := uint64(10)
+	if tsresol&0x80 != 0 {
+		base = 2
+	}
+	n := uint64(1)
+	for i := uint8(0); i < tsresol&0x7f; i++ {
+		n *= base
+	}
+	return n
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// decodeDatagram strips the link layer, IPv4 and UDP headers of a packet. It
+// returns nil for packets that are not IPv4 UDP datagrams.
+func decodeDatagram(iface captureInterface, ts uint64, dir Direction, pkt []byte) *CapturedDatagram {
+	switch iface.linkType {
+	case linkTypeRaw:
+	case linkTypeNull:
+		if len(pkt) < 4 {
+			return nil
+		}
+		pkt = pkt[4:]
+	case linkTypeEther:
+		if len(pkt) < 14 || binary.BigEndian.Uint16(pkt[12:]) != 0x0800 {
+			return nil
+		}
+		pkt = pkt[14:]
+	case linkTypeLinux:
+		if len(pkt) < 16 || binary.BigEndian.Uint16(pkt[14:]) != 0x0800 {
+			return nil
+		}
+		pkt = pkt[16:]
+	default:
+		return nil
+	}
+
+	if len(pkt) < 20 || pkt[0]>>4 != 4 || pkt[9] != 17 {
+		return nil
+	}
+	ihl := int(pkt[0]&0x0f) * 4
+	if len(pkt) < ihl+8 {
+		return nil
+	}
+	udp := pkt[ihl:]
+	udpLen := int(binary.BigEndian.Uint16(udp[4:]))
+	if udpLen < 8 || udpLen > len(udp) {
+		udpLen = len(udp)
+	}
+
+	sec := ts / iface.tsPerSec
+	nsec := (ts % iface.tsPerSec) * 1000000000 / iface.tsPerSec
+	return &CapturedDatagram{
+		Time:      time.Unix(int64(sec), int64(nsec)),
+		Direction: dir,
+		Src:       &net.UDPAddr{IP: net.IP(append([]byte(nil), pkt[12:16]...)), Port: int(binary.BigEndian.Uint16(udp[0:]))},
+		Dst:       &net.UDPAddr{IP: net.IP(append([]byte(nil), pkt[16:20]...)), Port: int(binary.BigEndian.Uint16(udp[2:]))},
+		Data:      udp[8:udpLen],
+	}
+}
+
+func msgTypeName(t uint8) string {
+	switch t {
+	case msgClientRequest:
+		return "request"
+	case msgServerMetadata:
+		return "metadata"
+	case msgServerPayload:
+		return "payload"
+	case msgClientAck:
+		return "ack"
+	case msgClose:
+		return "close"
+	case msgClientRangeRequest:
+		return "range-request"
+	case msgServerRepair:
+		return "repair"
+	case msgClientSignatures:
+		return "signatures"
+	}
+	return fmt.Sprintf("unknown(%d)", t)
+}
+
+// DescribeDatagram decodes an rftp datagram into a human readable line.
+func DescribeDatagram(data []byte) string {
+	header := &msgHeader{}
+	if err := header.UnmarshalBinary(data); err != nil {
+		return fmt.Sprintf("invalid header: %v", err)
+	}
+
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "v%d %s ack=%d", header.version, msgTypeName(header.msgType), header.ackNum)
+	for _, o := range header.options {
+		fmt.Fprintf(b, " opt(%d)=%x", o.otype, o.value)
+	}
+
+	var msg encoding.BinaryUnmarshaler
+	switch header.msgType {
+	case msgClientRequest:
+		msg = &clientRequest{}
+	case msgClientRangeRequest:
+		msg = &clientRangeRequest{}
+	case msgServerMetadata:
+		msg = &serverMetaData{}
+	case msgServerPayload:
+		msg = &serverPayload{}
+	case msgServerRepair:
+		msg = &serverRepair{}
+	case msgClientSignatures:
+		msg = &clientSignatures{}
+	case msgClientAck:
+		msg = &clientAck{}
+	case msgClose:
+		msg = &closeConnection{}
+	default:
+		fmt.Fprintf(b, " body=%v bytes", len(data)-header.hdrLen)
+		return b.String()
+	}
+	if err := msg.UnmarshalBinary(data[header.hdrLen:]); err != nil {
+		fmt.Fprintf(b, " invalid body: %v", err)
+		return b.String()
+	}
+
+	switch m := msg.(type) {
+	case *clientRequest:
+		fmt.Fprintf(b, " rate=%d files=%d", m.maxTransmissionRate, len(m.files))
+		for i, f := range m.files {
+			fmt.Fprintf(b, " [%d %q offset=%d]", i, f.fileName, f.offset)
+		}
+	case *clientRangeRequest:
+		fmt.Fprintf(b, " rate=%d files=%d", m.maxTransmissionRate, len(m.files))
+		for i, f := range m.files {
+			fmt.Fprintf(b, " [%d %q offset=%d start=%d length=%d]", i, f.fileName, f.offset, f.start, f.length)
+		}
+	case *serverMetaData:
+		fmt.Fprintf(b, " file=%d status=%q size=%d checksum=%x", m.fileIndex, m.status, m.size, m.checkSum)
+	case *serverPayload:
+		fmt.Fprintf(b, " file=%d offset=%d len=%d", m.fileIndex, m.offset, len(m.data))
+	case *serverRepair:
+		fmt.Fprintf(b, " file=%d offset=%d count=%d", m.fileIndex, m.offset, m.count)
+	case *clientSignatures:
+		fmt.Fprintf(b, " file=%d block-size=%d blocks=%d first=%d signatures=%d",
+			m.fileIndex, m.blockSize, m.blocks, m.first, len(m.signatures))
+	case *clientAck:
+		fmt.Fprintf(b, " file=%d offset=%d status=%d rate=%d resend=%d",
+			m.fileIndex, m.offset, m.status, m.maxTransmissionRate, len(m.resendEntries))
+		for _, re := range m.resendEntries {
+			fmt.Fprintf(b, " [file=%d offset=%d len=%d]", re.fileIndex, re.offset, re.length)
+		}
+	case *closeConnection:
+		fmt.Fprintf(b, " reason=%q", m.reason)
+	}
+	return b.String()
+}
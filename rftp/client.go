@@ -1,11 +1,13 @@
 package rftp
 
 import (
+	"encoding"
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"math"
+	"sync/atomic"
 	"time"
 )
 
@@ -17,72 +19,273 @@ func Request(host string, files []string) ([]*FileResponse, error) {
 	return defaultClient.Request(host, files)
 }
 
+// FileRequest describes a single file of a request. If Start or Length are
+// set, only the given byte range of the file is requested. A Length of 0
+// requests everything from Start up to the end of the file.
+//
+// If Dest is set, each chunk is written to Dest at its position as soon as it
+// arrives, instead of being delivered in order by FileResponse.Read. Use
+// FileResponse.Wait to learn when the file is complete. If Dest also
+// implements io.ReaderAt, e.g., an *os.File, the checksum of the written file
+// is verified.
+//
+// Offset resumes a partial download at the given chunk, the server only
+// sends the chunks starting at Offset. It requires Dest to already contain
+// the first Offset*1024 bytes, which are read back to verify the checksum.
+//
+// Servers that schedule files by client priority stream files with a higher
+// Priority first.
+//
+// Basis is an older copy of the file. The server then only sends the parts
+// of the file that are not in Basis, and the file is rebuilt in Dest, which
+// must not be Basis. Dest is written in order and verified against the
+// checksum of the file.
+//
+// If Checksum is set, the file is requested by its MD5 checksum instead of
+// its name, from the content index of the server, see
+// Server.SetContentHandler. Name then only names the response and defaults
+// to the checksum in hex. The response fails if the file has another
+// checksum.
+//
+// If Listing is set, the listing of the directory Name is requested instead
+// of a file, see Server.SetListingHandler.
+type FileRequest struct {
+	Name     string
+	Start    uint64
+	Length   uint64
+	Dest     io.WriterAt
+	Offset   uint64
+	Priority uint8
+	Basis    *io.SectionReader
+	Checksum [16]byte
+	Listing  bool
+}
+
 type Client struct {
 	Conn connection
-	rtt  time.Duration
-
-	responses []*FileResponse
-	ack       chan uint8
-	err       chan struct{}
-	closeMsg  chan struct{}
-	done      chan uint16
-	stopAck   chan struct{}
-	start     time.Time
+	// Clock is the clock of the timeouts and retransmissions. If nil, the
+	// system clock is used.
+	Clock Clock
+	// Tracer receives the events of each request. If nil, nothing is traced.
+	Tracer Tracer
+	// Logger receives the log records of each request, with the remote host
+	// as attribute. If nil, the client is silent.
+	Logger *slog.Logger
+	// Multicast is the multicast group, e.g., "239.0.0.1:9001", the client
+	// joins to receive the files together with other clients. Servers that
+	// don't stream to the group and requests of ranges or resumed files are
+	// answered over unicast.
+	Multicast string
+	// FEC asks the server for a repair packet per FEC chunks, from which a
+	// single lost chunk of the group can be reconstructed without
+	// re-requesting it. 0 disables repair packets.
+	FEC uint8
+	// Compression offers the server to compress the chunks with one of the
+	// algorithms, in the order of preference. The server compresses blocks
+	// of chunks independently, so chunks are still re-requested and resumed
+	// one by one.
+	Compression []Compression
+
+	rtt    time.Duration
+	trace  *connTrace
+	logger *slog.Logger
+	stats  *connStats
+
+	responses  []*FileResponse
+	tag        []byte // of the multicast session, if any
+	signatures []clientSignatures
+	ack        chan uint8
+	err        chan struct{}
+	closeMsg   chan struct{}
+	done       chan uint16
+	stopAck    chan struct{}
+	cancel     chan struct{}
+	closed     chan struct{} // once the connection of the request is closed
+	start      time.Time
+}
+
+func (c *Client) clock() Clock {
+	if c.Clock == nil {
+		return systemClock{}
+	}
+	return c.Clock
 }
 
 func (c *Client) Request(host string, files []string) ([]*FileResponse, error) {
+	frs := make([]FileRequest, len(files))
+	for i, f := range files {
+		frs[i] = FileRequest{Name: f}
+	}
+	return c.RequestFiles(host, frs)
+}
+
+// RequestFiles is like Request, but allows to request byte ranges of files.
+// The size of a FileResponse of a range request is the size of the range.
+func (c *Client) RequestFiles(host string, files []FileRequest) ([]*FileResponse, error) {
 
 	if len(files) > 65536 {
 		return nil, errors.New("too many files in request, use max. 65536 files per request")
 	}
+	for _, f := range files {
+		if f.Offset > 0 && f.Dest == nil {
+			return nil, fmt.Errorf("can't resume %v without destination", f.Name)
+		}
+		if f.Basis != nil && (f.Dest == nil || f.Offset > 0 || f.Start > 0 || f.Length > 0) {
+			return nil, fmt.Errorf("can't request delta of %v without destination or with range", f.Name)
+		}
+		if f.Checksum != ([16]byte{}) && (f.Start > 0 || f.Length > 0) {
+			return nil, fmt.Errorf("can't request range of %x by checksum", f.Checksum)
+		}
+		if f.Listing && (f.Checksum != ([16]byte{}) || f.Basis != nil) {
+			return nil, fmt.Errorf("can't request listing of %v by checksum or as delta", f.Name)
+		}
+	}
 
 	fs := make([]fileDescriptor, len(files))
+	priorities := make([]uint8, len(files))
 	c.responses = make([]*FileResponse, len(files))
 	c.ack = make(chan uint8, 1024)
-	c.err = make(chan struct{})
-	c.closeMsg = make(chan struct{})
+	c.err = make(chan struct{}, 1)
+	c.closeMsg = make(chan struct{}, 1)
 	c.done = make(chan uint16, len(fs))
 	c.stopAck = make(chan struct{})
+	c.cancel = make(chan struct{})
+	c.closed = make(chan struct{})
+	c.trace = newConnTrace(c.Tracer, c.clock(), "client", host)
+	c.logger = loggerOrSilent(c.Logger).With("remote", host)
+	c.stats = newConnStats(host, c.clock().Now())
+	c.Conn.setLogger(c.logger)
+	c.Conn.setClock(c.clock())
 
+	c.signatures = nil
+	deltaFiles := []uint16{}
+	contentFiles := []uint16{}
+	listingFiles := []uint16{}
 	for i, f := range files {
-		fs[i] = fileDescriptor{0, f}
-		c.responses[i] = newFileResponse(f, uint16(i))
+		fs[i] = fileDescriptor{offset: f.Offset, fileName: f.Name, start: f.Start, length: f.Length}
+		priorities[i] = f.Priority
+		if f.Listing {
+			listingFiles = append(listingFiles, uint16(i))
+		}
+		if f.Checksum != ([16]byte{}) {
+			fs[i].fileName = contentName(f.Checksum)
+			contentFiles = append(contentFiles, uint16(i))
+			if f.Name == "" {
+				f.Name = fs[i].fileName
+			}
+		}
+		if f.Basis != nil {
+			sigs, blockSize, err := signBlocks(f.Basis, uint16(i))
+			if err != nil {
+				return nil, fmt.Errorf("can't read local copy of %v: %v", f.Name, err)
+			}
+			c.signatures = append(c.signatures, sigs...)
+			deltaFiles = append(deltaFiles, uint16(i))
+			// The delta is received in order and rebuilt into Dest.
+			c.responses[i] = newFileResponse(f.Name, uint16(i))
+			c.responses[i].delta = newDeltaWriter(f.Basis, blockSize, f.Dest, &c.responses[i].written)
+		} else if f.Dest != nil {
+			c.responses[i] = newFileResponseAt(f.Name, uint16(i), f.Dest, f.Offset)
+		} else {
+			c.responses[i] = newFileResponse(f.Name, uint16(i))
+		}
+		c.responses[i].clock = c.clock()
+		c.responses[i].logger = c.logger
+		if c.FEC > 0 {
+			c.responses[i].fec = newFECDecoder(int(c.FEC), f.Offset)
+		}
+		c.responses[i].blocks = newBlockDecoder(f.Offset)
+		if f.Checksum != ([16]byte{}) {
+			sum := f.Checksum
+			c.responses[i].want = &sum
+		}
 		go c.responses[i].write(c.done)
 	}
 
 	c.Conn.handle(msgServerMetadata, handlerFunc(c.handleMetadata))
 	c.Conn.handle(msgServerPayload, handlerFunc(c.handleServerPayload))
+	c.Conn.handle(msgServerRepair, handlerFunc(c.handleRepair))
 	c.Conn.handle(msgClose, handlerFunc(c.handleClose))
 
-	if err := c.sendRequest(host, fs); err != nil {
+	options := priorityOptions(priorities)
+	if c.FEC > 0 {
+		options = append(options, option{otype: optFEC, value: []byte{c.FEC}})
+	}
+	options = append(options, compressionOffer(c.Compression)...)
+	options = append(options, deltaOption(deltaFiles)...)
+	options = append(options, contentOption(contentFiles)...)
+	options = append(options, listingOption(listingFiles)...)
+	req := newRequest(fs, options)
+	c.tag = nil
+	if cr, ok := req.(clientRequest); ok && c.Multicast != "" && !resumed(fs) && len(deltaFiles)+len(contentFiles)+len(listingFiles) == 0 {
+		c.tag = multicastTag(fs)
+		cr.options = append(cr.options, option{otype: optMulticast, value: c.tag})
+		req = cr
+	}
+
+	if err := c.sendRequest(host, req); err != nil {
+		c.trace.close(err.Error())
+		close(c.closed)
 		return nil, err
 	}
 
 	return c.responses, nil
 }
 
-func (c *Client) sendRequest(host string, fs []fileDescriptor) error {
+func newRequest(fs []fileDescriptor, options []option) encoding.BinaryMarshaler {
+	req := clientRequest{
+		maxTransmissionRate: 0,
+		files:               fs,
+		options:             options,
+	}
+	for _, f := range fs {
+		if f.isRange() {
+			return clientRangeRequest{req}
+		}
+	}
+	return req
+}
+
+// resumed returns whether a file is resumed, such requests are not served by
+// multicast.
+func resumed(fs []fileDescriptor) bool {
+	for _, f := range fs {
+		if f.offset > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Client) sendRequest(host string, req encoding.BinaryMarshaler) error {
 	for i := 1; i <= 10; i++ {
 		if err := c.Conn.connectTo(host); err != nil {
 			return err
 		}
-		c.start = time.Now()
-		if err := c.Conn.send(clientRequest{
-			maxTransmissionRate: 0,
-			files:               fs,
-		}); err != nil {
+		if c.tag != nil {
+			if err := c.Conn.joinGroup(c.Multicast); err != nil {
+				return err
+			}
+		}
+		c.start = c.clock().Now()
+		n, err := c.Conn.send(req)
+		if err != nil {
 			return err
 		}
+		c.stats.sent(n)
+		c.trace.packetSent(req)
+		c.sendSignatures()
 
 		go func() {
 			err := c.Conn.receive()
 			if err != nil {
-				log.Println("receive crashed with err")
-				c.err <- struct{}{}
+				c.logger.Error("receive crashed", "err", err)
+				c.abort()
 			}
 		}()
 		if err := c.waitForFirstResponse(i); err != nil {
-			log.Printf("err: %v, try again\n", err)
+			c.logger.Info("request timed out, trying again", "err", err)
+			c.trace.timeout("request")
 			c.Conn.cclose(0 * time.Second)
 			continue
 		}
@@ -100,86 +303,165 @@ func (c *Client) waitForCloseConnection() {
 	for {
 		select {
 		case i := <-c.done:
-			fr := c.responses[i]
-			if fr.Err != nil {
-				log.Printf("Transfer of file %v aborted: %s", i, fr.Err)
+			if err := c.responses[i].err(); err != nil {
+				c.logger.Warn("transfer aborted", "file", i, "err", err)
 			}
 			done++
 			if done == len(c.responses) {
-				c.closeConnection()
+				c.closeConnection("done")
+				return
 			}
 
 		case <-c.closeMsg:
-			c.closeConnection()
+			c.closeConnection("closed by server")
+			return
 		case <-c.err:
-			c.closeConnection()
+			c.closeConnection("error")
+			return
+		case <-c.cancel:
+			c.closeConnection("canceled")
+			return
 		}
 	}
 }
 
-func (c *Client) closeConnection() {
+// abort closes the connection because of an error. It doesn't block, the
+// connection is closed once.
+func (c *Client) abort() {
+	select {
+	case c.err <- struct{}{}:
+	default:
+	}
+}
+
+func (c *Client) closeConnection(reason string) {
+	c.stats.close(c.clock().Now())
+	c.trace.close(reason)
 	c.stopAck <- struct{}{}
 	for _, r := range c.responses {
-		log.Printf("send abort to file writer: %v\n", r.index)
-		r.cc <- struct{}{}
+		c.logger.Debug("send abort to file writer", "file", r.index)
+		// Closing doesn't block on the writers that are already done.
+		close(r.cc)
 	}
 	c.Conn.cclose(1 * time.Second)
+	close(c.closed)
+}
+
+// Close aborts the last request. The files that are not complete yet fail
+// with an error. Close returns once the connection is closed and the
+// responses are finished, so their destinations are no longer written to.
+// Like for Wait, responses without destination have to be read
+// concurrently.
+func (c *Client) Close() {
+	if c.closed == nil {
+		return
+	}
+	select {
+	case c.cancel <- struct{}{}:
+	case <-c.closed:
+	}
+	<-c.closed
+	for _, r := range c.responses {
+		<-r.finished
+	}
+}
+
+// Stats returns a snapshot of the statistics of the last request. It may be
+// called while the transfer runs and after it ended.
+func (c *Client) Stats() Stats {
+	if c.stats == nil {
+		return Stats{}
+	}
+	s := c.stats.snapshot()
+	for _, r := range c.responses {
+		s.Retransmissions += r.Retransmissions()
+		s.DuplicateChunks += r.Duplicates()
+		s.RepairedChunks += r.Repaired()
+		s.ReorderBuffer += r.buffered()
+	}
+	return s
+}
+
+// sendSignatures sends the signatures of the local copies of the files that
+// are requested as delta.
+func (c *Client) sendSignatures() {
+	for _, sigs := range c.signatures {
+		n, err := c.Conn.send(sigs)
+		if err != nil {
+			c.logger.Warn("failed to send signatures", "err", err)
+			return
+		}
+		c.stats.sent(n)
+		c.trace.packetSent(sigs)
+	}
 }
 
 func (c *Client) waitForFirstResponse(try int) error {
 	exp := math.Pow(2, float64(try))
 	timeoutTime := time.Duration(exp) * time.Second // TODO Set initial timeout with expo backoff
-	timeout := time.NewTimer(timeoutTime)
-	select {
-	case <-timeout.C:
-		return fmt.Errorf("%v. try timed out after %v", try, timeoutTime)
-	case <-c.ack:
-		c.rtt = time.Since(c.start)
-		return nil
+	timeout := c.clock().NewTimer(timeoutTime)
+	defer timeout.Stop()
+	// The server waits for all signatures before it responds, so they are
+	// sent again until it does.
+	var resend <-chan time.Time
+	if len(c.signatures) > 0 {
+		ticker := c.clock().NewTicker(500 * time.Millisecond)
+		defer ticker.Stop()
+		resend = ticker.C()
+	}
+	for {
+		select {
+		case <-timeout.C():
+			return fmt.Errorf("%v. try timed out after %v", try, timeoutTime)
+		case <-resend:
+			c.sendSignatures()
+		case <-c.ack:
+			c.rtt = since(c.clock(), c.start)
+			c.stats.setRTT(c.rtt)
+			c.trace.rttUpdated(c.rtt)
+			return nil
+		}
 	}
 }
 
 func (c *Client) sendAcks(conn connection) {
-	timeout := time.NewTimer(500 * time.Millisecond)
+	clock := c.clock()
+	timeout := clock.NewTimer(500 * time.Millisecond)
 	ackNumWaitingMap := map[uint8]bool{}
 	ackSendTimeMap := map[uint8]time.Time{}
 	nextAckNum := uint8(1)
-	lastPing := time.Now()
+	lastPing := clock.Now()
+	writeAt := false
+	for _, r := range c.responses {
+		if r.dest != nil {
+			writeAt = true
+		}
+	}
 
 	for {
 		select {
-		case <-timeout.C:
-			if time.Since(lastPing) > 3*time.Second+3*c.rtt {
-				log.Println("connection timed out")
-				c.err <- struct{}{}
+		case <-timeout.C():
+			if since(clock, lastPing) > 3*time.Second+3*c.rtt {
+				c.logger.Warn("connection timed out")
+				c.trace.timeout("idle")
+				c.abort()
 				continue
 			}
-			maxFile := uint16(0)
-			maxOff := uint64(0)
-			status := metaDataReceived
 			maxTransmission := 1
 			res := []*resendEntry{}
-			for i, r := range c.responses {
+			rds := []*resendData{}
+			for _, r := range c.responses {
 				if len(res) > 3 {
 					break
 				}
-				index := uint16(i)
 				rd := r.getResendEntries(140)
 				maxTransmission += rd.bufferSize
 				if rd.res != nil {
 					res = append(res, rd.res...)
 				}
-				if index == maxFile {
-					maxOff = rd.head
-				}
-				if index > maxFile && rd.started {
-					maxFile = index
-					maxOff = rd.head
-					if !rd.metadata {
-						status = metaDataMissing
-					}
-				}
+				rds = append(rds, rd)
 			}
+			maxFile, maxOff, status := ackPosition(rds, writeAt)
 			ack := clientAck{
 				ackNumber:           nextAckNum,
 				maxTransmissionRate: uint32(maxTransmission),
@@ -188,10 +470,18 @@ func (c *Client) sendAcks(conn connection) {
 				resendEntries:       res,
 				status:              status,
 			}
-			ackSendTimeMap[nextAckNum] = time.Now()
+			ackSendTimeMap[nextAckNum] = clock.Now()
 			ackNumWaitingMap[nextAckNum] = true
-			log.Printf("sending ack at timeout: %v: %v\n", c.rtt, &ack)
-			c.Conn.send(ack)
+			if debugEnabled(c.logger) {
+				c.logger.Debug("sending ack", "ack", ack.ackNumber, "file", ack.fileIndex,
+					"offset", ack.offset, "resend", len(ack.resendEntries), "rtt", c.rtt)
+			}
+			if n, err := c.Conn.send(ack); err == nil {
+				c.stats.sent(n)
+			}
+			c.stats.setRates(0, ack.maxTransmissionRate)
+			atomic.AddUint64(&c.stats.resendEntries, uint64(len(res)))
+			c.trace.packetSent(ack)
 
 			nextAckNum++
 			// avoid 0 as it can't be distinguished from not set
@@ -199,52 +489,149 @@ func (c *Client) sendAcks(conn connection) {
 				nextAckNum++
 			}
 			if c.rtt > 500*time.Millisecond {
-				timeout = time.NewTimer(500 * time.Millisecond)
+				timeout = clock.NewTimer(500 * time.Millisecond)
 			} else if c.rtt < 10*time.Millisecond {
-				timeout = time.NewTimer(5 * time.Millisecond)
+				timeout = clock.NewTimer(5 * time.Millisecond)
 			} else {
-				timeout = time.NewTimer(c.rtt)
+				timeout = clock.NewTimer(c.rtt)
 			}
 
 		case ackNum := <-c.ack:
 			if waiting, ok := ackNumWaitingMap[ackNum]; ok && waiting {
 				if sent, ok := ackSendTimeMap[ackNum]; ok {
-					c.rtt = time.Since(sent)
+					c.rtt = since(clock, sent)
+					c.stats.setRTT(c.rtt)
 					ackNumWaitingMap[ackNum] = false
-					log.Printf("got new rtt: %v\n", c.rtt)
+					if debugEnabled(c.logger) {
+						c.logger.Debug("got new rtt", "rtt", c.rtt)
+					}
+					c.trace.rttUpdated(c.rtt)
 				}
 			}
-			lastPing = time.Now()
+			lastPing = clock.Now()
 
 		case <-c.stopAck:
-			log.Println("leaving ack writer")
+			timeout.Stop()
+			c.logger.Debug("leaving ack writer")
 			return
 		}
 	}
 }
 
+// ackPosition returns the file and offset to acknowledge and whether the
+// metadata of the file is missing. Files that are read are received in order,
+// so the highest started file is acknowledged. If files are written to a
+// destination, they may finish in any order, and the first started file that
+// is not done yet is acknowledged.
+func ackPosition(rds []*resendData, writeAt bool) (uint16, uint64, uint8) {
+	maxFile := uint16(0)
+	maxOff := uint64(0)
+	status := metaDataReceived
+	for i, rd := range rds {
+		index := uint16(i)
+		if writeAt && rd.done {
+			continue
+		}
+		if index == maxFile {
+			maxOff = rd.head
+		}
+		if rd.started && (index > maxFile || writeAt) {
+			maxFile = index
+			maxOff = rd.head
+			if index > 0 && !rd.metadata {
+				status = metaDataMissing
+			}
+			if writeAt {
+				break
+			}
+		}
+	}
+	return maxFile, maxOff, status
+}
+
+// fromOtherSession returns whether the packet was sent to the multicast group
+// for other files.
+func (c *Client) fromOtherSession(p *packet) bool {
+	tag := multicastOption(p.os)
+	return tag != nil && string(tag) != string(c.tag)
+}
+
 func (c *Client) handleMetadata(_ io.Writer, p *packet) {
+	if c.fromOtherSession(p) {
+		return
+	}
 	smd := serverMetaData{}
 	err := smd.UnmarshalBinary(p.data)
 	if err != nil {
 		// TODO: what now? Rerequest metadata.
 		// Maybe log something or cancel the whole thing?
 	}
+	c.stats.received(p.size)
+	c.trace.packetReceived(p.ackNum, smd)
 	c.ack <- p.ackNum
-	log.Printf("handling metadata for file %v\n", smd.fileIndex)
-	c.responses[smd.fileIndex].mc <- &smd
+	c.logger.Debug("handling metadata", "file", smd.fileIndex)
+	r := c.responses[smd.fileIndex]
+	if length, ok := parseDeltaLength(p.os); ok && r.delta != nil {
+		r.delta.setStream(length)
+	}
+	r.mc <- &smd
 }
 
 func (c *Client) handleServerPayload(_ io.Writer, p *packet) {
+	if c.fromOtherSession(p) {
+		return
+	}
 	pl := serverPayload{}
 	err := pl.UnmarshalBinary(p.data)
 	if err != nil {
 		// TODO: what now? Rerequest payload
 		// Maybe log something or cancel the whole thing?
 	}
+	c.stats.received(p.size)
+	c.trace.packetReceived(p.ackNum, pl)
+	c.ack <- p.ackNum
+	if debugEnabled(c.logger) {
+		c.logger.Debug("handling payload", "file", pl.fileIndex, "offset", pl.offset)
+	}
+	r := c.responses[pl.fileIndex]
+	if r.delta != nil && isDeltaPayload(p.os) {
+		r.delta.markDelta()
+	}
+	if comp, count, ok := parseBlockOption(p.os); ok {
+		ps, err := r.blocks.add(&pl, comp, count)
+		if err != nil {
+			c.logger.Warn("dropping compressed block", "file", pl.fileIndex, "err", err)
+		}
+		for _, p := range ps {
+			r.pc <- p
+		}
+		return
+	}
+	r.pc <- &pl
+}
+
+func (c *Client) handleRepair(_ io.Writer, p *packet) {
+	if c.fromOtherSession(p) {
+		return
+	}
+	rp := serverRepair{}
+	if err := rp.UnmarshalBinary(p.data); err != nil {
+		c.logger.Warn("dropping invalid repair packet", "err", err)
+		return
+	}
+	c.stats.received(p.size)
+	c.trace.packetReceived(p.ackNum, rp)
 	c.ack <- p.ackNum
-	log.Printf("handling payload %v for file %v\n", pl.offset, pl.fileIndex)
-	c.responses[pl.fileIndex].pc <- &pl
+	if int(rp.fileIndex) >= len(c.responses) || c.responses[rp.fileIndex].fec == nil {
+		return
+	}
+	if debugEnabled(c.logger) {
+		c.logger.Debug("handling repair", "file", rp.fileIndex, "offset", rp.offset, "count", rp.count)
+	}
+	if r := c.responses[rp.fileIndex]; r.delta != nil && isDeltaPayload(p.os) {
+		r.delta.markDelta()
+	}
+	c.responses[rp.fileIndex].rc <- &rp
 }
 
 func (c *Client) handleClose(_ io.Writer, p *packet) {
@@ -253,6 +640,11 @@ func (c *Client) handleClose(_ io.Writer, p *packet) {
 	if err != nil {
 		// TODO: what now? Just drop everything?
 	}
+	c.stats.received(p.size)
+	c.trace.packetReceived(p.ackNum, cl)
 	c.ack <- p.ackNum
-	c.closeMsg <- struct{}{}
+	select {
+	case c.closeMsg <- struct{}{}:
+	default:
+	}
 }
@@ -0,0 +1,42 @@
+package rftp
+
+import "testing"
+
+func TestAckPosition(t *testing.T) {
+	rds := []*resendData{
+		{done: true, started: true, metadata: true, head: 10},
+		{started: true, metadata: true, head: 5},
+		{started: true, head: 2},
+	}
+	tests := map[string]struct {
+		rds        []*resendData
+		writeAt    bool
+		wantFile   uint16
+		wantOff    uint64
+		wantStatus uint8
+	}{
+		"read: highest started file": {
+			rds: rds, wantFile: 2, wantOff: 2, wantStatus: metaDataMissing,
+		},
+		"read: first file": {
+			rds:      []*resendData{{started: true, metadata: true, head: 3}, {}},
+			wantFile: 0, wantOff: 3, wantStatus: metaDataReceived,
+		},
+		"write at: first file not done": {
+			rds: rds, writeAt: true, wantFile: 1, wantOff: 5, wantStatus: metaDataReceived,
+		},
+		"write at: metadata missing": {
+			rds:     []*resendData{rds[0], rds[2], rds[1]},
+			writeAt: true, wantFile: 1, wantOff: 2, wantStatus: metaDataMissing,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			file, off, status := ackPosition(tc.rds, tc.writeAt)
+			if file != tc.wantFile || off != tc.wantOff || status != tc.wantStatus {
+				t.Errorf("ackPosition() = %v, %v, %v, want %v, %v, %v",
+					file, off, status, tc.wantFile, tc.wantOff, tc.wantStatus)
+			}
+		})
+	}
+}
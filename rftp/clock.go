@@ -0,0 +1,224 @@
+package rftp
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock is the source of time of the protocol logic, i.e., timeouts, rate
+// control and retransmissions. The default is the system clock. Tests use a
+// FakeClock to simulate long transfers quickly and deterministically.
+type Clock interface {
+	Now() time.Time
+	// AfterFunc calls f after d, in its own goroutine or, for a FakeClock,
+	// in Advance and AdvanceNext. f must not block. The channel of the
+	// returned Timer is not used.
+	AfterFunc(d time.Duration, f func()) Timer
+	NewTimer(d time.Duration) Timer
+	NewTicker(d time.Duration) Ticker
+}
+
+// Timer is a time.Timer of a Clock.
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+}
+
+// Ticker is a time.Ticker of a Clock.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+func since(c Clock, t time.Time) time.Duration {
+	return c.Now().Sub(t)
+}
+
+type systemClock struct{}
+
+type systemTimer struct {
+	*time.Timer
+}
+
+func (t systemTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
+
+type systemTicker struct {
+	*time.Ticker
+}
+
+func (t systemTicker) C() <-chan time.Time {
+	return t.Ticker.C
+}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) AfterFunc(d time.Duration, f func()) Timer {
+	return systemTimer{time.AfterFunc(d, f)}
+}
+
+func (systemClock) NewTimer(d time.Duration) Timer {
+	return systemTimer{time.NewTimer(d)}
+}
+
+func (systemClock) NewTicker(d time.Duration) Ticker {
+	return systemTicker{time.NewTicker(d)}
+}
+
+// FakeClock is a Clock whose time only moves when Advance or AdvanceNext is
+// called.
+type FakeClock struct {
+	lock   sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+var _ Clock = (*FakeClock)(nil)
+
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+type fakeTimer struct {
+	clock  *FakeClock
+	at     time.Time
+	period time.Duration // of tickers
+	c      chan time.Time
+	f      func()
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Stop() bool {
+	return t.clock.remove(t)
+}
+
+type fakeTicker struct {
+	*fakeTimer
+}
+
+func (t fakeTicker) Stop() {
+	t.fakeTimer.Stop()
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+func (c *FakeClock) add(t *fakeTimer) *fakeTimer {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	t.clock = c
+	c.timers = append(c.timers, t)
+	return t
+}
+
+func (c *FakeClock) remove(t *fakeTimer) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for i, other := range c.timers {
+		if other == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (c *FakeClock) AfterFunc(d time.Duration, f func()) Timer {
+	return c.add(&fakeTimer{at: c.Now().Add(d), f: f})
+}
+
+func (c *FakeClock) NewTimer(d time.Duration) Timer {
+	return c.add(&fakeTimer{at: c.Now().Add(d), c: make(chan time.Time, 1)})
+}
+
+func (c *FakeClock) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+	return fakeTicker{c.add(&fakeTimer{at: c.Now().Add(d), period: d, c: make(chan time.Time, 1)})}
+}
+
+// Advance moves the time forward by d and fires all timers that expire until
+// then in the order of their expiry. The functions of AfterFunc are called
+// before Advance returns, one after the other, so they must not block.
+func (c *FakeClock) Advance(d time.Duration) {
+	end := c.Now().Add(d)
+	for c.fire(end) {
+	}
+	c.lock.Lock()
+	c.now = end
+	c.lock.Unlock()
+}
+
+// AdvanceNext moves the time forward to the next timer and fires it. It
+// returns false if no timer is pending. Tests call it once the goroutines
+// that use the clock are idle, to jump from one event to the next.
+func (c *FakeClock) AdvanceNext() bool {
+	c.lock.Lock()
+	c.sortTimers()
+	if len(c.timers) == 0 {
+		c.lock.Unlock()
+		return false
+	}
+	at := c.timers[0].at
+	c.lock.Unlock()
+	return c.fire(at)
+}
+
+func (c *FakeClock) sortTimers() {
+	sort.SliceStable(c.timers, func(i, j int) bool {
+		return c.timers[i].at.Before(c.timers[j].at)
+	})
+}
+
+// fire fires the first timer if it expires until end. It returns false if
+// there is no such timer.
+func (c *FakeClock) fire(end time.Time) bool {
+	c.lock.Lock()
+	c.sortTimers()
+	if len(c.timers) == 0 || c.timers[0].at.After(end) {
+		c.lock.Unlock()
+		return false
+	}
+	t := c.timers[0]
+	if t.at.After(c.now) {
+		c.now = t.at
+	}
+	if t.period > 0 {
+		t.at = t.at.Add(t.period)
+	} else {
+		c.timers = c.timers[1:]
+	}
+	now := c.now
+	c.lock.Unlock()
+
+	if t.f != nil {
+		// without the lock, f may use the clock
+		t.f()
+		return true
+	}
+	// like time.Timer, drop the tick if the last one was not received yet
+	select {
+	case t.c <- now:
+	default:
+	}
+	return true
+}
+
+// Timers returns the number of timers and tickers that have not fired or were
+// not stopped yet. Tests use it to wait until a goroutine armed its timer.
+func (c *FakeClock) Timers() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.timers)
+}
@@ -0,0 +1,283 @@
+package rftp
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFakeClock(t *testing.T) {
+	clock := NewFakeClock(time.Unix(0, 0))
+	timer := clock.NewTimer(2 * time.Second)
+	ticker := clock.NewTicker(time.Second)
+	stopped := clock.NewTimer(time.Second)
+	stopped.Stop()
+
+	clock.Advance(time.Second)
+	select {
+	case <-timer.C():
+		t.Error("timer fired before its expiry")
+	default:
+	}
+	if got := <-ticker.C(); !got.Equal(time.Unix(1, 0)) {
+		t.Errorf("ticker fired at %v, want %v", got, time.Unix(1, 0))
+	}
+
+	clock.Advance(time.Second)
+	if got := <-timer.C(); !got.Equal(time.Unix(2, 0)) {
+		t.Errorf("timer fired at %v, want %v", got, time.Unix(2, 0))
+	}
+	<-ticker.C()
+	select {
+	case <-stopped.C():
+		t.Error("stopped timer fired")
+	default:
+	}
+
+	ticker.Stop()
+	if clock.Timers() != 0 {
+		t.Errorf("Timers() = %v, want 0", clock.Timers())
+	}
+}
+
+func TestCleanerTimeout(t *testing.T) {
+	clock := NewFakeClock(time.Unix(0, 0))
+	closed := []time.Time{}
+	c := &cleaner{clock: clock}
+	c.cb = func(string) {
+		closed = append(closed, clock.Now())
+	}
+	c.refresh(5 * time.Second)
+	c.checkTimeout()
+
+	clock.Advance(3 * time.Second)
+	c.refresh(5 * time.Second)
+	// the timer of the first deadline arms the one of the refreshed deadline
+	clock.Advance(3 * time.Second)
+	if len(closed) != 0 {
+		t.Fatalf("cleaner closed at %v before the refreshed deadline", closed)
+	}
+	clock.Advance(3 * time.Second)
+	if want := []time.Time{time.Unix(8, 0)}; len(closed) != 1 || !closed[0].Equal(want[0]) {
+		t.Errorf("cleaner closed at %v, want %v", closed, want)
+	}
+}
+
+func TestFileResponseRetransmissionTimeout(t *testing.T) {
+	clock := NewFakeClock(time.Unix(0, 0))
+	data := bytes.Repeat([]byte("0123456789"), 350)
+	ps := chunks(data)
+	f := newFileResponseAt("test", 0, &memFile{}, 0)
+	f.clock = clock
+	f.pc = make(chan *serverPayload)
+	go f.write(make(chan uint16, 1))
+
+	f.mc <- &serverMetaData{size: uint64(len(data))}
+	f.pc <- ps[0]
+	f.pc <- ps[2]
+	waitIdle(t)
+
+	// The missing chunk is requested right away and again once more than
+	// 500ms passed.
+	requested := []time.Duration{}
+	for d := time.Duration(0); d <= 1100*time.Millisecond; d += time.Millisecond {
+		if len(f.getResendEntries(140).res) > 0 {
+			requested = append(requested, d)
+		}
+		clock.Advance(time.Millisecond)
+	}
+	want := []time.Duration{0, 501 * time.Millisecond, 1002 * time.Millisecond}
+	if !reflect.DeepEqual(requested, want) {
+		t.Errorf("chunk requested at %v, want %v", requested, want)
+	}
+	if got := f.Retransmissions(); got != 3 {
+		t.Errorf("Retransmissions() = %v, want 3", got)
+	}
+}
+
+func TestFakeClockLossyTransfer(t *testing.T) {
+	data := make([]byte, 1024*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	clock := NewFakeClock(time.Unix(0, 0))
+	network := NewMemNetwork()
+	server := NewServer()
+	server.SetClock(clock)
+	stop := startMemServerWith(t, server, network, ":2020", map[string][]byte{"file": data})
+	defer stop()
+
+	conn := network.NewConnection()
+	conn.LossSim(NewMarkovLossSimulator(0.2, 0.5, NewRand(1, 0)))
+	client := &Client{Conn: conn, Clock: clock}
+
+	received := make(chan []byte, 1)
+	go func() {
+		reqs, err := client.Request("localhost:2020", []string{"file"})
+		if err != nil {
+			t.Error(err)
+			close(received)
+			return
+		}
+		got, _ := ioutil.ReadAll(reqs[0])
+		if reqs[0].Err != nil {
+			t.Errorf("transfer failed: %v", reqs[0].Err)
+		}
+		received <- got
+	}()
+
+	var got []byte
+	runUntil(t, clock, func() bool {
+		select {
+		case got = <-received:
+			return true
+		default:
+			return false
+		}
+	})
+	if !bytes.Equal(got, data) {
+		t.Errorf("received %v bytes that differ from the %v sent bytes", len(got), len(data))
+	}
+	if want := time.Unix(1, 650*int64(time.Millisecond)); !clock.Now().Equal(want) {
+		t.Errorf("transfer finished at %v, want %v", clock.Now(), want)
+	}
+	if got, want := client.Stats().Retransmissions, uint64(476); got != want {
+		t.Errorf("Retransmissions = %v, want %v", got, want)
+	}
+}
+
+// dropAfter is a LossSimulator that drops all packets after the first n.
+type dropAfter struct {
+	n int
+}
+
+func (l *dropAfter) shouldDrop() bool {
+	if l.n == 0 {
+		return true
+	}
+	l.n--
+	return false
+}
+
+func TestFakeClockIdleTimeout(t *testing.T) {
+	clock := NewFakeClock(time.Unix(0, 0))
+	network := NewMemNetwork()
+	server := NewServer()
+	server.SetClock(clock)
+	data := bytes.Repeat([]byte("0123456789"), 100*1024)
+	stop := startMemServerWith(t, server, network, ":2020", map[string][]byte{"file": data})
+	defer stop()
+
+	// The client receives the first chunks and then nothing anymore.
+	conn := network.NewConnection()
+	conn.LossSim(&dropAfter{n: 10})
+	client := &Client{Conn: conn, Clock: clock}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		reqs, err := client.Request("localhost:2020", []string{"file"})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		ioutil.ReadAll(reqs[0])
+	}()
+
+	runUntil(t, clock, func() bool {
+		select {
+		case <-done:
+			return true
+		default:
+			return false
+		}
+	})
+	// The last packet arrived at 0s, the acks after 3s check the idle time.
+	if got, want := client.Stats().End, time.Unix(3, 5*int64(time.Millisecond)); !got.Equal(want) {
+		t.Errorf("client timed out at %v, want %v", got, want)
+	}
+
+	// The server closes the connection once the acks of the client stop.
+	runUntil(t, clock, func() bool {
+		return len(server.Stats()) == 0
+	})
+	if want := time.Unix(8, 0); !clock.Now().Equal(want) {
+		t.Errorf("server timed out at %v, want %v", clock.Now(), want)
+	}
+}
+
+// runUntil advances the clock from timer to timer until done returns true.
+// done is checked whenever all other goroutines wait.
+func runUntil(t *testing.T, clock *FakeClock, done func() bool) {
+	t.Helper()
+	limit := clock.Now().Add(10 * time.Minute)
+	for {
+		waitIdle(t)
+		if done() {
+			return
+		}
+		if clock.Now().After(limit) {
+			t.Fatal("not done after 10 minutes of simulated time")
+		}
+		if !clock.AdvanceNext() {
+			t.Fatal("not done and no timer is pending")
+		}
+	}
+}
+
+// waitIdle waits until all goroutines but the calling one are blocked, e.g.,
+// on a channel or a timer of the fake clock.
+func waitIdle(t *testing.T) {
+	t.Helper()
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n == len(buf) {
+			buf = make([]byte, 2*len(buf))
+			continue
+		}
+		if idle(string(buf[:n])) {
+			return
+		}
+		runtime.Gosched()
+	}
+}
+
+// blocked are the states of goroutines that wait for another goroutine. Other
+// states, e.g., runnable or the waits of the runtime for the garbage
+// collector, end on their own.
+var blocked = map[string]bool{
+	"chan receive":            true,
+	"chan receive (nil chan)": true,
+	"chan send":               true,
+	"chan send (nil chan)":    true,
+	"select":                  true,
+	"select (no cases)":       true,
+	"sync.Mutex.Lock":         true,
+	"sync.RWMutex.Lock":       true,
+	"sync.RWMutex.RLock":      true,
+	"sync.WaitGroup.Wait":     true,
+	"sync.Cond.Wait":          true,
+}
+
+// idle returns whether the goroutines of a stack dump besides the first, the
+// calling one, are blocked.
+func idle(dump string) bool {
+	for i, g := range strings.Split(dump, "\n\n") {
+		if i == 0 {
+			continue
+		}
+		start := strings.Index(g, "[")
+		end := strings.IndexAny(g, ",]")
+		if start < 0 || end < start {
+			continue
+		}
+		if !blocked[g[start+1:end]] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,282 @@
+package rftp
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"sync"
+)
+
+// Compression is an algorithm the server compresses the chunks of a file
+// with.
+type Compression uint8
+
+const (
+	NoCompression Compression = iota
+	Deflate
+	Gzip
+)
+
+func (c Compression) String() string {
+	switch c {
+	case NoCompression:
+		return "none"
+	case Deflate:
+		return "deflate"
+	case Gzip:
+		return "gzip"
+	}
+	return fmt.Sprintf("unknown compression %d", uint8(c))
+}
+
+// ParseCompression returns the compression with the given name.
+func ParseCompression(name string) (Compression, error) {
+	for c := range codecs {
+		if c.String() == name {
+			return c, nil
+		}
+	}
+	if name == NoCompression.String() {
+		return NoCompression, nil
+	}
+	return NoCompression, fmt.Errorf("unknown compression %q", name)
+}
+
+// codec compresses and decompresses data with one algorithm. Further
+// algorithms are added to codecs.
+type codec struct {
+	writer func(w io.Writer) (io.WriteCloser, error)
+	reader func(r io.Reader) (io.Reader, error)
+}
+
+var codecs = map[Compression]codec{
+	Deflate: {
+		writer: func(w io.Writer) (io.WriteCloser, error) { return flate.NewWriter(w, flate.DefaultCompression) },
+		reader: func(r io.Reader) (io.Reader, error) { return flate.NewReader(r), nil },
+	},
+	Gzip: {
+		writer: func(w io.Writer) (io.WriteCloser, error) { return gzip.NewWriter(w), nil },
+		reader: func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+	},
+}
+
+// compressionBlock is the number of chunks that are compressed together. The
+// compressed data of a block is sent in the first chunks of the block, the
+// remaining offsets of the block are skipped. So the offsets of the blocks
+// don't depend on each other, and chunks are re-requested and resumed like
+// uncompressed chunks.
+const compressionBlock = 64
+
+func compress(c Compression, data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := codecs[c].writer(&buf)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decompress(c Compression, data []byte) ([]byte, error) {
+	if c == NoCompression {
+		return data, nil
+	}
+	cd, ok := codecs[c]
+	if !ok {
+		return nil, fmt.Errorf("unknown compression %d", uint8(c))
+	}
+	r, err := cd.reader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(io.LimitReader(r, compressionBlock*1024))
+}
+
+// compressionOffer returns the option that offers the algorithms to the
+// server.
+func compressionOffer(cs []Compression) []option {
+	if len(cs) == 0 {
+		return nil
+	}
+	value := make([]byte, len(cs))
+	for i, c := range cs {
+		value[i] = byte(c)
+	}
+	return []option{{otype: optCompression, value: value}}
+}
+
+// blockOption returns the option of the chunks of a block, which is
+// compressed with c into count chunks.
+func blockOption(c Compression, count int) []option {
+	return []option{{otype: optCompression, value: []byte{byte(c), byte(count)}}}
+}
+
+// parseBlockOption returns the compression and the number of chunks of the
+// block of a payload, ok is false for uncompressed files.
+func parseBlockOption(os []option) (c Compression, count int, ok bool) {
+	for _, o := range os {
+		if o.otype == optCompression && len(o.value) == 2 {
+			return Compression(o.value[0]), int(o.value[1]), true
+		}
+	}
+	return NoCompression, 0, false
+}
+
+// compressBlock reads the next block of the file, compresses it and queues
+// its chunks. Blocks that don't get smaller are sent uncompressed.
+func (fr *fileReader) compressBlock() {
+	start := fr.offset
+	raw := make([]byte, compressionBlock*1024)
+	n, err := fr.sr.ReadAt(raw, 1024*int64(start))
+	if err != nil && err != io.EOF {
+		fr.logger.Warn("failed to read file", "file", fr.index, "err", err)
+	}
+	raw = raw[:n]
+	if _, err := fr.hasher.Write(raw); err != nil {
+		fr.logger.Warn("failed to write to hash", "file", fr.index, "err", err)
+	}
+	fr.offset += uint64(n+1023) / 1024
+	fr.eof = err == io.EOF || uint64(fr.sr.Size()) <= 1024*fr.offset
+
+	c := fr.compression
+	data, err := compress(c, raw)
+	if err != nil || len(data) >= len(raw) {
+		c, data = NoCompression, raw
+	}
+	count := (len(data) + 1023) / 1024
+	fr.blockOptions = blockOption(c, count)
+	for i := 0; i < count; i++ {
+		end := (i + 1) * 1024
+		if end > len(data) {
+			end = len(data)
+		}
+		fr.pending = append(fr.pending, &serverPayload{
+			fileIndex: fr.index,
+			offset:    start + uint64(i),
+			data:      data[i*1024 : end],
+		})
+	}
+}
+
+// nextCompressed returns the next chunk of the compressed blocks of the file
+// and whether it is the last one.
+func (fr *fileReader) nextCompressed() (*serverPayload, bool) {
+	if len(fr.pending) == 0 {
+		if fr.eof {
+			return nil, true
+		}
+		fr.compressBlock()
+		if len(fr.pending) == 0 {
+			return nil, true
+		}
+	}
+	p := fr.pending[0]
+	fr.pending = fr.pending[1:]
+	return p, fr.eof && len(fr.pending) == 0
+}
+
+// blockDecoder collects the chunks of the compressed blocks of a file and
+// decompresses each block when all of its chunks arrived. The blocks begin at
+// the first requested chunk, like on the server.
+type blockDecoder struct {
+	lock    sync.Mutex
+	start   uint64
+	blocks  map[uint64]*compressedBlock // by the offset of the block
+	decoded bitmap                      // by the number of the block
+}
+
+type compressedBlock struct {
+	compression Compression
+	count       int
+	chunks      map[uint64][]byte
+}
+
+func newBlockDecoder(start uint64) *blockDecoder {
+	return &blockDecoder{start: start, blocks: make(map[uint64]*compressedBlock)}
+}
+
+func (d *blockDecoder) block(offset uint64) uint64 {
+	return d.start + (offset-d.start)/compressionBlock*compressionBlock
+}
+
+// add adds a chunk of a compressed block. If it completes the block, the
+// decompressed chunks of the block are returned.
+func (d *blockDecoder) add(p *serverPayload, c Compression, count int) ([]*serverPayload, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if p.offset < d.start {
+		return nil, nil
+	}
+	start := d.block(p.offset)
+	n := (start - d.start) / compressionBlock
+	if d.decoded.get(n) || count < 1 || count > compressionBlock || p.offset >= start+uint64(count) {
+		return nil, nil
+	}
+	b, ok := d.blocks[start]
+	if !ok {
+		b = &compressedBlock{compression: c, count: count, chunks: make(map[uint64][]byte)}
+		d.blocks[start] = b
+	}
+	b.chunks[p.offset] = p.data
+	if len(b.chunks) < b.count {
+		return nil, nil
+	}
+
+	delete(d.blocks, start)
+	data := []byte{}
+	for o := start; o < start+uint64(b.count); o++ {
+		data = append(data, b.chunks[o]...)
+	}
+	raw, err := decompress(b.compression, data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress block at chunk %v: %v", start, err)
+	}
+	d.decoded.set(n)
+	ps := []*serverPayload{}
+	for i := 0; i*1024 < len(raw); i++ {
+		end := (i + 1) * 1024
+		if end > len(raw) {
+			end = len(raw)
+		}
+		ps = append(ps, &serverPayload{fileIndex: p.fileIndex, offset: start + uint64(i), data: raw[i*1024 : end]})
+	}
+	return ps, nil
+}
+
+// collecting returns whether chunks of the block of offset arrived, the
+// missing chunks of such blocks are returned by missing.
+func (d *blockDecoder) collecting(offset uint64) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if offset < d.start {
+		return false
+	}
+	_, ok := d.blocks[d.block(offset)]
+	return ok
+}
+
+// missing returns the offsets of the chunks that are missing to complete
+// the blocks that are partly received.
+func (d *blockDecoder) missing() []uint64 {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	offsets := []uint64{}
+	for start, b := range d.blocks {
+		for o := start; o < start+uint64(b.count); o++ {
+			if _, ok := b.chunks[o]; !ok {
+				offsets = append(offsets, o)
+			}
+		}
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+	return offsets
+}
@@ -0,0 +1,147 @@
+package rftp
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+)
+
+func TestBlockRoundTrip(t *testing.T) {
+	text := []byte{}
+	for i := 0; len(text) < 150*1024; i++ {
+		text = append(text, fmt.Sprintf("line %v: nothing happened\n", i)...)
+	}
+	random := make([]byte, 100*1024+1)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	for name, data := range map[string][]byte{"text": text, "random": random} {
+		for _, c := range []Compression{Deflate, Gzip} {
+			fr := &fileReader{
+				sr:          io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data))),
+				hasher:      md5.New(),
+				compression: c,
+				logger:      silentLogger,
+			}
+			type chunk struct {
+				p       *serverPayload
+				options []option
+			}
+			chunks := []chunk{}
+			for done := false; !done; {
+				var p *serverPayload
+				p, done = fr.nextChunk()
+				chunks = append(chunks, chunk{p, fr.blockOptions})
+			}
+			if name == "text" && len(chunks) > len(data)/1024/4 {
+				t.Errorf("%v %v: %v chunks for %v bytes", name, c, len(chunks), len(data))
+			}
+			if name == "random" && len(chunks) != (len(data)+1023)/1024 {
+				t.Errorf("%v %v: %v chunks, want the uncompressed chunks", name, c, len(chunks))
+			}
+			if md5.Sum(data) != [16]byte(fr.hasher.Sum(nil)) {
+				t.Errorf("%v %v: checksum differs", name, c)
+			}
+
+			// Chunks may arrive in any order.
+			rand.New(rand.NewSource(2)).Shuffle(len(chunks), func(i, j int) {
+				chunks[i], chunks[j] = chunks[j], chunks[i]
+			})
+			d := newBlockDecoder(0)
+			got := make([]byte, len(data))
+			n := 0
+			for _, ch := range chunks {
+				comp, count, ok := parseBlockOption(ch.options)
+				if !ok {
+					t.Fatalf("%v %v: chunk %v without block option", name, c, ch.p.offset)
+				}
+				ps, err := d.add(ch.p, comp, count)
+				if err != nil {
+					t.Fatalf("%v %v: add() error = %v", name, c, err)
+				}
+				for _, p := range ps {
+					n += copy(got[p.offset*1024:], p.data)
+				}
+			}
+			if n != len(data) || !bytes.Equal(got, data) {
+				t.Errorf("%v %v: decoded %v bytes that differ from the %v sent bytes", name, c, n, len(data))
+			}
+		}
+	}
+}
+
+func TestBlockDecoderMissing(t *testing.T) {
+	d := newBlockDecoder(10)
+	d.add(&serverPayload{offset: 10 + compressionBlock + 1}, Deflate, 4)
+	want := []uint64{10 + compressionBlock, 10 + compressionBlock + 2, 10 + compressionBlock + 3}
+	if got := d.missing(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("missing() = %v, want %v", got, want)
+	}
+	if !d.collecting(10+compressionBlock+10) || d.collecting(10) {
+		t.Errorf("collecting() reports the wrong blocks")
+	}
+}
+
+func TestCompressedTransfer(t *testing.T) {
+	data := []byte{}
+	for i := 0; len(data) < 500*1024; i++ {
+		data = append(data, fmt.Sprintf("%v GET /index.html 200\n", i)...)
+	}
+
+	tests := map[string]struct {
+		compression []Compression
+		dest        bool
+		offset      uint64
+	}{
+		"deflate":        {compression: []Compression{Deflate}},
+		"gzip":           {compression: []Compression{Gzip, Deflate}},
+		"unknown first":  {compression: []Compression{Compression(200), Gzip}},
+		"destination":    {compression: []Compression{Deflate}, dest: true},
+		"resumed":        {compression: []Compression{Deflate}, dest: true, offset: 100},
+		"no compression": {},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			network := NewMemNetwork()
+			stop := startMemServer(t, network, ":2020", map[string][]byte{"file": data})
+			defer stop()
+
+			conn := network.NewConnection()
+			conn.LossSim(NewMarkovLossSimulator(0.02, 0.3, NewRand(1, 4)))
+			client := &Client{Conn: conn, Compression: tc.compression}
+			req := FileRequest{Name: "file", Offset: tc.offset}
+			file := &memFile{}
+			if tc.dest {
+				file.data = append(file.data, data[:tc.offset*1024]...)
+				req.Dest = file
+			}
+			reqs, err := client.RequestFiles("localhost:2020", []FileRequest{req})
+			if err != nil {
+				t.Fatalf("RequestFiles() error = %v", err)
+			}
+			if tc.dest {
+				err = reqs[0].Wait()
+			} else {
+				file.data, err = ioutil.ReadAll(reqs[0])
+				if err == nil {
+					err = reqs[0].err()
+				}
+			}
+			if err != nil {
+				t.Fatalf("error = %v", err)
+			}
+			if !bytes.Equal(file.data, data) {
+				t.Errorf("received %v bytes that differ from the %v sent bytes", len(file.data), len(data))
+			}
+
+			received := client.Stats().BytesReceived
+			compressed := received < uint64(len(data))/4
+			if compressed != (tc.compression != nil) {
+				t.Errorf("received %v bytes for %v bytes of data", received, len(data))
+			}
+		})
+	}
+}
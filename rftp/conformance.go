@@ -0,0 +1,895 @@
+package rftp
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// The conformance checks exchange hand-crafted messages with another
+// implementation of the protocol to find out which behaviors it gets wrong.
+// CheckServer plays the client against a server under test, CheckClient plays
+// the server against a client under test.
+
+// ConformanceResult is the outcome of one checked behavior.
+type ConformanceResult struct {
+	// Role is the role of the implementation under test, "server" or
+	// "client".
+	Role   string
+	Name   string
+	Passed bool
+	// Detail explains a failure or adds an observation to a pass.
+	Detail string
+}
+
+// ClientExit is the outcome of a run of a client under test.
+type ClientExit struct {
+	// Data is the downloaded file, nil if the client did not write one.
+	Data []byte
+	// Err is set if the client failed, e.g., exited with a non-zero status.
+	Err error
+}
+
+// ConformanceClient starts the client under test of CheckClient. The client
+// must request the file name from host. The returned channel receives the
+// result when the client exits, stop terminates the client.
+type ConformanceClient func(host, name string) (exit <-chan ClientExit, stop func(), err error)
+
+const (
+	// conformanceTimeout bounds each step of a check.
+	conformanceTimeout = 5 * time.Second
+	// conformanceQuiet is how long a peer has to stay silent to pass a check
+	// that expects no answer.
+	conformanceQuiet       = time.Second
+	conformanceAckInterval = 20 * time.Millisecond
+)
+
+// scriptedPeer sends and receives the messages of a check.
+type scriptedPeer struct {
+	socket net.PacketConn
+	remote net.Addr
+	ackNum uint8 // of the messages sent by a scripted server
+}
+
+type peerMessage struct {
+	header msgHeader
+	body   []byte
+}
+
+func (p *scriptedPeer) send(msg encoding.BinaryMarshaler) error {
+	return p.sendVersion(1, msg)
+}
+
+// sendVersion sends msg with a header of the given protocol version.
+func (p *scriptedPeer) sendVersion(version uint8, msg encoding.BinaryMarshaler) error {
+	return sendTo(responseWriter(func(bs []byte) (int, error) {
+		bs[0] = version<<4 | bs[0]&0x0F
+		return p.socket.WriteTo(bs, p.remote)
+	}), msg)
+}
+
+// receive returns the next message of the remote peer. If no remote is set
+// yet, the sender of the first message becomes the remote. It returns nil
+// and no error if nothing arrives within timeout.
+func (p *scriptedPeer) receive(timeout time.Duration) (*peerMessage, error) {
+	buf := make([]byte, 65536)
+	if err := p.socket.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+	for {
+		n, addr, err := p.socket.ReadFrom(buf)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if p.remote != nil && addr.String() != p.remote.String() {
+			continue
+		}
+		m := &peerMessage{}
+		if err := m.header.UnmarshalBinary(buf[:n]); err != nil {
+			continue
+		}
+		p.remote = addr
+		m.body = append([]byte(nil), buf[m.header.hdrLen:n]...)
+		return m, nil
+	}
+}
+
+// quiet reports an error if the remote peer sends a message other than a close
+// within d.
+func (p *scriptedPeer) quiet(d time.Duration) error {
+	deadline := time.Now().Add(d)
+	for {
+		left := time.Until(deadline)
+		if left <= 0 {
+			return nil
+		}
+		m, err := p.receive(left)
+		if err != nil {
+			return err
+		}
+		if m != nil && m.header.msgType != msgClose {
+			return fmt.Errorf("received %v", describeMessage(m))
+		}
+	}
+}
+
+func describeMessage(m *peerMessage) string {
+	switch m.header.msgType {
+	case msgClientRequest:
+		return "request"
+	case msgClientRangeRequest:
+		return "range request"
+	case msgServerMetadata:
+		return "metadata"
+	case msgServerPayload:
+		return "payload"
+	case msgServerRepair:
+		return "repair"
+	case msgClientSignatures:
+		return "signatures"
+	case msgClientAck:
+		return "ack"
+	case msgClose:
+		return "close"
+	}
+	return fmt.Sprintf("message of type %v", m.header.msgType)
+}
+
+func chunkCount(data []byte) int {
+	return (len(data) + 1023) / 1024
+}
+
+func chunk(data []byte, offset int) []byte {
+	end := (offset + 1) * 1024
+	if end > len(data) {
+		end = len(data)
+	}
+	return data[offset*1024 : end]
+}
+
+// CheckServer runs the checks of a server that serves a file called name with
+// the given content at host. Each check uses a new client address.
+func CheckServer(host, name string, content []byte) []ConformanceResult {
+	return checkServer(udpNetwork{}, host, name, content)
+}
+
+type serverCheck struct {
+	name string
+	run  func(c *serverChecker) error
+}
+
+var serverChecks = []serverCheck{
+	{"transfer", (*serverChecker).checkTransfer},
+	{"missing-file", (*serverChecker).checkMissingFile},
+	{"lost-metadata", (*serverChecker).checkLostMetadata},
+	{"resend-length-0", (*serverChecker).checkResendLengthZero},
+	{"resend-entry", (*serverChecker).checkResendEntry},
+	{"duplicate-request", (*serverChecker).checkDuplicateRequest},
+	{"out-of-order-acks", (*serverChecker).checkOutOfOrderAcks},
+	{"close", (*serverChecker).checkClose},
+	{"unknown-version", (*serverChecker).checkUnknownVersion},
+}
+
+// serverChecker plays a client against a server under test.
+type serverChecker struct {
+	peer    *scriptedPeer
+	name    string
+	content []byte
+}
+
+func checkServer(network packetNetwork, host, name string, content []byte) []ConformanceResult {
+	results := []ConformanceResult{}
+	for _, check := range serverChecks {
+		r := ConformanceResult{Role: "server", Name: check.name}
+		err := runServerCheck(network, host, name, content, check)
+		r.Passed = err == nil
+		if err != nil {
+			r.Detail = err.Error()
+		}
+		results = append(results, r)
+	}
+	return results
+}
+
+func runServerCheck(network packetNetwork, host, name string, content []byte, check serverCheck) error {
+	remote, err := network.resolve(host)
+	if err != nil {
+		return err
+	}
+	socket, err := network.listenPacket("")
+	if err != nil {
+		return err
+	}
+	defer socket.Close()
+	c := &serverChecker{
+		peer:    &scriptedPeer{socket: socket, remote: remote},
+		name:    name,
+		content: content,
+	}
+	return check.run(c)
+}
+
+func (c *serverChecker) request(name string) error {
+	return c.peer.send(clientRequest{files: []fileDescriptor{{fileName: name}}})
+}
+
+// checkTransfer downloads the file.
+func (c *serverChecker) checkTransfer() error {
+	if err := c.request(c.name); err != nil {
+		return err
+	}
+	return c.download(&downloader{})
+}
+
+// checkMissingFile expects the status "file does not exist" for a file the
+// server does not have.
+func (c *serverChecker) checkMissingFile() error {
+	if err := c.request(c.name + ".missing"); err != nil {
+		return err
+	}
+	deadline := time.Now().Add(conformanceTimeout)
+	for time.Now().Before(deadline) {
+		m, err := c.peer.receive(time.Until(deadline))
+		if err != nil {
+			return err
+		}
+		if m == nil || m.header.msgType != msgServerMetadata {
+			continue
+		}
+		md := serverMetaData{}
+		if err := md.UnmarshalBinary(m.body); err != nil {
+			return fmt.Errorf("invalid metadata: %v", err)
+		}
+		if md.status != fileNotExistent {
+			return fmt.Errorf("got status %v", md.status)
+		}
+		return nil
+	}
+	return errors.New("no metadata received")
+}
+
+// checkLostMetadata ignores the first metadata and expects the server to
+// send it again after an ack with the status "metadata missing".
+func (c *serverChecker) checkLostMetadata() error {
+	if err := c.request(c.name); err != nil {
+		return err
+	}
+	return c.download(&downloader{dropMetadata: 1, missingStatus: true})
+}
+
+// checkResendLengthZero ignores the first metadata and expects the server to
+// send it again after a resend entry with length 0.
+func (c *serverChecker) checkResendLengthZero() error {
+	if err := c.request(c.name); err != nil {
+		return err
+	}
+	return c.download(&downloader{dropMetadata: 1})
+}
+
+// checkResendEntry requests the first chunk again after the download.
+func (c *serverChecker) checkResendEntry() error {
+	if err := c.request(c.name); err != nil {
+		return err
+	}
+	d := &downloader{keepOpen: true}
+	if err := c.download(d); err != nil {
+		return fmt.Errorf("download failed: %v", err)
+	}
+	defer c.peer.send(closeConnection{reason: donwloadFinished})
+	ack := clientAck{
+		ackNumber:           d.nextAckNum(),
+		maxTransmissionRate: 10000,
+		offset:              uint64(chunkCount(c.content)),
+		resendEntries:       resendEntryList{{fileIndex: 0, offset: 0, length: 1}},
+	}
+	resent, err := c.acking(conformanceTimeout, ack, func(m *peerMessage) (bool, error) {
+		if m.header.msgType != msgServerPayload {
+			return false, nil
+		}
+		pl := serverPayload{}
+		if err := pl.UnmarshalBinary(m.body); err != nil {
+			return false, fmt.Errorf("invalid payload: %v", err)
+		}
+		if pl.fileIndex != 0 || pl.offset != 0 {
+			return false, nil
+		}
+		if !bytes.Equal(pl.data, chunk(c.content, 0)) {
+			return false, errors.New("resent chunk differs from the file")
+		}
+		return true, nil
+	})
+	if err != nil {
+		return err
+	}
+	if !resent {
+		return errors.New("chunk 0 was not resent")
+	}
+	return nil
+}
+
+// acking sends ack repeatedly for d, like a client that waits for a chunk,
+// and passes the received messages to handle until it returns true.
+func (c *serverChecker) acking(d time.Duration, ack clientAck, handle func(*peerMessage) (bool, error)) (bool, error) {
+	deadline := time.Now().Add(d)
+	for time.Now().Before(deadline) {
+		if err := c.peer.send(ack); err != nil {
+			return false, err
+		}
+		ack.ackNumber++
+		if ack.ackNumber == 0 {
+			ack.ackNumber++
+		}
+		ackDeadline := time.Now().Add(conformanceAckInterval)
+		for time.Now().Before(ackDeadline) {
+			m, err := c.peer.receive(time.Until(ackDeadline))
+			if err != nil {
+				return false, err
+			}
+			if m == nil {
+				continue
+			}
+			if done, err := handle(m); done || err != nil {
+				return done, err
+			}
+		}
+	}
+	return false, nil
+}
+
+// checkDuplicateRequest sends the request twice and expects every chunk to be
+// sent once. It does not send acks, which could trigger resends.
+func (c *serverChecker) checkDuplicateRequest() error {
+	for i := 0; i < 2; i++ {
+		if err := c.request(c.name); err != nil {
+			return err
+		}
+	}
+	chunks := map[uint64]int{}
+	metadata := 0
+	deadline := time.Now().Add(2 * conformanceQuiet)
+	for time.Now().Before(deadline) {
+		m, err := c.peer.receive(time.Until(deadline))
+		if err != nil {
+			return err
+		}
+		if m == nil {
+			continue
+		}
+		switch m.header.msgType {
+		case msgServerPayload:
+			pl := serverPayload{}
+			if err := pl.UnmarshalBinary(m.body); err != nil {
+				return fmt.Errorf("invalid payload: %v", err)
+			}
+			chunks[pl.offset]++
+			if chunks[pl.offset] > 1 {
+				return fmt.Errorf("chunk %v was sent twice", pl.offset)
+			}
+		case msgServerMetadata:
+			metadata++
+			if metadata > 1 {
+				return errors.New("metadata was sent twice")
+			}
+		}
+	}
+	if len(chunks) == 0 && metadata == 0 {
+		return errors.New("no response")
+	}
+	return nil
+}
+
+// checkOutOfOrderAcks downloads the file with acks whose numbers are swapped
+// pairwise.
+func (c *serverChecker) checkOutOfOrderAcks() error {
+	if err := c.request(c.name); err != nil {
+		return err
+	}
+	return c.download(&downloader{ackNums: func(i int) uint8 {
+		return uint8((i%254)^1) + 1
+	}})
+}
+
+// checkClose closes the connection after the first payload and expects the
+// server to ignore the following acks.
+func (c *serverChecker) checkClose() error {
+	if err := c.request(c.name); err != nil {
+		return err
+	}
+	deadline := time.Now().Add(conformanceTimeout)
+	for {
+		m, err := c.peer.receive(time.Until(deadline))
+		if err != nil {
+			return err
+		}
+		if m == nil {
+			return errors.New("no payload received")
+		}
+		if m.header.msgType == msgServerPayload {
+			break
+		}
+	}
+	if err := c.peer.send(closeConnection{reason: applicationClosed}); err != nil {
+		return err
+	}
+	// let the packets in flight arrive
+	if _, err := c.drain(200 * time.Millisecond); err != nil {
+		return err
+	}
+	ack := clientAck{
+		ackNumber:           1,
+		maxTransmissionRate: 10000,
+		resendEntries:       resendEntryList{{fileIndex: 0, offset: 0, length: 1}},
+	}
+	var answer *peerMessage
+	_, err := c.acking(conformanceQuiet, ack, func(m *peerMessage) (bool, error) {
+		if m.header.msgType == msgClose {
+			return false, nil
+		}
+		answer = m
+		return true, nil
+	})
+	if err != nil {
+		return err
+	}
+	if answer != nil {
+		return fmt.Errorf("server answered with %v after close", describeMessage(answer))
+	}
+	return nil
+}
+
+// checkUnknownVersion sends a request of protocol version 2 and expects the
+// server to ignore it or to close the connection.
+func (c *serverChecker) checkUnknownVersion() error {
+	req := clientRequest{files: []fileDescriptor{{fileName: c.name}}}
+	if err := c.peer.sendVersion(2, req); err != nil {
+		return err
+	}
+	if err := c.peer.quiet(conformanceQuiet); err != nil {
+		return fmt.Errorf("server accepted the request: %v", err)
+	}
+	return nil
+}
+
+// drain reads messages for d and returns how many arrived.
+func (c *serverChecker) drain(d time.Duration) (int, error) {
+	n := 0
+	deadline := time.Now().Add(d)
+	for time.Now().Before(deadline) {
+		m, err := c.peer.receive(time.Until(deadline))
+		if err != nil {
+			return n, err
+		}
+		if m != nil {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// downloader receives the file after the request was sent. It acknowledges
+// the received chunks and requests the missing ones like a client does.
+type downloader struct {
+	// dropMetadata is the number of metadata messages to ignore.
+	dropMetadata int
+	// missingStatus requests lost metadata by the status of the ack instead
+	// of a resend entry with length 0.
+	missingStatus bool
+	// ackNums returns the number of the i-th ack, by default i+1.
+	ackNums func(i int) uint8
+	// keepOpen doesn't close the connection after the download, the check
+	// continues with it.
+	keepOpen bool
+
+	chunks   [][]byte
+	received int
+	metadata *serverMetaData
+	dropped  int
+	acks     int
+}
+
+func (d *downloader) nextAckNum() uint8 {
+	i := d.acks
+	d.acks++
+	if d.ackNums != nil {
+		return d.ackNums(i)
+	}
+	return uint8(i%255) + 1
+}
+
+func (c *serverChecker) download(d *downloader) error {
+	d.chunks = make([][]byte, chunkCount(c.content))
+	deadline := time.Now().Add(conformanceTimeout)
+	lastAck := time.Now()
+	for d.metadata == nil || d.received < len(d.chunks) {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("received %v of %v chunks and %v metadata before the timeout",
+				d.received, len(d.chunks), d.dropped+btoi(d.metadata != nil))
+		}
+		m, err := c.peer.receive(conformanceAckInterval)
+		if err != nil {
+			return err
+		}
+		if m != nil {
+			if err := d.handle(m); err != nil {
+				return err
+			}
+		}
+		if time.Since(lastAck) >= conformanceAckInterval {
+			if err := c.peer.send(d.ack()); err != nil {
+				return err
+			}
+			lastAck = time.Now()
+		}
+	}
+
+	if d.metadata.status != noErr {
+		return fmt.Errorf("got status %v", d.metadata.status)
+	}
+	if d.metadata.size != uint64(len(c.content)) {
+		return fmt.Errorf("got size %v, want %v", d.metadata.size, len(c.content))
+	}
+	if !bytes.Equal(bytes.Join(d.chunks, nil), c.content) {
+		return errors.New("received data differs from the file")
+	}
+	if d.metadata.checkSum != md5.Sum(c.content) {
+		return errors.New("wrong checksum")
+	}
+	if !d.keepOpen {
+		c.peer.send(closeConnection{reason: donwloadFinished})
+	}
+	return nil
+}
+
+func (d *downloader) handle(m *peerMessage) error {
+	switch m.header.msgType {
+	case msgServerPayload:
+		pl := serverPayload{}
+		if err := pl.UnmarshalBinary(m.body); err != nil {
+			return fmt.Errorf("invalid payload: %v", err)
+		}
+		if pl.fileIndex != 0 || pl.offset >= uint64(len(d.chunks)) {
+			return fmt.Errorf("payload of file %v at offset %v out of range", pl.fileIndex, pl.offset)
+		}
+		if d.chunks[pl.offset] == nil {
+			d.chunks[pl.offset] = pl.data
+			d.received++
+		}
+	case msgServerMetadata:
+		md := serverMetaData{}
+		if err := md.UnmarshalBinary(m.body); err != nil {
+			return fmt.Errorf("invalid metadata: %v", err)
+		}
+		if d.dropped < d.dropMetadata {
+			d.dropped++
+			return nil
+		}
+		d.metadata = &md
+	case msgClose:
+		cl := closeConnection{}
+		cl.UnmarshalBinary(m.body)
+		return fmt.Errorf("server closed the connection: %v", cl.reason)
+	}
+	return nil
+}
+
+// ack acknowledges the first missing chunk and requests up to ten missing
+// chunks before the last received one. Metadata is requested once all chunks
+// arrived.
+func (d *downloader) ack() clientAck {
+	ack := clientAck{
+		ackNumber:           d.nextAckNum(),
+		maxTransmissionRate: 10000,
+	}
+	head := len(d.chunks)
+	last := -1
+	for i, c := range d.chunks {
+		if c == nil && i < head {
+			head = i
+		}
+		if c != nil {
+			last = i
+		}
+	}
+	ack.offset = uint64(head)
+	for i := head; i < last && len(ack.resendEntries) < 10; i++ {
+		if d.chunks[i] == nil {
+			ack.resendEntries = append(ack.resendEntries, &resendEntry{offset: uint64(i), length: 1})
+		}
+	}
+	if d.metadata == nil && d.received == len(d.chunks) {
+		if d.missingStatus {
+			ack.status = metaDataMissing
+		} else {
+			ack.resendEntries = append(ack.resendEntries, &resendEntry{offset: uint64(head), length: 0})
+		}
+	}
+	return ack
+}
+
+func btoi(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// CheckClient runs the checks of a client. The scripted server listens at
+// host and serves a file called name with the given content. start is called
+// once per check.
+func CheckClient(host, name string, content []byte, start ConformanceClient) []ConformanceResult {
+	return checkClient(udpNetwork{}, host, name, content, start)
+}
+
+// clientScript describes how the scripted server answers a client.
+type clientScript struct {
+	name string
+	// version of the sent messages, 1 by default.
+	version uint8
+	// order returns the offsets of the chunks in the order they are sent.
+	order func(chunks int) []int
+	// holdMetadata sends the metadata only when the client asks for it.
+	holdMetadata  bool
+	wrongChecksum bool
+	// closeAfter sends a close instead of the rest of the file after this
+	// many chunks, if greater than 0.
+	closeAfter int
+	// verify decides whether the check passed.
+	verify func(r clientRun, content []byte) error
+}
+
+// clientRun is what the scripted server saw of a client.
+type clientRun struct {
+	exit              *ClientExit // nil if the client had to be stopped
+	metadataRequested bool
+	closeReasons      []CloseConnectionReason
+}
+
+func (r clientRun) closed(reason CloseConnectionReason) bool {
+	for _, cr := range r.closeReasons {
+		if cr == reason {
+			return true
+		}
+	}
+	return false
+}
+
+var clientScripts = []clientScript{
+	{name: "transfer", verify: verifyTransfer},
+	{name: "lost-metadata", holdMetadata: true, verify: func(r clientRun, content []byte) error {
+		if !r.metadataRequested {
+			return errors.New("client did not request the missing metadata")
+		}
+		return verifyTransfer(r, content)
+	}},
+	{name: "duplicate-payloads", order: func(n int) []int {
+		order := []int{}
+		for i := 0; i < n; i++ {
+			order = append(order, i, i)
+		}
+		return order
+	}, verify: verifyTransfer},
+	{name: "out-of-order-payloads", order: func(n int) []int {
+		order := []int{}
+		for i := n - 1; i >= 0; i-- {
+			order = append(order, i)
+		}
+		return order
+	}, verify: verifyTransfer},
+	{name: "close", closeAfter: 2, verify: func(r clientRun, _ []byte) error {
+		if r.exit == nil {
+			return errors.New("client did not stop after close")
+		}
+		return nil
+	}},
+	{name: "unknown-version", version: 2, verify: func(r clientRun, content []byte) error {
+		if r.exit != nil && r.exit.Err == nil && bytes.Equal(r.exit.Data, content) {
+			return errors.New("client accepted the messages of version 2")
+		}
+		return nil
+	}},
+	{name: "wrong-checksum", wrongChecksum: true, verify: func(r clientRun, _ []byte) error {
+		if r.closed(wrongChecksum) || (r.exit != nil && r.exit.Err != nil) {
+			return nil
+		}
+		return errors.New("client neither failed nor closed with reason wrong checksum")
+	}},
+}
+
+func verifyTransfer(r clientRun, content []byte) error {
+	if r.exit == nil {
+		return errors.New("client did not finish")
+	}
+	if r.exit.Err != nil {
+		return fmt.Errorf("client failed: %v", r.exit.Err)
+	}
+	if !bytes.Equal(r.exit.Data, content) {
+		return fmt.Errorf("downloaded %v bytes that differ from the file", len(r.exit.Data))
+	}
+	return nil
+}
+
+func checkClient(network packetNetwork, host, name string, content []byte, start ConformanceClient) []ConformanceResult {
+	results := []ConformanceResult{}
+	for _, script := range clientScripts {
+		r := ConformanceResult{Role: "client", Name: script.name}
+		err := runClientScript(network, host, name, content, start, script)
+		r.Passed = err == nil
+		if err != nil {
+			r.Detail = err.Error()
+		}
+		results = append(results, r)
+	}
+	return results
+}
+
+func runClientScript(network packetNetwork, host, name string, content []byte, start ConformanceClient, script clientScript) error {
+	socket, err := network.listenPacket(host)
+	if err != nil {
+		return err
+	}
+	defer socket.Close()
+
+	exit, stop, err := start(host, name)
+	if err != nil {
+		return fmt.Errorf("failed to start client: %v", err)
+	}
+	s := &clientScriptRunner{
+		script:  script,
+		peer:    &scriptedPeer{socket: socket},
+		content: content,
+		exit:    exit,
+	}
+	run, err := s.run(name)
+	if run.exit == nil {
+		stop()
+	}
+	if err != nil {
+		return err
+	}
+	return script.verify(run, content)
+}
+
+// clientScriptRunner plays the server of a script.
+type clientScriptRunner struct {
+	script  clientScript
+	peer    *scriptedPeer
+	content []byte
+	exit    <-chan ClientExit
+}
+
+func (s *clientScriptRunner) send(msg encoding.BinaryMarshaler) error {
+	version := s.script.version
+	if version == 0 {
+		version = 1
+	}
+	return s.peer.sendVersion(version, msg)
+}
+
+func (s *clientScriptRunner) sendChunk(offset int) error {
+	return s.send(serverPayload{
+		ackNumber: s.peer.ackNum,
+		offset:    uint64(offset),
+		data:      chunk(s.content, offset),
+	})
+}
+
+func (s *clientScriptRunner) metadata() serverMetaData {
+	md := serverMetaData{size: uint64(len(s.content)), checkSum: md5.Sum(s.content)}
+	if s.script.wrongChecksum {
+		md.checkSum[0] ^= 0xFF
+	}
+	return md
+}
+
+func (s *clientScriptRunner) run(name string) (clientRun, error) {
+	run := clientRun{}
+
+	m, err := s.peer.receive(conformanceTimeout)
+	if err != nil {
+		return run, err
+	}
+	if m == nil {
+		return run, errors.New("no request received")
+	}
+	if m.header.msgType != msgClientRequest {
+		return run, fmt.Errorf("expected request, got %v", describeMessage(m))
+	}
+	req := clientRequest{}
+	if err := req.UnmarshalBinary(m.body); err != nil {
+		return run, fmt.Errorf("invalid request: %v", err)
+	}
+	if len(req.files) != 1 || req.files[0].fileName != name {
+		return run, fmt.Errorf("request does not ask for %v only", name)
+	}
+
+	chunks := chunkCount(s.content)
+	order := make([]int, chunks)
+	for i := range order {
+		order[i] = i
+	}
+	if s.script.order != nil {
+		order = s.script.order(chunks)
+	}
+	for i, offset := range order {
+		if s.script.closeAfter > 0 && i == s.script.closeAfter {
+			if err := s.send(closeConnection{reason: applicationClosed}); err != nil {
+				return run, err
+			}
+			break
+		}
+		if err := s.sendChunk(offset); err != nil {
+			return run, err
+		}
+	}
+	if !s.script.holdMetadata && s.script.closeAfter == 0 {
+		if err := s.send(s.metadata()); err != nil {
+			return run, err
+		}
+	}
+
+	deadline := time.Now().Add(conformanceTimeout)
+	for time.Now().Before(deadline) {
+		select {
+		case exit := <-s.exit:
+			run.exit = &exit
+			return run, nil
+		default:
+		}
+		m, err := s.peer.receive(conformanceAckInterval)
+		if err != nil {
+			return run, err
+		}
+		if m == nil {
+			continue
+		}
+		switch m.header.msgType {
+		case msgClientAck:
+			if err := s.handleAck(m, &run); err != nil {
+				return run, err
+			}
+		case msgClose:
+			cl := closeConnection{}
+			cl.UnmarshalBinary(m.body)
+			run.closeReasons = append(run.closeReasons, cl.reason)
+		}
+	}
+	return run, nil
+}
+
+// handleAck answers the resend entries and the metadata requests of an ack.
+// After a close, acks are not answered.
+func (s *clientScriptRunner) handleAck(m *peerMessage, run *clientRun) error {
+	if s.script.closeAfter > 0 {
+		return nil
+	}
+	ack := clientAck{}
+	if err := ack.UnmarshalBinary(m.body); err != nil {
+		return fmt.Errorf("invalid ack: %v", err)
+	}
+	s.peer.ackNum = m.header.ackNum
+	sendMetadata := ack.status == metaDataMissing
+	for _, re := range ack.resendEntries {
+		if re.length == 0 {
+			sendMetadata = true
+		}
+		for i := uint64(0); i < uint64(re.length); i++ {
+			if offset := int(re.offset + i); offset < chunkCount(s.content) {
+				if err := s.sendChunk(offset); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if sendMetadata {
+		run.metadataRequested = true
+		return s.send(s.metadata())
+	}
+	return nil
+}
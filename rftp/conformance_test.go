@@ -0,0 +1,131 @@
+package rftp
+
+import (
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+)
+
+func conformanceContent() []byte {
+	data := make([]byte, 20*1024+100)
+	rand.New(rand.NewSource(1)).Read(data)
+	return data
+}
+
+func TestCheckServer(t *testing.T) {
+	data := conformanceContent()
+	network := NewMemNetwork()
+	stop := startMemServer(t, network, ":2020", map[string][]byte{"file": data})
+	defer stop()
+
+	results := checkServer(network, "localhost:2020", "file", data)
+	if len(results) != len(serverChecks) {
+		t.Fatalf("got %v results, want %v", len(results), len(serverChecks))
+	}
+	for _, r := range results {
+		t.Logf("%v: passed: %v %v", r.Name, r.Passed, r.Detail)
+	}
+	want := map[string]bool{
+		"transfer":          true,
+		"missing-file":      true,
+		"lost-metadata":     true,
+		"resend-length-0":   true,
+		"resend-entry":      true,
+		"duplicate-request": true,
+		"out-of-order-acks": true,
+		"close":             true,
+		// The server does not check the version yet.
+		"unknown-version": false,
+	}
+	for _, r := range results {
+		if r.Passed != want[r.Name] {
+			t.Errorf("%v passed = %v, want %v: %v", r.Name, r.Passed, want[r.Name], r.Detail)
+		}
+	}
+}
+
+// ignoreResends is the connection of a misbehaving server that drops the
+// resend entries of all acks.
+type ignoreResends struct {
+	connection
+}
+
+func (c ignoreResends) handle(msgType uint8, h packetHandler) {
+	if msgType == msgClientAck {
+		next := h
+		h = handlerFunc(func(w io.Writer, p *packet) {
+			// the resend entries follow the 14 byte of the ack
+			if len(p.data) > 14 {
+				p.data = p.data[:14]
+			}
+			next.handle(w, p)
+		})
+	}
+	c.connection.handle(msgType, h)
+}
+
+func TestCheckServerIgnoresResends(t *testing.T) {
+	data := conformanceContent()
+	network := NewMemNetwork()
+	server := NewServer()
+	server.Conn = ignoreResends{network.NewConnection()}
+	stop := startServer(t, server, ":2020", map[string][]byte{"file": data})
+	defer stop()
+
+	for _, check := range serverChecks {
+		if check.name != "resend-entry" {
+			continue
+		}
+		if err := runServerCheck(network, "localhost:2020", "file", data, check); err == nil {
+			t.Errorf("%v passed against a server that ignores resend entries", check.name)
+		}
+		return
+	}
+	t.Fatal("no resend-entry check")
+}
+
+func TestCheckClient(t *testing.T) {
+	data := conformanceContent()
+	network := NewMemNetwork()
+	start := func(host, name string) (<-chan ClientExit, func(), error) {
+		client := &Client{Conn: network.NewConnection()}
+		exit := make(chan ClientExit, 1)
+		go func() {
+			// Request waits for the first response of the scripted server.
+			reqs, err := client.Request(host, []string{name})
+			if err != nil {
+				exit <- ClientExit{Err: err}
+				return
+			}
+			data, err := ioutil.ReadAll(reqs[0])
+			if err == nil {
+				err = reqs[0].Err
+			}
+			exit <- ClientExit{Data: data, Err: err}
+		}()
+		return exit, func() {}, nil
+	}
+
+	results := checkClient(network, "localhost:2021", "file", data, start)
+	if len(results) != len(clientScripts) {
+		t.Fatalf("got %v results, want %v", len(results), len(clientScripts))
+	}
+	for _, r := range results {
+		t.Logf("%v: passed: %v %v", r.Name, r.Passed, r.Detail)
+	}
+	// The client does not check the version yet.
+	want := map[string]bool{
+		"transfer":              true,
+		"lost-metadata":         true,
+		"duplicate-payloads":    true,
+		"out-of-order-payloads": true,
+		"close":                 true,
+		"wrong-checksum":        true,
+	}
+	for _, r := range results {
+		if want[r.Name] && !r.Passed {
+			t.Errorf("%v failed: %v", r.Name, r.Detail)
+		}
+	}
+}
@@ -4,7 +4,7 @@ import (
 	"encoding"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
 	"sync"
 	"time"
@@ -14,7 +14,8 @@ type packet struct {
 	os         []option
 	data       []byte
 	ackNum     uint8
-	remoteAddr *net.UDPAddr
+	remoteAddr net.Addr
+	size       int // of the datagram
 }
 
 type handlerFunc func(io.Writer, *packet)
@@ -33,22 +34,43 @@ type connection interface {
 	receive() error
 	listen(host string) (func(), error)
 	connectTo(host string) error
-	send(msg encoding.BinaryMarshaler) error
+	// joinGroup receives the packets sent to the multicast group in addition
+	// to the ones from the remote. It must be called after connectTo.
+	joinGroup(group string) error
+	// groupWriter returns a writer that sends to the multicast group from the
+	// socket of the connection.
+	groupWriter(group string) (io.Writer, error)
+	// send returns the size of the sent datagram.
+	send(msg encoding.BinaryMarshaler) (int, error)
 	cclose(time.Duration) error
 	LossSim(LossSimulator)
+	Impair(send, receive Impairment)
+	Record(*PcapWriter)
+	setLogger(*slog.Logger)
+	setClock(Clock)
 }
 
-type udpConnection struct {
+// packetConnection exchanges messages over the sockets of a packetNetwork.
+type packetConnection struct {
+	network    packetNetwork
 	lossSim    LossSimulator
-	socket     *net.UDPConn
+	socket     net.PacketConn
+	remote     net.Addr       // set by connectTo
+	group      net.PacketConn // set by joinGroup
 	handlers   map[uint8]packetHandler
 	bufferSize int
 
+	impairSend    Impairment
+	impairReceive Impairment
+	recorder      *PcapWriter
+	logger        *slog.Logger
+	clock         Clock
+
 	closed  chan struct{}
 	closing bool
 }
 
-var _ connection = (*udpConnection)(nil)
+var _ connection = (*packetConnection)(nil)
 
 type responseWriter func([]byte) (int, error)
 
@@ -56,157 +78,343 @@ func (rw responseWriter) Write(bs []byte) (int, error) {
 	return rw(bs)
 }
 
-func NewUDPConnection() *udpConnection {
-	return &udpConnection{
+// packetNetwork creates the sockets of a packetConnection.
+type packetNetwork interface {
+	// listenPacket opens a socket at host. An empty host picks any free
+	// address.
+	listenPacket(host string) (net.PacketConn, error)
+	// joinGroup opens a socket that receives the packets sent to the
+	// multicast group.
+	joinGroup(group string) (net.PacketConn, error)
+	resolve(host string) (net.Addr, error)
+}
+
+type udpNetwork struct{}
+
+func (udpNetwork) listenPacket(host string) (net.PacketConn, error) {
+	if host == "" {
+		return net.ListenUDP("udp", nil)
+	}
+	addr, err := net.ResolveUDPAddr("udp4", host)
+	if err != nil {
+		return nil, err
+	}
+	return net.ListenUDP("udp4", addr)
+}
+
+func (udpNetwork) joinGroup(group string) (net.PacketConn, error) {
+	addr, err := net.ResolveUDPAddr("udp4", group)
+	if err != nil {
+		return nil, err
+	}
+	if !addr.IP.IsMulticast() {
+		return nil, fmt.Errorf("%v is not a multicast address", group)
+	}
+	return net.ListenMulticastUDP("udp4", nil, addr)
+}
+
+func (udpNetwork) resolve(host string) (net.Addr, error) {
+	return net.ResolveUDPAddr("udp", host)
+}
+
+func NewUDPConnection() *packetConnection {
+	return newPacketConnection(udpNetwork{})
+}
+
+func newPacketConnection(network packetNetwork) *packetConnection {
+	return &packetConnection{
+		network:    network,
 		lossSim:    &NoopLossSimulator{},
 		handlers:   make(map[uint8]packetHandler),
 		bufferSize: 2048,
+		logger:     silentLogger,
+		clock:      systemClock{},
 		closed:     make(chan struct{}),
 	}
 }
 
-func (c *udpConnection) addr() net.Addr {
+func (c *packetConnection) addr() net.Addr {
 	return c.socket.LocalAddr()
 }
 
-func (c *udpConnection) handle(msgType uint8, h packetHandler) {
+func (c *packetConnection) handle(msgType uint8, h packetHandler) {
 	c.handlers[msgType] = h
 }
 
-func (c *udpConnection) cclose(deadline time.Duration) error {
-	timeout := time.NewTimer(deadline)
+func (c *packetConnection) cclose(deadline time.Duration) error {
+	timeout := c.clock.NewTimer(deadline)
+	defer timeout.Stop()
 	if c.closing {
 		return fmt.Errorf("connection already closed")
 	}
 	c.closing = true
+	if c.group != nil {
+		c.group.Close()
+	}
 	err := c.socket.Close()
-	log.Printf("closed connection with err: %v\n", err)
+	c.logger.Debug("closed socket", "err", err)
 	select {
 	case <-c.closed:
-		log.Println("closed connection")
-	case <-timeout.C:
-		log.Println("timeout while closing connection")
+		c.logger.Debug("closed connection")
+	case <-timeout.C():
+		c.logger.Warn("timeout while closing connection")
 	}
 	return err
 }
 
-func (c *udpConnection) receive() error {
+func (c *packetConnection) receive() error {
 	var wg sync.WaitGroup
 
+	if c.group != nil {
+		// The source of multicast packets is the address of the interface the
+		// server sent them from, so they are not filtered by the remote.
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				msg := make([]byte, c.bufferSize)
+				n, addr, err := c.group.ReadFrom(msg)
+				if err != nil {
+					if !c.closing {
+						c.logger.Warn("stopped receiving from group", "err", err)
+					}
+					return
+				}
+				c.dispatch(&wg, msg, n, addr)
+			}
+		}()
+	}
+
 	for {
 		msg := make([]byte, c.bufferSize)
-		n, addr, err := c.socket.ReadFromUDP(msg)
+		n, addr, err := c.socket.ReadFrom(msg)
 		if err != nil {
 			if c.closing {
-				log.Println("finishing connection close")
+				c.logger.Debug("finishing connection close")
 				wg.Wait()
 				c.closed <- struct{}{}
-				log.Println("finished connection close")
+				c.logger.Debug("finished connection close")
 				return nil
 			}
-			log.Printf("discarded packet due to error: %v", err)
-			log.Println("closing due to crashed connection")
+			c.logger.Error("closing due to crashed connection", "err", err)
 			return err
 		}
 
-		if c.lossSim.shouldDrop() {
-			continue
-		}
-
-		header := &msgHeader{}
-		if err := header.UnmarshalBinary(msg); err != nil {
-			// Some wisdom: "Be conservative in what you do, be liberal in what you
-			// accept from others."
-			log.Printf("error while unmarshalling packet header: %v\n", err)
+		if c.remote != nil && addr.String() != c.remote.String() {
+			if debugEnabled(c.logger) {
+				c.logger.Debug("discarded packet from unknown peer", "peer", addr)
+			}
 			continue
 		}
 
-		rw := responseWriter(func(bs []byte) (int, error) {
-			return c.socket.WriteTo(bs, addr)
-		})
-		p := &packet{
-			os:         header.options,
-			data:       msg[header.hdrLen:n],
-			remoteAddr: addr,
-			ackNum:     header.ackNum,
-		}
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			if handler, ok := c.handlers[header.msgType]; !ok {
-				log.Printf("no handler for message type %d\n", header.msgType)
-			} else {
-				handler.handle(rw, p)
-			}
-		}()
+		c.dispatch(&wg, msg, n, addr)
 	}
 }
 
-func (c *udpConnection) listen(host string) (func(), error) {
-	addr, err := net.ResolveUDPAddr("udp4", host)
-	if err != nil {
-		return nil, err
+// dispatch passes a received datagram to the handler of its message type.
+func (c *packetConnection) dispatch(wg *sync.WaitGroup, msg []byte, n int, addr net.Addr) {
+	if c.lossSim.shouldDrop() {
+		return
+	}
+
+	header := &msgHeader{}
+	if err := header.UnmarshalBinary(msg); err != nil {
+		// Some wisdom: "Be conservative in what you do, be liberal in what you
+		// accept from others."
+		c.logger.Warn("failed to unmarshal packet header", "peer", addr, "err", err)
+		return
 	}
 
-	conn, err := net.ListenUDP("udp4", addr)
+	rw := responseWriter(func(bs []byte) (int, error) {
+		return c.socket.WriteTo(bs, addr)
+	})
+	p := &packet{
+		os:         header.options,
+		data:       msg[header.hdrLen:n],
+		remoteAddr: addr,
+		ackNum:     header.ackNum,
+		size:       n,
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if handler, ok := c.handlers[header.msgType]; !ok {
+			c.logger.Warn("no handler for message type", "type", header.msgType)
+		} else {
+			handler.handle(rw, p)
+		}
+	}()
+}
+
+func (c *packetConnection) listen(host string) (func(), error) {
+	conn, err := c.network.listenPacket(host)
 	if err != nil {
 		return nil, err
 	}
-	c.socket = conn
+	c.socket = c.wrap(conn)
 
 	return func() {
-		conn.Close()
+		c.socket.Close()
 	}, nil
 }
 
-func (c *udpConnection) connectTo(host string) error {
-	addr, err := net.ResolveUDPAddr("udp", host)
+func (c *packetConnection) connectTo(host string) error {
+	addr, err := c.network.resolve(host)
 	if err != nil {
 		return err
 	}
 
-	conn, err := net.DialUDP("udp", nil, addr)
-
+	conn, err := c.network.listenPacket("")
 	if err != nil {
 		return err
 	}
 
-	c.socket = conn
+	c.socket = c.wrap(conn)
+	c.remote = addr
 	return nil
 }
 
-func (c udpConnection) send(msg encoding.BinaryMarshaler) error {
-	return sendTo(c.socket, msg)
+func (c *packetConnection) joinGroup(group string) error {
+	conn, err := c.network.joinGroup(group)
+	if err != nil {
+		return err
+	}
+	c.group = c.wrap(conn)
+	return nil
+}
+
+func (c *packetConnection) groupWriter(group string) (io.Writer, error) {
+	addr, err := c.network.resolve(group)
+	if err != nil {
+		return nil, err
+	}
+	return responseWriter(func(bs []byte) (int, error) {
+		return c.socket.WriteTo(bs, addr)
+	}), nil
+}
+
+// clockedConn is a socket whose read deadlines run on a Clock, like the ones
+// of a MemNetwork.
+type clockedConn interface {
+	setClock(Clock)
+}
+
+// wrap adds the recorder and the impairments to a socket. The recorder sees the
+// packets as they are sent to and received from the network. The socket and
+// impairments without a clock of their own use the one of the connection.
+func (c *packetConnection) wrap(conn net.PacketConn) net.PacketConn {
+	if cc, ok := conn.(clockedConn); ok {
+		cc.setClock(c.clock)
+	}
+	if c.recorder != nil {
+		conn = &recordingConn{PacketConn: conn, w: c.recorder, logger: c.logger}
+	}
+	if !c.impairSend.active() && !c.impairReceive.active() {
+		return conn
+	}
+	send, receive := c.impairSend, c.impairReceive
+	if send.Clock == nil {
+		send.Clock = c.clock
+	}
+	if receive.Clock == nil {
+		receive.Clock = c.clock
+	}
+	return newImpairedConn(conn, send, receive, c.logger)
+}
+
+func (c packetConnection) send(msg encoding.BinaryMarshaler) (int, error) {
+	n := 0
+	err := sendTo(responseWriter(func(bs []byte) (int, error) {
+		var err error
+		n, err = c.socket.WriteTo(bs, c.remote)
+		return n, err
+	}), msg)
+	return n, err
 }
 
-func (c *udpConnection) LossSim(lossSim LossSimulator) {
+func (c *packetConnection) LossSim(lossSim LossSimulator) {
 	c.lossSim = lossSim
 }
 
+// Impair applies the impairments to the sent and the received packets. It must
+// be called before the connection is used.
+func (c *packetConnection) Impair(send, receive Impairment) {
+	c.impairSend = send
+	c.impairReceive = receive
+}
+
+// setLogger sets the logger of the connection. It must be called before the
+// connection is used.
+func (c *packetConnection) setLogger(l *slog.Logger) {
+	c.logger = loggerOrSilent(l)
+}
+
+// setClock sets the clock of the connection. It must be called before the
+// connection is used.
+func (c *packetConnection) setClock(clock Clock) {
+	c.clock = clock
+}
+
+// Record writes all sent and received packets to w. It must be called before
+// the connection is used.
+func (c *packetConnection) Record(w *PcapWriter) {
+	c.recorder = w
+}
+
+// optionsMsg adds options to the header of a message, e.g., the tag of a
+// multicast session. Messages may be wrapped several times.
+type optionsMsg struct {
+	msg     encoding.BinaryMarshaler
+	options []option
+}
+
+func (g optionsMsg) MarshalBinary() ([]byte, error) {
+	return g.msg.MarshalBinary()
+}
+
 func sendTo(writer io.Writer, msg encoding.BinaryMarshaler) error {
 	header := msgHeader{
 		version:   1,
 		optionLen: 0,
 	}
+	var extraOptions []option
+	for {
+		o, ok := msg.(optionsMsg)
+		if !ok {
+			break
+		}
+		msg, extraOptions = o.msg, append(extraOptions, o.options...)
+	}
 
 	switch v := msg.(type) {
 	case clientRequest:
 		header.msgType = msgClientRequest
+		header.options = v.options
+	case clientRangeRequest:
+		header.msgType = msgClientRangeRequest
+		header.options = v.options
 	case clientAck:
 		header.msgType = msgClientAck
 		header.ackNum = v.ackNumber
 	case serverMetaData:
 		header.msgType = msgServerMetadata
 	case serverPayload:
-		log.Printf("sending payload: file %v at offset %v\n", v.fileIndex, v.offset)
 		header.msgType = msgServerPayload
 		header.ackNum = v.ackNumber
+	case serverRepair:
+		header.msgType = msgServerRepair
+		header.ackNum = v.ackNumber
+	case clientSignatures:
+		header.msgType = msgClientSignatures
 	case closeConnection:
 		header.msgType = msgClose
 	default:
 		return fmt.Errorf("unknown msg type %T", v)
 	}
 
+	header.options = append(header.options, extraOptions...)
+	header.optionLen = uint8(len(header.options))
+
 	hs, err := header.MarshalBinary()
 	if err != nil {
 		return err
@@ -262,10 +470,16 @@ func (c *testConnection) receive() error {
 		switch header.msgType {
 		case msgClientRequest:
 			msg = &clientRequest{}
+		case msgClientRangeRequest:
+			msg = &clientRangeRequest{}
 		case msgServerMetadata:
 			msg = &serverMetaData{}
 		case msgServerPayload:
 			msg = &serverPayload{}
+		case msgServerRepair:
+			msg = &serverRepair{}
+		case msgClientSignatures:
+			msg = &clientSignatures{}
 		case msgClientAck:
 			msg = &clientAck{}
 		case msgClose:
@@ -312,14 +526,34 @@ func (c testConnection) connectTo(host string) error {
 	return nil
 }
 
-func (c testConnection) send(msg encoding.BinaryMarshaler) error {
-	c.sentChan <- msg
+func (c testConnection) joinGroup(group string) error {
 	return nil
 }
 
+func (c testConnection) groupWriter(group string) (io.Writer, error) {
+	return nil, fmt.Errorf("multicast is not supported")
+}
+
+func (c testConnection) send(msg encoding.BinaryMarshaler) (int, error) {
+	c.sentChan <- msg
+	return 0, nil
+}
+
 func (c testConnection) cclose(timeout time.Duration) error {
 	return nil
 }
 
 func (c testConnection) LossSim(lossSim LossSimulator) {
 }
+
+func (c testConnection) Impair(send, receive Impairment) {
+}
+
+func (c testConnection) Record(w *PcapWriter) {
+}
+
+func (c testConnection) setLogger(l *slog.Logger) {
+}
+
+func (c testConnection) setClock(clock Clock) {
+}
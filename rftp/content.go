@@ -0,0 +1,82 @@
+package rftp
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+)
+
+// ContentHandler returns the file with the given MD5 checksum. It serves the
+// requests that name files by their content instead of their name, e.g.,
+// from an index of the checksums of the served files.
+type ContentHandler func(sum [16]byte) (*io.SectionReader, error)
+
+// ListingHandler returns the listing of the files of a directory. The
+// format of the listing is up to the handler, the client receives it like a
+// file.
+type ListingHandler func(dir string) (*io.SectionReader, error)
+
+// contentName is the name of a file that is requested by its checksum, the
+// checksum in hex.
+func contentName(sum [16]byte) string {
+	return hex.EncodeToString(sum[:])
+}
+
+func parseContentName(name string) ([16]byte, error) {
+	var sum [16]byte
+	b, err := hex.DecodeString(name)
+	if err != nil || len(b) != len(sum) {
+		return sum, fmt.Errorf("invalid checksum %q", name)
+	}
+	copy(sum[:], b)
+	return sum, nil
+}
+
+// contentOption returns the option that requests the files by their
+// checksum.
+func contentOption(files []uint16) []option {
+	return indexOptions(optContent, files)
+}
+
+// listingOption returns the option that requests the listings of the
+// directories.
+func listingOption(files []uint16) []option {
+	return indexOptions(optListing, files)
+}
+
+// open returns the requested file i, which may also be requested by its
+// checksum or be the listing of a directory. Each file is opened once.
+func (c *clientConnection) open(fh FileHandler, i uint16) (*io.SectionReader, error) {
+	if r, ok := c.opened[i]; ok {
+		return r, nil
+	}
+	r, err := c.openFile(fh, i)
+	if err == nil && c.opened != nil {
+		c.opened[i] = r
+	}
+	return r, err
+}
+
+func (c *clientConnection) openFile(fh FileHandler, i uint16) (*io.SectionReader, error) {
+	if int(i) >= len(c.req.files) {
+		return nil, fmt.Errorf("no file %v in request", i)
+	}
+	name := c.req.files[i].fileName
+	if c.listings[i] {
+		if c.listing == nil {
+			return nil, fmt.Errorf("no listing of %v", name)
+		}
+		return c.listing(name)
+	}
+	if !c.byContent[i] {
+		return fh(name)
+	}
+	if c.content == nil {
+		return nil, fmt.Errorf("no content index for %v", name)
+	}
+	sum, err := parseContentName(name)
+	if err != nil {
+		return nil, err
+	}
+	return c.content(sum)
+}
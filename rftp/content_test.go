@@ -0,0 +1,125 @@
+package rftp
+
+import (
+	"bytes"
+	"crypto/md5"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func TestContentRequest(t *testing.T) {
+	data := randomBytes(300*1024+5, 5)
+	other := randomBytes(2000, 6)
+	index := map[[16]byte][]byte{md5.Sum(data): data}
+
+	tests := map[string]struct {
+		sum     [16]byte
+		content ContentHandler
+		wantErr bool
+	}{
+		"found": {sum: md5.Sum(data)},
+		"unknown checksum": {
+			sum:     md5.Sum(other),
+			wantErr: true,
+		},
+		"wrong file": {
+			sum: md5.Sum(data),
+			content: func(sum [16]byte) (*io.SectionReader, error) {
+				return io.NewSectionReader(bytes.NewReader(other), 0, int64(len(other))), nil
+			},
+			wantErr: true,
+		},
+		"no content handler": {sum: md5.Sum(data), wantErr: true},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			server := NewServer()
+			switch {
+			case tc.content != nil:
+				server.SetContentHandler(tc.content)
+			case name != "no content handler":
+				server.SetContentHandler(func(sum [16]byte) (*io.SectionReader, error) {
+					d, ok := index[sum]
+					if !ok {
+						return nil, errors.New("file not found")
+					}
+					return io.NewSectionReader(bytes.NewReader(d), 0, int64(len(d))), nil
+				})
+			}
+			network := NewMemNetwork()
+			// The file is served under the hex checksum as well, which must
+			// not be mistaken for a request by checksum.
+			stop := startMemServerWith(t, server, network, ":2020", map[string][]byte{contentName(tc.sum): other})
+			defer stop()
+
+			conn := network.NewConnection()
+			conn.LossSim(NewMarkovLossSimulator(0.02, 0.3, NewRand(1, 4)))
+			client := &Client{Conn: conn}
+			reqs, err := client.RequestFiles("localhost:2020", []FileRequest{{Checksum: tc.sum}})
+			if err != nil {
+				t.Fatalf("RequestFiles() error = %v", err)
+			}
+			if reqs[0].Name != contentName(tc.sum) {
+				t.Errorf("Name = %v, want the checksum", reqs[0].Name)
+			}
+			got, err := ioutil.ReadAll(reqs[0])
+			if err == nil {
+				err = reqs[0].err()
+			}
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tc.wantErr)
+			}
+			if !tc.wantErr && !bytes.Equal(got, data) {
+				t.Errorf("received %v bytes that differ from the %v sent bytes", len(got), len(data))
+			}
+		})
+	}
+}
+
+func TestContentRequestRange(t *testing.T) {
+	client := &Client{Conn: NewMemNetwork().NewConnection()}
+	_, err := client.RequestFiles("localhost:2020", []FileRequest{{Checksum: [16]byte{1}, Length: 10}})
+	if err == nil {
+		t.Errorf("RequestFiles() of a range by checksum succeeded")
+	}
+}
+
+func TestListingRequest(t *testing.T) {
+	listing := []byte("a.txt\nb.txt\n")
+	for _, handler := range []bool{true, false} {
+		server := NewServer()
+		if handler {
+			server.SetListingHandler(func(dir string) (*io.SectionReader, error) {
+				if dir != "dir" {
+					return nil, errors.New("directory not found")
+				}
+				return io.NewSectionReader(bytes.NewReader(listing), 0, int64(len(listing))), nil
+			})
+		}
+		network := NewMemNetwork()
+		// A file with the name of the directory is not its listing.
+		stop := startMemServerWith(t, server, network, ":2020", map[string][]byte{"dir": []byte("file")})
+
+		client := &Client{Conn: network.NewConnection()}
+		reqs, err := client.RequestFiles("localhost:2020", []FileRequest{{Name: "dir", Listing: true}, {Name: "dir"}})
+		if err != nil {
+			t.Fatalf("RequestFiles() error = %v", err)
+		}
+		got, err := ioutil.ReadAll(reqs[0])
+		if err == nil {
+			err = reqs[0].err()
+		}
+		if handler && (err != nil || !bytes.Equal(got, listing)) {
+			t.Errorf("listing = %q, %v, want %q", got, err, listing)
+		}
+		if !handler && err == nil {
+			t.Errorf("listing without listing handler succeeded")
+		}
+		if got, err := ioutil.ReadAll(reqs[1]); err != nil || string(got) != "file" {
+			t.Errorf("file = %q, %v, want %q", got, err, "file")
+		}
+		stop()
+	}
+}
@@ -0,0 +1,630 @@
+package rftp
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// A delta transfers a file as instructions to rebuild it from the local copy
+// of the client, like rsync does. The client sends the signatures of the
+// blocks of its copy, the server looks for the blocks in the requested file
+// and sends the delta instead of the file: the magic deltaMagic followed by
+// operations, each a 1 byte type and two 8 byte values:
+//
+//	deltaCopy, first block, blocks: copy the blocks of the local copy
+//	deltaLiteral, length, 0: followed by length bytes of the file
+//
+// The payloads and repair packets of a delta carry an empty delta option, so
+// that the client tells a delta from the file before the metadata arrives.
+// The metadata of a delta has the size and checksum of the file itself and
+// the length of the delta as option.
+const deltaMagic = "rftdelta"
+
+const (
+	deltaCopy    = 1
+	deltaLiteral = 2
+	deltaOpSize  = 17
+
+	// signaturesPerMsg fits the signatures in one datagram.
+	signaturesPerMsg = 80
+	// maxSignatures limits the number of signatures of a local copy.
+	maxSignatures = 1 << 22
+)
+
+// deltaBlockSize returns the block size of a local copy of size bytes, about
+// the square root of the size, like rsync uses.
+func deltaBlockSize(size int64) uint32 {
+	bs := uint32(math.Sqrt(float64(size))+1023) / 1024 * 1024
+	for bs == 0 || int64(bs)*maxSignatures < size {
+		bs += 1024
+	}
+	return bs
+}
+
+// weakSum is the rolling checksum of a block.
+type weakSum struct {
+	a, b uint32
+	n    uint32
+}
+
+func newWeakSum(block []byte) weakSum {
+	s := weakSum{n: uint32(len(block))}
+	for i, c := range block {
+		s.a += uint32(c)
+		s.b += (s.n - uint32(i)) * uint32(c)
+	}
+	return s
+}
+
+// roll moves the block one byte forward, out leaves and in enters it.
+func (s *weakSum) roll(out, in byte) {
+	s.a += uint32(in) - uint32(out)
+	s.b += s.a - s.n*uint32(out)
+}
+
+func (s weakSum) sum() uint32 {
+	return s.a&0xffff | s.b<<16
+}
+
+func strongSum(block []byte) [8]byte {
+	var s [8]byte
+	sum := md5.Sum(block)
+	copy(s[:], sum[:8])
+	return s
+}
+
+// signBlocks returns the messages with the signatures of the full blocks of
+// basis.
+func signBlocks(basis *io.SectionReader, index uint16) ([]clientSignatures, uint32, error) {
+	bs := deltaBlockSize(basis.Size())
+	blocks := uint32(basis.Size() / int64(bs))
+	msgs := []clientSignatures{}
+	block := make([]byte, bs)
+	for i := uint32(0); i == 0 || i < blocks; i += signaturesPerMsg {
+		msg := clientSignatures{fileIndex: index, blockSize: bs, blocks: blocks, first: i}
+		for j := i; j < blocks && j < i+signaturesPerMsg; j++ {
+			if _, err := basis.ReadAt(block, int64(j)*int64(bs)); err != nil {
+				return nil, 0, err
+			}
+			msg.signatures = append(msg.signatures, blockSignature{
+				weak:   newWeakSum(block).sum(),
+				strong: strongSum(block),
+			})
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, bs, nil
+}
+
+// signatureSet collects the signatures of the local copy of a file. The
+// signatures are kept as they arrive, so the memory grows with the received
+// signatures instead of the announced ones.
+type signatureSet struct {
+	blockSize  uint32
+	blocks     uint32 // accepted blocks of the local copy
+	received   map[uint32]blockSignature
+	signatures []blockSignature // once complete
+}
+
+func (s *signatureSet) complete() bool {
+	return len(s.received) == int(s.blocks)
+}
+
+// deltaRequest collects the signatures of the files a client requests as
+// delta. The response starts once all signatures arrived.
+type deltaRequest struct {
+	lock    sync.Mutex
+	files   map[uint16]*signatureSet
+	size    func(file uint16) int64
+	started bool
+	streams map[uint16]uint64 // length of the delta of a file
+}
+
+// newDeltaRequest returns the request for the files. size returns the size of
+// a requested file, which limits the number of signatures that are kept.
+func newDeltaRequest(files []uint16, size func(file uint16) int64) *deltaRequest {
+	d := &deltaRequest{files: make(map[uint16]*signatureSet), size: size, streams: make(map[uint16]uint64)}
+	for _, f := range files {
+		d.files[f] = nil
+	}
+	return d
+}
+
+// add adds signatures and returns whether the response can start now. Only
+// the signatures of the first blocks that fit in the requested file are
+// kept, blocks beyond can't be found in the file anyway.
+func (d *deltaRequest) add(msg *clientSignatures) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	set, ok := d.files[msg.fileIndex]
+	if !ok || d.started || msg.blockSize < 1024 {
+		return false
+	}
+	if set == nil {
+		limit := d.size(msg.fileIndex)/int64(msg.blockSize) + 1
+		blocks := msg.blocks
+		if int64(blocks) > limit {
+			blocks = uint32(limit)
+		}
+		set = &signatureSet{blockSize: msg.blockSize, blocks: blocks, received: make(map[uint32]blockSignature)}
+		d.files[msg.fileIndex] = set
+	}
+	if msg.blockSize != set.blockSize {
+		return false
+	}
+	for i, sig := range msg.signatures {
+		n := uint64(msg.first) + uint64(i)
+		if n >= uint64(set.blocks) {
+			break
+		}
+		set.received[uint32(n)] = sig
+	}
+	for _, s := range d.files {
+		if s == nil || !s.complete() {
+			return false
+		}
+	}
+	for _, s := range d.files {
+		s.signatures = make([]blockSignature, s.blocks)
+		for n, sig := range s.received {
+			s.signatures[n] = sig
+		}
+		s.received = nil
+	}
+	d.started = true
+	return true
+}
+
+// signatures returns the signatures of a file, or nil, if the file is not
+// requested as delta.
+func (d *deltaRequest) signatures(file uint16) *signatureSet {
+	if d == nil {
+		return nil
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.files[file]
+}
+
+func (d *deltaRequest) setStream(file uint16, length uint64) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.streams[file] = length
+}
+
+// metadataOptions returns the options of the metadata of a file, which carry
+// the length of its delta.
+func (d *deltaRequest) metadataOptions(file uint16) []option {
+	if d == nil {
+		return nil
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	length, ok := d.streams[file]
+	if !ok {
+		return nil
+	}
+	return []option{{otype: optDelta, value: binary.BigEndian.AppendUint64(nil, length)}}
+}
+
+// deltaOption returns the option that requests the files as delta.
+func deltaOption(files []uint16) []option {
+	return indexOptions(optDelta, files)
+}
+
+// isDeltaPayload returns whether the options mark a payload of a delta.
+func isDeltaPayload(os []option) bool {
+	for _, o := range os {
+		if o.otype == optDelta && len(o.value) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// options returns the options of the header of the current chunk.
+func (fr *fileReader) options() []option {
+	if fr.delta == nil {
+		return fr.blockOptions
+	}
+	os := append([]option{}, fr.blockOptions...)
+	return append(os, option{otype: optDelta})
+}
+
+// parseDeltaLength returns the length of the delta from the options of
+// metadata.
+func parseDeltaLength(os []option) (uint64, bool) {
+	for _, o := range os {
+		if o.otype == optDelta && len(o.value) == 8 {
+			return binary.BigEndian.Uint64(o.value), true
+		}
+	}
+	return 0, false
+}
+
+// deltaOp copies blocks of the local copy or literal bytes of the file.
+type deltaOp struct {
+	copy   bool
+	offset uint64 // first block or offset in the file
+	length uint64 // blocks or bytes
+}
+
+// delta is the delta of a file to the local copy of the client.
+type delta struct {
+	stream   *io.SectionReader
+	size     uint64
+	checksum [16]byte
+	copied   uint64 // bytes
+}
+
+// newDelta looks for the blocks of the local copy in the file and returns
+// the delta.
+func newDelta(sr *io.SectionReader, set *signatureSet) (*delta, error) {
+	bs := int(set.blockSize)
+	weak := map[uint32][]uint32{}
+	for i, sig := range set.signatures {
+		weak[sig.weak] = append(weak[sig.weak], uint32(i))
+	}
+
+	d := &delta{size: uint64(sr.Size())}
+	ops := []deltaOp{}
+	literal := uint64(0) // start of the pending literal bytes
+	addOp := func(op deltaOp) {
+		if n := len(ops) - 1; n >= 0 && op.copy && ops[n].copy && ops[n].offset+ops[n].length == op.offset {
+			ops[n].length += op.length
+			return
+		}
+		ops = append(ops, op)
+	}
+
+	hasher := md5.New()
+	buf := []byte{}
+	bufStart := uint64(0) // offset of buf in the file
+	read := make([]byte, 1<<20)
+	eof := false
+	// fill makes sure buf holds the block at pos, unless the file ends.
+	fill := func(pos uint64) error {
+		for !eof && uint64(len(buf)) < pos-bufStart+uint64(bs) {
+			n, err := sr.ReadAt(read, int64(bufStart)+int64(len(buf)))
+			hasher.Write(read[:n])
+			buf = append(buf, read[:n]...)
+			if err == io.EOF || n == 0 {
+				eof = true
+			} else if err != nil {
+				return err
+			}
+		}
+		// The bytes before pos are not needed anymore, literals are read
+		// from the file when they are sent.
+		if drop := pos - bufStart; drop > 1<<20 {
+			buf = buf[drop:]
+			bufStart = pos
+		}
+		return nil
+	}
+
+	var sum weakSum
+	rolling := false
+	for pos := uint64(0); ; {
+		if err := fill(pos); err != nil {
+			return nil, err
+		}
+		if pos+uint64(bs) > bufStart+uint64(len(buf)) {
+			break
+		}
+		block := buf[pos-bufStart : pos-bufStart+uint64(bs)]
+		if !rolling {
+			sum = newWeakSum(block)
+			rolling = true
+		}
+		if match, ok := findBlock(weak[sum.sum()], set, block); ok {
+			if pos > literal {
+				addOp(deltaOp{offset: literal, length: pos - literal})
+			}
+			addOp(deltaOp{copy: true, offset: uint64(match), length: 1})
+			d.copied += uint64(bs)
+			pos += uint64(bs)
+			literal = pos
+			rolling = false
+			continue
+		}
+		if pos+uint64(bs) >= bufStart+uint64(len(buf)) {
+			if err := fill(pos + 1); err != nil {
+				return nil, err
+			}
+		}
+		if pos+uint64(bs) < bufStart+uint64(len(buf)) {
+			sum.roll(buf[pos-bufStart], buf[pos-bufStart+uint64(bs)])
+		}
+		pos++
+	}
+	if literal < d.size {
+		addOp(deltaOp{offset: literal, length: d.size - literal})
+	}
+	copy(d.checksum[:], hasher.Sum(nil))
+	d.stream = deltaStream(sr, ops)
+	return d, nil
+}
+
+// findBlock returns the block of the candidates that matches the strong
+// checksum of block.
+func findBlock(candidates []uint32, set *signatureSet, block []byte) (uint32, bool) {
+	if len(candidates) == 0 {
+		return 0, false
+	}
+	strong := strongSum(block)
+	for _, c := range candidates {
+		if set.signatures[c].strong == strong {
+			return c, true
+		}
+	}
+	return 0, false
+}
+
+// segment is a part of a delta stream, either encoded bytes or a section of
+// the file.
+type segment struct {
+	start int64
+	data  []byte
+	sr    *io.SectionReader
+}
+
+func (s segment) size() int64 {
+	if s.sr != nil {
+		return s.sr.Size()
+	}
+	return int64(len(s.data))
+}
+
+// segmentReader concatenates segments without copying the sections of the
+// file.
+type segmentReader []segment
+
+func deltaStream(sr *io.SectionReader, ops []deltaOp) *io.SectionReader {
+	segs := segmentReader{}
+	header := []byte(deltaMagic)
+	size := int64(0)
+	add := func(s segment) {
+		s.start = size
+		size += s.size()
+		segs = append(segs, s)
+	}
+	for _, op := range ops {
+		if op.copy {
+			header = append(header, deltaCopy)
+			header = binary.BigEndian.AppendUint64(header, op.offset)
+			header = binary.BigEndian.AppendUint64(header, op.length)
+			continue
+		}
+		header = append(header, deltaLiteral)
+		header = binary.BigEndian.AppendUint64(header, op.length)
+		header = binary.BigEndian.AppendUint64(header, 0)
+		add(segment{data: header})
+		add(segment{sr: io.NewSectionReader(sr, int64(op.offset), int64(op.length))})
+		header = []byte{}
+	}
+	if len(header) > 0 {
+		add(segment{data: header})
+	}
+	return io.NewSectionReader(segs, 0, size)
+}
+
+func (r segmentReader) ReadAt(p []byte, off int64) (int, error) {
+	i := sort.Search(len(r), func(i int) bool { return r[i].start+r[i].size() > off })
+	n := 0
+	for ; i < len(r) && n < len(p); i++ {
+		s := r[i]
+		o := off + int64(n) - s.start
+		if s.sr != nil {
+			m, err := s.sr.ReadAt(p[n:min(len(p), n+int(s.size()-o))], o)
+			n += m
+			if err != nil && err != io.EOF {
+				return n, err
+			}
+		} else {
+			n += copy(p[n:], s.data[o:])
+		}
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// deltaWriter rebuilds a file from its delta and the local copy of the
+// client. Files the server sends without delta are written unchanged.
+type deltaWriter struct {
+	basis     *io.SectionReader
+	blockSize uint64
+	dest      io.WriterAt
+	hasher    hash.Hash
+	written   *uint64
+
+	header  []byte // of the delta or of the next operation
+	plain   bool   // the file is received instead of its delta
+	decided bool   // whether plain is known
+	isDelta bool   // the magic of the delta was received
+	literal uint64 // bytes of the current literal operation
+
+	lock   sync.Mutex
+	marked bool   // payloads of a delta arrived
+	stream uint64 // length of the delta, if the server announced it
+	size   uint64 // of the file
+	err    error
+}
+
+func newDeltaWriter(basis *io.SectionReader, blockSize uint32, dest io.WriterAt, written *uint64) *deltaWriter {
+	return &deltaWriter{
+		basis:     basis,
+		blockSize: uint64(blockSize),
+		dest:      dest,
+		hasher:    md5.New(),
+		written:   written,
+	}
+}
+
+func (d *deltaWriter) setStream(length uint64) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.stream = length
+}
+
+// markDelta records that the server sends the delta instead of the file.
+// It is called before the marked payload is written.
+func (d *deltaWriter) markDelta() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.marked = true
+}
+
+func (d *deltaWriter) fileSize() uint64 {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.size
+}
+
+// transferSize returns the number of bytes the chunks of a file of size
+// bytes carry.
+func (d *deltaWriter) transferSize(size uint64) uint64 {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.size = size
+	if d.stream > 0 {
+		return d.stream
+	}
+	return size
+}
+
+// Write receives the next bytes of the delta. After an error, the delta is
+// dropped and verify reports the error.
+func (d *deltaWriter) Write(p []byte) (int, error) {
+	if err := d.failed(); err != nil {
+		return 0, err
+	}
+	if err := d.write(p); err != nil {
+		d.lock.Lock()
+		d.err = err
+		d.lock.Unlock()
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (d *deltaWriter) failed() error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.err
+}
+
+func (d *deltaWriter) write(p []byte) error {
+	if !d.decided && len(p) > 0 {
+		d.lock.Lock()
+		d.plain = !d.marked
+		d.lock.Unlock()
+		d.decided = true
+	}
+	for len(p) > 0 {
+		switch {
+		case d.plain:
+			return d.output(p)
+
+		case !d.isDelta:
+			m := min(len(p), len(deltaMagic)-len(d.header))
+			d.header, p = append(d.header, p[:m]...), p[m:]
+			if len(d.header) < len(deltaMagic) {
+				continue
+			}
+			if string(d.header) != deltaMagic {
+				return errors.New("delta doesn't start with its magic")
+			}
+			d.isDelta = true
+			d.header = nil
+
+		case d.literal > 0:
+			m := min(uint64(len(p)), d.literal)
+			if err := d.output(p[:m]); err != nil {
+				return err
+			}
+			d.literal -= m
+			p = p[m:]
+
+		default:
+			m := min(len(p), deltaOpSize-len(d.header))
+			d.header, p = append(d.header, p[:m]...), p[m:]
+			if len(d.header) < deltaOpSize {
+				continue
+			}
+			op, a, b := d.header[0], binary.BigEndian.Uint64(d.header[1:9]), binary.BigEndian.Uint64(d.header[9:17])
+			d.header = nil
+			switch op {
+			case deltaLiteral:
+				d.literal = a
+			case deltaCopy:
+				if err := d.copyBlocks(a, b); err != nil {
+					return err
+				}
+			default:
+				return fmt.Errorf("unknown delta operation %v", op)
+			}
+		}
+	}
+	return nil
+}
+
+func (d *deltaWriter) copyBlocks(first, blocks uint64) error {
+	block := make([]byte, d.blockSize)
+	for i := first; i < first+blocks; i++ {
+		if _, err := d.basis.ReadAt(block, int64(i*d.blockSize)); err != nil {
+			return fmt.Errorf("failed to read block %v of the local copy: %v", i, err)
+		}
+		if err := d.output(block); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *deltaWriter) output(p []byte) error {
+	written := atomic.LoadUint64(d.written)
+	if _, err := d.dest.WriteAt(p, int64(written)); err != nil {
+		return err
+	}
+	d.hasher.Write(p)
+	atomic.AddUint64(d.written, uint64(len(p)))
+	return nil
+}
+
+// verify compares the rebuilt file with the size and checksum of the
+// metadata.
+func (d *deltaWriter) verify(checksum [16]byte) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.err != nil {
+		return d.err
+	}
+	if d.literal > 0 || len(d.header) > 0 {
+		return errors.New("delta ended within an operation")
+	}
+	if d.plain && d.stream > 0 {
+		return errors.New("server announced a delta, but sent the file")
+	}
+	if d.isDelta && d.stream == 0 {
+		return errors.New("server sent a delta, but announced the file")
+	}
+	if atomic.LoadUint64(d.written) != d.size {
+		return fmt.Errorf("rebuilt %v bytes of %v", atomic.LoadUint64(d.written), d.size)
+	}
+	if !bytes.Equal(checksum[:], d.hasher.Sum(nil)) {
+		return errors.New("Checksum validation failed")
+	}
+	return nil
+}
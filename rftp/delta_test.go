@@ -0,0 +1,213 @@
+package rftp
+
+import (
+	"bytes"
+	"crypto/md5"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+func randomBytes(n int, seed int64) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+// modify returns a copy of data with inserted, changed and removed bytes.
+func modify(data []byte) []byte {
+	m := append([]byte{}, data[:1000]...)
+	m = append(m, "inserted bytes"...)
+	m = append(m, data[1000:200*1024]...)
+	m = append(m, randomBytes(3000, 9)...)
+	m = append(m, data[203*1024:400*1024]...)
+	return append(m, data[410*1024:]...)
+}
+
+func rebuild(t *testing.T, basis, data []byte) (*memFile, *delta) {
+	t.Helper()
+	sigs, bs, err := signBlocks(io.NewSectionReader(bytes.NewReader(basis), 0, int64(len(basis))), 0)
+	if err != nil {
+		t.Fatalf("signBlocks() error = %v", err)
+	}
+	req := newDeltaRequest([]uint16{0}, func(uint16) int64 { return int64(len(data)) })
+	// Signatures of blocks beyond the size of the file are not needed.
+	started := false
+	for i := range sigs {
+		started = req.add(&sigs[i]) || started
+	}
+	if !started {
+		t.Fatalf("add() of all signatures didn't start the response")
+	}
+	d, err := newDelta(io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data))), req.signatures(0))
+	if err != nil {
+		t.Fatalf("newDelta() error = %v", err)
+	}
+	if d.size != uint64(len(data)) || d.checksum != md5.Sum(data) {
+		t.Fatalf("delta has size %v and checksum %x", d.size, d.checksum)
+	}
+
+	dest := &memFile{}
+	written := uint64(0)
+	w := newDeltaWriter(io.NewSectionReader(bytes.NewReader(basis), 0, int64(len(basis))), bs, dest, &written)
+	w.setStream(uint64(d.stream.Size()))
+	w.markDelta()
+	if got := w.transferSize(d.size); got != uint64(d.stream.Size()) {
+		t.Errorf("transferSize() = %v, want %v", got, d.stream.Size())
+	}
+	// Chunks are written one at a time, so operations are split.
+	chunk := make([]byte, 1024)
+	for off := int64(0); off < d.stream.Size(); off += 1024 {
+		n, err := d.stream.ReadAt(chunk, off)
+		if err != nil && err != io.EOF {
+			t.Fatalf("ReadAt(%v) error = %v", off, err)
+		}
+		if _, err := w.Write(chunk[:n]); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+	}
+	if err := w.verify(d.checksum); err != nil {
+		t.Errorf("verify() error = %v", err)
+	}
+	return dest, d
+}
+
+func TestDeltaRoundTrip(t *testing.T) {
+	basis := randomBytes(600*1024+17, 1)
+	tests := map[string]struct {
+		data      []byte
+		minCopied int
+	}{
+		"unchanged": {data: basis, minCopied: len(basis) - 1024},
+		"modified":  {data: modify(basis), minCopied: 500 * 1024},
+		"unrelated": {data: randomBytes(300*1024, 2)},
+		"short":     {data: []byte("short")},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			dest, d := rebuild(t, basis, tc.data)
+			if !bytes.Equal(dest.data, tc.data) {
+				t.Errorf("rebuilt %v bytes that differ from the %v bytes of the file", len(dest.data), len(tc.data))
+			}
+			if d.copied < uint64(tc.minCopied) {
+				t.Errorf("copied %v bytes, want at least %v", d.copied, tc.minCopied)
+			}
+			if tc.minCopied > 0 && d.stream.Size() > int64(len(tc.data)-tc.minCopied)+1024 {
+				t.Errorf("delta has %v bytes for a %v byte file", d.stream.Size(), len(tc.data))
+			}
+		})
+	}
+}
+
+func TestDeltaRequestLimit(t *testing.T) {
+	req := newDeltaRequest([]uint16{0}, func(uint16) int64 { return 10 * 1024 })
+	msg := &clientSignatures{blockSize: 1024, blocks: maxSignatures, first: maxSignatures - signaturesPerMsg}
+	msg.signatures = make([]blockSignature, signaturesPerMsg)
+	if req.add(msg) {
+		t.Fatalf("add() of signatures beyond the file started the response")
+	}
+	if n := len(req.files[0].received); n != 0 {
+		t.Errorf("kept %v signatures beyond the file", n)
+	}
+	if req.add(&clientSignatures{blockSize: 1, blocks: 1, signatures: msg.signatures[:1]}) {
+		t.Errorf("add() accepted signatures of tiny blocks")
+	}
+
+	msg.first = 0
+	if !req.add(msg) {
+		t.Fatalf("add() of the signatures of the file didn't start the response")
+	}
+	if n := len(req.signatures(0).signatures); n != 11 {
+		t.Errorf("kept %v signatures, want 11", n)
+	}
+}
+
+func TestDeltaWriterPlain(t *testing.T) {
+	// Unmarked payloads are the file, even if it looks like a delta.
+	looksLikeDelta := append([]byte(deltaMagic), deltaLiteral, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 'x')
+	for _, data := range [][]byte{[]byte("short"), randomBytes(5000, 3), looksLikeDelta} {
+		dest := &memFile{}
+		written := uint64(0)
+		w := newDeltaWriter(io.NewSectionReader(bytes.NewReader(nil), 0, 0), 1024, dest, &written)
+		w.transferSize(uint64(len(data)))
+		for i := 0; i < len(data); i += 3 {
+			w.Write(data[i:min(i+3, len(data))])
+		}
+		if err := w.verify(md5.Sum(data)); err != nil {
+			t.Errorf("verify() error = %v", err)
+		}
+		if !bytes.Equal(dest.data, data) {
+			t.Errorf("wrote %v bytes that differ from the %v bytes of the file", len(dest.data), len(data))
+		}
+	}
+}
+
+func TestDeltaWriterErrors(t *testing.T) {
+	written := uint64(0)
+	w := newDeltaWriter(io.NewSectionReader(bytes.NewReader(nil), 0, 0), 1024, &memFile{}, &written)
+	w.transferSize(1024)
+	w.markDelta()
+	op := []byte(deltaMagic)
+	op = append(op, deltaCopy, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1)
+	if _, err := w.Write(op); err == nil {
+		t.Errorf("Write() copied a block that isn't in the local copy")
+	}
+	if err := w.verify([16]byte{}); err == nil {
+		t.Errorf("verify() = nil after a failed write")
+	}
+
+	w = newDeltaWriter(io.NewSectionReader(bytes.NewReader(nil), 0, 0), 1024, &memFile{}, &written)
+	w.markDelta()
+	if _, err := w.Write([]byte("not a delta")); err == nil {
+		t.Errorf("Write() accepted a marked payload without magic")
+	}
+}
+
+func TestDeltaTransfer(t *testing.T) {
+	basis := randomBytes(800*1024+100, 4)
+	data := modify(basis)
+	tests := map[string]struct {
+		options []Compression
+		fec     uint8
+	}{
+		"delta":       {},
+		"compression": {options: []Compression{Deflate}},
+		"fec":         {fec: 4},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			network := NewMemNetwork()
+			stop := startMemServer(t, network, ":2020", map[string][]byte{"file": data, "other": basis[:100*1024]})
+			defer stop()
+
+			conn := network.NewConnection()
+			conn.LossSim(NewMarkovLossSimulator(0.02, 0.3, NewRand(1, 4)))
+			client := &Client{Conn: conn, Compression: tc.options, FEC: tc.fec}
+			files := []FileRequest{
+				{Name: "file", Basis: io.NewSectionReader(bytes.NewReader(basis), 0, int64(len(basis))), Dest: &memFile{}},
+				{Name: "other", Dest: &memFile{}},
+			}
+			reqs, err := client.RequestFiles("localhost:2020", files)
+			if err != nil {
+				t.Fatalf("RequestFiles() error = %v", err)
+			}
+			for i, r := range reqs {
+				if err := r.Wait(); err != nil {
+					t.Fatalf("file %v: Wait() error = %v", i, err)
+				}
+			}
+			if got := files[0].Dest.(*memFile).data; !bytes.Equal(got, data) {
+				t.Errorf("rebuilt %v bytes that differ from the %v bytes of the file", len(got), len(data))
+			}
+			if got := files[1].Dest.(*memFile).data; !bytes.Equal(got, basis[:100*1024]) {
+				t.Errorf("received %v bytes that differ from the %v sent bytes", len(got), 100*1024)
+			}
+			if reqs[0].Size() != uint64(len(data)) {
+				t.Errorf("Size() = %v, want %v", reqs[0].Size(), len(data))
+			}
+			if received := client.Stats().BytesReceived; received > uint64(len(data))/2 {
+				t.Errorf("received %v bytes for files of %v and %v bytes", received, len(data), 100*1024)
+			}
+		})
+	}
+}
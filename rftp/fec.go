@@ -0,0 +1,154 @@
+package rftp
+
+import "time"
+
+// fecRepairWait is how long a client waits for the repair packet of a group
+// before it re-requests a missing chunk of the group.
+const fecRepairWait = 100 * time.Millisecond
+
+// fecEncoder computes the repair packets of a file, one for each group of
+// groupSize consecutive chunks.
+type fecEncoder struct {
+	groupSize int
+	repair    *serverRepair
+}
+
+func newFECEncoder(groupSize int) *fecEncoder {
+	if groupSize < 1 || groupSize > 255 {
+		return nil
+	}
+	return &fecEncoder{groupSize: groupSize}
+}
+
+// add adds a chunk to the current group and returns the repair packet of the
+// group if the chunk completes it.
+func (e *fecEncoder) add(p *serverPayload) *serverRepair {
+	if e.repair == nil {
+		e.repair = &serverRepair{fileIndex: p.fileIndex, offset: p.offset, data: make([]byte, 1024)}
+	}
+	xorInto(e.repair.data, p.data)
+	e.repair.lengthXOR ^= uint16(len(p.data))
+	e.repair.count++
+	if int(e.repair.count) < e.groupSize {
+		return nil
+	}
+	return e.flush()
+}
+
+// flush returns the repair packet of the incomplete group at the end of a file.
+func (e *fecEncoder) flush() *serverRepair {
+	r := e.repair
+	e.repair = nil
+	return r
+}
+
+// fecDecoder keeps the chunks of the groups that are not complete yet and
+// reconstructs the missing chunk of a group from its repair packet. The groups
+// begin at the first requested chunk, like on the server.
+type fecDecoder struct {
+	groupSize int
+	start     uint64
+	pruned    uint64 // groups before pruned are complete
+	chunks    map[uint64][]byte
+	repairs   map[uint64]*serverRepair // by the offset of the group
+	gaps      map[uint64]time.Time     // when a chunk was noticed missing
+}
+
+func newFECDecoder(groupSize int, start uint64) *fecDecoder {
+	return &fecDecoder{
+		groupSize: groupSize,
+		start:     start,
+		pruned:    start,
+		chunks:    make(map[uint64][]byte),
+		repairs:   make(map[uint64]*serverRepair),
+		gaps:      make(map[uint64]time.Time),
+	}
+}
+
+func (d *fecDecoder) group(offset uint64) uint64 {
+	k := uint64(d.groupSize)
+	return d.start + (offset-d.start)/k*k
+}
+
+// received records a chunk and returns the chunk of its group that can be
+// reconstructed now, if any.
+func (d *fecDecoder) received(p *serverPayload) *serverPayload {
+	if p.offset < d.pruned {
+		return nil
+	}
+	d.chunks[p.offset] = p.data
+	delete(d.gaps, p.offset)
+	return d.reconstruct(d.group(p.offset))
+}
+
+// addRepair records a repair packet and returns the chunk it reconstructs, if
+// any. Repair packets of other group sizes are ignored.
+func (d *fecDecoder) addRepair(r *serverRepair) *serverPayload {
+	if r.offset < d.pruned || d.group(r.offset) != r.offset || int(r.count) > d.groupSize || len(r.data) > 1024 {
+		return nil
+	}
+	d.repairs[r.offset] = r
+	return d.reconstruct(r.offset)
+}
+
+func (d *fecDecoder) reconstruct(group uint64) *serverPayload {
+	r, ok := d.repairs[group]
+	if !ok {
+		return nil
+	}
+	missing := []uint64{}
+	for o := group; o < group+uint64(r.count); o++ {
+		if _, ok := d.chunks[o]; !ok {
+			missing = append(missing, o)
+		}
+	}
+	if len(missing) != 1 {
+		return nil
+	}
+	data := make([]byte, 1024)
+	copy(data, r.data)
+	length := r.lengthXOR
+	for o := group; o < group+uint64(r.count); o++ {
+		if o != missing[0] {
+			xorInto(data, d.chunks[o])
+			length ^= uint16(len(d.chunks[o]))
+		}
+	}
+	if length > 1024 {
+		return nil
+	}
+	return &serverPayload{fileIndex: r.fileIndex, offset: missing[0], data: data[:length]}
+}
+
+// prune drops the groups before the group of head, all their chunks arrived.
+func (d *fecDecoder) prune(head uint64) {
+	for end := d.group(head); d.pruned < end; d.pruned++ {
+		delete(d.chunks, d.pruned)
+		delete(d.gaps, d.pruned)
+		delete(d.repairs, d.pruned)
+	}
+}
+
+// missing notes that a chunk is missing.
+func (d *fecDecoder) missing(offset uint64, now time.Time) {
+	if _, ok := d.gaps[offset]; !ok {
+		d.gaps[offset] = now
+	}
+}
+
+// waiting returns whether a missing chunk may still be reconstructed, because
+// the repair packet of its group did not arrive yet. Such chunks are not
+// re-requested before fecRepairWait passed.
+func (d *fecDecoder) waiting(offset uint64, now time.Time) bool {
+	if _, ok := d.repairs[d.group(offset)]; ok {
+		return false
+	}
+	t, ok := d.gaps[offset]
+	return ok && now.Sub(t) < fecRepairWait
+}
+
+func xorInto(dst, src []byte) {
+	for i := range src {
+		dst[i] ^= src[i]
+	}
+}
@@ -0,0 +1,148 @@
+package rftp
+
+import (
+	"bytes"
+	"crypto/md5"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+)
+
+func TestFECReconstruct(t *testing.T) {
+	data := make([]byte, 10*1024+100)
+	rand.New(rand.NewSource(1)).Read(data)
+	ps := chunks(data)
+
+	for _, lost := range []int{0, 3, 7, 8, 10} {
+		enc := newFECEncoder(4)
+		repairs := []*serverRepair{}
+		for i, p := range ps {
+			if r := enc.add(p); r != nil {
+				repairs = append(repairs, r)
+			} else if i == len(ps)-1 {
+				repairs = append(repairs, enc.flush())
+			}
+		}
+		if len(repairs) != 3 {
+			t.Fatalf("got %v repair packets, want 3", len(repairs))
+		}
+
+		dec := newFECDecoder(4, 0)
+		for i, p := range ps {
+			if i == lost {
+				continue
+			}
+			if rec := dec.received(p); rec != nil {
+				t.Fatalf("lost %v: reconstructed %v before repair packets arrived", lost, rec.offset)
+			}
+		}
+		var got *serverPayload
+		for _, r := range repairs {
+			if p := dec.addRepair(r); p != nil {
+				got = p
+			}
+		}
+		if got == nil || got.offset != uint64(lost) || !bytes.Equal(got.data, ps[lost].data) {
+			t.Errorf("lost %v: reconstructed %v, want chunk %v", lost, got, lost)
+		}
+	}
+}
+
+func TestFECNotRepairable(t *testing.T) {
+	ps := chunks(bytes.Repeat([]byte("rft"), 4*1024))
+	enc := newFECEncoder(4)
+	var repair *serverRepair
+	for _, p := range ps[:4] {
+		repair = enc.add(p)
+	}
+
+	dec := newFECDecoder(4, 0)
+	dec.received(ps[0])
+	dec.received(ps[3])
+	if p := dec.addRepair(repair); p != nil {
+		t.Errorf("reconstructed chunk %v with two chunks lost", p.offset)
+	}
+	if p := dec.received(ps[1]); p == nil || p.offset != 2 {
+		t.Errorf("received() = %v, want chunk 2", p)
+	}
+	if p := newFECDecoder(8, 0).addRepair(repair); p != nil {
+		t.Errorf("accepted repair packet of another group size")
+	}
+}
+
+func TestFECTransfer(t *testing.T) {
+	data := make([]byte, 300*1024+10)
+	rand.New(rand.NewSource(2)).Read(data)
+
+	for _, dest := range []bool{false, true} {
+		network := NewMemNetwork()
+		stop := startMemServer(t, network, ":2020", map[string][]byte{"file": data})
+
+		conn := network.NewConnection()
+		conn.LossSim(NewMarkovLossSimulator(0.02, 0.9, NewRand(1, 3)))
+		client := &Client{Conn: conn, FEC: 8}
+		req := FileRequest{Name: "file"}
+		file := &memFile{}
+		if dest {
+			req.Dest = file
+		}
+		reqs, err := client.RequestFiles("localhost:2020", []FileRequest{req})
+		if err != nil {
+			t.Fatalf("RequestFiles() error = %v", err)
+		}
+		if dest {
+			err = reqs[0].Wait()
+		} else {
+			file.data, err = ioutil.ReadAll(reqs[0])
+			if err == nil {
+				err = reqs[0].err()
+			}
+		}
+		if err != nil {
+			t.Errorf("dest %v: error = %v", dest, err)
+		}
+		if md5.Sum(file.data) != md5.Sum(data) {
+			t.Errorf("dest %v: received %v bytes that differ from the %v sent bytes", dest, len(file.data), len(data))
+		}
+		if s := client.Stats(); s.RepairedChunks == 0 {
+			t.Errorf("dest %v: no chunks repaired, %v retransmissions", dest, s.Retransmissions)
+		}
+		stop()
+	}
+}
+
+func TestFECRepairedCount(t *testing.T) {
+	data := make([]byte, 4*1024)
+	rand.New(rand.NewSource(4)).Read(data)
+	ps := chunks(data)
+	enc := newFECEncoder(4)
+	var repair *serverRepair
+	for _, p := range ps {
+		repair = enc.add(p)
+	}
+
+	for _, lost := range []int{-1, 2} {
+		f := newFileResponseAt("file", 0, &memFile{}, 0)
+		f.fec = newFECDecoder(4, 0)
+		// The repair packet is handed over while the chunks before it still
+		// wait to be received.
+		for i, p := range ps {
+			if i != lost {
+				f.pc <- p
+			}
+		}
+		f.rc <- repair
+		go f.write(make(chan uint16, 1))
+		f.mc <- &serverMetaData{size: uint64(len(data)), checkSum: md5.Sum(data)}
+		if err := f.Wait(); err != nil {
+			t.Fatalf("lost %v: Wait() error = %v", lost, err)
+		}
+		want := uint64(0)
+		if lost >= 0 {
+			want = 1
+		}
+		if got := f.Repaired(); got != want {
+			t.Errorf("lost %v: Repaired() = %v, want %v", lost, got, want)
+		}
+	}
+}
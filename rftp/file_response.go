@@ -4,12 +4,14 @@ import (
 	"bytes"
 	"container/heap"
 	"crypto/md5"
+	"errors"
 	"fmt"
 	"hash"
 	"io"
-	"log"
+	"log/slog"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -19,6 +21,7 @@ type FileResponse struct {
 
 	mc chan *serverMetaData
 	pc chan *serverPayload
+	rc chan *serverRepair
 	cc chan struct{}
 
 	preader       *io.PipeReader
@@ -27,22 +30,104 @@ type FileResponse struct {
 	maxBufferSize int
 	resendEntries map[uint64]struct{}
 	rerequested   map[uint64]time.Time
+	clock         Clock
+	logger        *slog.Logger
 	outOfOrder    map[uint64]struct{}
 	head          uint64
 	metadata      bool
 	lock          sync.Mutex
 	hasher        hash.Hash
 
+	// dest is set, if chunks are written directly to their position in dest
+	// instead of being delivered in order through the pipe.
+	dest     io.WriterAt
+	received *bitmap
+	finished chan struct{}
+	done     bool
+	written  uint64
+
+	// fec is set, if the server sends repair packets.
+	fec *fecDecoder
+	// blocks decompresses the chunks of compressed files before they are
+	// received.
+	blocks *blockDecoder
+	// want is the checksum the file was requested by, if any.
+	want *[16]byte
+	// delta is set, if the file is rebuilt from its delta and a local copy.
+	// The chunks then carry the delta and are written to it in order.
+	delta *deltaWriter
+
+	retransmissions uint64
+	duplicates      uint64
+	repaired        uint64
+
 	size     uint64
 	chunks   uint64
 	checksum [16]byte
 	Err      error
 }
 
+// Size returns the size of the file, or of the range, or 0 until its
+// metadata arrived. It may be called while the file is received.
 func (f *FileResponse) Size() uint64 {
+	if f.delta != nil {
+		return f.delta.fileSize()
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
 	return f.size
 }
 
+// Received returns the number of bytes that were delivered so far, either to
+// the reader or to the destination of the response.
+func (f *FileResponse) Received() uint64 {
+	return atomic.LoadUint64(&f.written)
+}
+
+// err returns Err, which Read sets when the checksum does not match.
+func (f *FileResponse) err() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.Err
+}
+
+// Retransmissions returns the number of chunks the client re-requested for
+// this file so far.
+func (f *FileResponse) Retransmissions() uint64 {
+	return atomic.LoadUint64(&f.retransmissions)
+}
+
+// Duplicates returns the number of chunks of this file that were received
+// more than once.
+func (f *FileResponse) Duplicates() uint64 {
+	return atomic.LoadUint64(&f.duplicates)
+}
+
+// Repaired returns the number of chunks of this file that were reconstructed
+// from repair packets.
+func (f *FileResponse) Repaired() uint64 {
+	return atomic.LoadUint64(&f.repaired)
+}
+
+// buffered returns the number of chunks that are held back until the chunks
+// before them arrive.
+func (f *FileResponse) buffered() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.buffer.Len()
+}
+
+// Wait blocks until the transfer of the file is finished and returns the
+// error of the response. It verifies the checksum of responses that write to
+// a destination if it implements io.ReaderAt. Responses without destination
+// have to be read concurrently, otherwise Wait blocks forever.
+func (f *FileResponse) Wait() error {
+	<-f.finished
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.Err
+}
+
 func newFileResponse(name string, index uint16) *FileResponse {
 	r, w := io.Pipe()
 
@@ -52,6 +137,7 @@ func newFileResponse(name string, index uint16) *FileResponse {
 
 		mc: make(chan *serverMetaData),
 		pc: make(chan *serverPayload, 1024*1024),
+		rc: make(chan *serverRepair, 64*1024),
 		cc: make(chan struct{}),
 
 		preader:       r,
@@ -60,15 +146,36 @@ func newFileResponse(name string, index uint16) *FileResponse {
 		maxBufferSize: 10 * 1024,
 		resendEntries: make(map[uint64]struct{}),
 		rerequested:   make(map[uint64]time.Time),
+		clock:         systemClock{},
+		logger:        silentLogger,
 		hasher:        md5.New(),
 
 		outOfOrder: make(map[uint64]struct{}),
+		finished:   make(chan struct{}),
 	}
 }
 
+// newFileResponseAt returns a FileResponse that writes each chunk to dest at
+// offset*1024 as soon as it arrives. The chunks before offset are expected to
+// be present in dest already.
+func newFileResponseAt(name string, index uint16, dest io.WriterAt, offset uint64) *FileResponse {
+	f := newFileResponse(name, index)
+	f.dest = dest
+	f.received = &bitmap{}
+	f.head = offset
+	f.written = offset * 1024
+	return f
+}
+
 func (f *FileResponse) Read(p []byte) (n int, err error) {
+	if f.dest != nil || f.delta != nil {
+		return 0, errors.New("file is written to its destination, use Wait instead")
+	}
 	n, readErr := f.preader.Read(p)
 	_, hashErr := f.hasher.Write(p[:n])
+	// Don't take the lock here, drainBuffer holds it while writing to the
+	// pipe.
+	atomic.AddUint64(&f.written, uint64(n))
 	if readErr == io.EOF {
 		if !bytes.Equal(f.checksum[:], f.hasher.Sum(nil)[:16]) {
 			f.lock.Lock()
@@ -87,6 +194,7 @@ func (f *FileResponse) Read(p []byte) (n int, err error) {
 }
 
 type resendData struct {
+	done       bool
 	started    bool
 	metadata   bool
 	head       uint64
@@ -97,6 +205,15 @@ type resendData struct {
 func (f *FileResponse) getResendEntries(max int) *resendData {
 	f.lock.Lock()
 	defer f.lock.Unlock()
+	if f.done {
+		return &resendData{
+			done:       true,
+			started:    true,
+			metadata:   f.metadata,
+			head:       f.head,
+			bufferSize: f.getMaxTransmissionRate(),
+		}
+	}
 	res := []*resendEntry{}
 	// TODO: make sort faster? keep it sorted? Check loss of precision when
 	// converting uint64 to int?
@@ -107,26 +224,49 @@ func (f *FileResponse) getResendEntries(max int) *resendData {
 		i++
 	}
 	sort.Ints(entries)
+	now := f.clock.Now()
+	request := func(offset uint64) {
+		if t, ok := f.rerequested[offset]; !ok || since(f.clock, t) > 500*time.Millisecond {
+			if debugEnabled(f.logger) {
+				f.logger.Debug("re-requesting chunk", "file", f.index, "offset", offset)
+			}
+			f.rerequested[offset] = f.clock.Now()
+			atomic.AddUint64(&f.retransmissions, 1)
+			res = append(res, &resendEntry{
+				fileIndex: f.index,
+				offset:    offset,
+				length:    1,
+			})
+		}
+	}
 	for _, offset := range entries {
 		if len(res) > max {
 			break
 		}
+		if f.fec != nil && f.fec.waiting(uint64(offset), now) {
+			continue
+		}
+		// The missing chunks of partly received blocks are requested below,
+		// the other offsets of such blocks are not used.
+		if f.blocks != nil && f.blocks.collecting(uint64(offset)) {
+			continue
+		}
 		if _, ok := f.outOfOrder[uint64(offset)]; !ok {
-			if t, ok := f.rerequested[uint64(offset)]; !ok || time.Since(t) > 500*time.Millisecond {
-				log.Printf("re-requesting file %v at offset %v\n", f.index, offset)
-				f.rerequested[uint64(offset)] = time.Now()
-				res = append(res, &resendEntry{
-					fileIndex: f.index,
-					offset:    uint64(offset),
-					length:    1,
-				})
+			request(uint64(offset))
+		}
+	}
+	if f.blocks != nil {
+		for _, offset := range f.blocks.missing() {
+			if len(res) > max {
+				break
 			}
+			request(offset)
 		}
 	}
 
 	if !f.metadata {
-		if t, ok := f.rerequested[uint64(f.head)]; !ok || time.Since(t) > 500*time.Millisecond {
-			f.rerequested[uint64(f.head)] = time.Now()
+		if t, ok := f.rerequested[uint64(f.head)]; !ok || since(f.clock, t) > 500*time.Millisecond {
+			f.rerequested[uint64(f.head)] = f.clock.Now()
 			res = append(res, &resendEntry{
 				fileIndex: f.index,
 				offset:    f.head,
@@ -158,7 +298,7 @@ func (f *FileResponse) getResendEntries(max int) *resendData {
 	//		}
 	//	}
 	return &resendData{
-		started:    (f.head > 0) || f.buffer.Len() > 0,
+		started:    (f.head > 0) || f.buffer.Len() > 0 || (f.received != nil && f.received.count > 0),
 		metadata:   f.metadata,
 		head:       f.head,
 		res:        res,
@@ -167,6 +307,10 @@ func (f *FileResponse) getResendEntries(max int) *resendData {
 }
 
 func (f *FileResponse) getMaxTransmissionRate() int {
+	if f.dest != nil {
+		// Chunks are not buffered, so there is always enough space.
+		return f.maxBufferSize
+	}
 	if f.maxBufferSize > f.buffer.Len() {
 		return f.maxBufferSize - f.buffer.Len()
 	} else {
@@ -178,16 +322,25 @@ func (f *FileResponse) getMaxTransmissionRate() int {
 }
 
 func (f *FileResponse) write(done chan<- uint16) {
-	log.Printf("Start processing file %v\n", f.index)
+	f.logger.Debug("start processing file", "file", f.index)
 	defer func() {
+		if f.dest != nil {
+			f.verify()
+		}
+		if f.delta != nil {
+			f.verifyDelta()
+		}
+		f.lock.Lock()
+		f.done = true
+		f.lock.Unlock()
+		close(f.finished)
 		done <- f.index
 		f.pwriter.Close()
-		log.Printf("Finished processing file %v\n", f.index)
+		f.logger.Debug("finished processing file", "file", f.index, "err", f.err())
 	}()
 	for {
 		select {
 		case metadata := <-f.mc:
-			log.Printf("metadata: %v\n", metadata)
 			f.lock.Lock()
 			if metadata.status != noErr {
 				f.Err = fmt.Errorf("Server returned error for file %d: status %s",
@@ -195,72 +348,167 @@ func (f *FileResponse) write(done chan<- uint16) {
 				f.lock.Unlock()
 				return
 			}
+			if f.want != nil && metadata.checkSum != *f.want {
+				f.Err = fmt.Errorf("file %d has checksum %x instead of the requested %x",
+					f.index, metadata.checkSum, *f.want)
+				f.lock.Unlock()
+				return
+			}
 			f.size = metadata.size
+			if f.delta != nil {
+				f.size = f.delta.transferSize(metadata.size)
+			}
 			f.chunks = f.size / 1024
 			if f.size%1024 > 0 {
 				f.chunks++
 			}
-			log.Printf("fileresponse received metadata: size: %v\n", f.chunks)
+			f.logger.Debug("received metadata", "file", f.index, "size", f.size, "chunks", f.chunks)
 			f.checksum = metadata.checkSum
 			f.metadata = true
 			f.lock.Unlock()
 
 		case payload := <-f.pc:
-			log.Printf("fileresponse received payload %v\n", payload.offset)
-			if payload.offset == f.head {
-				if f.metadata && payload.offset == f.chunks-1 {
-					log.Printf("writing last chunk")
-					lastSize := f.size - (f.chunks-1)*1024
-					f.pwriter.Write(payload.data[:lastSize])
-				} else {
-					f.pwriter.Write(payload.data)
-				}
-				f.lock.Lock()
-				delete(f.resendEntries, f.head)
-				f.head++
-				f.lock.Unlock()
-			} else if payload.offset > f.head {
-				if payload.offset > f.head {
-					f.lock.Lock()
-					if _, ok := f.outOfOrder[payload.offset]; !ok {
-						heap.Push(f.buffer, payload)
-						f.outOfOrder[payload.offset] = struct{}{}
-						for i := f.head; i < payload.offset; i++ {
-							f.resendEntries[i] = struct{}{}
-						}
-					}
-					f.lock.Unlock()
+			if !f.receive(payload) {
+				return
+			}
+
+		case repair := <-f.rc:
+			// The chunks that arrived before the repair packet are received
+			// first, so that it only repairs the chunks that are missing.
+			if !f.receivePending() {
+				return
+			}
+			f.lock.Lock()
+			p := f.fec.addRepair(repair)
+			f.lock.Unlock()
+			if p != nil {
+				atomic.AddUint64(&f.repaired, 1)
+				if !f.receive(p) {
+					return
 				}
 			}
-			f.drainBuffer()
 
 		case <-f.cc:
 			f.drainBuffer()
+			f.lock.Lock()
 			f.Err = fmt.Errorf("Write canceled")
+			f.lock.Unlock()
 			return
 		}
 
-		log.Printf("file %v at head %v and buffer size %v\n", f.index, f.head, f.buffer.Len())
+		if debugEnabled(f.logger) {
+			f.logger.Debug("advanced file", "file", f.index, "head", f.head, "buffered", f.buffer.Len())
+		}
 		if f.metadata && f.head >= f.chunks && f.buffer.Len() == 0 {
 			return
 		}
 	}
 }
 
+// receivePending receives the chunks that wait in pc. It returns false, if a
+// chunk could not be written and the response failed.
+func (f *FileResponse) receivePending() bool {
+	for {
+		select {
+		case payload := <-f.pc:
+			if !f.receive(payload) {
+				return false
+			}
+		default:
+			return true
+		}
+	}
+}
+
+// receive processes a chunk. It returns false, if the chunk could not be
+// written and the response failed.
+func (f *FileResponse) receive(payload *serverPayload) bool {
+	if debugEnabled(f.logger) {
+		f.logger.Debug("received payload", "file", f.index, "offset", payload.offset)
+	}
+	if f.dest != nil {
+		if err := f.writeAt(payload); err != nil {
+			f.lock.Lock()
+			f.Err = fmt.Errorf("Failed to write chunk %v: %v", payload.offset, err)
+			f.lock.Unlock()
+			return false
+		}
+	} else if payload.offset == f.head {
+		if f.metadata && payload.offset == f.chunks-1 {
+			f.logger.Debug("writing last chunk", "file", f.index)
+			lastSize := f.size - (f.chunks-1)*1024
+			f.out().Write(payload.data[:lastSize])
+		} else {
+			f.out().Write(payload.data)
+		}
+		f.lock.Lock()
+		delete(f.resendEntries, f.head)
+		f.head++
+		f.lock.Unlock()
+	} else if payload.offset > f.head {
+		f.lock.Lock()
+		if _, ok := f.outOfOrder[payload.offset]; !ok {
+			heap.Push(f.buffer, payload)
+			f.outOfOrder[payload.offset] = struct{}{}
+			for i := f.head; i < payload.offset; i++ {
+				f.missing(i)
+			}
+		} else {
+			atomic.AddUint64(&f.duplicates, 1)
+		}
+		f.lock.Unlock()
+	} else {
+		atomic.AddUint64(&f.duplicates, 1)
+	}
+	f.drainBuffer()
+
+	if f.fec == nil {
+		return true
+	}
+	f.lock.Lock()
+	p := f.fec.received(payload)
+	f.fec.prune(f.head)
+	f.lock.Unlock()
+	if p != nil {
+		if debugEnabled(f.logger) {
+			f.logger.Debug("repaired chunk", "file", f.index, "offset", p.offset)
+		}
+		atomic.AddUint64(&f.repaired, 1)
+		return f.receive(p)
+	}
+	return true
+}
+
+// missing marks a chunk for re-requesting. It has to be called with the lock
+// held.
+func (f *FileResponse) missing(offset uint64) {
+	f.resendEntries[offset] = struct{}{}
+	if f.fec != nil {
+		f.fec.missing(offset, f.clock.Now())
+	}
+}
+
+// out receives the chunks in order.
+func (f *FileResponse) out() io.Writer {
+	if f.delta != nil {
+		return f.delta
+	}
+	return f.pwriter
+}
+
 func (f *FileResponse) drainBuffer() {
 	f.lock.Lock()
 	defer f.lock.Unlock()
 	top := f.buffer.Top()
-	log.Printf("buffer top: %v, head: %v\n", top, f.head)
 	for top <= f.head && f.buffer.Len() > 0 {
 		payload := heap.Pop(f.buffer).(*serverPayload)
 		if top == f.head {
 			if f.metadata && payload.offset == f.chunks-1 {
-				log.Printf("writing last chunk")
+				f.logger.Debug("writing last chunk", "file", f.index)
 				lastSize := f.size - (f.chunks-1)*1024
-				f.pwriter.Write(payload.data[:lastSize])
+				f.out().Write(payload.data[:lastSize])
 			} else {
-				f.pwriter.Write(payload.data)
+				f.out().Write(payload.data)
 			}
 			delete(f.resendEntries, f.head)
 			f.head++
@@ -268,3 +516,77 @@ func (f *FileResponse) drainBuffer() {
 		top = f.buffer.Top()
 	}
 }
+
+// writeAt writes a chunk directly to its position in the destination. Chunks
+// may arrive in any order, only the missing chunks below the highest received
+// chunk are re-requested.
+func (f *FileResponse) writeAt(payload *serverPayload) error {
+	// Only this goroutine modifies head and received, so they can be read
+	// without holding the lock.
+	if payload.offset < f.head || f.received.get(payload.offset) {
+		atomic.AddUint64(&f.duplicates, 1)
+		if debugEnabled(f.logger) {
+			f.logger.Debug("dropping duplicate chunk", "file", f.index, "offset", payload.offset)
+		}
+		return nil
+	}
+
+	data := payload.data
+	if f.metadata && payload.offset == f.chunks-1 {
+		lastSize := f.size - (f.chunks-1)*1024
+		if uint64(len(data)) > lastSize {
+			data = data[:lastSize]
+		}
+	}
+	if _, err := f.dest.WriteAt(data, int64(payload.offset*1024)); err != nil {
+		return err
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.received.set(payload.offset)
+	atomic.AddUint64(&f.written, uint64(len(data)))
+	delete(f.resendEntries, payload.offset)
+	for i := f.head; i < payload.offset; i++ {
+		if !f.received.get(i) {
+			f.missing(i)
+		}
+	}
+	for f.received.get(f.head) {
+		f.head++
+	}
+	return nil
+}
+
+// verifyDelta checks the file that was rebuilt from its delta.
+func (f *FileResponse) verifyDelta() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.Err != nil || !f.metadata {
+		return
+	}
+	f.Err = f.delta.verify(f.checksum)
+}
+
+// verify compares the checksum of the written file with the checksum sent by
+// the server. Destinations that can't be read from are not verified.
+func (f *FileResponse) verify() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.Err != nil || !f.metadata {
+		return
+	}
+	ra, ok := f.dest.(io.ReaderAt)
+	if !ok {
+		f.logger.Warn("can't verify file, destination is not readable", "file", f.index)
+		return
+	}
+	hasher := md5.New()
+	if _, err := io.Copy(hasher, io.NewSectionReader(ra, 0, int64(f.size))); err != nil {
+		f.Err = fmt.Errorf("Failed to read file for checksum validation: %v", err)
+		return
+	}
+	if !bytes.Equal(f.checksum[:], hasher.Sum(nil)[:16]) {
+		f.Err = fmt.Errorf("Checksum validation failed")
+	}
+}
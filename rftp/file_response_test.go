@@ -0,0 +1,124 @@
+package rftp
+
+import (
+	"bytes"
+	"crypto/md5"
+	"io"
+	"testing"
+)
+
+// memFile is an in-memory io.WriterAt and io.ReaderAt.
+type memFile struct {
+	data []byte
+}
+
+func (m *memFile) WriteAt(p []byte, off int64) (int, error) {
+	if end := int(off) + len(p); end > len(m.data) {
+		m.data = append(m.data, make([]byte, end-len(m.data))...)
+	}
+	copy(m.data[off:], p)
+	return len(p), nil
+}
+
+func (m *memFile) ReadAt(p []byte, off int64) (int, error) {
+	if off >= int64(len(m.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, m.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func chunks(data []byte) []*serverPayload {
+	ps := []*serverPayload{}
+	for off := 0; off*1024 < len(data); off++ {
+		end := (off + 1) * 1024
+		if end > len(data) {
+			end = len(data)
+		}
+		ps = append(ps, &serverPayload{offset: uint64(off), data: data[off*1024 : end]})
+	}
+	return ps
+}
+
+func TestFileResponseWriteAt(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 350)
+	ps := chunks(data)
+	tests := map[string]struct {
+		checksum [16]byte
+		wantErr  bool
+	}{
+		"valid":   {checksum: md5.Sum(data)},
+		"invalid": {checksum: md5.Sum(data[1:]), wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			dest := &memFile{}
+			f := newFileResponseAt("test", 0, dest, 0)
+			// unbuffered, so that each send waits until the previous chunk is
+			// processed
+			f.pc = make(chan *serverPayload)
+			done := make(chan uint16, 1)
+			go f.write(done)
+
+			f.mc <- &serverMetaData{size: uint64(len(data)), checkSum: tc.checksum}
+			f.pc <- ps[3]
+			f.pc <- ps[0]
+			f.pc <- ps[2]
+			f.pc <- ps[3]
+
+			rd := f.getResendEntries(140)
+			if rd.head != 1 || len(rd.res) != 1 || rd.res[0].offset != 1 {
+				t.Errorf("getResendEntries() = head %v, %v, want head 1 with resend entry 1", rd.head, rd.res)
+			}
+
+			// duplicates must not be written twice
+			f.pc <- ps[0]
+			f.pc <- ps[1]
+			err := f.Wait()
+			if (err != nil) != tc.wantErr {
+				t.Errorf("Wait() = %v, want error: %v", err, tc.wantErr)
+			}
+			if !bytes.Equal(dest.data, data) {
+				t.Errorf("destination contains %v bytes, want %v", len(dest.data), len(data))
+			}
+			if f.Received() != uint64(len(data)) {
+				t.Errorf("Received() = %v, want %v", f.Received(), len(data))
+			}
+		})
+	}
+}
+
+func TestFileResponseSizeConcurrent(t *testing.T) {
+	data := bytes.Repeat([]byte("size"), 1000)
+	f := newFileResponseAt("test", 0, &memFile{}, 0)
+	go f.write(make(chan uint16, 1))
+
+	// Progress is rendered while the file is received.
+	rendered := make(chan struct{})
+	go func() {
+		defer close(rendered)
+		for {
+			select {
+			case <-f.finished:
+				return
+			default:
+				f.Size()
+			}
+		}
+	}()
+	f.mc <- &serverMetaData{size: uint64(len(data)), checkSum: md5.Sum(data)}
+	for _, p := range chunks(data) {
+		f.pc <- p
+	}
+	if err := f.Wait(); err != nil {
+		t.Errorf("Wait() error = %v", err)
+	}
+	<-rendered
+	if got := f.Size(); got != uint64(len(data)) {
+		t.Errorf("Size() = %v, want %v", got, len(data))
+	}
+}
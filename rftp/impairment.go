@@ -0,0 +1,313 @@
+package rftp
+
+import (
+	"container/heap"
+	"log/slog"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// Impairment describes the network conditions that are applied to the packets
+// of one direction of a connection.
+type Impairment struct {
+	// Loss decides which packets are dropped. nil drops no packets.
+	Loss LossSimulator
+	// Delay is added to every packet. It is the one-way delay of the
+	// direction, applying it to both directions adds it twice to the round
+	// trip time.
+	Delay time.Duration
+	// Jitter is the maximum random deviation from Delay. Packets are reordered
+	// if the jitter is larger than the interval between them.
+	Jitter time.Duration
+	// Reorder is the probability that a packet is sent without Delay and thus
+	// overtakes the packets sent before it.
+	Reorder float64
+	// Duplicate is the probability that a packet is delivered twice.
+	Duplicate float64
+	// Corrupt is the probability that a random bit of a packet is flipped.
+	Corrupt float64
+	// Bandwidth limits the throughput to the given number of bytes per second.
+	// 0 means unlimited.
+	Bandwidth int
+	// QueueSize is the number of bytes that can wait for the bandwidth limited
+	// link. Packets that do not fit into the queue are dropped. 0 means
+	// unlimited.
+	QueueSize int
+	// Rand is the random source of the impairments. If nil, a source seeded
+	// with Seed is used, an independent one for each direction of a
+	// connection. It must not be shared with other impairments.
+	Rand *rand.Rand
+	Seed int64
+	// Clock is the clock of the delays and the bandwidth limit. If nil, the
+	// system clock is used.
+	Clock Clock
+}
+
+func (im Impairment) active() bool {
+	return im.Loss != nil || im.Delay > 0 || im.Jitter > 0 || im.Reorder > 0 ||
+		im.Duplicate > 0 || im.Corrupt > 0 || im.Bandwidth > 0
+}
+
+type datagram struct {
+	at   time.Time
+	seq  uint64
+	data []byte
+	addr net.Addr
+}
+
+// datagramQueue is a heap of datagrams ordered by delivery time.
+type datagramQueue []*datagram
+
+func (q datagramQueue) Len() int { return len(q) }
+func (q datagramQueue) Less(i, j int) bool {
+	if q[i].at.Equal(q[j].at) {
+		return q[i].seq < q[j].seq
+	}
+	return q[i].at.Before(q[j].at)
+}
+func (q datagramQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *datagramQueue) Push(x interface{}) { *q = append(*q, x.(*datagram)) }
+func (q *datagramQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	d := old[n-1]
+	*q = old[:n-1]
+	return d
+}
+
+// impairer applies an Impairment to a stream of packets and hands them to
+// deliver once they are due.
+type impairer struct {
+	im      Impairment
+	rng     *rand.Rand
+	clock   Clock
+	deliver func([]byte, net.Addr)
+
+	lock      sync.Mutex
+	queue     datagramQueue
+	seq       uint64
+	busyUntil time.Time
+
+	wakeup chan struct{}
+	done   chan struct{}
+}
+
+func newImpairer(im Impairment, deliver func([]byte, net.Addr)) *impairer {
+	i := &impairer{
+		im:      im,
+		rng:     im.Rand,
+		clock:   im.Clock,
+		deliver: deliver,
+		wakeup:  make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	if i.rng == nil {
+		i.rng = rand.New(rand.NewSource(im.Seed))
+	}
+	if i.clock == nil {
+		i.clock = systemClock{}
+	}
+	go i.run()
+	return i
+}
+
+func (i *impairer) process(data []byte, addr net.Addr) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	if i.im.Loss != nil && i.im.Loss.shouldDrop() {
+		return
+	}
+
+	// the caller may reuse the buffer
+	data = append([]byte(nil), data...)
+	if len(data) > 0 && i.rng.Float64() < i.im.Corrupt {
+		bit := i.rng.Intn(len(data) * 8)
+		data[bit/8] ^= 1 << uint(bit%8)
+	}
+
+	now := i.clock.Now()
+	at := now
+	if i.im.Bandwidth > 0 {
+		if i.busyUntil.Before(now) {
+			i.busyUntil = now
+		}
+		queued := i.busyUntil.Sub(now).Seconds() * float64(i.im.Bandwidth)
+		if i.im.QueueSize > 0 && int(queued)+len(data) > i.im.QueueSize {
+			return
+		}
+		transmission := float64(len(data)) / float64(i.im.Bandwidth)
+		i.busyUntil = i.busyUntil.Add(time.Duration(transmission * float64(time.Second)))
+		at = i.busyUntil
+	}
+
+	if i.rng.Float64() >= i.im.Reorder {
+		delay := i.im.Delay
+		if i.im.Jitter > 0 {
+			delay += time.Duration(i.rng.Int63n(2*int64(i.im.Jitter)+1)) - i.im.Jitter
+		}
+		if delay > 0 {
+			at = at.Add(delay)
+		}
+	}
+
+	copies := 1
+	if i.rng.Float64() < i.im.Duplicate {
+		copies = 2
+	}
+	for c := 0; c < copies; c++ {
+		heap.Push(&i.queue, &datagram{at: at, seq: i.seq, data: data, addr: addr})
+		i.seq++
+	}
+
+	select {
+	case i.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+// run delivers the queued packets when they are due.
+func (i *impairer) run() {
+	for {
+		due := []*datagram{}
+		var next <-chan time.Time
+
+		i.lock.Lock()
+		now := i.clock.Now()
+		for len(i.queue) > 0 && !i.queue[0].at.After(now) {
+			due = append(due, heap.Pop(&i.queue).(*datagram))
+		}
+		var timer Timer
+		if len(i.queue) > 0 {
+			timer = i.clock.NewTimer(i.queue[0].at.Sub(now))
+			next = timer.C()
+		}
+		i.lock.Unlock()
+
+		for _, d := range due {
+			i.deliver(d.data, d.addr)
+		}
+
+		select {
+		case <-i.wakeup:
+		case <-next:
+		case <-i.done:
+			return
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+func (i *impairer) stop() {
+	close(i.done)
+}
+
+// impairedConn is a net.PacketConn that impairs the sent and the received
+// packets. Read deadlines are not supported.
+type impairedConn struct {
+	net.PacketConn
+	send, receive *impairer
+
+	in      chan *datagram
+	readErr error
+	failed  chan struct{}
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// NewImpairedPacketConn wraps conn such that the packets written to it are
+// impaired according to send and the packets read from it according to receive.
+// Wrapped connections can be wrapped again to combine impairments.
+func NewImpairedPacketConn(conn net.PacketConn, send, receive Impairment) net.PacketConn {
+	return newImpairedConn(conn, send, receive, silentLogger)
+}
+
+// The streams of NewRand of the two directions of an impairedConn.
+const (
+	sendImpairStream = iota
+	receiveImpairStream
+)
+
+func newImpairedConn(conn net.PacketConn, send, receive Impairment, logger *slog.Logger) *impairedConn {
+	// With the same seed, the directions still draw different numbers.
+	if send.Rand == nil {
+		send.Rand = NewRand(send.Seed, sendImpairStream)
+	}
+	if receive.Rand == nil {
+		receive.Rand = NewRand(receive.Seed, receiveImpairStream)
+	}
+	c := &impairedConn{
+		PacketConn: conn,
+		in:         make(chan *datagram, 1024),
+		failed:     make(chan struct{}),
+		closed:     make(chan struct{}),
+	}
+	if send.active() {
+		c.send = newImpairer(send, func(data []byte, addr net.Addr) {
+			if _, err := conn.WriteTo(data, addr); err != nil {
+				logger.Warn("failed to send impaired packet", "err", err)
+			}
+		})
+	}
+	if receive.active() {
+		c.receive = newImpairer(receive, func(data []byte, addr net.Addr) {
+			select {
+			case c.in <- &datagram{data: data, addr: addr}:
+			case <-c.closed:
+			}
+		})
+		go c.read()
+	}
+	return c
+}
+
+func (c *impairedConn) read() {
+	for {
+		buf := make([]byte, 65536)
+		n, addr, err := c.PacketConn.ReadFrom(buf)
+		if err != nil {
+			c.readErr = err
+			close(c.failed)
+			return
+		}
+		c.receive.process(buf[:n], addr)
+	}
+}
+
+func (c *impairedConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	if c.receive == nil {
+		return c.PacketConn.ReadFrom(b)
+	}
+	select {
+	case d := <-c.in:
+		return copy(b, d.data), d.addr, nil
+	case <-c.failed:
+		return 0, nil, c.readErr
+	}
+}
+
+func (c *impairedConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if c.send == nil {
+		return c.PacketConn.WriteTo(b, addr)
+	}
+	c.send.process(b, addr)
+	return len(b), nil
+}
+
+func (c *impairedConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		if c.send != nil {
+			c.send.stop()
+		}
+		if c.receive != nil {
+			c.receive.stop()
+		}
+	})
+	return c.PacketConn.Close()
+}
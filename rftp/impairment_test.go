@@ -0,0 +1,125 @@
+package rftp
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestImpairedPacketConn(t *testing.T) {
+	tests := map[string]struct {
+		im        Impairment
+		wantCount int
+		wantDelay time.Duration
+		corrupt   bool
+	}{
+		"none":      {wantCount: 1},
+		"delay":     {im: Impairment{Delay: 50 * time.Millisecond}, wantCount: 1, wantDelay: 50 * time.Millisecond},
+		"duplicate": {im: Impairment{Duplicate: 1}, wantCount: 2},
+		"corrupt":   {im: Impairment{Corrupt: 1}, wantCount: 1, corrupt: true},
+		"loss":      {im: Impairment{Loss: NewTraceLossSimulator([]bool{true})}, wantCount: 0},
+		"bandwidth": {im: Impairment{Bandwidth: 10000}, wantCount: 1, wantDelay: 10 * time.Millisecond},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			receiver, err := net.ListenPacket("udp4", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer receiver.Close()
+			sender, err := net.ListenPacket("udp4", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn := NewImpairedPacketConn(sender, tc.im, Impairment{})
+			defer conn.Close()
+
+			msg := bytes.Repeat([]byte{0xaa}, 100)
+			start := time.Now()
+			if _, err := conn.WriteTo(msg, receiver.LocalAddr()); err != nil {
+				t.Fatal(err)
+			}
+
+			count := 0
+			buf := make([]byte, 1024)
+			for {
+				receiver.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+				n, _, err := receiver.ReadFrom(buf)
+				if err != nil {
+					break
+				}
+				if count == 0 && time.Since(start) < tc.wantDelay {
+					t.Errorf("packet arrived after %v, want at least %v", time.Since(start), tc.wantDelay)
+				}
+				if got := !bytes.Equal(buf[:n], msg); got != tc.corrupt {
+					t.Errorf("packet corrupted: %v, want %v", got, tc.corrupt)
+				}
+				count++
+			}
+			if count != tc.wantCount {
+				t.Errorf("received %v packets, want %v", count, tc.wantCount)
+			}
+		})
+	}
+}
+
+func TestImpairerClock(t *testing.T) {
+	clock := NewFakeClock(time.Unix(0, 0))
+	delivered := make(chan []byte, 1)
+	i := newImpairer(Impairment{Delay: time.Second, Clock: clock}, func(data []byte, _ net.Addr) {
+		delivered <- data
+	})
+	defer i.stop()
+
+	i.process([]byte{1}, nil)
+	clock.Advance(999 * time.Millisecond)
+	select {
+	case <-delivered:
+		t.Fatalf("packet delivered before the delay")
+	default:
+	}
+	clock.Advance(time.Millisecond)
+	select {
+	case <-delivered:
+	case <-time.After(time.Second):
+		t.Fatalf("packet not delivered after the delay")
+	}
+}
+
+func TestImpairerSeed(t *testing.T) {
+	corrupt := func(seed int64) []byte {
+		delivered := make(chan []byte, 1)
+		i := newImpairer(Impairment{Corrupt: 1, Seed: seed}, func(data []byte, _ net.Addr) {
+			delivered <- data
+		})
+		defer i.stop()
+		i.process(make([]byte, 64), nil)
+		return <-delivered
+	}
+	if a, b := corrupt(3), corrupt(3); !bytes.Equal(a, b) {
+		t.Errorf("the same seed corrupted %x and %x", a, b)
+	}
+}
+
+func TestImpairedConnSeed(t *testing.T) {
+	conn, err := NewMemNetwork().listenPacket("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	im := Impairment{Corrupt: 1, Seed: 3}
+	c := newImpairedConn(conn, im, im, silentLogger)
+	defer c.Close()
+
+	send, receive := c.send.rng.Int63(), c.receive.rng.Int63()
+	if send == receive {
+		t.Errorf("both directions drew %v from the same seed", send)
+	}
+	if want := NewRand(3, sendImpairStream).Int63(); send != want {
+		t.Errorf("send drew %v, want %v", send, want)
+	}
+	if want := NewRand(3, receiveImpairStream).Int63(); receive != want {
+		t.Errorf("receive drew %v, want %v", receive, want)
+	}
+}
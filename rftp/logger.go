@@ -0,0 +1,29 @@
+package rftp
+
+import (
+	"context"
+	"log/slog"
+)
+
+// discardHandler drops all records. Without a logger, the library is silent.
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (h discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return h }
+func (h discardHandler) WithGroup(string) slog.Handler           { return h }
+
+var silentLogger = slog.New(discardHandler{})
+
+func loggerOrSilent(l *slog.Logger) *slog.Logger {
+	if l == nil {
+		return silentLogger
+	}
+	return l
+}
+
+// debugEnabled guards debug logging on the hot path, so that the arguments
+// are not even built if debug records are dropped.
+func debugEnabled(l *slog.Logger) bool {
+	return l.Enabled(context.Background(), slog.LevelDebug)
+}
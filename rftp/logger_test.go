@@ -0,0 +1,68 @@
+package rftp
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type lockedBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.String()
+}
+
+func TestLoggerAttributes(t *testing.T) {
+	serverLog := &lockedBuffer{}
+	clientLog := &lockedBuffer{}
+	debug := &slog.HandlerOptions{Level: slog.LevelDebug}
+
+	network := NewMemNetwork()
+	server := NewServer()
+	server.SetLogger(slog.New(slog.NewTextHandler(serverLog, debug)))
+	data := bytes.Repeat([]byte("log"), 1000)
+	stop := startMemServerWith(t, server, network, ":2020", map[string][]byte{"file": data})
+	defer stop()
+
+	conn := network.NewConnection()
+	client := &Client{
+		Conn:   conn,
+		Logger: slog.New(slog.NewTextHandler(clientLog, debug)),
+	}
+	reqs, err := client.Request("localhost:2020", []string{"file"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(reqs[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	// The server logs the address the client sends from.
+	remote := conn.addr().String()
+	tests := []struct {
+		name, log, want string
+	}{
+		{"client payload", clientLog.String(), `msg="handling payload" remote=localhost:2020 file=0`},
+		{"server request", serverLog.String(), `msg="handling request" remote=` + remote + ` files=1`},
+		{"server payload", serverLog.String(), `msg="sending payload" remote=` + remote + ` file=0`},
+	}
+	for _, tt := range tests {
+		if !strings.Contains(tt.log, tt.want) {
+			t.Errorf("%v: log does not contain %q", tt.name, tt.want)
+		}
+	}
+}
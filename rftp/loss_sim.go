@@ -1,10 +1,27 @@
 package rftp
 
 import (
-	"log"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"math/rand"
+	"sync"
 )
 
+// NewRand returns a random source for one of several independent streams of a
+// simulation. The same seed and stream always result in the same sequence.
+func NewRand(seed int64, stream uint64) *rand.Rand {
+	// splitmix64, so that neighbouring seeds and streams are uncorrelated
+	z := uint64(seed) + (stream+1)*0x9e3779b97f4a7c15
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	z ^= z >> 31
+	return rand.New(rand.NewSource(int64(z)))
+}
+
+// LossSimulator decides which received packets are dropped. shouldDrop is
+// called concurrently by the readers of the socket and of a multicast group.
 type LossSimulator interface {
 	shouldDrop() bool
 }
@@ -19,24 +36,38 @@ type MarkovLossSimulator struct {
 	p         float32
 	q         float32
 	lossState bool
+	rng       *rand.Rand
+	lock      sync.Mutex
 }
 
-// Return a new loss simulator. p and q between 0 and 1.
-// Caller should consider seeding global randomness source.
-func NewMarkovLossSimulator(p float32, q float32) LossSimulator {
+// Return a new loss simulator. p and q between 0 and 1. The simulator draws
+// from rng, so that the same seed results in the same drop pattern. A nil rng
+// is NewRand(0, 0).
+func NewMarkovLossSimulator(p float32, q float32, rng *rand.Rand) LossSimulator {
 	if p < 0 || q < 0 || p > 1 || q > 1 {
-		log.Panic("The loss simulation parameters must be between 0 and 1")
+		panic("The loss simulation parameters must be between 0 and 1")
 	}
 
 	return &MarkovLossSimulator{
 		p:         p,
 		q:         q,
 		lossState: false,
+		rng:       orDefaultRand(rng),
+	}
+}
+
+// orDefaultRand returns rng, or the first stream of seed 0 if rng is nil.
+func orDefaultRand(rng *rand.Rand) *rand.Rand {
+	if rng == nil {
+		return NewRand(0, 0)
 	}
+	return rng
 }
 
 func (l *MarkovLossSimulator) shouldDrop() bool {
-	x := rand.Float32() // upper bound is exclusive, i.e., never 1; problem?
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	x := l.rng.Float32() // upper bound is exclusive, i.e., never 1; problem?
 	if l.lossState {
 		if x >= l.q {
 			l.lossState = false
@@ -49,3 +80,108 @@ func (l *MarkovLossSimulator) shouldDrop() bool {
 
 	return l.lossState
 }
+
+// GilbertElliottLossSimulator is a two-state Markov chain with a good and a
+// bad state. Unlike MarkovLossSimulator, packets are lost in both states with
+// a state dependent probability.
+type GilbertElliottLossSimulator struct {
+	p, r     float32
+	k, h     float32
+	badState bool
+	rng      *rand.Rand
+	lock     sync.Mutex
+}
+
+// Return a new Gilbert-Elliott loss simulator. p is the probability to change
+// from the good to the bad state and r the probability to change from the bad
+// to the good state. A packet is lost with probability 1-k in the good state and
+// with probability 1-h in the bad state. All parameters between 0 and 1. The
+// simulator draws from rng, a nil rng is NewRand(0, 0).
+func NewGilbertElliottLossSimulator(p, r, k, h float32, rng *rand.Rand) LossSimulator {
+	for _, x := range []float32{p, r, k, h} {
+		if x < 0 || x > 1 {
+			panic("The loss simulation parameters must be between 0 and 1")
+		}
+	}
+
+	return &GilbertElliottLossSimulator{
+		p:   p,
+		r:   r,
+		k:   k,
+		h:   h,
+		rng: orDefaultRand(rng),
+	}
+}
+
+func (l *GilbertElliottLossSimulator) shouldDrop() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	x := l.rng.Float32()
+	if l.badState {
+		if x < l.r {
+			l.badState = false
+		}
+	} else {
+		if x < l.p {
+			l.badState = true
+		}
+	}
+
+	if l.badState {
+		return l.rng.Float32() >= l.h
+	}
+	return l.rng.Float32() >= l.k
+}
+
+// TraceLossSimulator replays a recorded loss trace. The trace starts over once
+// it is exhausted.
+type TraceLossSimulator struct {
+	trace []bool
+	next  int
+	lock  sync.Mutex
+}
+
+// Return a new loss simulator that drops the n-th packet if trace[n] is true.
+func NewTraceLossSimulator(trace []bool) LossSimulator {
+	if len(trace) == 0 {
+		panic("The loss trace must not be empty")
+	}
+
+	return &TraceLossSimulator{
+		trace: trace,
+	}
+}
+
+func (l *TraceLossSimulator) shouldDrop() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	drop := l.trace[l.next]
+	l.next = (l.next + 1) % len(l.trace)
+	return drop
+}
+
+// ParseLossTrace reads a loss trace that consists of the characters '1' for a
+// lost and '0' for a received packet. Whitespace is ignored.
+func ParseLossTrace(r io.Reader) ([]bool, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	trace := []bool{}
+	for i, c := range data {
+		switch c {
+		case '0':
+			trace = append(trace, false)
+		case '1':
+			trace = append(trace, true)
+		case ' ', '\t', '\r', '\n':
+		default:
+			return nil, fmt.Errorf("invalid character %q at position %v in loss trace", c, i)
+		}
+	}
+	if len(trace) == 0 {
+		return nil, errors.New("loss trace is empty")
+	}
+	return trace, nil
+}
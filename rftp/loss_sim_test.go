@@ -0,0 +1,126 @@
+package rftp
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestGilbertElliottLossSimulator(t *testing.T) {
+	tests := map[string]struct {
+		p, r, k, h float32
+		want       bool
+	}{
+		"never lose in good state":  {p: 0, r: 1, k: 1, h: 0, want: false},
+		"always lose in good state": {p: 0, r: 1, k: 0, h: 1, want: true},
+		"never lose in bad state":   {p: 1, r: 0, k: 0, h: 1, want: false},
+		"always lose in bad state":  {p: 1, r: 0, k: 1, h: 0, want: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			l := NewGilbertElliottLossSimulator(tc.p, tc.r, tc.k, tc.h, NewRand(1, 0))
+			for i := 0; i < 100; i++ {
+				if got := l.shouldDrop(); got != tc.want {
+					t.Fatalf("shouldDrop() of packet %v = %v, want %v", i, got, tc.want)
+				}
+			}
+		})
+	}
+}
+
+func TestTraceLossSimulator(t *testing.T) {
+	trace, err := ParseLossTrace(strings.NewReader("0 01\n1\n"))
+	if err != nil {
+		t.Fatalf("ParseLossTrace() error = %v", err)
+	}
+	want := []bool{false, false, true, true}
+	if !reflect.DeepEqual(trace, want) {
+		t.Fatalf("ParseLossTrace() = %v, want %v", trace, want)
+	}
+
+	l := NewTraceLossSimulator(trace)
+	for i := 0; i < 2*len(want); i++ {
+		if got := l.shouldDrop(); got != want[i%len(want)] {
+			t.Errorf("shouldDrop() of packet %v = %v, want %v", i, got, want[i%len(want)])
+		}
+	}
+
+	for _, invalid := range []string{"", " \n", "01x"} {
+		if _, err := ParseLossTrace(strings.NewReader(invalid)); err == nil {
+			t.Errorf("ParseLossTrace(%q) returned no error", invalid)
+		}
+	}
+}
+
+func TestLossSimulatorSeed(t *testing.T) {
+	pattern := func(seed int64, stream uint64) []bool {
+		l := NewMarkovLossSimulator(0.2, 0.5, NewRand(seed, stream))
+		drops := make([]bool, 1000)
+		for i := range drops {
+			drops[i] = l.shouldDrop()
+		}
+		return drops
+	}
+
+	if !reflect.DeepEqual(pattern(42, 0), pattern(42, 0)) {
+		t.Error("same seed and stream resulted in different drop patterns")
+	}
+	if reflect.DeepEqual(pattern(42, 0), pattern(42, 1)) {
+		t.Error("different streams resulted in the same drop pattern")
+	}
+	if reflect.DeepEqual(pattern(42, 0), pattern(43, 0)) {
+		t.Error("different seeds resulted in the same drop pattern")
+	}
+}
+
+func TestLossSimulatorNilRand(t *testing.T) {
+	pattern := func(l LossSimulator) []bool {
+		drops := make([]bool, 1000)
+		for i := range drops {
+			drops[i] = l.shouldDrop()
+		}
+		return drops
+	}
+
+	if !reflect.DeepEqual(pattern(NewMarkovLossSimulator(0.2, 0.5, nil)),
+		pattern(NewMarkovLossSimulator(0.2, 0.5, NewRand(0, 0)))) {
+		t.Error("Markov simulator without rng does not draw from NewRand(0, 0)")
+	}
+	if !reflect.DeepEqual(pattern(NewGilbertElliottLossSimulator(0.1, 0.3, 0.9, 0.2, nil)),
+		pattern(NewGilbertElliottLossSimulator(0.1, 0.3, 0.9, 0.2, NewRand(0, 0)))) {
+		t.Error("Gilbert-Elliott simulator without rng does not draw from NewRand(0, 0)")
+	}
+}
+
+// The socket and the multicast group are read concurrently, so the
+// simulators must count every packet exactly once.
+func TestLossSimulatorConcurrent(t *testing.T) {
+	trace := make([]bool, 1000)
+	trace[0] = true
+	sims := map[string]LossSimulator{
+		"markov":          NewMarkovLossSimulator(0.1, 0.5, NewRand(1, 0)),
+		"gilbert-elliott": NewGilbertElliottLossSimulator(0.1, 0.5, 0.9, 0.1, NewRand(1, 0)),
+		"trace":           NewTraceLossSimulator(trace),
+	}
+	for name, l := range sims {
+		var wg sync.WaitGroup
+		drops := make([]int, 4)
+		for i := range drops {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for j := 0; j < 250; j++ {
+					if l.shouldDrop() {
+						drops[i]++
+					}
+				}
+			}(i)
+		}
+		wg.Wait()
+		if name == "trace" && drops[0]+drops[1]+drops[2]+drops[3] != 1 {
+			t.Errorf("%v: dropped %v packets of one trace, want 1", name, drops)
+		}
+	}
+}
@@ -0,0 +1,259 @@
+package rftp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// memQueueSize is the number of packets an endpoint of a MemNetwork buffers.
+// Further packets are dropped like by a full socket buffer.
+const memQueueSize = 4096
+
+// MemNetwork is a virtual network that delivers packets in memory. It allows to
+// run a Server and many Clients in one process without sockets. Endpoints are
+// addressed by "host:port" like UDP endpoints, the host is only a name. A
+// packet sent to the address of a multicast group is delivered to each
+// endpoint that joined the group.
+type MemNetwork struct {
+	lock      sync.Mutex
+	endpoints map[string]*memConn
+	groups    map[string]map[*memConn]struct{}
+	nextPort  int
+}
+
+func NewMemNetwork() *MemNetwork {
+	return &MemNetwork{
+		endpoints: make(map[string]*memConn),
+		groups:    make(map[string]map[*memConn]struct{}),
+		nextPort:  49152,
+	}
+}
+
+// NewConnection returns a connection that can be used by a Server or a Client
+// to communicate over the network.
+func (n *MemNetwork) NewConnection() *packetConnection {
+	return newPacketConnection(n)
+}
+
+type memAddr string
+
+func (a memAddr) Network() string {
+	return "mem"
+}
+
+func (a memAddr) String() string {
+	return string(a)
+}
+
+func (n *MemNetwork) resolve(host string) (net.Addr, error) {
+	h, port, err := net.SplitHostPort(host)
+	if err != nil {
+		return nil, err
+	}
+	if h == "" || h == "0.0.0.0" {
+		h = "localhost"
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return nil, fmt.Errorf("invalid port %q", port)
+	}
+	return memAddr(net.JoinHostPort(h, port)), nil
+}
+
+func (n *MemNetwork) listenPacket(host string) (net.PacketConn, error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	var addr memAddr
+	if host == "" {
+		addr = n.freeAddr()
+	} else {
+		a, err := n.resolve(host)
+		if err != nil {
+			return nil, err
+		}
+		addr = a.(memAddr)
+		if _, ok := n.endpoints[string(addr)]; ok {
+			return nil, fmt.Errorf("address %v already in use", addr)
+		}
+	}
+
+	c := n.newConn(addr)
+	n.endpoints[string(addr)] = c
+	return c, nil
+}
+
+// joinGroup returns an endpoint with a free address that receives the packets
+// sent to the group.
+func (n *MemNetwork) joinGroup(group string) (net.PacketConn, error) {
+	g, err := n.resolve(group)
+	if err != nil {
+		return nil, err
+	}
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	c := n.newConn(n.freeAddr())
+	c.group = g.String()
+	n.endpoints[string(c.addr)] = c
+	if n.groups[c.group] == nil {
+		n.groups[c.group] = make(map[*memConn]struct{})
+	}
+	n.groups[c.group][c] = struct{}{}
+	return c, nil
+}
+
+// freeAddr returns an unused address. The lock must be held.
+func (n *MemNetwork) freeAddr() memAddr {
+	for {
+		addr := memAddr(net.JoinHostPort("localhost", strconv.Itoa(n.nextPort)))
+		n.nextPort++
+		if _, ok := n.endpoints[string(addr)]; !ok {
+			return addr
+		}
+	}
+}
+
+func (n *MemNetwork) newConn(addr memAddr) *memConn {
+	return &memConn{
+		network:  n,
+		addr:     addr,
+		in:       make(chan *datagram, memQueueSize),
+		closed:   make(chan struct{}),
+		deadline: make(chan struct{}),
+		clock:    systemClock{},
+	}
+}
+
+func (n *MemNetwork) deliver(data []byte, from, to net.Addr) {
+	n.lock.Lock()
+	receivers := []*memConn{}
+	if c, ok := n.endpoints[to.String()]; ok {
+		receivers = append(receivers, c)
+	}
+	for c := range n.groups[to.String()] {
+		receivers = append(receivers, c)
+	}
+	n.lock.Unlock()
+	for _, c := range receivers {
+		select {
+		case c.in <- &datagram{data: append([]byte(nil), data...), addr: from}:
+		default:
+		}
+	}
+}
+
+func (n *MemNetwork) remove(c *memConn) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.endpoints[string(c.addr)] == c {
+		delete(n.endpoints, string(c.addr))
+	}
+	if members, ok := n.groups[c.group]; ok {
+		delete(members, c)
+		if len(members) == 0 {
+			delete(n.groups, c.group)
+		}
+	}
+}
+
+// memConn is an endpoint of a MemNetwork.
+type memConn struct {
+	network *MemNetwork
+	addr    memAddr
+	group   string // the joined multicast group, if any
+	in      chan *datagram
+
+	closeOnce sync.Once
+	closed    chan struct{}
+
+	deadlineLock  sync.Mutex
+	deadline      chan struct{} // closed when the read deadline passed
+	deadlineTimer Timer
+	clock         Clock // of the read deadlines
+}
+
+var _ net.PacketConn = (*memConn)(nil)
+
+var (
+	errMemClosed = errors.New("use of closed network connection")
+	// errDeadline is the error of the sockets of package net, so that
+	// errors.Is(err, os.ErrDeadlineExceeded) works for both.
+	errDeadline = os.ErrDeadlineExceeded
+)
+
+func (c *memConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	c.deadlineLock.Lock()
+	deadline := c.deadline
+	c.deadlineLock.Unlock()
+
+	select {
+	case d := <-c.in:
+		return copy(b, d.data), d.addr, nil
+	case <-c.closed:
+		return 0, nil, errMemClosed
+	case <-deadline:
+		return 0, nil, errDeadline
+	}
+}
+
+func (c *memConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, errMemClosed
+	default:
+	}
+	c.network.deliver(b, c.addr, addr)
+	return len(b), nil
+}
+
+func (c *memConn) Close() error {
+	err := errMemClosed
+	c.closeOnce.Do(func() {
+		c.network.remove(c)
+		close(c.closed)
+		err = nil
+	})
+	return err
+}
+
+// setClock sets the clock of the read deadlines. It must be called before
+// a deadline is set.
+func (c *memConn) setClock(clock Clock) {
+	c.clock = clock
+}
+
+func (c *memConn) LocalAddr() net.Addr {
+	return c.addr
+}
+
+func (c *memConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *memConn) SetReadDeadline(t time.Time) error {
+	c.deadlineLock.Lock()
+	defer c.deadlineLock.Unlock()
+
+	if c.deadlineTimer != nil {
+		c.deadlineTimer.Stop()
+	}
+	deadline := make(chan struct{})
+	c.deadline = deadline
+	if t.IsZero() {
+		return nil
+	}
+	c.deadlineTimer = c.clock.AfterFunc(t.Sub(c.clock.Now()), func() {
+		close(deadline)
+	})
+	return nil
+}
+
+// SetWriteDeadline has no effect, writes never block.
+func (c *memConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
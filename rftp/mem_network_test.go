@@ -0,0 +1,175 @@
+package rftp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startMemServer serves files on the network and returns a function that
+// stops the server.
+func startMemServer(t *testing.T, network *MemNetwork, host string, files map[string][]byte) func() {
+	t.Helper()
+	return startMemServerWith(t, NewServer(), network, host, files)
+}
+
+func startMemServerWith(t *testing.T, server *Server, network *MemNetwork, host string, files map[string][]byte) func() {
+	t.Helper()
+	server.Conn = network.NewConnection()
+	return startServer(t, server, host, files)
+}
+
+// startServer serves files on the connection of server.
+func startServer(t *testing.T, server *Server, host string, files map[string][]byte) func() {
+	t.Helper()
+	server.SetFileHandler(func(name string) (*io.SectionReader, error) {
+		data, ok := files[name]
+		if !ok {
+			return nil, errors.New("file not found")
+		}
+		return io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data))), nil
+	})
+
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Listen(host)
+	}()
+	select {
+	case <-server.Ready():
+	case err := <-done:
+		t.Fatalf("server failed to listen: %v", err)
+	}
+
+	return func() {
+		if err := server.Close(); err != nil {
+			t.Errorf("failed to close server: %v", err)
+		}
+		if err := <-done; err != nil {
+			t.Errorf("server returned %v", err)
+		}
+	}
+}
+
+func TestMemNetworkTransfer(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	files := map[string][]byte{}
+	for _, size := range []int{10, 1024, 5000, 300 * 1024} {
+		data := make([]byte, size)
+		rng.Read(data)
+		files[fmt.Sprintf("file-%v", size)] = data
+	}
+
+	tests := map[string]struct {
+		lossSim LossSimulator
+		im      Impairment
+	}{
+		"no loss":   {lossSim: &NoopLossSimulator{}},
+		"loss":      {lossSim: NewMarkovLossSimulator(0.02, 0.3, NewRand(1, 0))},
+		"reordered": {lossSim: &NoopLossSimulator{}, im: Impairment{Jitter: time.Millisecond, Rand: NewRand(1, 1)}},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			network := NewMemNetwork()
+			stop := startMemServer(t, network, ":2020", files)
+			defer stop()
+
+			conn := network.NewConnection()
+			conn.LossSim(tc.lossSim)
+			conn.Impair(Impairment{}, tc.im)
+			client := &Client{Conn: conn}
+
+			names := []string{}
+			for name := range files {
+				names = append(names, name)
+			}
+			reqs, err := client.Request("localhost:2020", names)
+			if err != nil {
+				t.Fatalf("Request() error = %v", err)
+			}
+			for i, req := range reqs {
+				data, err := ioutil.ReadAll(req)
+				if err != nil || req.Err != nil {
+					t.Fatalf("%v: Read() error = %v, %v", names[i], err, req.Err)
+				}
+				if !bytes.Equal(data, files[names[i]]) {
+					t.Errorf("%v: received %v bytes that differ from the %v sent bytes", names[i], len(data), len(files[names[i]]))
+				}
+			}
+		})
+	}
+}
+
+func TestMemNetworkManyClients(t *testing.T) {
+	data := bytes.Repeat([]byte("rft"), 20000)
+	network := NewMemNetwork()
+	stop := startMemServer(t, network, ":2020", map[string][]byte{"file": data})
+	defer stop()
+
+	errs := make(chan error)
+	for i := 0; i < 5; i++ {
+		go func() {
+			client := &Client{Conn: network.NewConnection()}
+			reqs, err := client.Request("localhost:2020", []string{"file"})
+			if err != nil {
+				errs <- err
+				return
+			}
+			got, err := ioutil.ReadAll(reqs[0])
+			if err == nil && !bytes.Equal(got, data) {
+				err = errors.New("received data differs")
+			}
+			errs <- err
+		}()
+	}
+	for i := 0; i < 5; i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+// closedFile fails the test if it is written to after it was closed.
+type closedFile struct {
+	memFile
+	t      *testing.T
+	closed atomic.Bool
+}
+
+func (f *closedFile) WriteAt(p []byte, off int64) (int, error) {
+	if f.closed.Load() {
+		f.t.Errorf("WriteAt(%v) after the client was closed", off)
+	}
+	return f.memFile.WriteAt(p, off)
+}
+
+func TestClientClose(t *testing.T) {
+	data := randomBytes(1024*1024, 7)
+	network := NewMemNetwork()
+	stop := startMemServer(t, network, ":2020", map[string][]byte{"file": data})
+	defer stop()
+
+	conn := network.NewConnection()
+	// The transfer takes about 10 seconds.
+	conn.Impair(Impairment{}, Impairment{Bandwidth: 100 * 1024})
+	client := &Client{Conn: conn}
+	dest := &closedFile{t: t}
+	reqs, err := client.RequestFiles("localhost:2020", []FileRequest{{Name: "file", Dest: dest}})
+	if err != nil {
+		t.Fatalf("RequestFiles() error = %v", err)
+	}
+	client.Close()
+	dest.closed.Store(true)
+	if err := reqs[0].Wait(); err == nil {
+		t.Errorf("Wait() of the canceled file succeeded")
+	}
+	// Packets that are still on their way must not reach the file.
+	time.Sleep(100 * time.Millisecond)
+	client.Close()
+}
@@ -0,0 +1,189 @@
+package rftp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// serverMetrics counts the events of a server that are not part of the
+// statistics of a single connection, and the totals of closed connections.
+type serverMetrics struct {
+	lock          sync.Mutex
+	connections   uint64
+	closed        map[string]uint64 // by reason, "timeout" or "close"
+	closeReceived map[string]uint64 // by reason sent by the client
+	fileStatus    map[string]uint64
+	parseErrors   uint64
+	finished      Stats // sums of the closed connections
+}
+
+func newServerMetrics() *serverMetrics {
+	return &serverMetrics{
+		closed:        map[string]uint64{},
+		closeReceived: map[string]uint64{},
+		fileStatus:    map[string]uint64{},
+	}
+}
+
+func (m *serverMetrics) connectionOpened() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.connections++
+}
+
+// connectionClosed adds the final statistics of a connection to the totals.
+// It must be called while the connection is removed from the clients of the
+// server, so that a scrape counts it exactly once.
+func (m *serverMetrics) connectionClosed(reason string, s Stats) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.closed[reason]++
+	addStats(&m.finished, s)
+}
+
+func (m *serverMetrics) closeMessage(reason CloseConnectionReason) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.closeReceived[closeReasonLabel(reason)]++
+}
+
+func (m *serverMetrics) file(status MetaDataStatus) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.fileStatus[statusLabel(status)]++
+}
+
+func (m *serverMetrics) parseError() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.parseErrors++
+}
+
+func addStats(sum *Stats, s Stats) {
+	sum.PacketsSent += s.PacketsSent
+	sum.PacketsReceived += s.PacketsReceived
+	sum.BytesSent += s.BytesSent
+	sum.BytesReceived += s.BytesReceived
+	sum.Retransmissions += s.Retransmissions
+	sum.ResendEntries += s.ResendEntries
+}
+
+func statusLabel(s MetaDataStatus) string {
+	switch s {
+	case noErr:
+		return "ok"
+	case fileNotExistent:
+		return "file_not_found"
+	case fileEmpty:
+		return "file_empty"
+	case accessDenied:
+		return "access_denied"
+	case offsetTooBig:
+		return "offset_too_big"
+	}
+	return "unknown"
+}
+
+func closeReasonLabel(r CloseConnectionReason) string {
+	switch r {
+	case noReason:
+		return "none"
+	case applicationClosed:
+		return "application_closed"
+	case unsupportedVersion:
+		return "unsupported_version"
+	case unknownRequest:
+		return "unknown_request"
+	case wrongChecksum:
+		return "wrong_checksum"
+	case donwloadFinished:
+		return "download_finished"
+	case timeout:
+		return "timeout"
+	}
+	return "unknown"
+}
+
+// MetricsHandler serves the metrics of the server in the Prometheus text
+// format.
+func (s *Server) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		s.WriteMetrics(w)
+	})
+}
+
+// WriteMetrics writes the metrics of the server in the Prometheus text format
+// to w. The totals include the open and the closed connections.
+func (s *Server) WriteMetrics(w io.Writer) error {
+	s.clientMux.Lock()
+	active := len(s.clients)
+	total := Stats{}
+	for _, c := range s.clients {
+		addStats(&total, c.stats.snapshot())
+	}
+	m := s.metrics
+	m.lock.Lock()
+	addStats(&total, m.finished)
+	connections := m.connections
+	closed := copyCounts(m.closed)
+	closeReceived := copyCounts(m.closeReceived)
+	fileStatus := copyCounts(m.fileStatus)
+	parseErrors := m.parseErrors
+	m.lock.Unlock()
+	s.clientMux.Unlock()
+
+	ratio := 0.0
+	if total.PacketsSent > 0 {
+		ratio = float64(total.Retransmissions) / float64(total.PacketsSent)
+	}
+
+	b := bufio.NewWriter(w)
+	writeMetric(b, "rft_active_clients", "gauge", "Number of open client connections.", float64(active))
+	writeMetric(b, "rft_connections_total", "counter", "Number of accepted client connections.", float64(connections))
+	writeLabeledMetric(b, "rft_connections_closed_total", "counter", "Number of closed client connections by reason.", "reason", closed)
+	writeLabeledMetric(b, "rft_close_messages_total", "counter", "Number of close messages received from clients by reason.", "reason", closeReceived)
+	writeLabeledMetric(b, "rft_files_total", "counter", "Number of requested files by metadata status.", "status", fileStatus)
+	writeMetric(b, "rft_parse_errors_total", "counter", "Number of messages that could not be parsed.", float64(parseErrors))
+	writeMetric(b, "rft_packets_sent_total", "counter", "Number of sent packets.", float64(total.PacketsSent))
+	writeMetric(b, "rft_packets_received_total", "counter", "Number of received packets.", float64(total.PacketsReceived))
+	writeMetric(b, "rft_bytes_sent_total", "counter", "Number of sent bytes.", float64(total.BytesSent))
+	writeMetric(b, "rft_bytes_received_total", "counter", "Number of received bytes.", float64(total.BytesReceived))
+	writeMetric(b, "rft_retransmissions_total", "counter", "Number of resent payloads.", float64(total.Retransmissions))
+	writeMetric(b, "rft_resend_entries_total", "counter", "Number of resend entries received from clients.", float64(total.ResendEntries))
+	writeMetric(b, "rft_retransmission_ratio", "gauge", "Share of the sent packets that were retransmissions, an estimate of the loss rate.", ratio)
+	return b.Flush()
+}
+
+func copyCounts(m map[string]uint64) map[string]uint64 {
+	c := make(map[string]uint64, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+func writeMetric(w io.Writer, name, typ, help string, value float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %s\n", name, help, name, typ, name, formatValue(value))
+}
+
+func writeLabeledMetric(w io.Writer, name, typ, help, label string, values map[string]uint64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s{%s=%q} %s\n", name, label, k, formatValue(float64(values[k])))
+	}
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,124 @@
+package rftp
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// metricValues parses the samples of the Prometheus text format.
+func metricValues(t *testing.T, text string) map[string]float64 {
+	t.Helper()
+	values := map[string]float64{}
+	for _, line := range strings.Split(strings.TrimSpace(text), "\n") {
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndex(line, " ")
+		v, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			t.Fatalf("invalid sample %q: %v", line, err)
+		}
+		values[line[:i]] = v
+	}
+	return values
+}
+
+func TestServerMetrics(t *testing.T) {
+	clock := NewFakeClock(time.Unix(0, 0))
+	network := NewMemNetwork()
+	server := NewServer()
+	server.SetClock(clock)
+	data := bytes.Repeat([]byte("metrics"), 1000)
+	stop := startMemServerWith(t, server, network, ":2020", map[string][]byte{"file": data})
+	defer stop()
+
+	client := &Client{Conn: network.NewConnection()}
+	reqs, err := client.Request("localhost:2020", []string{"file", "missing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(reqs[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	server.MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	open := metricValues(t, rec.Body.String())
+	want := map[string]float64{
+		"rft_active_clients":                       1,
+		"rft_connections_total":                    1,
+		`rft_files_total{status="ok"}`:             1,
+		`rft_files_total{status="file_not_found"}`: 1,
+	}
+	for name, v := range want {
+		if open[name] != v {
+			t.Errorf("%v = %v, want %v", name, open[name], v)
+		}
+	}
+	if chunks := float64(len(data) / 1024); open["rft_packets_sent_total"] < chunks {
+		t.Errorf("rft_packets_sent_total = %v, want at least %v", open["rft_packets_sent_total"], chunks)
+	}
+
+	// let the connection time out
+	for i := 0; i < 100 && len(server.Stats()) > 0; i++ {
+		clock.Advance(time.Second)
+		time.Sleep(10 * time.Millisecond)
+	}
+	buf := &bytes.Buffer{}
+	if err := server.WriteMetrics(buf); err != nil {
+		t.Fatal(err)
+	}
+	closed := metricValues(t, buf.String())
+	if closed["rft_active_clients"] != 0 || closed[`rft_connections_closed_total{reason="timeout"}`] != 1 {
+		t.Errorf("after the timeout: %v active clients and %v closed connections, want 0 and 1",
+			closed["rft_active_clients"], closed[`rft_connections_closed_total{reason="timeout"}`])
+	}
+	for _, name := range []string{"rft_packets_sent_total", "rft_bytes_sent_total", "rft_packets_received_total"} {
+		if closed[name] < open[name] {
+			t.Errorf("%v decreased from %v to %v after the connection closed", name, open[name], closed[name])
+		}
+	}
+}
+
+func TestServerMetricsClose(t *testing.T) {
+	network := NewMemNetwork()
+	server := NewServer()
+	stop := startMemServerWith(t, server, network, ":2020", map[string][]byte{"file": bytes.Repeat([]byte("close"), 1000)})
+	defer stop()
+
+	conn := network.NewConnection()
+	if err := conn.connectTo("localhost:2020"); err != nil {
+		t.Fatal(err)
+	}
+	defer conn.cclose(0)
+	if _, err := conn.send(clientRequest{files: []fileDescriptor{{fileName: "file"}}}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100 && len(server.Stats()) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := conn.send(closeConnection{reason: donwloadFinished}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100 && len(server.Stats()) > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := server.WriteMetrics(buf); err != nil {
+		t.Fatal(err)
+	}
+	closed := metricValues(t, buf.String())
+	if closed["rft_active_clients"] != 0 || closed[`rft_connections_closed_total{reason="close"}`] != 1 {
+		t.Errorf("after the close: %v active clients and %v closed connections, want 0 and 1",
+			closed["rft_active_clients"], closed[`rft_connections_closed_total{reason="close"}`])
+	}
+}
@@ -2,6 +2,7 @@ package rftp
 
 import (
 	"bytes"
+	"crypto/md5"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -17,6 +18,9 @@ const (
 	msgServerPayload
 	msgClientAck
 	msgClose
+	msgClientRangeRequest
+	msgServerRepair
+	msgClientSignatures
 )
 
 // status, the server puts to metadata
@@ -27,6 +31,7 @@ const (
 	fileNotExistent
 	fileEmpty
 	accessDenied
+	offsetTooBig
 )
 
 func (m MetaDataStatus) String() string {
@@ -45,6 +50,36 @@ func (m MetaDataStatus) String() string {
 	return fmt.Sprintf("unknown error: %v", uint8(m))
 }
 
+// option types
+const (
+	// Value is a list of 2 byte file indices, each followed by a 1 byte
+	// priority. Files that are not listed have priority 0.
+	optPriority uint8 = iota
+	// Value is the 4 byte tag of a multicast session, see multicastTag.
+	// Requests carry it to join a session, the packets sent to the group
+	// carry it so that receivers can tell the sessions on a group apart.
+	optMulticast
+	// Value is the 1 byte number of chunks the server protects with one
+	// repair packet, see serverRepair.
+	optFEC
+	// In requests, the value is a list of 1 byte compressions the client
+	// supports, in the order of preference. In payloads, it is the 1 byte
+	// compression of the block of the chunk, followed by the 1 byte number of
+	// chunks of the block, see compressionBlock.
+	optCompression
+	// In requests, the value is a list of 2 byte indices of the files the
+	// client requests as delta to its local copy, see clientSignatures. In
+	// metadata, it is the 8 byte length of the delta the chunks of the file
+	// carry.
+	optDelta
+	// Value is a list of 2 byte indices of the files the client requests by
+	// their MD5 checksum instead of their name, see contentName.
+	optContent
+	// Value is a list of 2 byte indices of the files that name directories,
+	// the client requests their listings, see ListingHandler.
+	optListing
+)
+
 type option struct {
 	otype uint8
 	value []byte
@@ -117,7 +152,7 @@ func (s msgHeader) MarshalBinary() ([]byte, error) {
 }
 
 func (s *msgHeader) UnmarshalBinary(data []byte) error {
-	if len(data) < 2 {
+	if len(data) < 3 {
 		return fmt.Errorf("MsgHeader too short")
 	}
 	vt := uint8(data[0])
@@ -148,11 +183,161 @@ func (s *msgHeader) UnmarshalBinary(data []byte) error {
 type clientRequest struct {
 	maxTransmissionRate uint32
 	files               []fileDescriptor
+
+	// options are transmitted in the message header.
+	options []option
+}
+
+// priorityOptions encodes the priorities of the files of a request. Files
+// with priority 0 are omitted.
+func priorityOptions(priorities []uint8) []option {
+	os := []option{}
+	value := []byte{}
+	for i, p := range priorities {
+		if p == 0 {
+			continue
+		}
+		value = append(value, byte(i>>8), byte(i), p)
+		if len(value) > 255-3 {
+			os = append(os, option{otype: optPriority, value: value})
+			value = []byte{}
+		}
+	}
+	if len(value) > 0 {
+		os = append(os, option{otype: optPriority, value: value})
+	}
+	return os
+}
+
+// multicastTag identifies the multicast session of the files: all requests
+// for the same files in the same order have the same tag.
+func multicastTag(files []fileDescriptor) []byte {
+	h := md5.New()
+	for _, f := range files {
+		h.Write([]byte(f.fileName))
+		h.Write([]byte{0})
+	}
+	return h.Sum(nil)[:4]
+}
+
+// multicastOption returns the value of the multicast option of the header
+// options or nil if there is none.
+func multicastOption(os []option) []byte {
+	for _, o := range os {
+		if o.otype == optMulticast {
+			return o.value
+		}
+	}
+	return nil
+}
+
+// fecGroupSize returns the number of chunks per repair packet the client
+// asked for, or 0 if it did not ask for repair packets.
+func (s *clientRequest) fecGroupSize() int {
+	for _, o := range s.options {
+		if o.otype == optFEC && len(o.value) == 1 {
+			return int(o.value[0])
+		}
+	}
+	return 0
+}
+
+// deltaFiles returns the indices of the files the client requested as delta.
+func (s *clientRequest) deltaFiles() []uint16 {
+	return s.fileIndices(optDelta)
+}
+
+// contentFiles returns the indices of the files the client requested by
+// their checksum.
+func (s *clientRequest) contentFiles() []uint16 {
+	return s.fileIndices(optContent)
+}
+
+// listingFiles returns the indices of the files that request the listing of
+// a directory.
+func (s *clientRequest) listingFiles() []uint16 {
+	return s.fileIndices(optListing)
+}
+
+// fileIndices returns the file indices listed in the options of type otype.
+func (s *clientRequest) fileIndices(otype uint8) []uint16 {
+	files := []uint16{}
+	for _, o := range s.options {
+		if o.otype != otype {
+			continue
+		}
+		for i := 0; i+1 < len(o.value); i += 2 {
+			files = append(files, binary.BigEndian.Uint16(o.value[i:i+2]))
+		}
+	}
+	return files
+}
+
+// indexOptions returns the options of type otype that list the file indices.
+func indexOptions(otype uint8, files []uint16) []option {
+	os := []option{}
+	value := []byte{}
+	for _, f := range files {
+		value = binary.BigEndian.AppendUint16(value, f)
+		if len(value) > 255-2 {
+			os = append(os, option{otype: otype, value: value})
+			value = []byte{}
+		}
+	}
+	if len(value) > 0 {
+		os = append(os, option{otype: otype, value: value})
+	}
+	return os
+}
+
+// compression returns the first compression the client offered that the
+// server supports. Requests for repair packets are not compressed, because
+// the groups of repair packets don't skip the unused chunks of compressed
+// blocks.
+func (s *clientRequest) compression() Compression {
+	if s.fecGroupSize() > 0 {
+		return NoCompression
+	}
+	for _, o := range s.options {
+		if o.otype != optCompression {
+			continue
+		}
+		for _, c := range o.value {
+			if _, ok := codecs[Compression(c)]; ok {
+				return Compression(c)
+			}
+		}
+	}
+	return NoCompression
+}
+
+// priorities returns the priorities the client requested for the files.
+func (s *clientRequest) priorities() map[uint16]uint8 {
+	ps := map[uint16]uint8{}
+	for _, o := range s.options {
+		if o.otype != optPriority {
+			continue
+		}
+		for v := o.value; len(v) >= 3; v = v[3:] {
+			ps[binary.BigEndian.Uint16(v[:2])] = v[2]
+		}
+	}
+	return ps
 }
 
 type fileDescriptor struct {
 	offset   uint64
 	fileName string
+
+	// start and length select a byte range of the file. They are only
+	// transmitted in a clientRangeRequest. A length of 0 requests everything
+	// from start up to the end of the file.
+	start  uint64
+	length uint64
+}
+
+func (f fileDescriptor) isRange() bool {
+	return f.start > 0 || f.length > 0
 }
 
 var maxFileOffset = uint64(math.Pow(2, 56)) - 1
@@ -198,6 +383,9 @@ func (s clientRequest) MarshalBinary() ([]byte, error) {
 }
 
 func (s *clientRequest) UnmarshalBinary(data []byte) error {
+	if len(data) < 6 {
+		return fmt.Errorf("request too short")
+	}
 	s.maxTransmissionRate = binary.BigEndian.Uint32(data[:4])
 	numFiles := binary.BigEndian.Uint16(data[4:6])
 
@@ -209,9 +397,15 @@ func (s *clientRequest) UnmarshalBinary(data []byte) error {
 
 	dataLens := data[6:]
 	for i := uint16(0); i < numFiles; i++ {
+		if len(dataLens) < 9 {
+			return fmt.Errorf("request too short for file %d", i)
+		}
 		f := fileDescriptor{}
 		f.offset = uintOffset(dataLens[:7])
 		pathLen := binary.BigEndian.Uint16(dataLens[7:9])
+		if len(dataLens) < 9+int(pathLen) {
+			return fmt.Errorf("request too short for path of file %d", i)
+		}
 		f.fileName = string(dataLens[9 : 9+pathLen])
 		dataLens = dataLens[9+pathLen:]
 		s.files[i] = f
@@ -220,6 +414,95 @@ func (s *clientRequest) UnmarshalBinary(data []byte) error {
 	return nil
 }
 
+// clientRangeRequest is a clientRequest, whose file descriptors additionally
+// carry a byte range. The offset of a file descriptor is relative to the start
+// of the range.
+type clientRangeRequest struct {
+	clientRequest
+}
+
+func (s clientRangeRequest) MarshalBinary() ([]byte, error) {
+	buf := new(bytes.Buffer)
+
+	err := binary.Write(buf, binary.BigEndian, s.maxTransmissionRate)
+	if err != nil {
+		return nil, err
+	}
+	err = binary.Write(buf, binary.BigEndian, uint16(len(s.files)))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range s.files {
+		if file.offset > maxFileOffset {
+			return nil, errors.New("file offset to big")
+		}
+
+		sb, err := sevenByteOffset(file.offset)
+		if err != nil {
+			return nil, err
+		}
+		err = binary.Write(buf, binary.BigEndian, sb)
+		if err != nil {
+			return nil, err
+		}
+		err = binary.Write(buf, binary.BigEndian, file.start)
+		if err != nil {
+			return nil, err
+		}
+		err = binary.Write(buf, binary.BigEndian, file.length)
+		if err != nil {
+			return nil, err
+		}
+
+		pathBin := []byte(file.fileName)
+		err = binary.Write(buf, binary.BigEndian, uint16(len(pathBin)))
+		if err != nil {
+			return nil, err
+		}
+		_, err = buf.Write(pathBin)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (s *clientRangeRequest) UnmarshalBinary(data []byte) error {
+	if len(data) < 6 {
+		return fmt.Errorf("range request too short")
+	}
+	s.maxTransmissionRate = binary.BigEndian.Uint32(data[:4])
+	numFiles := binary.BigEndian.Uint16(data[4:6])
+
+	if numFiles == 0 {
+		return nil
+	}
+
+	s.files = make([]fileDescriptor, numFiles)
+
+	dataLens := data[6:]
+	for i := uint16(0); i < numFiles; i++ {
+		if len(dataLens) < 25 {
+			return fmt.Errorf("range request too short for file %d", i)
+		}
+		f := fileDescriptor{}
+		f.offset = uintOffset(dataLens[:7])
+		f.start = binary.BigEndian.Uint64(dataLens[7:15])
+		f.length = binary.BigEndian.Uint64(dataLens[15:23])
+		pathLen := binary.BigEndian.Uint16(dataLens[23:25])
+		if len(dataLens) < 25+int(pathLen) {
+			return fmt.Errorf("range request too short for path of file %d", i)
+		}
+		f.fileName = string(dataLens[25 : 25+pathLen])
+		dataLens = dataLens[25+pathLen:]
+		s.files[i] = f
+	}
+
+	return nil
+}
+
 type serverMetaData struct {
 	ackNum    uint8
 	status    MetaDataStatus
@@ -254,6 +537,9 @@ func (s serverMetaData) MarshalBinary() ([]byte, error) {
 }
 
 func (s *serverMetaData) UnmarshalBinary(data []byte) error {
+	if len(data) < 28 {
+		return fmt.Errorf("metadata too short")
+	}
 	s.status = MetaDataStatus(data[1])
 	s.fileIndex = binary.BigEndian.Uint16(data[2:4])
 	s.size = binary.BigEndian.Uint64(data[4:12])
@@ -298,6 +584,9 @@ func (s serverPayload) MarshalBinary() ([]byte, error) {
 }
 
 func (s *serverPayload) UnmarshalBinary(data []byte) error {
+	if len(data) < 9 {
+		return fmt.Errorf("payload too short")
+	}
 	s.fileIndex = binary.BigEndian.Uint16(data[0:2])
 
 	s.offset = uintOffset(data[2:9])
@@ -308,6 +597,109 @@ func (s *serverPayload) UnmarshalBinary(data []byte) error {
 	return nil
 }
 
+// serverRepair is the XOR parity of count consecutive chunks of a file,
+// beginning at offset. A client that misses one of the chunks reconstructs it
+// from the others. Chunks shorter than 1024 bytes are padded with zeros,
+// lengthXOR is the XOR of the lengths of the chunks.
+type serverRepair struct {
+	fileIndex uint16
+	ackNumber uint8
+	offset    uint64
+	count     uint8
+	lengthXOR uint16
+	data      []byte
+}
+
+func (s serverRepair) MarshalBinary() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	err := binary.Write(buf, binary.BigEndian, s.fileIndex)
+	if err != nil {
+		return nil, err
+	}
+	sb, err := sevenByteOffset(s.offset)
+	if err != nil {
+		return nil, err
+	}
+	err = binary.Write(buf, binary.BigEndian, sb)
+	if err != nil {
+		return nil, err
+	}
+	err = binary.Write(buf, binary.BigEndian, s.count)
+	if err != nil {
+		return nil, err
+	}
+	err = binary.Write(buf, binary.BigEndian, s.lengthXOR)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = buf.Write(s.data)
+	return buf.Bytes(), err
+}
+
+func (s *serverRepair) UnmarshalBinary(data []byte) error {
+	if len(data) < 12 {
+		return fmt.Errorf("repair too short")
+	}
+	s.fileIndex = binary.BigEndian.Uint16(data[0:2])
+	s.offset = uintOffset(data[2:9])
+	s.count = data[9]
+	s.lengthXOR = binary.BigEndian.Uint16(data[10:12])
+	if len(data) > 12 {
+		s.data = data[12:]
+	}
+	return nil
+}
+
+// clientSignatures carries the signatures of consecutive blocks of the local
+// copy of a file the client requested as delta, beginning at block first.
+// The copy has blocks blocks of blockSize bytes, a shorter last block is not
+// signed.
+type clientSignatures struct {
+	fileIndex  uint16
+	blockSize  uint32
+	blocks     uint32
+	first      uint32
+	signatures []blockSignature
+}
+
+// blockSignature is the rolling checksum and the first 8 bytes of the MD5
+// checksum of a block.
+type blockSignature struct {
+	weak   uint32
+	strong [8]byte
+}
+
+func (s clientSignatures) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, 14, 14+12*len(s.signatures))
+	binary.BigEndian.PutUint16(buf[0:2], s.fileIndex)
+	binary.BigEndian.PutUint32(buf[2:6], s.blockSize)
+	binary.BigEndian.PutUint32(buf[6:10], s.blocks)
+	binary.BigEndian.PutUint32(buf[10:14], s.first)
+	for _, sig := range s.signatures {
+		buf = binary.BigEndian.AppendUint32(buf, sig.weak)
+		buf = append(buf, sig.strong[:]...)
+	}
+	return buf, nil
+}
+
+func (s *clientSignatures) UnmarshalBinary(data []byte) error {
+	if len(data) < 14 || (len(data)-14)%12 != 0 {
+		return fmt.Errorf("invalid signatures length %v", len(data))
+	}
+	s.fileIndex = binary.BigEndian.Uint16(data[0:2])
+	s.blockSize = binary.BigEndian.Uint32(data[2:6])
+	s.blocks = binary.BigEndian.Uint32(data[6:10])
+	s.first = binary.BigEndian.Uint32(data[10:14])
+	s.signatures = nil
+	for i := 14; i < len(data); i += 12 {
+		sig := blockSignature{weak: binary.BigEndian.Uint32(data[i : i+4])}
+		copy(sig.strong[:], data[i+4:i+12])
+		s.signatures = append(s.signatures, sig)
+	}
+	return nil
+}
+
 type resendEntry struct {
 	fileIndex uint16
 	offset    uint64
@@ -431,6 +823,9 @@ func (c clientAck) MarshalBinary() ([]byte, error) {
 }
 
 func (c *clientAck) UnmarshalBinary(data []byte) error {
+	if len(data) < 14 {
+		return fmt.Errorf("ack too short")
+	}
 	c.fileIndex = binary.BigEndian.Uint16(data[0:2])
 	c.status = uint8(data[2])
 	c.maxTransmissionRate = binary.BigEndian.Uint32(data[3:7])
@@ -497,6 +892,9 @@ func (c closeConnection) MarshalBinary() ([]byte, error) {
 }
 
 func (c *closeConnection) UnmarshalBinary(data []byte) error {
+	if len(data) < 2 {
+		return fmt.Errorf("close too short")
+	}
 	c.reason = CloseConnectionReason(binary.BigEndian.Uint16(data[:2]))
 	return nil
 }
@@ -58,19 +58,19 @@ func TestClientRequestMarshalling(t *testing.T) {
 		"empty": {},
 		"one file": {
 			maxTransmissionRate: 0,
-			files:               []fileDescriptor{{5, "path1"}},
+			files:               []fileDescriptor{{offset: 5, fileName: "path1"}},
 		},
 		"two files": {
 			maxTransmissionRate: 0,
-			files:               []fileDescriptor{{5, "path1"}, {10, "path2"}},
+			files:               []fileDescriptor{{offset: 5, fileName: "path1"}, {offset: 10, fileName: "path2"}},
 		},
 		"whitespace": {
 			maxTransmissionRate: 0,
-			files:               []fileDescriptor{{5, "path 1"}, {10, "path2"}},
+			files:               []fileDescriptor{{offset: 5, fileName: "path 1"}, {offset: 10, fileName: "path2"}},
 		},
 		"new line": {
 			maxTransmissionRate: 0,
-			files:               []fileDescriptor{{5, "path\n1"}, {10, "path \n2"}},
+			files:               []fileDescriptor{{offset: 5, fileName: "path\n1"}, {offset: 10, fileName: "path \n2"}},
 		},
 	}
 
@@ -81,6 +81,31 @@ func TestClientRequestMarshalling(t *testing.T) {
 	}
 }
 
+func TestClientRangeRequestMarshalling(t *testing.T) {
+	tests := map[string]clientRangeRequest{
+		"empty": {},
+		"one range": {clientRequest{
+			files: []fileDescriptor{{fileName: "path1", start: 2048, length: 100}},
+		}},
+		"open range": {clientRequest{
+			files: []fileDescriptor{{offset: 3, fileName: "path1", start: 1}},
+		}},
+		"mixed": {clientRequest{
+			maxTransmissionRate: 10,
+			files: []fileDescriptor{
+				{fileName: "path1"},
+				{offset: 1, fileName: "path 2", start: 1 << 40, length: 1 << 20},
+			},
+		}},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			testConversion(t, &tc, &clientRangeRequest{})
+		})
+	}
+}
+
 func TestFileRequestMarshalling(t *testing.T) {
 	cs := []byte("846e302501dfdab67f93c10f831d7eee")
 	var csa [16]byte
@@ -115,11 +140,38 @@ func TestDataMarshalling(t *testing.T) {
 	}
 }
 
+func TestRepairMarshalling(t *testing.T) {
+	tests := map[string]serverRepair{
+		"empty":    {},
+		"non-zero": {fileIndex: 1, offset: 40, count: 8, lengthXOR: 1000, data: []byte("parity")},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			testConversion(t, &tc, &serverRepair{})
+		})
+	}
+}
+
+func TestSignaturesMarshalling(t *testing.T) {
+	tests := map[string]clientSignatures{
+		"empty": {},
+		"non-zero": {fileIndex: 2, blockSize: 4096, blocks: 300, first: 80, signatures: []blockSignature{
+			{weak: 1, strong: [8]byte{1, 2, 3, 4, 5, 6, 7, 8}},
+			{weak: 1 << 31},
+		}},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			testConversion(t, &tc, &clientSignatures{})
+		})
+	}
+}
+
 func TestAcknowledgementMarshalling(t *testing.T) {
 	tests := map[string]clientAck{
-		"no-missing":   {0, 0, 0, false, 0, 0, nil},
-		"resend-entry": {0, 0, 0, false, 0, 0, []*resendEntry{{0, 1, 2}}},
-		"offset-2":     {0, 0, 0, false, 0, 2, []*resendEntry{{0, 1, 2}}},
+		"no-missing":   {0, 0, 0, 0, 0, nil},
+		"resend-entry": {0, 0, 0, 0, 0, []*resendEntry{{0, 1, 2}}},
+		"offset-2":     {0, 0, 0, 0, 2, []*resendEntry{{0, 1, 2}}},
 	}
 	for name, tc := range tests {
 		t.Run(name, func(t *testing.T) {
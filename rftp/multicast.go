@@ -0,0 +1,504 @@
+package rftp
+
+import (
+	"encoding"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// multicastRepairHoldoff is the time in which a chunk or the metadata of a
+	// file is retransmitted to the group at most once, no matter how many
+	// receivers report it missing.
+	multicastRepairHoldoff = 100 * time.Millisecond
+	// A receiver whose congestion rate falls below the median rate of the
+	// session divided by multicastLaggardRatio continues over unicast, so that
+	// it does not slow down the others.
+	multicastLaggardRatio = 4
+	// multicastTimeout is the time after which a receiver that stopped sending
+	// acks leaves the session.
+	multicastTimeout = 5 * time.Second
+)
+
+// multicastReceiver is a client of a session without a connection of its
+// own.
+type multicastReceiver struct {
+	key    string
+	socket io.Writer
+	stats  *connStats
+	// rate estimates the rate the receiver can take, it is not used to send.
+	rate    *aimd
+	lastAck time.Time
+	// late receivers joined after the first chunk was sent to the group.
+	late bool
+}
+
+type receiverAck struct {
+	receiver string
+	ack      *clientAck
+	size     int
+}
+
+type chunkID struct {
+	file   uint16
+	offset uint64
+}
+
+// multicastSession streams the files of a request once to a multicast group
+// for all receivers that requested the same files. Its connection writes to
+// the group, the caches of the connection are shared with the laggards, the
+// receivers that are served over unicast.
+type multicastSession struct {
+	server  *Server
+	tag     string
+	options []option
+	group   *clientConnection
+	ack     chan receiverAck
+	closed  <-chan struct{}
+
+	// Only used by the writer.
+	repaired         map[chunkID]time.Time
+	metadataRepaired map[uint16]time.Time
+
+	lock      sync.Mutex
+	started   bool // the first chunk was sent to the group
+	read      bool // all chunks were read from the files
+	receivers map[string]*multicastReceiver
+	laggards  map[string]*clientConnection
+}
+
+// joinSession adds the client to the multicast session of its files. It
+// returns false if the client should be served over unicast. The caller must
+// hold clientMux.
+func (s *Server) joinSession(w io.Writer, key string, cr *clientRequest, stats *connStats) bool {
+	if s.multicastGroup == "" {
+		return false
+	}
+	tag := multicastOption(cr.options)
+	if tag == nil || string(tag) != string(multicastTag(cr.files)) {
+		return false
+	}
+	for _, f := range cr.files {
+		if f.offset > 0 || f.isRange() {
+			return false
+		}
+	}
+	if len(cr.deltaFiles()) > 0 || len(cr.contentFiles()) > 0 || len(cr.listingFiles()) > 0 {
+		return false
+	}
+
+	m, ok := s.sessions[string(tag)]
+	if !ok {
+		var err error
+		m, err = s.newSession(tag, cr)
+		if err != nil {
+			s.logger.Warn("failed to start multicast session", "group", s.multicastGroup, "err", err)
+			return false
+		}
+		s.sessions[m.tag] = m
+	}
+
+	m.lock.Lock()
+	m.receivers[key] = &multicastReceiver{
+		key:     key,
+		socket:  statsWriter{w, stats},
+		stats:   stats,
+		rate:    &aimd{congRate: 1000, clock: s.clock},
+		lastAck: s.clock.Now(),
+		late:    m.started,
+	}
+	receivers := len(m.receivers)
+	m.lock.Unlock()
+	s.receivers[key] = m
+	s.metrics.connectionOpened()
+	m.group.logger.Info("receiver joined", "remote", key, "receivers", receivers)
+	return true
+}
+
+func (s *Server) newSession(tag []byte, cr *clientRequest) (*multicastSession, error) {
+	w, err := s.Conn.groupWriter(s.multicastGroup)
+	if err != nil {
+		return nil, err
+	}
+	stats := newConnStats(s.multicastGroup, s.clock.Now())
+	g := &clientConnection{
+		socket:  statsWriter{w, stats},
+		req:     cr,
+		policy:  s.policy,
+		clock:   s.clock,
+		trace:   newConnTrace(s.tracer, s.clock, "server", s.multicastGroup),
+		logger:  s.logger.With("group", s.multicastGroup),
+		stats:   stats,
+		metrics: s.metrics,
+
+		cache:         newPayloadCache(),
+		metadataCache: make(map[uint16]*serverMetaData),
+	}
+	g.cleaner = cleaner{clock: s.clock, cb: func(string) {
+		g.trace.close("done")
+		g.logger.Info("multicast session closed")
+	}}
+	g.openChannels()
+
+	m := &multicastSession{
+		server:           s,
+		tag:              string(tag),
+		options:          []option{{otype: optMulticast, value: tag}},
+		group:            g,
+		ack:              make(chan receiverAck, 1024),
+		closed:           g.cleaner.subscribe(),
+		repaired:         make(map[chunkID]time.Time),
+		metadataRepaired: make(map[uint16]time.Time),
+		receivers:        make(map[string]*multicastReceiver),
+		laggards:         make(map[string]*clientConnection),
+	}
+	go m.writeGroup()
+	s.clock.AfterFunc(s.multicastWait, func() {
+		// streaming waits for the group to be sent
+		go func() {
+			g.streamFiles(s.fh)
+			m.lock.Lock()
+			m.read = true
+			m.lock.Unlock()
+			m.checkStreamed()
+		}()
+	})
+	s.clock.AfterFunc(time.Second, m.sweep)
+	g.logger.Info("multicast session started", "files", len(cr.files))
+	return m, nil
+}
+
+// writeGroup sends the chunks and the metadata to the group, as fast as the
+// slowest receiver allows, and answers the acks of the receivers.
+func (m *multicastSession) writeGroup() {
+	g := m.group
+	rateControl := &aimd{congRate: 1000, clock: g.clock}
+	rateControl.start()
+	defer rateControl.stop()
+
+	send := func(msg encoding.BinaryMarshaler) {
+		if err := sendTo(g.socket, optionsMsg{msg: msg, options: m.options}); err != nil {
+			g.logger.Warn("failed to send packet", "err", err)
+		}
+		rateControl.onSend()
+		g.trace.packetSent(msg)
+	}
+	sendMetadata := func(md *serverMetaData) {
+		g.logger.Debug("sending metadata", "file", md.fileIndex, "status", md.status, "size", md.size)
+		g.metadataCache[md.fileIndex] = md
+		send(*md)
+		m.forwardMetadata(md)
+	}
+
+	for !g.cleaner.closed() {
+		if rateControl.isAvailable() {
+			select {
+			case pl := <-g.resend:
+				if debugEnabled(g.logger) {
+					g.logger.Debug("resending payload", "file", pl.fileIndex, "offset", pl.offset)
+				}
+				send(g.cache.message(pl))
+				atomic.AddUint64(&g.stats.retransmissions, 1)
+				continue
+
+			case ra := <-m.ack:
+				m.handleAck(ra, rateControl, send)
+
+			default:
+			}
+			select {
+			case md := <-g.metadata:
+				sendMetadata(md)
+
+			case ch := <-g.payload:
+				if ch.metadata != nil {
+					sendMetadata(ch.metadata)
+					m.checkStreamed()
+					break
+				}
+				m.lock.Lock()
+				m.started = true
+				m.lock.Unlock()
+				g.cache.save(ch)
+				send(optionsMsg{msg: *ch.payload, options: ch.options})
+				if ch.repair != nil {
+					send(*ch.repair)
+				}
+				m.checkStreamed()
+
+			case ra := <-m.ack:
+				m.handleAck(ra, rateControl, send)
+
+			case <-m.closed:
+				return
+			}
+		} else {
+			select {
+			case <-rateControl.awaitAvailable():
+			case ra := <-m.ack:
+				m.handleAck(ra, rateControl, send)
+			case <-m.closed:
+				return
+			}
+		}
+	}
+}
+
+// handleAck updates the rate of the receiver and of the session and
+// retransmits the chunks the receiver misses, unless they were retransmitted
+// just before because of another receiver.
+func (m *multicastSession) handleAck(ra receiverAck, rateControl *aimd, send func(encoding.BinaryMarshaler)) {
+	g := m.group
+	m.lock.Lock()
+	r, ok := m.receivers[ra.receiver]
+	if ok {
+		r.lastAck = g.clock.Now()
+		r.stats.received(ra.size)
+		r.rate.onAck(ra.ack)
+		r.stats.setRates(r.rate.congRate, r.rate.flowRate)
+		atomic.AddUint64(&r.stats.resendEntries, uint64(len(ra.ack.resendEntries)))
+	}
+	laggard := ok && m.isLaggard(r)
+	m.lock.Unlock()
+	if !ok {
+		return
+	}
+	if laggard {
+		m.toUnicast(r, ra.ack)
+		return
+	}
+	m.adaptRate(rateControl)
+
+	now := g.clock.Now()
+	metadata := map[uint16]struct{}{}
+	if ra.ack.status == metaDataMissing {
+		metadata[ra.ack.fileIndex] = struct{}{}
+	}
+	for _, re := range ra.ack.resendEntries {
+		length := uint64(re.length)
+		if length == 0 {
+			metadata[re.fileIndex] = struct{}{}
+			length = 1
+		}
+		for i := uint64(0); i < length; i++ {
+			id := chunkID{re.fileIndex, re.offset + i}
+			if t, ok := m.repaired[id]; ok && now.Sub(t) < multicastRepairHoldoff {
+				continue
+			}
+			p, ok := g.cache.get(id.file, id.offset)
+			if !ok {
+				break
+			}
+			m.repaired[id] = now
+			g.trace.resendScheduled(p)
+			select {
+			case g.resend <- p:
+			default:
+			}
+		}
+	}
+	for file := range metadata {
+		md, ok := g.metadataCache[file]
+		if !ok {
+			continue
+		}
+		if t, ok := m.metadataRepaired[file]; ok && now.Sub(t) < multicastRepairHoldoff {
+			continue
+		}
+		m.metadataRepaired[file] = now
+		send(*md)
+	}
+}
+
+// isLaggard returns whether the receiver joined late or can take much less
+// than the others. The session keeps at least one receiver. The lock must be
+// held.
+func (m *multicastSession) isLaggard(r *multicastReceiver) bool {
+	if r.late {
+		return true
+	}
+	if len(m.receivers) < 2 {
+		return false
+	}
+	rates := make([]int, 0, len(m.receivers))
+	for _, o := range m.receivers {
+		rates = append(rates, int(o.rate.congRate))
+	}
+	sort.Ints(rates)
+	median := rates[len(rates)/2]
+	return int(r.rate.congRate)*multicastLaggardRatio < median
+}
+
+// adaptRate limits the session to the rate of its slowest receiver.
+func (m *multicastSession) adaptRate(rateControl *aimd) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if len(m.receivers) == 0 {
+		return
+	}
+	congRate, flowRate := uint32(0), uint32(0)
+	for _, r := range m.receivers {
+		if congRate == 0 || r.rate.congRate < congRate {
+			congRate = r.rate.congRate
+		}
+		if r.rate.flowRate > 0 && (flowRate == 0 || r.rate.flowRate < flowRate) {
+			flowRate = r.rate.flowRate
+		}
+	}
+	if rateControl.congRate != congRate || rateControl.flowRate != flowRate {
+		rateControl.congRate, rateControl.flowRate = congRate, flowRate
+		m.group.stats.setRates(congRate, flowRate)
+		m.group.trace.rateUpdated(congRate, flowRate)
+		if rateControl.isAvailable() {
+			rateControl.notifyAvailable()
+		}
+	}
+}
+
+// toUnicast moves the receiver to a connection of its own, which retransmits
+// the chunks it misses from the cache of the session. The receiver still gets
+// the chunks that are sent to the group.
+func (m *multicastSession) toUnicast(r *multicastReceiver, ack *clientAck) {
+	s := m.server
+	s.clientMux.Lock()
+	defer s.clientMux.Unlock()
+
+	c := s.newClientConnection(r.socket, r.key, m.group.req, r.stats)
+	// The writer of the session is the only one that accesses the metadata
+	// cache, the copy is made before the connection starts.
+	c.cache = m.group.cache
+	for k, md := range m.group.metadataCache {
+		cp := *md
+		c.metadataCache[k] = &cp
+	}
+	c.onClose = func() {
+		m.leave(r.key)
+	}
+
+	m.lock.Lock()
+	delete(m.receivers, r.key)
+	m.laggards[r.key] = c
+	m.lock.Unlock()
+	delete(s.receivers, r.key)
+	s.clients[r.key] = c
+
+	c.startResponse()
+	c.cleaner.refresh(5 * time.Second)
+	c.cleaner.checkTimeout()
+	c.ack <- ack
+	c.logger.Info("receiver continues over unicast", "late", r.late, "rate", r.rate.congRate)
+}
+
+// forwardMetadata sends the metadata to the laggards as well, so that they
+// can retransmit it.
+func (m *multicastSession) forwardMetadata(md *serverMetaData) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, c := range m.laggards {
+		cp := *md
+		select {
+		case c.metadata <- &cp:
+		default:
+		}
+	}
+}
+
+// checkStreamed makes the session unavailable for new receivers after all
+// chunks were sent to the group.
+func (m *multicastSession) checkStreamed() {
+	m.lock.Lock()
+	done := m.read && len(m.group.payload) == 0
+	m.lock.Unlock()
+	if !done {
+		return
+	}
+	s := m.server
+	s.clientMux.Lock()
+	defer s.clientMux.Unlock()
+	if s.sessions[m.tag] == m {
+		delete(s.sessions, m.tag)
+	}
+}
+
+// sweep removes the receivers that stopped sending acks.
+func (m *multicastSession) sweep() {
+	s := m.server
+	s.clientMux.Lock()
+	defer s.clientMux.Unlock()
+	if m.group.cleaner.closed() {
+		return
+	}
+
+	m.lock.Lock()
+	timedOut := []*multicastReceiver{}
+	for _, r := range m.receivers {
+		if s.clock.Now().Sub(r.lastAck) > multicastTimeout {
+			timedOut = append(timedOut, r)
+		}
+	}
+	m.lock.Unlock()
+	for _, r := range timedOut {
+		m.removeReceiver(r, "timeout")
+	}
+	if !m.group.cleaner.closed() {
+		s.clock.AfterFunc(time.Second, m.sweep)
+	}
+}
+
+// closeReceiver removes the receiver after it closed the connection.
+func (m *multicastSession) closeReceiver(key string) {
+	s := m.server
+	s.clientMux.Lock()
+	defer s.clientMux.Unlock()
+	m.lock.Lock()
+	r, ok := m.receivers[key]
+	m.lock.Unlock()
+	if ok {
+		m.removeReceiver(r, "close")
+	}
+}
+
+// removeReceiver closes the connection of the receiver for the reason. The
+// caller must hold clientMux.
+func (m *multicastSession) removeReceiver(r *multicastReceiver, reason string) {
+	s := m.server
+	r.stats.close(s.clock.Now())
+	if s.statsHandler != nil {
+		s.statsHandler(r.stats.snapshot())
+	}
+	delete(s.receivers, r.key)
+	s.metrics.connectionClosed(reason, r.stats.snapshot())
+	m.leave(r.key)
+}
+
+// leave removes the receiver or laggard from the session and closes the
+// session after the last one left. The caller must hold clientMux.
+func (m *multicastSession) leave(key string) {
+	m.lock.Lock()
+	delete(m.receivers, key)
+	delete(m.laggards, key)
+	empty := len(m.receivers) == 0 && len(m.laggards) == 0
+	m.lock.Unlock()
+	m.group.logger.Info("receiver left", "remote", key)
+	if !empty {
+		return
+	}
+	if s := m.server; s.sessions[m.tag] == m {
+		delete(s.sessions, m.tag)
+	}
+	m.group.cleaner.close()
+}
+
+// receiverStats returns the statistics of a receiver of the session.
+func (m *multicastSession) receiverStats(key string) (Stats, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	r, ok := m.receivers[key]
+	if !ok {
+		return Stats{}, false
+	}
+	return r.stats.snapshot(), true
+}
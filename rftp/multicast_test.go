@@ -0,0 +1,141 @@
+package rftp
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testGroup = "239.0.0.1:9001"
+
+func multicastDownload(network *MemNetwork, lossSim LossSimulator, name string, want []byte) error {
+	conn := network.NewConnection()
+	if lossSim != nil {
+		conn.LossSim(lossSim)
+	}
+	client := &Client{Conn: conn, Multicast: testGroup}
+	reqs, err := client.Request("localhost:2020", []string{name})
+	if err != nil {
+		return err
+	}
+	got, err := ioutil.ReadAll(reqs[0])
+	if err != nil {
+		return err
+	}
+	if err := reqs[0].err(); err != nil {
+		return err
+	}
+	if !bytes.Equal(got, want) {
+		return fmt.Errorf("received %v bytes that differ from the %v sent bytes", len(got), len(want))
+	}
+	return nil
+}
+
+func TestMulticast(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	files := map[string][]byte{}
+	for _, name := range []string{"a", "b"} {
+		files[name] = make([]byte, 200*1024+10)
+		rng.Read(files[name])
+	}
+
+	tests := map[string]struct {
+		files []string
+		loss  bool
+	}{
+		"receivers":     {files: []string{"a", "a", "a", "a"}},
+		"loss":          {files: []string{"a", "a", "a", "a"}, loss: true},
+		"two sessions":  {files: []string{"a", "b", "a", "b"}},
+		"one receiver":  {files: []string{"a"}},
+		"lossy session": {files: []string{"b", "b"}, loss: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			network := NewMemNetwork()
+			server := NewServer()
+			server.SetMulticast(testGroup, 100*time.Millisecond)
+			stop := startMemServerWith(t, server, network, ":2020", files)
+			defer stop()
+
+			var wg sync.WaitGroup
+			for i, f := range tc.files {
+				var lossSim LossSimulator
+				if tc.loss {
+					lossSim = NewMarkovLossSimulator(0.02, 0.3, NewRand(1, uint64(i)))
+				}
+				wg.Add(1)
+				go func(f string) {
+					defer wg.Done()
+					if err := multicastDownload(network, lossSim, f, files[f]); err != nil {
+						t.Errorf("%v: %v", f, err)
+					}
+				}(f)
+			}
+			wg.Wait()
+
+			// Without loss, the receivers get the chunks from the group, not
+			// from their own connection.
+			stats := server.Stats()
+			if !tc.loss && len(stats) != len(tc.files) {
+				t.Errorf("got stats of %v receivers, want %v", len(stats), len(tc.files))
+			}
+			for _, s := range stats {
+				if !tc.loss && s.BytesSent > 0 {
+					t.Errorf("%v: server sent %v bytes over unicast", s.Remote, s.BytesSent)
+				}
+			}
+		})
+	}
+}
+
+func TestMulticastLateReceiver(t *testing.T) {
+	data := make([]byte, 2*1024*1024)
+	rand.New(rand.NewSource(2)).Read(data)
+	network := NewMemNetwork()
+	server := NewServer()
+	server.SetMulticast(testGroup, 0)
+	stop := startMemServerWith(t, server, network, ":2020", map[string][]byte{"file": data})
+	defer stop()
+
+	client := &Client{Conn: network.NewConnection(), Multicast: testGroup}
+	reqs, err := client.Request("localhost:2020", []string{"file"})
+	if err != nil {
+		t.Fatalf("Request() error = %v", err)
+	}
+	errs := make(chan error, 2)
+	go func() {
+		got, err := ioutil.ReadAll(reqs[0])
+		if err == nil && !bytes.Equal(got, data) {
+			err = fmt.Errorf("received data differs")
+		}
+		errs <- err
+	}()
+	// The second receiver misses the first chunks and has to catch up over
+	// unicast.
+	for reqs[0].Received() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	go func() {
+		errs <- multicastDownload(network, nil, "file", data)
+	}()
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+
+	unicast := 0
+	for _, s := range server.Stats() {
+		if s.BytesSent > 0 {
+			unicast++
+		}
+	}
+	if unicast != 1 {
+		t.Errorf("%v receivers caught up over unicast, want 1", unicast)
+	}
+}
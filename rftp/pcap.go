@@ -0,0 +1,221 @@
+package rftp
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	pcapngSectionHeader   = 0x0a0d0d0a
+	pcapngInterface       = 0x00000001
+	pcapngEnhancedPacket  = 0x00000006
+	pcapngByteOrderMagic  = 0x1a2b3c4d
+	pcapngOptionEnd       = 0
+	pcapngOptionTsresol   = 9
+	pcapngOptionEpbFlags  = 2
+	pcapngFlagInbound     = 1
+	pcapngFlagOutbound    = 2
+	linkTypeRaw           = 101
+	pcapngTimestampPerSec = 1000000 // if_tsresol 6, i.e., microseconds
+)
+
+// PcapWriter writes datagrams to a pcapng file. Each datagram is encapsulated
+// in an IPv4 and UDP header, so that Wireshark can open the file. The
+// direction of a datagram is stored in the flags of its packet block. A
+// PcapWriter can be shared by several connections.
+type PcapWriter struct {
+	lock sync.Mutex
+	w    io.Writer
+	err  error
+}
+
+// NewPcapWriter writes the file header to w and returns a PcapWriter that
+// appends datagrams to it.
+func NewPcapWriter(w io.Writer) (*PcapWriter, error) {
+	p := &PcapWriter{w: w}
+
+	shb := make([]byte, 16)
+	binary.LittleEndian.PutUint32(shb[0:], pcapngByteOrderMagic)
+	binary.LittleEndian.PutUint16(shb[4:], 1) // major version
+	binary.LittleEndian.PutUint16(shb[6:], 0) // minor version
+	// section length is unknown
+	binary.LittleEndian.PutUint64(shb[8:], 0xffffffffffffffff)
+	if err := p.writeBlock(pcapngSectionHeader, shb); err != nil {
+		return nil, err
+	}
+
+	idb := make([]byte, 8)
+	binary.LittleEndian.PutUint16(idb[0:], linkTypeRaw)
+	binary.LittleEndian.PutUint32(idb[4:], 0) // no snap length
+	idb = appendPcapngOption(idb, pcapngOptionTsresol, []byte{6})
+	idb = appendPcapngOption(idb, pcapngOptionEnd, nil)
+	if err := p.writeBlock(pcapngInterface, idb); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func appendPcapngOption(b []byte, code uint16, value []byte) []byte {
+	hdr := make([]byte, 4)
+	binary.LittleEndian.PutUint16(hdr[0:], code)
+	binary.LittleEndian.PutUint16(hdr[2:], uint16(len(value)))
+	b = append(b, hdr...)
+	b = append(b, value...)
+	return append(b, make([]byte, pad4(len(value)))...)
+}
+
+func pad4(n int) int {
+	return (4 - n%4) % 4
+}
+
+func (p *PcapWriter) writeBlock(blockType uint32, body []byte) error {
+	total := 12 + len(body)
+	b := make([]byte, 8, total)
+	binary.LittleEndian.PutUint32(b[0:], blockType)
+	binary.LittleEndian.PutUint32(b[4:], uint32(total))
+	b = append(b, body...)
+	b = append(b, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(b[total-4:], uint32(total))
+	_, err := p.w.Write(b)
+	return err
+}
+
+// WriteDatagram records a datagram that was sent from src to dst. outbound
+// tells whether the datagram was sent or received by the recording endpoint.
+func (p *PcapWriter) WriteDatagram(t time.Time, src, dst net.Addr, outbound bool, data []byte) error {
+	pkt := encapsulateUDP(src, dst, data)
+
+	ts := uint64(t.UnixNano() / (int64(time.Second) / pcapngTimestampPerSec))
+	epb := make([]byte, 20, 20+len(pkt)+16)
+	binary.LittleEndian.PutUint32(epb[0:], 0) // interface
+	binary.LittleEndian.PutUint32(epb[4:], uint32(ts>>32))
+	binary.LittleEndian.PutUint32(epb[8:], uint32(ts))
+	binary.LittleEndian.PutUint32(epb[12:], uint32(len(pkt)))
+	binary.LittleEndian.PutUint32(epb[16:], uint32(len(pkt)))
+	epb = append(epb, pkt...)
+	epb = append(epb, make([]byte, pad4(len(pkt)))...)
+
+	flags := make([]byte, 4)
+	if outbound {
+		binary.LittleEndian.PutUint32(flags, pcapngFlagOutbound)
+	} else {
+		binary.LittleEndian.PutUint32(flags, pcapngFlagInbound)
+	}
+	epb = appendPcapngOption(epb, pcapngOptionEpbFlags, flags)
+	epb = appendPcapngOption(epb, pcapngOptionEnd, nil)
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.err != nil {
+		return p.err
+	}
+	p.err = p.writeBlock(pcapngEnhancedPacket, epb)
+	return p.err
+}
+
+// captureAddr maps an address to an IPv4 address and a port. Addresses of
+// other networks, e.g., of a MemNetwork, get a stable made up IP address.
+func captureAddr(a net.Addr) (net.IP, uint16) {
+	if a == nil {
+		return net.IPv4zero.To4(), 0
+	}
+	if udp, ok := a.(*net.UDPAddr); ok {
+		ip := udp.IP.To4()
+		if ip == nil {
+			ip = net.IPv4zero.To4()
+		}
+		return ip, uint16(udp.Port)
+	}
+
+	host, port, err := net.SplitHostPort(a.String())
+	if err != nil {
+		host = a.String()
+	}
+	p, _ := strconv.ParseUint(port, 10, 16)
+	if ip := net.ParseIP(host).To4(); ip != nil {
+		return ip, uint16(p)
+	}
+	if host == "localhost" {
+		return net.IPv4(127, 0, 0, 1).To4(), uint16(p)
+	}
+	h := fnv.New32a()
+	h.Write([]byte(host))
+	sum := h.Sum32()
+	return net.IPv4(10, byte(sum>>16), byte(sum>>8), byte(sum)).To4(), uint16(p)
+}
+
+// encapsulateUDP prepends an IPv4 and a UDP header to data.
+func encapsulateUDP(src, dst net.Addr, data []byte) []byte {
+	srcIP, srcPort := captureAddr(src)
+	dstIP, dstPort := captureAddr(dst)
+
+	pkt := make([]byte, 28+len(data))
+	ip := pkt[:20]
+	ip[0] = 0x45 // version 4, header length 5 words
+	binary.BigEndian.PutUint16(ip[2:], uint16(len(pkt)))
+	binary.BigEndian.PutUint16(ip[6:], 0x4000) // don't fragment
+	ip[8] = 64                                 // TTL
+	ip[9] = 17                                 // UDP
+	copy(ip[12:16], srcIP)
+	copy(ip[16:20], dstIP)
+	binary.BigEndian.PutUint16(ip[10:], ipChecksum(ip))
+
+	udp := pkt[20:28]
+	binary.BigEndian.PutUint16(udp[0:], srcPort)
+	binary.BigEndian.PutUint16(udp[2:], dstPort)
+	binary.BigEndian.PutUint16(udp[4:], uint16(8+len(data)))
+	// a checksum of 0 means none for UDP over IPv4
+	copy(pkt[28:], data)
+	return pkt
+}
+
+func ipChecksum(hdr []byte) uint16 {
+	sum := uint32(0)
+	for i := 0; i+1 < len(hdr); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(hdr[i:]))
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
+
+// recordingConn records all datagrams that are sent and received on a
+// net.PacketConn.
+type recordingConn struct {
+	net.PacketConn
+	w      *PcapWriter
+	logger *slog.Logger
+}
+
+// NewRecordingPacketConn records every datagram that is sent or received on
+// conn to w.
+func NewRecordingPacketConn(conn net.PacketConn, w *PcapWriter) net.PacketConn {
+	return &recordingConn{PacketConn: conn, w: w, logger: silentLogger}
+}
+
+func (c *recordingConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(b)
+	if err == nil {
+		if err := c.w.WriteDatagram(time.Now(), addr, c.LocalAddr(), false, b[:n]); err != nil {
+			c.logger.Warn("failed to record datagram", "err", err)
+		}
+	}
+	return n, addr, err
+}
+
+func (c *recordingConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	n, err := c.PacketConn.WriteTo(b, addr)
+	if err == nil {
+		if err := c.w.WriteDatagram(time.Now(), c.LocalAddr(), addr, true, b); err != nil {
+			c.logger.Warn("failed to record datagram", "err", err)
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,92 @@
+package rftp
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestPcapRoundTrip(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w, err := NewPcapWriter(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	network := NewMemNetwork()
+	data := bytes.Repeat([]byte("pcap"), 1000)
+	stop := startMemServer(t, network, ":2020", map[string][]byte{"file": data})
+	defer stop()
+
+	conn := network.NewConnection()
+	conn.Record(w)
+	client := &Client{Conn: conn}
+	reqs, err := client.Request("localhost:2020", []string{"file"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(reqs[0]); err != nil {
+		t.Fatal(err)
+	}
+	// the client may still be closing the connection
+	w.lock.Lock()
+	capture := append([]byte(nil), buf.Bytes()...)
+	w.lock.Unlock()
+
+	r, err := NewCaptureReader(bytes.NewReader(capture))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2020}
+	types := map[string]int{}
+	for i := 0; ; i++ {
+		d, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Next() error = %v", err)
+		}
+
+		desc := DescribeDatagram(d.Data)
+		types[strings.Fields(desc)[1]]++
+		if i == 0 && (d.Direction != Outbound || !strings.Contains(desc, `request`) || d.Dst.String() != server.String()) {
+			t.Errorf("first datagram = %v %v > %v %v, want outbound request to %v",
+				d.Direction, d.Src, d.Dst, desc, server)
+		}
+		if d.Direction == Inbound && d.Src.String() != server.String() {
+			t.Errorf("inbound datagram from %v, want from %v", d.Src, server)
+		}
+	}
+
+	want := map[string]int{"request": 1, "metadata": 1, "payload": 4}
+	for typ, n := range want {
+		if types[typ] < n {
+			t.Errorf("captured %v %v datagrams, want at least %v", types[typ], typ, n)
+		}
+	}
+}
+
+func TestDescribeDatagram(t *testing.T) {
+	buf := &bytes.Buffer{}
+	ack := clientAck{
+		ackNumber:     3,
+		fileIndex:     1,
+		offset:        7,
+		resendEntries: []*resendEntry{{fileIndex: 1, offset: 5, length: 2}},
+	}
+	if err := sendTo(buf, ack); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "v1 ack ack=3 file=1 offset=7 status=0 rate=0 resend=1 [file=1 offset=5 len=2]"
+	if got := DescribeDatagram(buf.Bytes()); got != want {
+		t.Errorf("DescribeDatagram() = %q, want %q", got, want)
+	}
+	if got := DescribeDatagram([]byte{0x13, 0}); !strings.HasPrefix(got, "invalid header") {
+		t.Errorf("DescribeDatagram() of a truncated datagram = %q", got)
+	}
+}
@@ -39,7 +39,8 @@ type aimd struct {
 	lastAck               uint8
 	decreaseCoolOffPeriod uint8
 
-	resetTicker         *time.Ticker
+	clock               Clock
+	resetTicker         Ticker
 	closedTicker        chan struct{}
 	availableChan       chan struct{}
 	notifyAvailableLock sync.Mutex
@@ -48,20 +49,25 @@ type aimd struct {
 var _ RateControl = (*aimd)(nil)
 
 func (c *aimd) start() {
-	c.resetTicker = time.NewTicker(1 * time.Second)
+	if c.clock == nil {
+		c.clock = systemClock{}
+	}
+	c.resetTicker = c.clock.NewTicker(1 * time.Second)
 	c.closedTicker = make(chan struct{}, 1)
 	c.availableChan = make(chan struct{}, 1)
 	c.notifyAvailableLock = sync.Mutex{}
 
+	// The first period starts right away, not when the goroutine runs.
+	c.notifyAvailable()
 	go func() {
 		for {
-			atomic.StoreUint32(&c.sent, 0)
-			c.notifyAvailable()
 			select {
-			case <-c.resetTicker.C:
+			case <-c.resetTicker.C():
 			case <-c.closedTicker:
 				return
 			}
+			atomic.StoreUint32(&c.sent, 0)
+			c.notifyAvailable()
 		}
 	}()
 }
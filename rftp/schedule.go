@@ -0,0 +1,108 @@
+package rftp
+
+import (
+	"fmt"
+	"sort"
+)
+
+// SchedulingPolicy decides in which order the server streams the chunks of
+// the files of a single request.
+type SchedulingPolicy uint8
+
+const (
+	// Sequential streams one file after another in the order of the request.
+	Sequential SchedulingPolicy = iota
+	// RoundRobin interleaves the chunks of all files of a request.
+	RoundRobin
+	// SmallestFirst streams the smallest remaining file first.
+	SmallestFirst
+	// ClientPriority streams the files with the highest priority requested by
+	// the client first. Files of the same priority are interleaved.
+	ClientPriority
+)
+
+func (p SchedulingPolicy) String() string {
+	switch p {
+	case Sequential:
+		return "sequential"
+	case RoundRobin:
+		return "round-robin"
+	case SmallestFirst:
+		return "smallest-first"
+	case ClientPriority:
+		return "priority"
+	}
+	return fmt.Sprintf("unknown policy: %d", uint8(p))
+}
+
+// ParseSchedulingPolicy returns the policy with the given name as returned by
+// SchedulingPolicy.String.
+func ParseSchedulingPolicy(name string) (SchedulingPolicy, error) {
+	for _, p := range []SchedulingPolicy{Sequential, RoundRobin, SmallestFirst, ClientPriority} {
+		if p.String() == name {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown scheduling policy %q", name)
+}
+
+// streamScheduler picks the file from which the next chunk is read.
+type streamScheduler struct {
+	policy SchedulingPolicy
+	files  []*fileReader
+	next   int
+}
+
+func newStreamScheduler(policy SchedulingPolicy, files []*fileReader) *streamScheduler {
+	s := &streamScheduler{
+		policy: policy,
+		files:  files,
+	}
+	switch policy {
+	case SmallestFirst:
+		sort.SliceStable(s.files, func(i, j int) bool {
+			return s.files[i].sr.Size() < s.files[j].sr.Size()
+		})
+	case ClientPriority:
+		sort.SliceStable(s.files, func(i, j int) bool {
+			return s.files[i].priority > s.files[j].priority
+		})
+	}
+	return s
+}
+
+func (s *streamScheduler) empty() bool {
+	return len(s.files) == 0
+}
+
+// pick returns the file that should send the next chunk.
+func (s *streamScheduler) pick() *fileReader {
+	if s.empty() {
+		return nil
+	}
+	n := 1
+	switch s.policy {
+	case RoundRobin:
+		n = len(s.files)
+	case ClientPriority:
+		for n < len(s.files) && s.files[n].priority == s.files[0].priority {
+			n++
+		}
+	}
+	i := s.next % n
+	s.next = i + 1
+	return s.files[i]
+}
+
+// remove removes a file that has been sent completely.
+func (s *streamScheduler) remove(fr *fileReader) {
+	for i, f := range s.files {
+		if f == fr {
+			s.files = append(s.files[:i], s.files[i+1:]...)
+			if i < s.next {
+				s.next--
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package rftp
+
+import (
+	"bytes"
+	"crypto/md5"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestStreamScheduler(t *testing.T) {
+	// sizes in chunks and priorities of the files
+	sizes := []int{3, 1, 2}
+	priorities := []uint8{0, 1, 1}
+
+	tests := map[SchedulingPolicy][]uint16{
+		Sequential:     {0, 0, 0, 1, 2, 2},
+		RoundRobin:     {0, 1, 2, 0, 2, 0},
+		SmallestFirst:  {1, 2, 2, 0, 0, 0},
+		ClientPriority: {1, 2, 2, 0, 0, 0},
+	}
+
+	for policy, want := range tests {
+		t.Run(policy.String(), func(t *testing.T) {
+			files := []*fileReader{}
+			for i, size := range sizes {
+				data := make([]byte, size*1024)
+				files = append(files, &fileReader{
+					index:    uint16(i),
+					sr:       io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data))),
+					hasher:   md5.New(),
+					priority: priorities[i],
+				})
+			}
+
+			s := newStreamScheduler(policy, files)
+			got := []uint16{}
+			for !s.empty() {
+				fr := s.pick()
+				p, done := fr.nextChunk()
+				if p != nil {
+					got = append(got, p.fileIndex)
+				}
+				if done {
+					s.remove(fr)
+				}
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got chunks of files %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestPriorityOptions(t *testing.T) {
+	priorities := make([]uint8, 300)
+	for i := range priorities {
+		priorities[i] = uint8(i % 7)
+	}
+	req := clientRequest{options: priorityOptions(priorities)}
+	got := req.priorities()
+	for i, p := range priorities {
+		if got[uint16(i)] != p {
+			t.Errorf("priority of file %v = %v, want %v", i, got[uint16(i)], p)
+		}
+	}
+}
@@ -5,57 +5,182 @@ import (
 	"fmt"
 	"hash"
 	"io"
-	"log"
+	"log/slog"
 	"net"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type FileHandler func(name string) (*io.SectionReader, error)
 
 type fileReader struct {
-	index  uint16
-	offset uint64
-	sr     *io.SectionReader
-	hasher hash.Hash
+	index    uint16
+	offset   uint64 // of the next chunk
+	sr       *io.SectionReader
+	hasher   hash.Hash
+	status   MetaDataStatus
+	priority uint8
+	fec      *fecEncoder
+	logger   *slog.Logger
+
+	// The chunks of compressed files are read block by block.
+	compression  Compression
+	blockOptions []option // of the chunks of the current block
+	pending      []*serverPayload
+	eof          bool
+
+	// delta is set, if sr is the delta of the file to the copy of the client.
+	delta *delta
+}
+
+// repair returns the repair packet to send after p, if p completes an FEC
+// group or is the last chunk of the file.
+func (fr *fileReader) repair(p *serverPayload, done bool) *serverRepair {
+	if fr.fec == nil {
+		return nil
+	}
+	if r := fr.fec.add(p); r != nil || !done {
+		return r
+	}
+	return fr.fec.flush()
+}
+
+// sendChunk is a payload with the options of its header and the repair packet
+// to send right after it, if any. The metadata of a streamed file is queued as
+// a chunk without payload after the last one of the file.
+type sendChunk struct {
+	payload  *serverPayload
+	options  []option
+	repair   *serverRepair
+	metadata *serverMetaData
+}
+
+// selectRange restricts sr to length bytes beginning at start. Ranges that
+// exceed the end of the file are clamped, ranges that start behind the end of
+// the file are rejected.
+func selectRange(sr *io.SectionReader, start, length uint64) (*io.SectionReader, MetaDataStatus) {
+	size := uint64(sr.Size())
+	if size == 0 {
+		return sr, noErr
+	}
+	if start >= size {
+		return nil, offsetTooBig
+	}
+	if length == 0 || length > size-start {
+		length = size - start
+	}
+	return io.NewSectionReader(sr, int64(start), int64(length)), noErr
 }
 
 type clientConnection struct {
 	rtt           time.Duration
 	req           *clientRequest
-	payload       chan *serverPayload
+	policy        SchedulingPolicy
+	payload       chan sendChunk
 	resend        chan *serverPayload
 	metadata      chan *serverMetaData
 	ack           chan *clientAck
 	reschedule    chan *clientAck
+	rescheduled   chan struct{} // the resends of an ack are queued
 	resendDone    chan *serverPayload
 	rescheduledAt map[uint64]time.Time
 	cclose        chan *closeConnection
 	socket        io.Writer
+	clock         Clock
+	trace         *connTrace
+	logger        *slog.Logger
+	stats         *connStats
+	metrics       *serverMetrics
 
 	cleaner cleaner
+	// onClose is called with clientMux held after the connection is closed.
+	onClose func()
+
+	metadataCache map[uint16]*serverMetaData
+	cache         *payloadCache
+	// deltas is set, if files are requested as delta. The response starts
+	// once their signatures arrived.
+	deltas *deltaRequest
+	// content opens the files in byContent, which are requested by their
+	// checksum.
+	content   ContentHandler
+	byContent map[uint16]bool
+	// listing returns the listings of the directories in listings.
+	listing  ListingHandler
+	listings map[uint16]bool
+	// opened are the files that are opened before the response starts.
+	opened map[uint16]*io.SectionReader
+}
+
+// payloadCache keeps the sent payloads and the options of their headers for
+// retransmissions. The laggards of a multicast session share the cache of the
+// session.
+type payloadCache struct {
+	lock     sync.Mutex
+	payloads map[uint16]map[uint64]sendChunk
+}
 
-	metadataCache    map[uint16]*serverMetaData
-	payloadCache     map[uint16]map[uint64]*serverPayload
-	payloadCacheLock sync.Mutex
+func newPayloadCache() *payloadCache {
+	return &payloadCache{payloads: make(map[uint16]map[uint64]sendChunk)}
 }
 
 func (c *clientConnection) writeResponse() {
-	log.Println("start writing response packets")
+	c.logger.Debug("start writing response packets")
 	lastAck := uint8(0)
-	rateControl := &aimd{congRate: 1000}
+	rateControl := &aimd{congRate: 1000, clock: c.clock}
 	rateControl.start()
 	defer rateControl.stop()
 
+	closeChan := c.cleaner.subscribe()
+
 	handleAck := func(ack *clientAck) {
 		lastAck = ack.ackNumber
+		congRate, flowRate := rateControl.congRate, rateControl.flowRate
 		rateControl.onAck(ack)
+		c.stats.setRates(rateControl.congRate, rateControl.flowRate)
+		atomic.AddUint64(&c.stats.resendEntries, uint64(len(ack.resendEntries)))
+		c.trace.ackProcessed(ack)
+		if rateControl.congRate != congRate || rateControl.flowRate != flowRate {
+			c.trace.rateUpdated(rateControl.congRate, rateControl.flowRate)
+		}
+		// The resends of the ack go out before further payloads.
 		c.reschedule <- ack
+		select {
+		case <-c.rescheduled:
+		case <-closeChan:
+		}
 		c.cleaner.refresh(5 * time.Second) // TODO: replace by 500 + RTT * 3 or something
 	}
 
-	closeChan := c.cleaner.subscribe()
+	resendPayload := func(pl *serverPayload) error {
+		pl.ackNumber = lastAck
+		if debugEnabled(c.logger) {
+			c.logger.Debug("resending payload", "file", pl.fileIndex, "offset", pl.offset)
+		}
+		err := sendTo(c.socket, c.cache.message(pl))
+		rateControl.onSend()
+		atomic.AddUint64(&c.stats.retransmissions, 1)
+		c.trace.packetSent(*pl)
+		c.resendDone <- pl
+		return err
+	}
+
+	sendMetadata := func(md *serverMetaData) error {
+		c.logger.Debug("sending metadata",
+			"file", md.fileIndex,
+			"status", md.status,
+			"size", md.size,
+			"checksum", fmt.Sprintf("%x", md.checkSum),
+		)
+		md.ackNum = lastAck
+		c.metadataCache[md.fileIndex] = md
+		err := sendTo(c.socket, optionsMsg{msg: *md, options: c.deltas.metadataOptions(md.fileIndex)})
+		rateControl.onSend()
+		c.trace.packetSent(*md)
+		return err
+	}
 
 	for !c.cleaner.closed() {
 		var err error
@@ -63,10 +188,7 @@ func (c *clientConnection) writeResponse() {
 		if rateControl.isAvailable() {
 			select {
 			case pl := <-c.resend:
-				pl.ackNumber = lastAck
-				err = sendTo(c.socket, *pl)
-				rateControl.onSend()
-				c.resendDone <- pl
+				resendPayload(pl)
 				continue
 
 			case ack := <-c.ack:
@@ -74,25 +196,34 @@ func (c *clientConnection) writeResponse() {
 
 			default:
 			}
+			// Resends that are scheduled while waiting go out right away.
 			select {
+			case pl := <-c.resend:
+				err = resendPayload(pl)
+
 			case md := <-c.metadata:
-				log.Printf(
-					"sending metadata for file %v: status: %v, size: %v, checksum: %x\n",
-					md.fileIndex,
-					md.status,
-					md.size,
-					md.checkSum,
-				)
-				md.ackNum = lastAck
-				c.metadataCache[md.fileIndex] = md
-				err = sendTo(c.socket, *md)
-				rateControl.onSend()
+				err = sendMetadata(md)
 
-			case pl := <-c.payload:
+			case ch := <-c.payload:
+				if ch.metadata != nil {
+					err = sendMetadata(ch.metadata)
+					break
+				}
+				pl := ch.payload
 				pl.ackNumber = lastAck
-				c.saveToCache(pl)
-				err = sendTo(c.socket, *pl)
+				if debugEnabled(c.logger) {
+					c.logger.Debug("sending payload", "file", pl.fileIndex, "offset", pl.offset)
+				}
+				c.cache.save(ch)
+				err = sendTo(c.socket, optionsMsg{msg: *pl, options: ch.options})
 				rateControl.onSend()
+				c.trace.packetSent(*pl)
+				if rp := ch.repair; rp != nil && err == nil {
+					rp.ackNumber = lastAck
+					err = sendTo(c.socket, optionsMsg{msg: *rp, options: ch.options})
+					rateControl.onSend()
+					c.trace.packetSent(*rp)
+				}
 
 			case ack := <-c.ack:
 				handleAck(ack)
@@ -112,7 +243,7 @@ func (c *clientConnection) writeResponse() {
 		}
 
 		if err != nil {
-			log.Println(err)
+			c.logger.Warn("failed to send packet", "err", err)
 		}
 	}
 }
@@ -120,41 +251,67 @@ func (c *clientConnection) writeResponse() {
 // TODO: Drop cached payloads. That's not trivial, because we don't have
 // explicit acks per file, so we have to calculate it, to avoid keeping all
 // files in the cache.
-func (c *clientConnection) saveToCache(p *serverPayload) {
-	c.payloadCacheLock.Lock()
-	defer c.payloadCacheLock.Unlock()
-	_, ok := c.payloadCache[p.fileIndex]
+func (c *payloadCache) save(ch sendChunk) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	p := ch.payload
+	_, ok := c.payloads[p.fileIndex]
 	if !ok {
-		c.payloadCache[p.fileIndex] = make(map[uint64]*serverPayload)
+		c.payloads[p.fileIndex] = make(map[uint64]sendChunk)
 	}
 
-	c.payloadCache[p.fileIndex][p.offset] = p
+	c.payloads[p.fileIndex][p.offset] = sendChunk{payload: p, options: ch.options}
 }
 
-func (c *clientConnection) getFromCache(file uint16, offset uint64) (*serverPayload, bool) {
-	c.payloadCacheLock.Lock()
-	defer c.payloadCacheLock.Unlock()
+// get returns a copy of the cached payload, so that its ack number can be set
+// without affecting other connections.
+func (c *payloadCache) get(file uint16, offset uint64) (*serverPayload, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
 
-	if c, ok := c.payloadCache[file]; ok {
-		if p, ok := c[offset]; ok {
-			return p, true
+	if c, ok := c.payloads[file]; ok {
+		if ch, ok := c[offset]; ok {
+			cp := *ch.payload
+			return &cp, true
 		}
 	}
 	return nil, false
 }
 
+// message returns the payload with the options it was sent with.
+func (c *payloadCache) message(p *serverPayload) optionsMsg {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return optionsMsg{msg: *p, options: c.payloads[p.fileIndex][p.offset].options}
+}
+
 func (c *clientConnection) rescheduler() {
 	closeChan := c.cleaner.subscribe()
 	resendScheduled := map[uint16]map[uint64]struct{}{}
+	unschedule := func(p *serverPayload) {
+		if debugEnabled(c.logger) {
+			c.logger.Debug("delete rescheduled entry", "file", p.fileIndex, "offset", p.offset)
+		}
+		delete(resendScheduled[p.fileIndex], p.offset)
+	}
 
 	for {
 		select {
 		case <-closeChan:
 			return
 		case p := <-c.resendDone:
-			log.Printf("delete rescheduled entry: file %v at offset %v\n", p.fileIndex, p.offset)
-			delete(resendScheduled[p.fileIndex], p.offset)
+			unschedule(p)
 		case ack := <-c.reschedule:
+			// The payloads resent before the ack are not scheduled anymore.
+			for pending := true; pending; {
+				select {
+				case p := <-c.resendDone:
+					unschedule(p)
+				default:
+					pending = false
+				}
+			}
+
 			// use a map to avoid duplicates in metadata resend entries
 			metadata := map[uint16]struct{}{}
 			if ack.status == metaDataMissing {
@@ -164,7 +321,8 @@ func (c *clientConnection) rescheduler() {
 			sort.Sort(&ack.resendEntries)
 
 			if len(ack.resendEntries) <= 0 {
-				if p, ok := c.getFromCache(ack.fileIndex, ack.offset); ok {
+				if p, ok := c.cache.get(ack.fileIndex, ack.offset); ok {
+					c.trace.resendScheduled(p)
 					c.resend <- p
 				}
 			}
@@ -181,18 +339,26 @@ func (c *clientConnection) rescheduler() {
 				if _, ok := resendScheduled[re.fileIndex][re.offset]; !ok {
 					resendScheduled[re.fileIndex][re.offset] = struct{}{}
 
-					if p, ok := c.getFromCache(re.fileIndex, re.offset); ok {
+					if p, ok := c.cache.get(re.fileIndex, re.offset); ok {
 						if re.length == 0 {
+							c.trace.resendScheduled(p)
 							c.resend <- p
-							log.Printf("rescheduled: file %v at %v\n", re.fileIndex, re.offset)
+							if debugEnabled(c.logger) {
+								c.logger.Debug("rescheduled", "file", re.fileIndex, "offset", re.offset)
+							}
 						}
 
 						for i := uint64(0); i < uint64(re.length); i++ {
-							if p, ok := c.getFromCache(re.fileIndex, re.offset+i); ok {
+							if p, ok := c.cache.get(re.fileIndex, re.offset+i); ok {
+								c.trace.resendScheduled(p)
 								c.resend <- p
-								log.Printf("rescheduled: file %v at %v\n", re.fileIndex, re.offset+i)
+								if debugEnabled(c.logger) {
+									c.logger.Debug("rescheduled", "file", re.fileIndex, "offset", re.offset+i)
+								}
 							} else {
-								log.Printf("didn't find resend entry in cache: %v\n", re.offset+i)
+								if debugEnabled(c.logger) {
+									c.logger.Debug("didn't find resend entry in cache", "file", re.fileIndex, "offset", re.offset+i)
+								}
 								break
 								// TODO:
 								// re-read from sectionReader, this isn't trivial either
@@ -201,47 +367,93 @@ func (c *clientConnection) rescheduler() {
 						}
 					}
 				} else {
-					log.Printf("skipped rescheduling for: file %v at %v\n", re.fileIndex, re.offset)
+					if debugEnabled(c.logger) {
+						c.logger.Debug("skipped rescheduling", "file", re.fileIndex, "offset", re.offset)
+					}
 				}
 			}
 
 			// resend metadata
+			mds := []*serverMetaData{}
 			for k := range metadata {
 				if m, ok := c.metadataCache[k]; ok {
-					c.metadata <- m
+					mds = append(mds, m)
 				}
 			}
+			select {
+			case c.rescheduled <- struct{}{}:
+			case <-closeChan:
+				return
+			}
+			for _, m := range mds {
+				c.metadata <- m
+			}
 		}
 	}
 }
 
 func (c *clientConnection) getResponse(fh FileHandler) {
-	if fh == nil {
-		// TODO Send error file not available
-	}
+	c.startResponse()
+	c.streamFiles(fh)
+}
+
+// startResponse starts writing the response and answering the acks.
+func (c *clientConnection) startResponse() {
+	c.openChannels()
+	go c.writeResponse()
+	go c.rescheduler()
+}
 
-	c.payload = make(chan *serverPayload, 1024*1024)
+func (c *clientConnection) openChannels() {
+	c.payload = make(chan sendChunk, 1024*1024)
 	c.resend = make(chan *serverPayload, 1024*1024)
 	c.metadata = make(chan *serverMetaData, len(c.req.files))
 	c.reschedule = make(chan *clientAck, 1024)
+	c.rescheduled = make(chan struct{})
 	c.resendDone = make(chan *serverPayload, 1024*1024)
+}
 
-	go c.writeResponse()
-	go c.rescheduler()
+// streamFiles reads the requested files and passes their chunks and metadata
+// to the writer.
+func (c *clientConnection) streamFiles(fh FileHandler) {
+	if fh == nil {
+		// TODO Send error file not available
+	}
 
-	srs := []fileReader{}
+	priorities := c.req.priorities()
+	srs := []*fileReader{}
 	for i, fr := range c.req.files {
-		r, err := fh(fr.fileName)
+		r, err := c.open(fh, uint16(i))
 		if err != nil {
 			// TODO
 			// send err metadata
 		}
-		sr := fileReader{
-			index:  uint16(i),
-			sr:     r,
-			hasher: md5.New(),
+		sr := &fileReader{
+			index:    uint16(i),
+			offset:   fr.offset,
+			sr:       r,
+			hasher:   md5.New(),
+			priority: priorities[uint16(i)],
+			fec:      newFECEncoder(c.req.fecGroupSize()),
+			logger:   c.logger,
+
+			compression: c.req.compression(),
+		}
+		if r != nil && fr.isRange() {
+			sr.sr, sr.status = selectRange(r, fr.start, fr.length)
+		} else if set := c.deltas.signatures(uint16(i)); set != nil && r != nil && r.Size() > 0 && fr.offset == 0 {
+			d, err := newDelta(r, set)
+			if err != nil {
+				c.logger.Warn("failed to compute delta, sending the file", "file", i, "err", err)
+			} else {
+				c.logger.Info("sending delta", "file", i, "size", d.stream.Size(), "copied", d.copied)
+				sr.sr, sr.delta = d.stream, d
+			}
 		}
 		srs = append(srs, sr)
+		if sr.sr == nil {
+			continue
+		}
 
 		// Copy pre offset bytes to hasher
 		n, err := io.CopyN(sr.hasher, sr.sr, int64(fr.offset*1024))
@@ -251,58 +463,94 @@ func (c *clientConnection) getResponse(fh FileHandler) {
 		}
 	}
 
-	closeChan := c.cleaner.subscribe()
-
+	// Files without content are answered right away, the others are streamed
+	// in the order of the scheduling policy.
+	streamed := []*fileReader{}
 	for _, fr := range srs {
-		if c.cleaner.closed() {
-			return
+		if fr.status != noErr {
+			c.metrics.file(fr.status)
+			c.metadata <- &serverMetaData{fileIndex: fr.index, status: fr.status}
+			continue
 		}
-
 		if fr.sr == nil {
+			c.metrics.file(fileNotExistent)
 			c.metadata <- &serverMetaData{fileIndex: fr.index, status: fileNotExistent}
 			continue
 		}
 		if fr.sr.Size() == 0 {
+			c.metrics.file(fileEmpty)
 			c.metadata <- &serverMetaData{fileIndex: fr.index, status: fileEmpty}
 			continue
 		}
+		streamed = append(streamed, fr)
+	}
 
-		done := false
-		off := int64(0)
-		for !done {
-			buf := make([]byte, 1024)
-			n, err := fr.sr.ReadAt(buf, 1024*off)
-			if err == io.EOF {
-				done = true
-			}
-			if err != nil {
-				log.Printf("error, on reading file: %v\n", err)
-			}
-			_, err = fr.hasher.Write(buf[:n])
-			if err != nil {
-				log.Printf("failed to write to hash: %v\n", err)
+	closeChan := c.cleaner.subscribe()
+	scheduler := newStreamScheduler(c.policy, streamed)
+
+	for !scheduler.empty() {
+		if c.cleaner.closed() {
+			return
+		}
+
+		fr := scheduler.pick()
+		p, done := fr.nextChunk()
+		if p != nil {
+			select {
+			case c.payload <- sendChunk{payload: p, options: fr.options(), repair: fr.repair(p, done)}:
+			case <-closeChan:
+				return
 			}
-			p := &serverPayload{
-				fileIndex: fr.index,
-				data:      buf[:n],
-				offset:    uint64(off),
+		}
+
+		if done {
+			scheduler.remove(fr)
+			m := &serverMetaData{fileIndex: fr.index, size: uint64(fr.sr.Size())}
+			copy(m.checkSum[:], fr.hasher.Sum(nil)[:16])
+			if fr.delta != nil {
+				m.size, m.checkSum = fr.delta.size, fr.delta.checksum
+				c.deltas.setStream(fr.index, uint64(fr.sr.Size()))
 			}
-			off++
+			c.metrics.file(noErr)
 			select {
-			case c.payload <- p:
+			case c.payload <- sendChunk{metadata: m}:
 			case <-closeChan:
 				return
 			}
 		}
+	}
+}
 
-		m := &serverMetaData{fileIndex: fr.index, size: uint64(fr.sr.Size())}
-		copy(m.checkSum[:], fr.hasher.Sum(nil)[:16])
-		c.metadata <- m
+// nextChunk reads the next chunk of the file. It returns nil, if there is no
+// data left, and whether the end of the file is reached.
+func (fr *fileReader) nextChunk() (*serverPayload, bool) {
+	if fr.compression != NoCompression {
+		return fr.nextCompressed()
+	}
+	buf := make([]byte, 1024)
+	n, err := fr.sr.ReadAt(buf, 1024*int64(fr.offset))
+	done := err == io.EOF || uint64(fr.sr.Size()) <= 1024*fr.offset+uint64(n)
+	if err != nil && err != io.EOF {
+		fr.logger.Warn("failed to read file", "file", fr.index, "err", err)
+	}
+	if n == 0 {
+		return nil, done
+	}
+	_, err = fr.hasher.Write(buf[:n])
+	if err != nil {
+		fr.logger.Warn("failed to write to hash", "file", fr.index, "err", err)
+	}
+	p := &serverPayload{
+		fileIndex: fr.index,
+		data:      buf[:n],
+		offset:    fr.offset,
 	}
+	fr.offset++
+	return p, done
 }
 
-func key(ip *net.UDPAddr) string {
-	return fmt.Sprintf("%v:%v", ip.IP, ip.Port)
+func key(addr net.Addr) string {
+	return addr.String()
 }
 
 type cleaner struct {
@@ -312,11 +560,18 @@ type cleaner struct {
 
 	timeoutLock sync.Mutex
 	deadline    time.Time
+	clock       Clock
 
-	cb func()
+	// cb is called once with the reason of the close.
+	cb func(reason string)
 }
 
+// close closes after a timeout.
 func (c *cleaner) close() {
+	c.closeWith("timeout")
+}
+
+func (c *cleaner) closeWith(reason string) {
 	c.closeLock.Lock()
 	defer c.closeLock.Unlock()
 	if c.closedState {
@@ -327,7 +582,7 @@ func (c *cleaner) close() {
 		sub <- struct{}{}
 		close(sub)
 	}
-	c.cb()
+	c.cb(reason)
 }
 
 func (c *cleaner) closed() bool {
@@ -339,16 +594,17 @@ func (c *cleaner) closed() bool {
 func (c *cleaner) refresh(d time.Duration) {
 	c.timeoutLock.Lock()
 	defer c.timeoutLock.Unlock()
-	c.deadline = time.Now().Add(d)
+	c.deadline = c.clock.Now().Add(d)
 }
 
 func (c *cleaner) checkTimeout() {
 	c.timeoutLock.Lock()
 	defer c.timeoutLock.Unlock()
-	if time.Now().After(c.deadline) {
+	now := c.clock.Now()
+	if !now.Before(c.deadline) {
 		c.close()
 	} else if !c.closed() {
-		time.AfterFunc(time.Until(c.deadline), c.checkTimeout)
+		c.clock.AfterFunc(c.deadline.Sub(now), c.checkTimeout)
 	}
 }
 
@@ -365,17 +621,43 @@ func (c *cleaner) subscribe() <-chan struct{} {
 }
 
 type Server struct {
-	Conn connection
-	fh   FileHandler
+	Conn   connection
+	fh     FileHandler
+	ch     ContentHandler
+	lh     ListingHandler
+	policy SchedulingPolicy
+	clock  Clock
+	tracer Tracer
+	logger *slog.Logger
+
+	statsHandler func(Stats)
+	metrics      *serverMetrics
 
 	clients   map[string]*clientConnection
 	clientMux sync.Mutex
+
+	multicastGroup string
+	multicastWait  time.Duration
+	// sessions are the multicast sessions that can be joined, by tag, and
+	// receivers the sessions of the receivers that don't have a connection
+	// of their own, by address. Both are guarded by clientMux.
+	sessions  map[string]*multicastSession
+	receivers map[string]*multicastSession
+
+	ready     chan struct{}
+	readyOnce sync.Once // closes ready only once if Listen is called again
 }
 
 func NewServer() *Server {
 	s := &Server{
-		Conn:    NewUDPConnection(),
-		clients: make(map[string]*clientConnection),
+		Conn:      NewUDPConnection(),
+		clock:     systemClock{},
+		logger:    silentLogger,
+		metrics:   newServerMetrics(),
+		clients:   make(map[string]*clientConnection),
+		sessions:  make(map[string]*multicastSession),
+		receivers: make(map[string]*multicastSession),
+		ready:     make(chan struct{}),
 	}
 
 	return s
@@ -387,8 +669,12 @@ func (s *Server) Addr() net.Addr {
 
 func (s *Server) Listen(host string) error {
 	s.Conn.handle(msgClientRequest, handlerFunc(s.handleRequest))
+	s.Conn.handle(msgClientRangeRequest, handlerFunc(s.handleRangeRequest))
 	s.Conn.handle(msgClientAck, handlerFunc(s.handleACK))
 	s.Conn.handle(msgClose, handlerFunc(s.handleClose))
+	s.Conn.handle(msgClientSignatures, handlerFunc(s.handleSignatures))
+	s.Conn.setLogger(s.logger)
+	s.Conn.setClock(s.clock)
 
 	cancel, err := s.Conn.listen(host)
 	if err != nil {
@@ -396,14 +682,100 @@ func (s *Server) Listen(host string) error {
 	}
 	defer cancel()
 
-	log.Printf("running server on addr '%v'\n", s.Conn.addr())
+	s.logger.Info("running server", "addr", s.Conn.addr())
+	s.readyOnce.Do(func() { close(s.ready) })
 	return s.Conn.receive()
 }
 
+// Ready returns a channel that is closed as soon as the server listens.
+func (s *Server) Ready() <-chan struct{} {
+	return s.ready
+}
+
+// Close stops a listening server. Listen returns nil after the messages that
+// are being handled are done.
+func (s *Server) Close() error {
+	return s.Conn.cclose(time.Second)
+}
+
 func (s *Server) SetFileHandler(fh FileHandler) {
 	s.fh = fh
 }
 
+// SetListingHandler sets the handler of the requests for the listing of a
+// directory. Without it, such requests fail with file not existent.
+func (s *Server) SetListingHandler(lh ListingHandler) {
+	s.lh = lh
+}
+
+// SetContentHandler sets the handler of the files that clients request by
+// their checksum. Without it, such requests fail with file not existent.
+func (s *Server) SetContentHandler(ch ContentHandler) {
+	s.ch = ch
+}
+
+// SetClock sets the clock of the timeouts and the rate control. The default
+// is the system clock.
+func (s *Server) SetClock(c Clock) {
+	s.clock = c
+}
+
+// SetLogger sets the logger of the server. The records of a client connection
+// carry the address of the client as attribute. By default, the server is
+// silent.
+func (s *Server) SetLogger(l *slog.Logger) {
+	s.logger = loggerOrSilent(l)
+}
+
+// SetStatsHandler sets a function that is called with the final statistics of
+// each client connection when it is closed.
+func (s *Server) SetStatsHandler(h func(Stats)) {
+	s.statsHandler = h
+}
+
+// Stats returns a snapshot of the statistics of each open client connection.
+func (s *Server) Stats() []Stats {
+	s.clientMux.Lock()
+	stats := make([]Stats, 0, len(s.clients)+len(s.receivers))
+	for _, c := range s.clients {
+		stats = append(stats, c.stats.snapshot())
+	}
+	for key, m := range s.receivers {
+		if st, ok := m.receiverStats(key); ok {
+			stats = append(stats, st)
+		}
+	}
+	s.clientMux.Unlock()
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Remote < stats[j].Remote
+	})
+	return stats
+}
+
+// SetTracer sets the receiver of the events of each client connection. By
+// default, nothing is traced.
+func (s *Server) SetTracer(t Tracer) {
+	s.tracer = t
+}
+
+// SetMulticast streams the files to the multicast group, e.g.,
+// "239.0.0.1:9001", once for all clients that ask for multicast and request
+// the same files. The first request starts a session that waits for further
+// receivers for the given time before it streams. Receivers send their acks
+// to the server, lost chunks are retransmitted to the group. The rate adapts
+// to the slowest receiver, receivers that fall far behind or join late get
+// the missing chunks over unicast instead.
+func (s *Server) SetMulticast(group string, wait time.Duration) {
+	s.multicastGroup = group
+	s.multicastWait = wait
+}
+
+// SetSchedulingPolicy sets the order in which the files of a request are
+// streamed. The default is Sequential.
+func (s *Server) SetSchedulingPolicy(p SchedulingPolicy) {
+	s.policy = p
+}
+
 type unreliableWriter struct {
 	breakTime  time.Time
 	returnTime time.Time
@@ -436,42 +808,118 @@ func (s *Server) handleRequest(w io.Writer, p *packet) {
 	//y := 20 * time.Second
 	//w = getUnreliableWriter(w, x, y)
 
-	log.Printf("handling cr from %v: %v\n", p.remoteAddr, p)
 	cr := &clientRequest{}
 	err := cr.UnmarshalBinary(p.data)
 	if err != nil {
 		// TODO: Close connection?
-		log.Println("failed to parse data")
+		s.metrics.parseError()
+		s.logger.Warn("failed to parse request", "remote", p.remoteAddr, "err", err)
 	}
+	s.logger.Info("handling request", "remote", p.remoteAddr, "files", len(cr.files))
+	cr.options = p.os
 
+	s.accept(w, p, cr)
+}
+
+func (s *Server) handleRangeRequest(w io.Writer, p *packet) {
+	cr := &clientRangeRequest{}
+	err := cr.UnmarshalBinary(p.data)
+	if err != nil {
+		s.metrics.parseError()
+		s.logger.Warn("failed to parse range request", "remote", p.remoteAddr, "err", err)
+		return
+	}
+	s.logger.Info("handling range request", "remote", p.remoteAddr, "files", len(cr.files))
+	cr.options = p.os
+
+	s.accept(w, p, &cr.clientRequest)
+}
+
+func (s *Server) accept(w io.Writer, p *packet, cr *clientRequest) {
 	key := key(p.remoteAddr)
 	s.clientMux.Lock()
 	defer s.clientMux.Unlock()
-	if _, ok := s.clients[key]; !ok {
-		c := &clientConnection{
-			ack:    make(chan *clientAck, 1024),
-			cclose: make(chan *closeConnection),
-			socket: w,
-			req:    cr,
-
-			cleaner: cleaner{cb: func() {
-				log.Printf("Trying to close Conn: %v. Current number of connections: %v\n", key, len(s.clients))
-				s.clientMux.Lock()
-				defer s.clientMux.Unlock()
-				delete(s.clients, key)
-				log.Printf("Conn %v closed. Current number of connections: %v\n", key, len(s.clients))
-			}},
-
-			payloadCache:  make(map[uint16]map[uint64]*serverPayload),
-			metadataCache: make(map[uint16]*serverMetaData),
-		}
-		s.clients[key] = c
-		go c.getResponse(s.fh)
-		c.cleaner.refresh(5 * time.Second)
-		c.cleaner.checkTimeout()
-	} else {
+	if _, ok := s.clients[key]; ok {
 		// TODO: send close, because duplicate connection request
+		return
+	}
+	if _, ok := s.receivers[key]; ok {
+		return
+	}
+	stats := newConnStats(key, s.clock.Now())
+	stats.received(p.size)
+	if s.joinSession(w, key, cr, stats) {
+		return
 	}
+	c := s.newClientConnection(w, key, cr, stats)
+	c.trace.packetReceived(p.ackNum, *cr)
+	s.clients[key] = c
+	s.metrics.connectionOpened()
+	if files := cr.deltaFiles(); len(files) > 0 {
+		c.deltas = newDeltaRequest(files, func(file uint16) int64 {
+			r, err := c.open(s.fh, file)
+			if err != nil || r == nil {
+				return 0
+			}
+			return r.Size()
+		})
+	} else {
+		go c.getResponse(s.fh)
+	}
+	c.cleaner.refresh(5 * time.Second)
+	c.cleaner.checkTimeout()
+}
+
+// newClientConnection creates the connection of a client. It removes itself
+// from the clients when it is closed.
+func (s *Server) newClientConnection(w io.Writer, key string, cr *clientRequest, stats *connStats) *clientConnection {
+	trace := newConnTrace(s.tracer, s.clock, "server", key)
+	logger := s.logger.With("remote", key)
+	c := &clientConnection{
+		ack:     make(chan *clientAck, 1024),
+		cclose:  make(chan *closeConnection),
+		socket:  statsWriter{w, stats},
+		req:     cr,
+		policy:  s.policy,
+		clock:   s.clock,
+		trace:   trace,
+		logger:  logger,
+		stats:   stats,
+		metrics: s.metrics,
+
+		cache:         newPayloadCache(),
+		metadataCache: make(map[uint16]*serverMetaData),
+		content:       s.ch,
+		byContent:     make(map[uint16]bool),
+		listing:       s.lh,
+		listings:      make(map[uint16]bool),
+		opened:        make(map[uint16]*io.SectionReader),
+	}
+	for _, f := range cr.contentFiles() {
+		c.byContent[f] = true
+	}
+	for _, f := range cr.listingFiles() {
+		c.listings[f] = true
+	}
+	c.cleaner = cleaner{clock: s.clock, cb: func(reason string) {
+		if reason == "timeout" {
+			trace.timeout("idle")
+		}
+		trace.close(reason)
+		stats.close(s.clock.Now())
+		if s.statsHandler != nil {
+			s.statsHandler(stats.snapshot())
+		}
+		s.clientMux.Lock()
+		defer s.clientMux.Unlock()
+		delete(s.clients, key)
+		s.metrics.connectionClosed(reason, stats.snapshot())
+		logger.Info("connection closed", "reason", reason, "connections", len(s.clients))
+		if c.onClose != nil {
+			c.onClose()
+		}
+	}}
+	return c
 }
 
 func (s *Server) handleACK(_ io.Writer, p *packet) {
@@ -479,15 +927,50 @@ func (s *Server) handleACK(_ io.Writer, p *packet) {
 	err := ack.UnmarshalBinary(p.data)
 	if err != nil {
 		// TODO: Close connection?
-		log.Println("failed to parse ack")
+		s.metrics.parseError()
+		s.logger.Warn("failed to parse ack", "remote", p.remoteAddr, "err", err)
 	}
 	ack.ackNumber = p.ackNum
 	key := key(p.remoteAddr)
 	s.clientMux.Lock()
-	defer s.clientMux.Unlock()
 	if conn, ok := s.clients[key]; ok {
+		conn.stats.received(p.size)
+		conn.trace.packetReceived(p.ackNum, *ack)
 		conn.ack <- ack
 	}
+	session := s.receivers[key]
+	s.clientMux.Unlock()
+	// The session may take clientMux to move the receiver to a connection of
+	// its own.
+	if session != nil {
+		select {
+		case session.ack <- receiverAck{receiver: key, ack: ack, size: p.size}:
+		case <-session.closed:
+		}
+	}
+}
+
+// handleSignatures adds signatures to the connection of the client and
+// starts the response once all signatures arrived.
+func (s *Server) handleSignatures(_ io.Writer, p *packet) {
+	sigs := &clientSignatures{}
+	if err := sigs.UnmarshalBinary(p.data); err != nil {
+		s.metrics.parseError()
+		s.logger.Warn("failed to parse signatures", "remote", p.remoteAddr, "err", err)
+		return
+	}
+	s.clientMux.Lock()
+	c, ok := s.clients[key(p.remoteAddr)]
+	s.clientMux.Unlock()
+	if !ok || c.deltas == nil {
+		return
+	}
+	c.stats.received(p.size)
+	c.trace.packetReceived(p.ackNum, *sigs)
+	c.cleaner.refresh(5 * time.Second)
+	if c.deltas.add(sigs) {
+		go c.getResponse(s.fh)
+	}
 }
 
 func (s *Server) handleClose(_ io.Writer, p *packet) {
@@ -495,9 +978,23 @@ func (s *Server) handleClose(_ io.Writer, p *packet) {
 	err := cl.UnmarshalBinary(p.data)
 	if err != nil {
 		// TODO What now?
-		log.Println("failed to parse close")
+		s.metrics.parseError()
+		s.logger.Warn("failed to parse close", "remote", p.remoteAddr, "err", err)
+		return
 	}
+	s.metrics.closeMessage(cl.reason)
 
-	log.Printf("connection closed: %s\n", cl.reason.String())
-	// TODO: clean up state
+	s.logger.Info("client closed connection", "remote", p.remoteAddr, "reason", cl.reason.String())
+	k := key(p.remoteAddr)
+	s.clientMux.Lock()
+	c, ok := s.clients[k]
+	session := s.receivers[k]
+	s.clientMux.Unlock()
+	// Both take clientMux.
+	if ok {
+		c.cleaner.closeWith("close")
+	}
+	if session != nil {
+		session.closeReceiver(k)
+	}
 }
@@ -0,0 +1,128 @@
+package rftp
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Stats is a snapshot of the counters of a connection. Counters that only
+// apply to one side of a connection are zero on the other side.
+type Stats struct {
+	Remote string
+	Start  time.Time
+	// End is zero while the connection is open.
+	End time.Time
+
+	PacketsSent     uint64
+	PacketsReceived uint64
+	BytesSent       uint64
+	BytesReceived   uint64
+
+	// Retransmissions counts the chunks re-requested by the client and the
+	// payloads resent by the server.
+	Retransmissions uint64
+	// DuplicateChunks counts the chunks the client received more than once.
+	DuplicateChunks uint64
+	// RepairedChunks counts the chunks the client reconstructed from repair
+	// packets instead of re-requesting them.
+	RepairedChunks uint64
+	// ResendEntries counts the resend entries the client sent in its acks
+	// and the server received.
+	ResendEntries uint64
+
+	// RTT is the round trip time last measured by the client.
+	RTT time.Duration
+	// CongestionRate and FlowRate are the packets per second allowed by the
+	// rate control of the server. FlowRate is the rate last advertised by
+	// the client on the client side.
+	CongestionRate uint32
+	FlowRate       uint32
+	// ReorderBuffer is the number of chunks the client holds back, because
+	// chunks before them are still missing.
+	ReorderBuffer int
+}
+
+// connStats collects the counters of a connection. The counters are updated
+// atomically, so that a snapshot can be taken while the transfer runs.
+type connStats struct {
+	packetsSent     uint64
+	packetsReceived uint64
+	bytesSent       uint64
+	bytesReceived   uint64
+	retransmissions uint64
+	resendEntries   uint64
+	rtt             int64
+	congRate        uint32
+	flowRate        uint32
+
+	lock   sync.Mutex
+	remote string
+	start  time.Time
+	end    time.Time
+}
+
+func newConnStats(remote string, start time.Time) *connStats {
+	return &connStats{remote: remote, start: start}
+}
+
+func (s *connStats) sent(n int) {
+	atomic.AddUint64(&s.packetsSent, 1)
+	atomic.AddUint64(&s.bytesSent, uint64(n))
+}
+
+func (s *connStats) received(n int) {
+	atomic.AddUint64(&s.packetsReceived, 1)
+	atomic.AddUint64(&s.bytesReceived, uint64(n))
+}
+
+func (s *connStats) setRTT(rtt time.Duration) {
+	atomic.StoreInt64(&s.rtt, int64(rtt))
+}
+
+func (s *connStats) setRates(congRate, flowRate uint32) {
+	atomic.StoreUint32(&s.congRate, congRate)
+	atomic.StoreUint32(&s.flowRate, flowRate)
+}
+
+func (s *connStats) close(end time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.end.IsZero() {
+		s.end = end
+	}
+}
+
+func (s *connStats) snapshot() Stats {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return Stats{
+		Remote:          s.remote,
+		Start:           s.start,
+		End:             s.end,
+		PacketsSent:     atomic.LoadUint64(&s.packetsSent),
+		PacketsReceived: atomic.LoadUint64(&s.packetsReceived),
+		BytesSent:       atomic.LoadUint64(&s.bytesSent),
+		BytesReceived:   atomic.LoadUint64(&s.bytesReceived),
+		Retransmissions: atomic.LoadUint64(&s.retransmissions),
+		ResendEntries:   atomic.LoadUint64(&s.resendEntries),
+		RTT:             time.Duration(atomic.LoadInt64(&s.rtt)),
+		CongestionRate:  atomic.LoadUint32(&s.congRate),
+		FlowRate:        atomic.LoadUint32(&s.flowRate),
+	}
+}
+
+// statsWriter counts the packets written to a socket.
+type statsWriter struct {
+	w     io.Writer
+	stats *connStats
+}
+
+func (w statsWriter) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	if err == nil {
+		w.stats.sent(n)
+	}
+	return n, err
+}
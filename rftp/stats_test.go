@@ -0,0 +1,72 @@
+package rftp
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestStats(t *testing.T) {
+	data := make([]byte, 200*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	network := NewMemNetwork()
+	server := NewServer()
+	stop := startMemServerWith(t, server, network, ":2020", map[string][]byte{"file": data})
+	defer stop()
+
+	conn := network.NewConnection()
+	conn.LossSim(NewMarkovLossSimulator(0.1, 0.5, NewRand(1, 0)))
+	client := &Client{Conn: conn}
+	if s := client.Stats(); s != (Stats{}) {
+		t.Errorf("Stats() before the request = %+v, want zero", s)
+	}
+	reqs, err := client.Request("localhost:2020", []string{"file"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(reqs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("received %v bytes that differ from the %v sent bytes", len(got), len(data))
+	}
+
+	servers := server.Stats()
+	if len(servers) != 1 {
+		t.Fatalf("server has stats of %v connections, want 1", len(servers))
+	}
+	for i := 0; i < 100 && client.Stats().End.IsZero(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c, s := client.Stats(), servers[0]
+
+	chunks := uint64(len(data) / 1024)
+	if c.Remote != "localhost:2020" || c.End.IsZero() {
+		t.Errorf("client stats of %q ending at %v, want closed connection to localhost:2020", c.Remote, c.End)
+	}
+	if c.PacketsReceived < chunks || c.BytesReceived < uint64(len(data)) {
+		t.Errorf("client received %v packets with %v bytes, want at least %v and %v",
+			c.PacketsReceived, c.BytesReceived, chunks, len(data))
+	}
+	if c.PacketsSent < 2 || c.RTT <= 0 {
+		t.Errorf("client sent %v packets and measured RTT %v, want at least 2 and a positive RTT", c.PacketsSent, c.RTT)
+	}
+	if c.Retransmissions == 0 || c.ResendEntries == 0 {
+		t.Errorf("client re-requested %v chunks in %v resend entries despite loss", c.Retransmissions, c.ResendEntries)
+	}
+	if c.ReorderBuffer != 0 {
+		t.Errorf("client holds back %v chunks after the transfer, want 0", c.ReorderBuffer)
+	}
+
+	if s.PacketsSent < chunks+s.Retransmissions || s.BytesSent < uint64(len(data)) {
+		t.Errorf("server sent %v packets with %v bytes, want at least %v and %v",
+			s.PacketsSent, s.BytesSent, chunks+s.Retransmissions, len(data))
+	}
+	if s.PacketsReceived == 0 || s.CongestionRate == 0 || !s.End.IsZero() {
+		t.Errorf("server stats = %+v, want received packets, a congestion rate and an open connection", s)
+	}
+}
@@ -0,0 +1,274 @@
+package rftp
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TraceEvent is a structured event of a connection, named after the qlog
+// convention "category:event", e.g., "transport:packet_sent".
+type TraceEvent struct {
+	// Time since the start of the connection.
+	Time time.Duration
+	Name string
+	Data map[string]interface{}
+}
+
+// Tracer creates the event trace of each new connection. Vantage is "client"
+// or "server", remote is the address of the peer.
+type Tracer interface {
+	TraceConnection(vantage, remote string) ConnectionTracer
+}
+
+// ConnectionTracer receives the events of a single connection. Event may be
+// called concurrently.
+type ConnectionTracer interface {
+	Event(e TraceEvent)
+	Close() error
+}
+
+type jsonTracer struct {
+	lock    sync.Mutex
+	w       io.WriteCloser
+	err     error
+	encoder *json.Encoder
+}
+
+// NewJSONConnectionTracer writes the events of a connection to w as JSON
+// lines. The first line describes the connection, each following line is an
+// event with its time in milliseconds.
+func NewJSONConnectionTracer(w io.WriteCloser, vantage, remote string) ConnectionTracer {
+	t := &jsonTracer{w: w, encoder: json.NewEncoder(w)}
+	t.err = t.encoder.Encode(map[string]interface{}{
+		"qlog_format":    "JSON-LINES",
+		"title":          "rft",
+		"vantage_point":  map[string]string{"type": vantage},
+		"remote":         remote,
+		"reference_time": time.Now().UnixNano() / int64(time.Millisecond),
+	})
+	return t
+}
+
+func (t *jsonTracer) Event(e TraceEvent) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.err != nil {
+		return
+	}
+	t.err = t.encoder.Encode(struct {
+		Time float64                `json:"time"`
+		Name string                 `json:"name"`
+		Data map[string]interface{} `json:"data,omitempty"`
+	}{float64(e.Time) / float64(time.Millisecond), e.Name, e.Data})
+}
+
+func (t *jsonTracer) Close() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if err := t.w.Close(); err != nil {
+		return err
+	}
+	return t.err
+}
+
+type dirTracer struct {
+	dir string
+	seq uint32
+}
+
+// NewDirTracer writes the trace of each connection as JSON lines to its own
+// file in dir.
+func NewDirTracer(dir string) Tracer {
+	return &dirTracer{dir: dir}
+}
+
+func (d *dirTracer) TraceConnection(vantage, remote string) ConnectionTracer {
+	seq := atomic.AddUint32(&d.seq, 1)
+	name := fmt.Sprintf("%v-%v-%v-%v.qlog", vantage, time.Now().Format("20060102T150405.000000"),
+		strings.NewReplacer(":", "_", "/", "_", "[", "", "]", "").Replace(remote), seq)
+	f, err := os.Create(filepath.Join(d.dir, name))
+	if err != nil {
+		return &failedTracer{err}
+	}
+	return NewJSONConnectionTracer(f, vantage, remote)
+}
+
+type failedTracer struct {
+	err error
+}
+
+func (t *failedTracer) Event(TraceEvent) {}
+
+func (t *failedTracer) Close() error {
+	return t.err
+}
+
+// connTrace emits the events of a connection. All methods are no-ops on a nil
+// connTrace, so that untraced connections don't pay for building the events.
+type connTrace struct {
+	lock  sync.Mutex
+	t     ConnectionTracer
+	clock Clock
+	start time.Time
+}
+
+func newConnTrace(tracer Tracer, clock Clock, vantage, remote string) *connTrace {
+	if tracer == nil {
+		return nil
+	}
+	return &connTrace{
+		t:     tracer.TraceConnection(vantage, remote),
+		clock: clock,
+		start: clock.Now(),
+	}
+}
+
+func (c *connTrace) event(name string, data map[string]interface{}) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.t == nil {
+		return
+	}
+	c.t.Event(TraceEvent{Time: since(c.clock, c.start), Name: name, Data: data})
+}
+
+func (c *connTrace) packetSent(msg interface{}) {
+	if c == nil {
+		return
+	}
+	c.event("transport:packet_sent", packetFields(msg))
+}
+
+func (c *connTrace) packetReceived(ackNum uint8, msg interface{}) {
+	if c == nil {
+		return
+	}
+	data := packetFields(msg)
+	data["ack"] = ackNum
+	c.event("transport:packet_received", data)
+}
+
+func (c *connTrace) ackProcessed(ack *clientAck) {
+	if c == nil {
+		return
+	}
+	c.event("recovery:ack_processed", map[string]interface{}{
+		"ack":    ack.ackNumber,
+		"file":   ack.fileIndex,
+		"offset": ack.offset,
+		"resend": len(ack.resendEntries),
+	})
+}
+
+func (c *connTrace) rateUpdated(congRate, flowRate uint32) {
+	if c == nil {
+		return
+	}
+	c.event("recovery:rate_updated", map[string]interface{}{
+		"congestion_rate": congRate,
+		"flow_rate":       flowRate,
+	})
+}
+
+func (c *connTrace) resendScheduled(p *serverPayload) {
+	if c == nil {
+		return
+	}
+	c.event("recovery:resend_scheduled", map[string]interface{}{
+		"file":   p.fileIndex,
+		"offset": p.offset,
+	})
+}
+
+func (c *connTrace) rttUpdated(rtt time.Duration) {
+	if c == nil {
+		return
+	}
+	c.event("recovery:rtt_updated", map[string]interface{}{
+		"rtt": float64(rtt) / float64(time.Millisecond),
+	})
+}
+
+func (c *connTrace) timeout(what string) {
+	if c == nil {
+		return
+	}
+	c.event("connectivity:timeout", map[string]interface{}{"timer": what})
+}
+
+// close emits the closing event and closes the trace. Later events are
+// dropped.
+func (c *connTrace) close(reason string) {
+	if c == nil {
+		return
+	}
+	c.event("connectivity:connection_closed", map[string]interface{}{"reason": reason})
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.t != nil {
+		c.t.Close()
+		c.t = nil
+	}
+}
+
+func packetFields(msg interface{}) map[string]interface{} {
+	switch m := msg.(type) {
+	case optionsMsg:
+		return packetFields(m.msg)
+	case clientRequest:
+		return map[string]interface{}{"type": "request", "files": len(m.files)}
+	case clientRangeRequest:
+		return map[string]interface{}{"type": "range-request", "files": len(m.files)}
+	case serverMetaData:
+		return map[string]interface{}{
+			"type":   "metadata",
+			"ack":    m.ackNum,
+			"file":   m.fileIndex,
+			"status": m.status.String(),
+			"size":   m.size,
+		}
+	case serverPayload:
+		return map[string]interface{}{
+			"type":   "payload",
+			"ack":    m.ackNumber,
+			"file":   m.fileIndex,
+			"offset": m.offset,
+			"length": len(m.data),
+		}
+	case serverRepair:
+		return map[string]interface{}{
+			"type":   "repair",
+			"ack":    m.ackNumber,
+			"file":   m.fileIndex,
+			"offset": m.offset,
+			"count":  m.count,
+		}
+	case clientSignatures:
+		return map[string]interface{}{
+			"type":       "signatures",
+			"file":       m.fileIndex,
+			"first":      m.first,
+			"signatures": len(m.signatures),
+		}
+	case clientAck:
+		return map[string]interface{}{
+			"type":   "ack",
+			"ack":    m.ackNumber,
+			"file":   m.fileIndex,
+			"offset": m.offset,
+			"status": m.status,
+			"rate":   m.maxTransmissionRate,
+			"resend": len(m.resendEntries),
+		}
+	case closeConnection:
+		return map[string]interface{}{"type": "close", "reason": m.reason.String()}
+	}
+	return map[string]interface{}{"type": fmt.Sprintf("%T", msg)}
+}
@@ -0,0 +1,146 @@
+package rftp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordingTracer struct {
+	lock   sync.Mutex
+	events map[string][]TraceEvent
+	closed map[string]bool
+}
+
+func newRecordingTracer() *recordingTracer {
+	return &recordingTracer{events: map[string][]TraceEvent{}, closed: map[string]bool{}}
+}
+
+type recordingConnTracer struct {
+	t       *recordingTracer
+	vantage string
+}
+
+func (t *recordingTracer) TraceConnection(vantage, remote string) ConnectionTracer {
+	return &recordingConnTracer{t: t, vantage: vantage}
+}
+
+func (c *recordingConnTracer) Event(e TraceEvent) {
+	c.t.lock.Lock()
+	defer c.t.lock.Unlock()
+	c.t.events[c.vantage] = append(c.t.events[c.vantage], e)
+}
+
+func (c *recordingConnTracer) Close() error {
+	c.t.lock.Lock()
+	defer c.t.lock.Unlock()
+	c.t.closed[c.vantage] = true
+	return nil
+}
+
+// count returns the number of events of the vantage point with the given name
+// and packet type, if typ is not empty.
+func (t *recordingTracer) count(vantage, name, typ string) int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	n := 0
+	for _, e := range t.events[vantage] {
+		if e.Name == name && (typ == "" || e.Data["type"] == typ) {
+			n++
+		}
+	}
+	return n
+}
+
+func (t *recordingTracer) isClosed(vantage string) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.closed[vantage]
+}
+
+func TestTraceTransfer(t *testing.T) {
+	tracer := newRecordingTracer()
+	network := NewMemNetwork()
+	server := NewServer()
+	server.SetTracer(tracer)
+	data := bytes.Repeat([]byte("trace"), 1000)
+	stop := startMemServerWith(t, server, network, ":2020", map[string][]byte{"file": data})
+	defer stop()
+
+	client := &Client{Conn: network.NewConnection(), Tracer: tracer}
+	reqs, err := client.Request("localhost:2020", []string{"file"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(reqs[0]); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 300 && !tracer.isClosed("client"); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	tests := []struct {
+		vantage, name, typ string
+		min                int
+	}{
+		{"client", "transport:packet_sent", "request", 1},
+		{"client", "transport:packet_received", "metadata", 1},
+		{"client", "transport:packet_received", "payload", 5},
+		{"client", "recovery:rtt_updated", "", 1},
+		{"client", "connectivity:connection_closed", "", 1},
+		{"server", "transport:packet_received", "request", 1},
+		{"server", "transport:packet_sent", "payload", 5},
+	}
+	for _, tt := range tests {
+		if got := tracer.count(tt.vantage, tt.name, tt.typ); got < tt.min {
+			t.Errorf("%v traced %v %v %v events, want at least %v", tt.vantage, got, tt.name, tt.typ, tt.min)
+		}
+	}
+	if !tracer.isClosed("client") {
+		t.Error("client trace was not closed")
+	}
+}
+
+type nopWriteCloser struct {
+	*bytes.Buffer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+func TestJSONConnectionTracer(t *testing.T) {
+	buf := &bytes.Buffer{}
+	tr := NewJSONConnectionTracer(nopWriteCloser{buf}, "client", "localhost:2020")
+	tr.Event(TraceEvent{
+		Time: 1500 * time.Microsecond,
+		Name: "transport:packet_sent",
+		Data: map[string]interface{}{"type": "ack"},
+	})
+	if err := tr.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s := bufio.NewScanner(buf)
+	lines := []map[string]interface{}{}
+	for s.Scan() {
+		line := map[string]interface{}{}
+		if err := json.Unmarshal(s.Bytes(), &line); err != nil {
+			t.Fatalf("invalid JSON line %q: %v", s.Text(), err)
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) != 2 {
+		t.Fatalf("got %v lines, want 2", len(lines))
+	}
+	if vp := lines[0]["vantage_point"].(map[string]interface{}); vp["type"] != "client" {
+		t.Errorf("vantage point = %v, want client", vp["type"])
+	}
+	if lines[1]["time"] != 1.5 || lines[1]["name"] != "transport:packet_sent" {
+		t.Errorf("event = %v, want packet_sent at 1.5ms", lines[1])
+	}
+}